@@ -0,0 +1,83 @@
+package pudding
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// AccountRoles maps a site, or a site and env joined with ":", to the
+// ARN of the IAM role to assume in the AWS account for it
+type AccountRoles map[string]string
+
+// ParseAccountRoles parses comma-delimited "{site}[:{env}]={role_arn}"
+// pairs, e.g. "org=arn:aws:iam::111111111111:role/pudding"
+func ParseAccountRoles(s string) (AccountRoles, error) {
+	roles := AccountRoles{}
+
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || AccountIDFromARN(parts[1]) == "" {
+			return nil, fmt.Errorf("invalid account role %q", pair)
+		}
+
+		roles[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+	}
+
+	return roles, nil
+}
+
+// RoleARNFor returns the role ARN for the site and env, falling back
+// to the one for the site alone, or "" if neither are mapped
+func (ar AccountRoles) RoleARNFor(site, env string) string {
+	if roleARN, ok := ar[fmt.Sprintf("%s:%s", site, env)]; ok {
+		return roleARN
+	}
+
+	return ar[site]
+}
+
+// RoleARNForAccount returns the first role ARN in the given account,
+// or "" if none are mapped
+func (ar AccountRoles) RoleARNForAccount(accountID string) string {
+	for _, roleARN := range ar.RoleARNs() {
+		if AccountIDFromARN(roleARN) == accountID {
+			return roleARN
+		}
+	}
+
+	return ""
+}
+
+// RoleARNs returns the distinct role ARNs in sorted order
+func (ar AccountRoles) RoleARNs() []string {
+	seen := map[string]bool{}
+	roleARNs := []string{}
+
+	for _, roleARN := range ar {
+		if seen[roleARN] {
+			continue
+		}
+		seen[roleARN] = true
+		roleARNs = append(roleARNs, roleARN)
+	}
+
+	sort.Strings(roleARNs)
+	return roleARNs
+}
+
+// AccountIDFromARN returns the account part of an ARN such as
+// "arn:aws:iam::111111111111:role/pudding", or "" if it has none
+func AccountIDFromARN(arn string) string {
+	parts := strings.Split(arn, ":")
+	if len(parts) < 5 || parts[0] != "arn" {
+		return ""
+	}
+
+	return parts[4]
+}
@@ -0,0 +1,156 @@
+package pudding
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+const (
+	// ApprovalStateAwaiting is the state of instance builds held for
+	// approval, which have not been enqueued
+	ApprovalStateAwaiting = "awaiting_approval"
+	// ApprovalStateApproved is the state of approvals whose build has
+	// been enqueued
+	ApprovalStateApproved = "approved"
+	// ApprovalStateRejected is the state of approvals whose build will
+	// never be enqueued
+	ApprovalStateRejected = "rejected"
+)
+
+// ApprovalsCollection is the collection representation used in
+// jsonapi bodies
+type ApprovalsCollection struct {
+	Approvals []*Approval `json:"approvals"`
+}
+
+// Approval is an instance or autoscaling group build held until
+// someone other than whoever requested it approves or rejects it, of
+// which only one of InstanceBuild and AutoscalingGroupBuild is set
+type Approval struct {
+	ID                    string                 `json:"id"`
+	State                 string                 `json:"state"`
+	Policies              []string               `json:"policies"`
+	InstanceBuild         *InstanceBuild         `json:"instance_build,omitempty"`
+	AutoscalingGroupBuild *AutoscalingGroupBuild `json:"autoscaling_group_build,omitempty"`
+	RequestedBy           string                 `json:"requested_by"`
+	RequestedAt           int64                  `json:"requested_at"`
+	DecidedBy             string                 `json:"decided_by,omitempty"`
+	DecidedAt             int64                  `json:"decided_at,omitempty"`
+	Reason                string                 `json:"reason,omitempty"`
+}
+
+// ApprovalPolicy marks the instance builds within its scope of site,
+// env, and queue as needing approval, any of which may be empty to
+// match all of them.  When instance types are given, only builds
+// requesting any of them need approval.
+type ApprovalPolicy struct {
+	Site          string   `json:"site,omitempty"`
+	Env           string   `json:"env,omitempty"`
+	Queue         string   `json:"queue,omitempty"`
+	InstanceTypes []string `json:"instance_types,omitempty"`
+}
+
+// ParseApprovalPolicies parses a JSON array of approval policies, with
+// an empty string resulting in no policies
+func ParseApprovalPolicies(s string) ([]*ApprovalPolicy, error) {
+	policies := []*ApprovalPolicy{}
+	if strings.TrimSpace(s) == "" {
+		return policies, nil
+	}
+
+	err := json.Unmarshal([]byte(s), &policies)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, p := range policies {
+		if p.Site == "" && p.Env == "" && p.Queue == "" && len(p.InstanceTypes) == 0 {
+			return nil, errEmptyApprovalPolicy
+		}
+	}
+
+	return policies, nil
+}
+
+// Matches returns whether the instance build needs approval under the
+// policy
+func (p *ApprovalPolicy) Matches(b *InstanceBuild) bool {
+	return p.matches(b.Site, b.Env, b.Queue, append([]string{b.InstanceType}, b.InstanceTypes...))
+}
+
+// MatchesAutoscalingGroupBuild returns whether the autoscaling group
+// build needs approval under the policy, by its mixed instance types
+func (p *ApprovalPolicy) MatchesAutoscalingGroupBuild(b *AutoscalingGroupBuild) bool {
+	return p.matches(b.Site, b.Env, b.Queue, b.InstanceTypes)
+}
+
+func (p *ApprovalPolicy) matches(site, env, queue string, instanceTypes []string) bool {
+	for _, pair := range [][2]string{
+		{p.Site, site},
+		{p.Env, env},
+		{p.Queue, queue},
+	} {
+		if pair[0] != "" && pair[0] != pair[1] {
+			return false
+		}
+	}
+
+	if len(p.InstanceTypes) == 0 {
+		return true
+	}
+
+	for _, instanceType := range instanceTypes {
+		for _, policyType := range p.InstanceTypes {
+			if instanceType == policyType {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// String describes the policy by the parts of its scope that are set,
+// e.g. "env=production instance_types=c5.18xlarge"
+func (p *ApprovalPolicy) String() string {
+	parts := []string{}
+	for _, pair := range [][2]string{
+		{"site", p.Site},
+		{"env", p.Env},
+		{"queue", p.Queue},
+		{"instance_types", strings.Join(p.InstanceTypes, ",")},
+	} {
+		if pair[1] != "" {
+			parts = append(parts, fmt.Sprintf("%s=%s", pair[0], pair[1]))
+		}
+	}
+
+	return strings.Join(parts, " ")
+}
+
+// MatchingApprovalPolicies returns the descriptions of the policies
+// under which the instance build needs approval
+func MatchingApprovalPolicies(policies []*ApprovalPolicy, b *InstanceBuild) []string {
+	matching := []string{}
+	for _, p := range policies {
+		if p.Matches(b) {
+			matching = append(matching, p.String())
+		}
+	}
+
+	return matching
+}
+
+// MatchingAutoscalingGroupApprovalPolicies is MatchingApprovalPolicies
+// for autoscaling group builds
+func MatchingAutoscalingGroupApprovalPolicies(policies []*ApprovalPolicy, b *AutoscalingGroupBuild) []string {
+	matching := []string{}
+	for _, p := range policies {
+		if p.MatchesAutoscalingGroupBuild(b) {
+			matching = append(matching, p.String())
+		}
+	}
+
+	return matching
+}
@@ -0,0 +1,37 @@
+package pudding
+
+const (
+	// AuditOutcomeOK is the outcome of actions that succeeded
+	AuditOutcomeOK = "ok"
+	// AuditOutcomeDenied is the outcome of API calls refused for lack
+	// of auth
+	AuditOutcomeDenied = "denied"
+	// AuditOutcomeError is the outcome of actions that failed
+	AuditOutcomeError = "error"
+)
+
+// AuditEntriesCollection is the collection representation used in
+// jsonapi bodies
+type AuditEntriesCollection struct {
+	AuditEntries []*AuditEntry `json:"audit_entries"`
+}
+
+// AuditEntry is the record of a mutating API call or of an action
+// taken by the workers, being "api" or "workers" as the Source
+type AuditEntry struct {
+	ID        int64  `json:"id"`
+	Time      int64  `json:"time"`
+	Source    string `json:"source"`
+	Actor     string `json:"actor"`
+	Route     string `json:"route,omitempty"`
+	Method    string `json:"method,omitempty"`
+	Path      string `json:"path,omitempty"`
+	Action    string `json:"action,omitempty"`
+	Target    string `json:"target,omitempty"`
+	Summary   string `json:"summary,omitempty"`
+	RequestID string `json:"request_id,omitempty"`
+	JobID     string `json:"job_id,omitempty"`
+	Status    int    `json:"status,omitempty"`
+	Outcome   string `json:"outcome"`
+	Error     string `json:"error,omitempty"`
+}
@@ -0,0 +1,81 @@
+package pudding
+
+import "strings"
+
+const (
+	// AutoscalingEventLaunch is sent when an instance has been launched
+	AutoscalingEventLaunch = "autoscaling:EC2_INSTANCE_LAUNCH"
+	// AutoscalingEventLaunchError is sent when an instance failed to launch
+	AutoscalingEventLaunchError = "autoscaling:EC2_INSTANCE_LAUNCH_ERROR"
+	// AutoscalingEventTerminate is sent when an instance has been terminated
+	AutoscalingEventTerminate = "autoscaling:EC2_INSTANCE_TERMINATE"
+	// AutoscalingEventTerminateError is sent when an instance failed to terminate
+	AutoscalingEventTerminateError = "autoscaling:EC2_INSTANCE_TERMINATE_ERROR"
+	// AutoscalingEventTestNotification is sent when a notification
+	// configuration is first set up
+	AutoscalingEventTestNotification = "autoscaling:TEST_NOTIFICATION"
+)
+
+// AutoscalingEvent is an SNS message payload of the form:
+//
+//	{
+//	  "Progress":50,
+//	  "AccountId":"account id string",
+//	  "Description":"prose goop string, e.g.: Launching a new EC2 instance: i-abcd1234",
+//	  "RequestId":"uuid string",
+//	  "EndTime":"iso 8601 timestamp string",
+//	  "AutoScalingGroupARN":"arn string",
+//	  "ActivityId":"uuid string",
+//	  "StartTime":"iso 8601 timestamp string",
+//	  "Service":"AWS Auto Scaling",
+//	  "Time":"iso 8601 timestamp string",
+//	  "EC2InstanceId":"instance id string",
+//	  "StatusCode":"status string, e.g.: InProgress",
+//	  "StatusMessage":"prose goop string",
+//	  "Details":{"Subnet ID":"subnet id string","Availability Zone":"az string"},
+//	  "AutoScalingGroupName":"name string",
+//	  "Cause":"prose goop string",
+//	  "Event":"event string, e.g.: autoscaling:EC2_INSTANCE_LAUNCH"
+//	}
+type AutoscalingEvent struct {
+	Event                string
+	AutoScalingGroupName string
+	AutoScalingGroupARN  string
+	Service              string
+	Time                 string
+	AccountID            string `json:"AccountId"`
+	RequestID            string `json:"RequestId"`
+	ActivityID           string `json:"ActivityId"`
+	EC2InstanceID        string `json:"EC2InstanceId"`
+	Description          string
+	Cause                string
+	StatusCode           string
+	StatusMessage        string
+	StartTime            string
+	EndTime              string
+	Progress             int
+	Details              map[string]interface{}
+}
+
+// IsAutoscalingEvent returns whether the given event name is one of
+// the autoscaling instance notification events
+func IsAutoscalingEvent(event string) bool {
+	switch event {
+	case AutoscalingEventLaunch, AutoscalingEventLaunchError,
+		AutoscalingEventTerminate, AutoscalingEventTerminateError:
+		return true
+	}
+	return false
+}
+
+// IsError returns whether the event represents a failed launch or
+// termination
+func (e *AutoscalingEvent) IsError() bool {
+	return strings.HasSuffix(e.Event, "_ERROR")
+}
+
+// EventName returns the event without the "autoscaling:" prefix, e.g.
+// "EC2_INSTANCE_LAUNCH_ERROR"
+func (e *AutoscalingEvent) EventName() string {
+	return strings.TrimPrefix(e.Event, "autoscaling:")
+}
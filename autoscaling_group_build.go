@@ -25,6 +25,7 @@ type AutoscalingGroupBuild struct {
 
 	ID              string `json:"id,omitempty"`
 	InstanceID      string `json:"instance_id,omitempty"`
+	Region          string `json:"region,omitempty"`
 	RoleARN         string `json:"role_arn,omitempty"`
 	TopicARN        string `json:"topic_arn,omitempty"`
 	NameTemplate    string `json:"name_template,omitempty"`
@@ -39,6 +40,24 @@ type AutoscalingGroupBuild struct {
 	SlackChannel    string `json:"slack_channel"`
 	Timestamp       int64  `json:"timestamp"`
 
+	// Team is the team whose token requested the build, which is set
+	// by the server and tagged on the group's instances to count them
+	// against the team's quotas
+	Team string `json:"team,omitempty"`
+
+	// Tags are propagated to launched instances in addition to those
+	// set by pudding itself
+	Tags map[string]string `json:"tags,omitempty"`
+
+	// InstanceTypes, OnDemandBaseCapacity, and SpotPercentage make up
+	// the mixed-instances policy, which is only used when either
+	// InstanceTypes or SpotPercentage are given
+	InstanceTypes          []string `json:"instance_types,omitempty"`
+	OnDemandBaseCapacity   int      `json:"on_demand_base_capacity,omitempty"`
+	SpotPercentage         int      `json:"spot_percentage,omitempty"`
+	SpotMaxPrice           string   `json:"spot_max_price,omitempty"`
+	SpotAllocationStrategy string   `json:"spot_allocation_strategy,omitempty"`
+
 	LifecycleDefaultResult    string `json:"lifecycle_default_result,omitempty"`
 	LifecycleHeartbeatTimeout int    `json:"lifecycle_heartbeat_timeout,omitempty"`
 
@@ -83,6 +102,10 @@ func (b *AutoscalingGroupBuild) Hydrate() {
 		b.DefaultCooldown = 300
 	}
 
+	if b.SpotAllocationStrategy == "" {
+		b.SpotAllocationStrategy = "capacity-optimized"
+	}
+
 	if b.LifecycleDefaultResult == "" {
 		b.LifecycleDefaultResult = "CONTINUE"
 	}
@@ -189,10 +212,26 @@ func (b *AutoscalingGroupBuild) Validate() []error {
 	if b.TopicARN == "" {
 		errors = append(errors, errEmptyTopicARN)
 	}
+	if b.SpotPercentage < 0 || b.SpotPercentage > 100 {
+		errors = append(errors, errInvalidSpotPercentage)
+	}
+	if b.OnDemandBaseCapacity < 0 {
+		errors = append(errors, errInvalidOnDemandBaseCapacity)
+	}
+	if b.Region != "" && !IsValidRegion(b.Region) {
+		errors = append(errors, errInvalidRegion)
+	}
+	errors = append(errors, ValidateTags(b.Tags)...)
 
 	return errors
 }
 
+// UsesMixedInstances returns whether the autoscaling group should be
+// created with a mixed-instances policy rather than from the instance
+func (b *AutoscalingGroupBuild) UsesMixedInstances() bool {
+	return len(b.InstanceTypes) > 0 || b.SpotPercentage > 0
+}
+
 // InstanceIDWithoutPrefix returns the instance id without the "i-"
 func (b *AutoscalingGroupBuild) InstanceIDWithoutPrefix() string {
 	return strings.TrimPrefix(b.InstanceID, "i-")
@@ -1,26 +1,36 @@
 package pudding
 
 // AutoscalingLifecycleAction is an SNS message payload of the form:
-// {
-//   "AutoScalingGroupName":"name string",
-//   "Service":"prose goop string",
-//   "Time":"iso 8601 timestamp string",
-//   "AccountId":"account id string",
-//   "LifecycleTransition":"transition string, e.g.: autoscaling:EC2_INSTANCE_TERMINATING",
-//   "RequestId":"uuid string",
-//   "LifecycleActionToken":"uuid string",
-//   "EC2InstanceId":"instance id string",
-//   "LifecycleHookName":"name string"
-// }
+//
+//	{
+//	  "AutoScalingGroupName":"name string",
+//	  "Service":"prose goop string",
+//	  "Time":"iso 8601 timestamp string",
+//	  "AccountId":"account id string",
+//	  "LifecycleTransition":"transition string, e.g.: autoscaling:EC2_INSTANCE_TERMINATING",
+//	  "RequestId":"uuid string",
+//	  "LifecycleActionToken":"uuid string",
+//	  "EC2InstanceId":"instance id string",
+//	  "LifecycleHookName":"name string"
+//	}
 type AutoscalingLifecycleAction struct {
 	Event                string
 	AutoScalingGroupName string `redis:"auto_scaling_group_name"`
 	Service              string
 	Time                 string
-	AccountID            string `json:"AccountId"`
-	LifecycleTransition  string
+	AccountID            string `json:"AccountId" redis:"account_id"`
+	LifecycleTransition  string `redis:"lifecycle_transition"`
 	RequestID            string `json:"RequestId"`
 	LifecycleActionToken string `redis:"lifecycle_action_token"`
-	EC2InstanceID        string `json:"EC2InstanceId"`
+	EC2InstanceID        string `json:"EC2InstanceId" redis:"ec2_instance_id"`
 	LifecycleHookName    string `redis:"lifecycle_hook_name"`
+
+	// Region is taken from the ARN of the topic the action was sent
+	// to, so that it is completed in the same region
+	Region string `json:",omitempty" redis:"region"`
+
+	// StoredAt and HeartbeatAt are unix timestamps tracked by pudding
+	// rather than anything sent along by SNS
+	StoredAt    int64 `json:",omitempty" redis:"stored_at"`
+	HeartbeatAt int64 `json:",omitempty" redis:"heartbeat_at"`
 }
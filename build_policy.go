@@ -0,0 +1,318 @@
+package pudding
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// PolicyChecksCollection is the collection representation used in
+// jsonapi bodies
+type PolicyChecksCollection struct {
+	PolicyChecks []*PolicyCheck `json:"policy_checks"`
+}
+
+// PolicyCheck is the outcome of checking a build as if it had been
+// submitted, with every error that would have been returned
+type PolicyCheck struct {
+	Kind   string   `json:"kind"`
+	ID     string   `json:"id,omitempty"`
+	Valid  bool     `json:"valid"`
+	Errors []string `json:"errors"`
+}
+
+// NewPolicyCheck creates a *PolicyCheck from the errors found for a
+// build of the given kind
+func NewPolicyCheck(kind, ID string, errors []error) *PolicyCheck {
+	pc := &PolicyCheck{
+		Kind:   kind,
+		ID:     ID,
+		Valid:  len(errors) == 0,
+		Errors: []string{},
+	}
+
+	for _, err := range errors {
+		pc.Errors = append(pc.Errors, err.Error())
+	}
+
+	return pc
+}
+
+// BuildPolicy is a declarative rule that the instance and autoscaling
+// group builds within its scope of site, env, queue, and role must
+// follow, any of which may be empty to match all of them.  Fields are
+// named as in the JSON representation of the builds, and only apply to
+// the kinds of build that have them.
+type BuildPolicy struct {
+	Description string `json:"description,omitempty"`
+
+	Site  string `json:"site,omitempty"`
+	Env   string `json:"env,omitempty"`
+	Queue string `json:"queue,omitempty"`
+	Role  string `json:"role,omitempty"`
+
+	// InstanceTypes are the patterns, e.g. "c3.*", of the only instance
+	// types that may be requested
+	InstanceTypes []string `json:"instance_types,omitempty"`
+	// Require are the fields that must not be empty, e.g. "subnet_id"
+	Require []string `json:"require,omitempty"`
+	// Max maps numeric fields to their maximum, e.g. {"max_size": 50}
+	Max map[string]int `json:"max,omitempty"`
+}
+
+var (
+	// buildPolicyTypes are the kinds of build that policies apply to,
+	// whose fields policies may name
+	buildPolicyTypes = []reflect.Type{
+		reflect.TypeOf(InstanceBuild{}),
+		reflect.TypeOf(AutoscalingGroupBuild{}),
+	}
+)
+
+// PolicyViolation is a build not following a BuildPolicy
+type PolicyViolation struct {
+	Policy string
+	Msg    string
+}
+
+func (v *PolicyViolation) Error() string {
+	return fmt.Sprintf("policy %q: %s", v.Policy, v.Msg)
+}
+
+// ParseBuildPolicies parses a JSON array of build policies, with an
+// empty string resulting in no policies, refusing policies without
+// rules or with rules on fields that no kind of build has or can't
+// follow
+func ParseBuildPolicies(s string) ([]*BuildPolicy, error) {
+	policies := []*BuildPolicy{}
+	if strings.TrimSpace(s) == "" {
+		return policies, nil
+	}
+
+	err := json.Unmarshal([]byte(s), &policies)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, p := range policies {
+		err = p.validate()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return policies, nil
+}
+
+func (p *BuildPolicy) validate() error {
+	if len(p.InstanceTypes) == 0 && len(p.Require) == 0 && len(p.Max) == 0 {
+		return fmt.Errorf("build policy %q must have instance_types, require, or max rules", p.String())
+	}
+
+	for _, pattern := range p.InstanceTypes {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return errInvalidBuildPolicyPattern
+		}
+	}
+
+	for _, field := range p.Require {
+		if len(buildPolicyFieldKinds(field)) == 0 {
+			return fmt.Errorf("build policy %q requires unknown field %q", p.String(), field)
+		}
+	}
+
+	for _, field := range sortedMaxFields(p.Max) {
+		kinds := buildPolicyFieldKinds(field)
+		if len(kinds) == 0 {
+			return fmt.Errorf("build policy %q has a max for unknown field %q", p.String(), field)
+		}
+
+		for _, kind := range kinds {
+			if kind != reflect.Int && kind != reflect.Int64 {
+				return fmt.Errorf("build policy %q has a max for non-integer field %q", p.String(), field)
+			}
+		}
+	}
+
+	return nil
+}
+
+// buildPolicyFieldKinds returns the kinds of the field with the given
+// JSON name in each kind of build that has it
+func buildPolicyFieldKinds(name string) []reflect.Kind {
+	kinds := []reflect.Kind{}
+	for _, t := range buildPolicyTypes {
+		if f, ok := jsonStructField(t, name); ok {
+			kinds = append(kinds, f.Type.Kind())
+		}
+	}
+
+	return kinds
+}
+
+// CheckInstanceBuildPolicies returns every violation of the policies
+// by the instance build
+func CheckInstanceBuildPolicies(policies []*BuildPolicy, b *InstanceBuild) []error {
+	errors := []error{}
+	for _, p := range policies {
+		errors = append(errors, p.check(b.Site, b.Env, b.Queue, b.Role, b.CandidateInstanceTypes(), b)...)
+	}
+
+	return errors
+}
+
+// CheckAutoscalingGroupBuildPolicies returns every violation of the
+// policies by the autoscaling group build, of which only the mixed
+// instance types are checked against instance type patterns
+func CheckAutoscalingGroupBuildPolicies(policies []*BuildPolicy, b *AutoscalingGroupBuild) []error {
+	errors := []error{}
+	for _, p := range policies {
+		errors = append(errors, p.check(b.Site, b.Env, b.Queue, b.Role, b.InstanceTypes, b)...)
+	}
+
+	return errors
+}
+
+// String describes the policy by its description, or else by the
+// parts of its scope that are set
+func (p *BuildPolicy) String() string {
+	if p.Description != "" {
+		return p.Description
+	}
+
+	parts := []string{}
+	for _, pair := range [][2]string{
+		{"site", p.Site},
+		{"env", p.Env},
+		{"queue", p.Queue},
+		{"role", p.Role},
+	} {
+		if pair[1] != "" {
+			parts = append(parts, fmt.Sprintf("%s=%s", pair[0], pair[1]))
+		}
+	}
+
+	if len(parts) == 0 {
+		return "*"
+	}
+
+	return strings.Join(parts, " ")
+}
+
+func (p *BuildPolicy) check(site, env, queue, role string, instanceTypes []string, build interface{}) []error {
+	for _, pair := range [][2]string{
+		{p.Site, site},
+		{p.Env, env},
+		{p.Queue, queue},
+		{p.Role, role},
+	} {
+		if pair[0] != "" && pair[0] != pair[1] {
+			return []error{}
+		}
+	}
+
+	errors := []error{}
+
+	if len(p.InstanceTypes) > 0 {
+		for _, instanceType := range instanceTypes {
+			if !p.allowsInstanceType(instanceType) {
+				errors = append(errors, &PolicyViolation{
+					Policy: p.String(),
+					Msg: fmt.Sprintf("instance type %s is not one of %s",
+						instanceType, strings.Join(p.InstanceTypes, ", ")),
+				})
+			}
+		}
+	}
+
+	for _, field := range p.Require {
+		v, ok := jsonField(build, field)
+		if ok && isZero(v) {
+			errors = append(errors, &PolicyViolation{
+				Policy: p.String(),
+				Msg:    fmt.Sprintf("%s is required", field),
+			})
+		}
+	}
+
+	for _, field := range sortedMaxFields(p.Max) {
+		v, ok := jsonField(build, field)
+		if !ok {
+			continue
+		}
+
+		switch v.Kind() {
+		case reflect.Int, reflect.Int64:
+			if v.Int() > int64(p.Max[field]) {
+				errors = append(errors, &PolicyViolation{
+					Policy: p.String(),
+					Msg:    fmt.Sprintf("%s must be at most %d", field, p.Max[field]),
+				})
+			}
+		}
+	}
+
+	return errors
+}
+
+func (p *BuildPolicy) allowsInstanceType(instanceType string) bool {
+	for _, pattern := range p.InstanceTypes {
+		if ok, _ := path.Match(pattern, instanceType); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// jsonField returns the value of the struct field with the given JSON
+// name, and whether there is one
+func jsonField(v interface{}, name string) (reflect.Value, bool) {
+	rv := reflect.Indirect(reflect.ValueOf(v))
+
+	f, ok := jsonStructField(rv.Type(), name)
+	if !ok {
+		return reflect.Value{}, false
+	}
+
+	return rv.FieldByIndex(f.Index), true
+}
+
+// jsonStructField returns the field of the struct type with the given
+// JSON name, and whether there is one
+func jsonStructField(t reflect.Type, name string) (reflect.StructField, bool) {
+	if name == "" || name == "-" {
+		return reflect.StructField{}, false
+	}
+
+	for i := 0; i < t.NumField(); i++ {
+		tag := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+		if tag == name {
+			return t.Field(i), true
+		}
+	}
+
+	return reflect.StructField{}, false
+}
+
+func isZero(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Slice, reflect.Map:
+		return v.Len() == 0
+	}
+
+	return reflect.DeepEqual(v.Interface(), reflect.Zero(v.Type()).Interface())
+}
+
+func sortedMaxFields(max map[string]int) []string {
+	fields := []string{}
+	for field := range max {
+		fields = append(fields, field)
+	}
+
+	sort.Strings(fields)
+	return fields
+}
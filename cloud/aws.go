@@ -0,0 +1,755 @@
+package cloud
+
+import (
+	"encoding/base64"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/sns"
+	"github.com/travis-ci/pudding"
+)
+
+// AWS is the aws-sdk-go implementation of Cloud
+type AWS struct {
+	region string
+	ec2    *ec2.EC2
+	as     *autoscaling.AutoScaling
+	cw     *cloudwatch.CloudWatch
+	sns    *sns.SNS
+}
+
+// NewAWSSession builds a session for the region that uses the given
+// static credentials when present, and otherwise the standard
+// credential chain of env vars, shared credentials file, and instance
+// profile
+func NewAWSSession(key, secret, region string) *session.Session {
+	cfg := &aws.Config{Region: aws.String(region)}
+	if key != "" && secret != "" {
+		cfg.Credentials = credentials.NewStaticCredentials(key, secret, "")
+	}
+
+	return session.New(cfg)
+}
+
+// NewAWS creates a new *AWS with clients for the session's region
+func NewAWS(sess *session.Session, region string) *AWS {
+	return &AWS{
+		region: region,
+		ec2:    ec2.New(sess),
+		as:     autoscaling.New(sess),
+		cw:     cloudwatch.New(sess),
+		sns:    sns.New(sess),
+	}
+}
+
+// Region returns the name of the region
+func (a *AWS) Region() string {
+	return a.region
+}
+
+// DescribeInstances fetches the instances with the given ids, if any,
+// that match the filter
+func (a *AWS) DescribeInstances(ids []string, f Filter) ([]*Instance, error) {
+	instances := []*Instance{}
+
+	err := a.ec2.DescribeInstancesPages(&ec2.DescribeInstancesInput{
+		InstanceIds: aws.StringSlice(ids),
+		Filters:     ec2Filters(f),
+	}, func(page *ec2.DescribeInstancesOutput, lastPage bool) bool {
+		for _, res := range page.Reservations {
+			for _, inst := range res.Instances {
+				instances = append(instances, a.instance(inst))
+			}
+		}
+		return true
+	})
+
+	return instances, err
+}
+
+// RunInstance launches a single instance, tagged at launch
+func (a *AWS) RunInstance(opts *LaunchOptions) (*Instance, error) {
+	input := &ec2.RunInstancesInput{
+		ImageId:          aws.String(opts.ImageID),
+		UserData:         aws.String(base64.StdEncoding.EncodeToString(opts.UserData)),
+		InstanceType:     aws.String(opts.InstanceType),
+		MinCount:         aws.Int64(1),
+		MaxCount:         aws.Int64(1),
+		SecurityGroupIds: aws.StringSlice(opts.SecurityGroupIDs),
+	}
+
+	if len(opts.Tags) > 0 {
+		input.TagSpecifications = []*ec2.TagSpecification{
+			&ec2.TagSpecification{
+				ResourceType: aws.String("instance"),
+				Tags:         ec2Tags(opts.Tags),
+			},
+		}
+	}
+
+	if opts.SubnetID != "" {
+		input.SubnetId = aws.String(opts.SubnetID)
+	}
+
+	if opts.Market == pudding.MarketSpot {
+		spotOptions := &ec2.SpotMarketOptions{
+			SpotInstanceType:             aws.String("one-time"),
+			InstanceInterruptionBehavior: aws.String("terminate"),
+		}
+		if opts.SpotMaxPrice != "" {
+			spotOptions.MaxPrice = aws.String(opts.SpotMaxPrice)
+		}
+
+		input.InstanceMarketOptions = &ec2.InstanceMarketOptionsRequest{
+			MarketType:  aws.String(pudding.MarketSpot),
+			SpotOptions: spotOptions,
+		}
+	}
+
+	resp, err := a.ec2.RunInstances(input)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(resp.Instances) < 1 {
+		return nil, fmt.Errorf("no instances launched")
+	}
+
+	return a.instance(resp.Instances[0]), nil
+}
+
+// CreateTags sets the given tags on the given resources
+func (a *AWS) CreateTags(ids []string, tags map[string]string) error {
+	_, err := a.ec2.CreateTags(&ec2.CreateTagsInput{
+		Resources: aws.StringSlice(ids),
+		Tags:      ec2Tags(tags),
+	})
+	return err
+}
+
+// TerminateInstances terminates the given instances
+func (a *AWS) TerminateInstances(ids []string) error {
+	_, err := a.ec2.TerminateInstances(&ec2.TerminateInstancesInput{
+		InstanceIds: aws.StringSlice(ids),
+	})
+	return err
+}
+
+// DescribeImages fetches the images with the given ids, if any, that
+// match the filter
+func (a *AWS) DescribeImages(ids []string, f Filter) ([]*Image, error) {
+	resp, err := a.ec2.DescribeImages(&ec2.DescribeImagesInput{
+		ImageIds: aws.StringSlice(ids),
+		Filters:  ec2Filters(f),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	images := []*Image{}
+	for _, img := range resp.Images {
+		images = append(images, &Image{
+			ID:     aws.StringValue(img.ImageId),
+			Name:   aws.StringValue(img.Name),
+			State:  aws.StringValue(img.State),
+			Region: a.region,
+			Tags:   tagsMap(img.Tags),
+		})
+	}
+
+	return images, nil
+}
+
+// DescribeSecurityGroups fetches the security groups matching the
+// filter
+func (a *AWS) DescribeSecurityGroups(f Filter) ([]*SecurityGroup, error) {
+	resp, err := a.ec2.DescribeSecurityGroups(&ec2.DescribeSecurityGroupsInput{
+		Filters: ec2Filters(f),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	groups := []*SecurityGroup{}
+	for _, sg := range resp.SecurityGroups {
+		groups = append(groups, &SecurityGroup{
+			ID:    aws.StringValue(sg.GroupId),
+			Name:  aws.StringValue(sg.GroupName),
+			VPCID: aws.StringValue(sg.VpcId),
+		})
+	}
+
+	return groups, nil
+}
+
+// CreateSecurityGroup creates a security group in the default VPC
+func (a *AWS) CreateSecurityGroup(name, description string) (*SecurityGroup, error) {
+	resp, err := a.ec2.CreateSecurityGroup(&ec2.CreateSecurityGroupInput{
+		GroupName:   aws.String(name),
+		Description: aws.String(description),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &SecurityGroup{ID: aws.StringValue(resp.GroupId), Name: name}, nil
+}
+
+// AuthorizeSecurityGroupIngress adds the ingress rules to the security
+// group
+func (a *AWS) AuthorizeSecurityGroupIngress(groupID string, rules []*pudding.IngressRule) error {
+	perms := []*ec2.IpPermission{}
+	for _, rule := range rules {
+		perm := &ec2.IpPermission{
+			IpProtocol: aws.String(rule.Protocol),
+			FromPort:   aws.Int64(int64(rule.FromPort)),
+			ToPort:     aws.Int64(int64(rule.ToPort)),
+		}
+
+		for _, cidr := range rule.CIDRs {
+			if strings.Contains(cidr, ":") {
+				perm.Ipv6Ranges = append(perm.Ipv6Ranges, &ec2.Ipv6Range{CidrIpv6: aws.String(cidr)})
+				continue
+			}
+			perm.IpRanges = append(perm.IpRanges, &ec2.IpRange{CidrIp: aws.String(cidr)})
+		}
+
+		for _, id := range rule.SourceSecurityGroupIDs {
+			perm.UserIdGroupPairs = append(perm.UserIdGroupPairs, &ec2.UserIdGroupPair{GroupId: aws.String(id)})
+		}
+
+		perms = append(perms, perm)
+	}
+
+	_, err := a.ec2.AuthorizeSecurityGroupIngress(&ec2.AuthorizeSecurityGroupIngressInput{
+		GroupId:       aws.String(groupID),
+		IpPermissions: perms,
+	})
+	return err
+}
+
+// DeleteSecurityGroup deletes the security group
+func (a *AWS) DeleteSecurityGroup(groupID string) error {
+	_, err := a.ec2.DeleteSecurityGroup(&ec2.DeleteSecurityGroupInput{
+		GroupId: aws.String(groupID),
+	})
+	return err
+}
+
+// CreateAutoscalingGroup creates an autoscaling group from an existing
+// instance.  When a mixed-instances policy is wanted, a launch
+// template is made from the instance so that the result matches what
+// creating the group directly from the instance would give.
+func (a *AWS) CreateAutoscalingGroup(opts *AutoscalingGroupOptions) error {
+	input := &autoscaling.CreateAutoScalingGroupInput{
+		AutoScalingGroupName: aws.String(opts.Name),
+		MinSize:              aws.Int64(int64(opts.MinSize)),
+		MaxSize:              aws.Int64(int64(opts.MaxSize)),
+		DesiredCapacity:      aws.Int64(int64(opts.DesiredCapacity)),
+		DefaultCooldown:      aws.Int64(int64(opts.DefaultCooldown)),
+		Tags:                 autoscalingTags(opts.Tags),
+	}
+
+	if opts.MixedInstances == nil {
+		input.InstanceId = aws.String(opts.InstanceID)
+		_, err := a.as.CreateAutoScalingGroup(input)
+		return err
+	}
+
+	instances, err := a.DescribeInstances([]string{opts.InstanceID}, Filter{})
+	if err != nil {
+		return err
+	}
+
+	if len(instances) < 1 {
+		return fmt.Errorf("unknown instance %q", opts.InstanceID)
+	}
+
+	inst := instances[0]
+
+	ltID, err := a.createLaunchTemplate(opts)
+	if err != nil {
+		return err
+	}
+
+	mi := opts.MixedInstances
+
+	overrides := []*autoscaling.LaunchTemplateOverrides{
+		&autoscaling.LaunchTemplateOverrides{InstanceType: aws.String(inst.Type)},
+	}
+	for _, instanceType := range mi.InstanceTypes {
+		if instanceType == inst.Type {
+			continue
+		}
+		overrides = append(overrides, &autoscaling.LaunchTemplateOverrides{InstanceType: aws.String(instanceType)})
+	}
+
+	distribution := &autoscaling.InstancesDistribution{
+		OnDemandBaseCapacity:                aws.Int64(int64(mi.OnDemandBaseCapacity)),
+		OnDemandPercentageAboveBaseCapacity: aws.Int64(int64(100 - mi.SpotPercentage)),
+		SpotAllocationStrategy:              aws.String(mi.SpotAllocationStrategy),
+	}
+	if mi.SpotMaxPrice != "" {
+		distribution.SpotMaxPrice = aws.String(mi.SpotMaxPrice)
+	}
+
+	input.MixedInstancesPolicy = &autoscaling.MixedInstancesPolicy{
+		InstancesDistribution: distribution,
+		LaunchTemplate: &autoscaling.LaunchTemplate{
+			LaunchTemplateSpecification: &autoscaling.LaunchTemplateSpecification{
+				LaunchTemplateId: aws.String(ltID),
+				Version:          aws.String("$Latest"),
+			},
+			Overrides: overrides,
+		},
+	}
+
+	if inst.SubnetID != "" {
+		input.VPCZoneIdentifier = aws.String(inst.SubnetID)
+	} else {
+		input.AvailabilityZones = []*string{aws.String(inst.AvailabilityZone)}
+	}
+
+	_, err = a.as.CreateAutoScalingGroup(input)
+	if err != nil {
+		// the launch template is of no use without the group, and is
+		// left to the garbage collector should this fail too
+		_ = a.DeleteLaunchTemplate(ltID)
+		return err
+	}
+
+	return nil
+}
+
+// createLaunchTemplate makes the launch template for the autoscaling
+// group from its instance, tagged with the name of the group, and
+// returns its id
+func (a *AWS) createLaunchTemplate(opts *AutoscalingGroupOptions) (string, error) {
+	resp, err := a.ec2.GetLaunchTemplateData(&ec2.GetLaunchTemplateDataInput{
+		InstanceId: aws.String(opts.InstanceID),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	tags := map[string]string{
+		LaunchTemplateAutoscalingGroupTag: opts.Name,
+	}
+	if opts.Tags["build_id"] != "" {
+		tags["build_id"] = opts.Tags["build_id"]
+	}
+
+	out, err := a.ec2.CreateLaunchTemplate(&ec2.CreateLaunchTemplateInput{
+		LaunchTemplateName: aws.String(fmt.Sprintf("%s-lt", opts.Name)),
+		LaunchTemplateData: requestLaunchTemplateData(resp.LaunchTemplateData),
+		TagSpecifications: []*ec2.TagSpecification{
+			&ec2.TagSpecification{
+				ResourceType: aws.String("launch-template"),
+				Tags:         ec2Tags(tags),
+			},
+		},
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return aws.StringValue(out.LaunchTemplate.LaunchTemplateId), nil
+}
+
+// requestLaunchTemplateData carries the parts of the instance's launch
+// template data that matter for launching more like it over to the
+// distinct request type
+func requestLaunchTemplateData(data *ec2.ResponseLaunchTemplateData) *ec2.RequestLaunchTemplateData {
+	req := &ec2.RequestLaunchTemplateData{
+		EbsOptimized:     data.EbsOptimized,
+		ImageId:          data.ImageId,
+		InstanceType:     data.InstanceType,
+		KeyName:          data.KeyName,
+		SecurityGroupIds: data.SecurityGroupIds,
+		UserData:         data.UserData,
+	}
+
+	if data.IamInstanceProfile != nil {
+		req.IamInstanceProfile = &ec2.LaunchTemplateIamInstanceProfileSpecificationRequest{
+			Arn:  data.IamInstanceProfile.Arn,
+			Name: data.IamInstanceProfile.Name,
+		}
+	}
+
+	for _, ni := range data.NetworkInterfaces {
+		req.NetworkInterfaces = append(req.NetworkInterfaces, &ec2.LaunchTemplateInstanceNetworkInterfaceSpecificationRequest{
+			AssociatePublicIpAddress: ni.AssociatePublicIpAddress,
+			DeleteOnTermination:      ni.DeleteOnTermination,
+			DeviceIndex:              ni.DeviceIndex,
+			Groups:                   ni.Groups,
+			SubnetId:                 ni.SubnetId,
+		})
+	}
+
+	for _, ts := range data.TagSpecifications {
+		req.TagSpecifications = append(req.TagSpecifications, &ec2.LaunchTemplateTagSpecificationRequest{
+			ResourceType: ts.ResourceType,
+			Tags:         ts.Tags,
+		})
+	}
+
+	return req
+}
+
+// DeleteLaunchTemplate deletes the launch template with the given id
+func (a *AWS) DeleteLaunchTemplate(ID string) error {
+	_, err := a.ec2.DeleteLaunchTemplate(&ec2.DeleteLaunchTemplateInput{
+		LaunchTemplateId: aws.String(ID),
+	})
+	return err
+}
+
+// DescribeAutoscalingGroups returns every autoscaling group, with the
+// security groups of the launch configuration or template it launches
+// instances from
+func (a *AWS) DescribeAutoscalingGroups() ([]*AutoscalingGroup, error) {
+	groups := []*AutoscalingGroup{}
+	lcNames := map[string][]*AutoscalingGroup{}
+	ltRefs := map[launchTemplateRef][]*AutoscalingGroup{}
+
+	err := a.as.DescribeAutoScalingGroupsPages(&autoscaling.DescribeAutoScalingGroupsInput{},
+		func(page *autoscaling.DescribeAutoScalingGroupsOutput, lastPage bool) bool {
+			for _, g := range page.AutoScalingGroups {
+				asg := &AutoscalingGroup{
+					Name:             aws.StringValue(g.AutoScalingGroupName),
+					InstanceIDs:      []string{},
+					SecurityGroupIDs: []string{},
+					Tags:             map[string]string{},
+				}
+
+				for _, inst := range g.Instances {
+					asg.InstanceIDs = append(asg.InstanceIDs, aws.StringValue(inst.InstanceId))
+				}
+				for _, tag := range g.Tags {
+					asg.Tags[aws.StringValue(tag.Key)] = aws.StringValue(tag.Value)
+				}
+
+				lt := g.LaunchTemplate
+				if g.MixedInstancesPolicy != nil && g.MixedInstancesPolicy.LaunchTemplate != nil {
+					lt = g.MixedInstancesPolicy.LaunchTemplate.LaunchTemplateSpecification
+				}
+
+				switch {
+				case g.LaunchConfigurationName != nil:
+					name := aws.StringValue(g.LaunchConfigurationName)
+					lcNames[name] = append(lcNames[name], asg)
+				case lt != nil:
+					ref := launchTemplateRef{
+						ID:      aws.StringValue(lt.LaunchTemplateId),
+						Name:    aws.StringValue(lt.LaunchTemplateName),
+						Version: aws.StringValue(lt.Version),
+					}
+					ltRefs[ref] = append(ltRefs[ref], asg)
+				}
+
+				groups = append(groups, asg)
+			}
+			return true
+		})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(lcNames) > 0 {
+		names := []*string{}
+		for name := range lcNames {
+			names = append(names, aws.String(name))
+		}
+
+		err = a.as.DescribeLaunchConfigurationsPages(&autoscaling.DescribeLaunchConfigurationsInput{
+			LaunchConfigurationNames: names,
+		}, func(page *autoscaling.DescribeLaunchConfigurationsOutput, lastPage bool) bool {
+			for _, lc := range page.LaunchConfigurations {
+				for _, asg := range lcNames[aws.StringValue(lc.LaunchConfigurationName)] {
+					for _, sg := range lc.SecurityGroups {
+						asg.SecurityGroupIDs = append(asg.SecurityGroupIDs, aws.StringValue(sg))
+					}
+				}
+			}
+			return true
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for ref, ltGroups := range ltRefs {
+		version := ref.Version
+		if version == "" {
+			version = "$Default"
+		}
+
+		input := &ec2.DescribeLaunchTemplateVersionsInput{
+			Versions: []*string{aws.String(version)},
+		}
+		if ref.ID != "" {
+			input.LaunchTemplateId = aws.String(ref.ID)
+		} else {
+			input.LaunchTemplateName = aws.String(ref.Name)
+		}
+
+		resp, err := a.ec2.DescribeLaunchTemplateVersions(input)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, ltv := range resp.LaunchTemplateVersions {
+			if ltv.LaunchTemplateData == nil {
+				continue
+			}
+
+			sgIDs := launchTemplateSecurityGroupIDs(ltv.LaunchTemplateData)
+			for _, asg := range ltGroups {
+				asg.SecurityGroupIDs = append(asg.SecurityGroupIDs, sgIDs...)
+			}
+		}
+	}
+
+	return groups, nil
+}
+
+// DescribeLaunchTemplates returns every launch template, with the
+// security groups of its latest and default versions
+func (a *AWS) DescribeLaunchTemplates() ([]*LaunchTemplate, error) {
+	templates := []*LaunchTemplate{}
+
+	err := a.ec2.DescribeLaunchTemplatesPages(&ec2.DescribeLaunchTemplatesInput{},
+		func(page *ec2.DescribeLaunchTemplatesOutput, lastPage bool) bool {
+			for _, lt := range page.LaunchTemplates {
+				template := &LaunchTemplate{
+					ID:               aws.StringValue(lt.LaunchTemplateId),
+					Name:             aws.StringValue(lt.LaunchTemplateName),
+					SecurityGroupIDs: []string{},
+					Tags:             tagsMap(lt.Tags),
+				}
+				if lt.CreateTime != nil {
+					template.CreatedAt = lt.CreateTime.Unix()
+				}
+				templates = append(templates, template)
+			}
+			return true
+		})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, lt := range templates {
+		resp, err := a.ec2.DescribeLaunchTemplateVersions(&ec2.DescribeLaunchTemplateVersionsInput{
+			LaunchTemplateId: aws.String(lt.ID),
+			Versions:         []*string{aws.String("$Latest"), aws.String("$Default")},
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		for _, ltv := range resp.LaunchTemplateVersions {
+			if ltv.LaunchTemplateData != nil {
+				lt.SecurityGroupIDs = append(lt.SecurityGroupIDs, launchTemplateSecurityGroupIDs(ltv.LaunchTemplateData)...)
+			}
+		}
+	}
+
+	return templates, nil
+}
+
+type launchTemplateRef struct {
+	ID      string
+	Name    string
+	Version string
+}
+
+func launchTemplateSecurityGroupIDs(ltData *ec2.ResponseLaunchTemplateData) []string {
+	sgIDs := []string{}
+	for _, sg := range ltData.SecurityGroupIds {
+		sgIDs = append(sgIDs, aws.StringValue(sg))
+	}
+	for _, ni := range ltData.NetworkInterfaces {
+		for _, sg := range ni.Groups {
+			sgIDs = append(sgIDs, aws.StringValue(sg))
+		}
+	}
+	return sgIDs
+}
+
+// PutScalingPolicy creates or updates a "ChangeInCapacity" scaling
+// policy, returning its ARN
+func (a *AWS) PutScalingPolicy(opts *ScalingPolicyOptions) (string, error) {
+	resp, err := a.as.PutScalingPolicy(&autoscaling.PutScalingPolicyInput{
+		PolicyName:           aws.String(opts.Name),
+		AutoScalingGroupName: aws.String(opts.AutoscalingGroupName),
+		AdjustmentType:       aws.String("ChangeInCapacity"),
+		Cooldown:             aws.Int64(int64(opts.Cooldown)),
+		ScalingAdjustment:    aws.Int64(int64(opts.Adjustment)),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return aws.StringValue(resp.PolicyARN), nil
+}
+
+// PutMetricAlarm creates or updates a metric alarm
+func (a *AWS) PutMetricAlarm(opts *MetricAlarmOptions) error {
+	_, err := a.cw.PutMetricAlarm(&cloudwatch.PutMetricAlarmInput{
+		AlarmName:          aws.String(opts.Name),
+		MetricName:         aws.String(opts.MetricName),
+		Namespace:          aws.String(opts.Namespace),
+		Statistic:          aws.String(opts.Statistic),
+		Period:             aws.Int64(int64(opts.Period)),
+		Threshold:          aws.Float64(opts.Threshold),
+		ComparisonOperator: aws.String(opts.ComparisonOperator),
+		EvaluationPeriods:  aws.Int64(int64(opts.EvaluationPeriods)),
+		AlarmActions:       aws.StringSlice(opts.ActionARNs),
+	})
+	return err
+}
+
+// PutLifecycleHook creates or updates a lifecycle hook
+func (a *AWS) PutLifecycleHook(opts *LifecycleHookOptions) error {
+	input := &autoscaling.PutLifecycleHookInput{
+		AutoScalingGroupName:  aws.String(opts.AutoscalingGroupName),
+		LifecycleHookName:     aws.String(opts.Name),
+		LifecycleTransition:   aws.String(opts.Transition),
+		NotificationTargetARN: aws.String(opts.NotificationTargetARN),
+		RoleARN:               aws.String(opts.RoleARN),
+	}
+	if opts.DefaultResult != "" {
+		input.DefaultResult = aws.String(opts.DefaultResult)
+	}
+	if opts.HeartbeatTimeout > 0 {
+		input.HeartbeatTimeout = aws.Int64(int64(opts.HeartbeatTimeout))
+	}
+
+	_, err := a.as.PutLifecycleHook(input)
+	return err
+}
+
+// CompleteLifecycleAction completes the lifecycle action with the
+// given result
+func (a *AWS) CompleteLifecycleAction(action *LifecycleAction, result string) error {
+	_, err := a.as.CompleteLifecycleAction(&autoscaling.CompleteLifecycleActionInput{
+		AutoScalingGroupName:  aws.String(action.AutoscalingGroupName),
+		LifecycleHookName:     aws.String(action.HookName),
+		LifecycleActionToken:  aws.String(action.Token),
+		LifecycleActionResult: aws.String(result),
+	})
+	return err
+}
+
+// RecordLifecycleActionHeartbeat extends the timeout of the lifecycle
+// action
+func (a *AWS) RecordLifecycleActionHeartbeat(action *LifecycleAction) error {
+	_, err := a.as.RecordLifecycleActionHeartbeat(&autoscaling.RecordLifecycleActionHeartbeatInput{
+		AutoScalingGroupName: aws.String(action.AutoscalingGroupName),
+		LifecycleHookName:    aws.String(action.HookName),
+		LifecycleActionToken: aws.String(action.Token),
+	})
+	return err
+}
+
+// ConfirmSubscription confirms an SNS subscription with the token sent
+// to the endpoint
+func (a *AWS) ConfirmSubscription(topicARN, token string) error {
+	_, err := a.sns.ConfirmSubscription(&sns.ConfirmSubscriptionInput{
+		TopicArn: aws.String(topicARN),
+		Token:    aws.String(token),
+	})
+	return err
+}
+
+func (a *AWS) instance(inst *ec2.Instance) *Instance {
+	i := &Instance{
+		ID:               aws.StringValue(inst.InstanceId),
+		Type:             aws.StringValue(inst.InstanceType),
+		ImageID:          aws.StringValue(inst.ImageId),
+		IP:               aws.StringValue(inst.PublicIpAddress),
+		PrivateIP:        aws.StringValue(inst.PrivateIpAddress),
+		Region:           a.region,
+		Lifecycle:        aws.StringValue(inst.InstanceLifecycle),
+		SubnetID:         aws.StringValue(inst.SubnetId),
+		VPCID:            aws.StringValue(inst.VpcId),
+		SecurityGroupIDs: []string{},
+		Tags:             tagsMap(inst.Tags),
+	}
+
+	if inst.LaunchTime != nil {
+		i.LaunchTime = inst.LaunchTime.UTC().Format(time.RFC3339)
+	}
+	if inst.Placement != nil {
+		i.AvailabilityZone = aws.StringValue(inst.Placement.AvailabilityZone)
+	}
+	if inst.State != nil {
+		i.State = aws.StringValue(inst.State.Name)
+	}
+	for _, sg := range inst.SecurityGroups {
+		i.SecurityGroupIDs = append(i.SecurityGroupIDs, aws.StringValue(sg.GroupId))
+	}
+
+	return i
+}
+
+func ec2Filters(f Filter) []*ec2.Filter {
+	if len(f) == 0 {
+		return nil
+	}
+
+	names := []string{}
+	for name := range f {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	filters := []*ec2.Filter{}
+	for _, name := range names {
+		filters = append(filters, &ec2.Filter{
+			Name:   aws.String(name),
+			Values: aws.StringSlice(f[name]),
+		})
+	}
+
+	return filters
+}
+
+func ec2Tags(tags map[string]string) []*ec2.Tag {
+	ec2Tags := []*ec2.Tag{}
+	for _, key := range pudding.SortedTagKeys(tags) {
+		ec2Tags = append(ec2Tags, &ec2.Tag{Key: aws.String(key), Value: aws.String(tags[key])})
+	}
+
+	return ec2Tags
+}
+
+func autoscalingTags(tags map[string]string) []*autoscaling.Tag {
+	asTags := []*autoscaling.Tag{}
+	for _, key := range pudding.SortedTagKeys(tags) {
+		asTags = append(asTags, &autoscaling.Tag{
+			Key:               aws.String(key),
+			Value:             aws.String(tags[key]),
+			PropagateAtLaunch: aws.Bool(true),
+		})
+	}
+
+	return asTags
+}
+
+func tagsMap(tags []*ec2.Tag) map[string]string {
+	m := map[string]string{}
+	for _, tag := range tags {
+		m[aws.StringValue(tag.Key)] = aws.StringValue(tag.Value)
+	}
+
+	return m
+}
@@ -0,0 +1,193 @@
+// Package cloud is the pudding-owned interface to the EC2, autoscaling,
+// CloudWatch, and SNS operations used by the workers, with an
+// aws-sdk-go implementation and an in-memory fake for testing offline
+// that may also be served over HTTP.
+package cloud
+
+import "github.com/travis-ci/pudding"
+
+// Cloud is everything the workers do within an AWS account and region
+type Cloud interface {
+	Region() string
+
+	DescribeInstances(ids []string, f Filter) ([]*Instance, error)
+	RunInstance(opts *LaunchOptions) (*Instance, error)
+	CreateTags(ids []string, tags map[string]string) error
+	TerminateInstances(ids []string) error
+
+	DescribeImages(ids []string, f Filter) ([]*Image, error)
+
+	DescribeSecurityGroups(f Filter) ([]*SecurityGroup, error)
+	CreateSecurityGroup(name, description string) (*SecurityGroup, error)
+	AuthorizeSecurityGroupIngress(groupID string, rules []*pudding.IngressRule) error
+	DeleteSecurityGroup(groupID string) error
+
+	CreateAutoscalingGroup(opts *AutoscalingGroupOptions) error
+	DescribeAutoscalingGroups() ([]*AutoscalingGroup, error)
+	DescribeLaunchTemplates() ([]*LaunchTemplate, error)
+	DeleteLaunchTemplate(ID string) error
+	PutScalingPolicy(opts *ScalingPolicyOptions) (string, error)
+	PutMetricAlarm(opts *MetricAlarmOptions) error
+	PutLifecycleHook(opts *LifecycleHookOptions) error
+	CompleteLifecycleAction(action *LifecycleAction, result string) error
+	RecordLifecycleActionHeartbeat(action *LifecycleAction) error
+
+	ConfirmSubscription(topicARN, token string) error
+}
+
+// AutoscalingGroupNameTag is the tag autoscaling sets on the instances
+// it launches, naming their group
+const AutoscalingGroupNameTag = "aws:autoscaling:groupName"
+
+// LaunchTemplateAutoscalingGroupTag is the tag set on the launch
+// templates made for mixed-instances autoscaling groups, naming the
+// group each was made for
+const LaunchTemplateAutoscalingGroupTag = "autoscaling_group"
+
+// Filter maps EC2 filter names such as "tag:role" or
+// "instance-state-name" to the values accepted for each
+type Filter map[string][]string
+
+// Instance is the cloud representation of an EC2 instance
+type Instance struct {
+	ID               string
+	Type             string
+	ImageID          string
+	IP               string
+	PrivateIP        string
+	LaunchTime       string
+	AvailabilityZone string
+	Region           string
+	Lifecycle        string
+	State            string
+	SubnetID         string
+	VPCID            string
+	SecurityGroupIDs []string
+	Tags             map[string]string
+}
+
+// Image is the cloud representation of an AMI
+type Image struct {
+	ID     string
+	Name   string
+	State  string
+	Region string
+	Tags   map[string]string
+}
+
+// SecurityGroup is the cloud representation of an EC2 security group
+type SecurityGroup struct {
+	ID    string
+	Name  string
+	VPCID string
+}
+
+// LaunchOptions describes a single instance to be launched, with Tags
+// applied as part of the launch request
+type LaunchOptions struct {
+	ImageID          string
+	InstanceType     string
+	UserData         []byte
+	SecurityGroupIDs []string
+	SubnetID         string
+	Market           string
+	SpotMaxPrice     string
+	Tags             map[string]string
+}
+
+// AutoscalingGroup is the cloud representation of an autoscaling
+// group, with the security groups its instances are launched with
+type AutoscalingGroup struct {
+	Name             string
+	InstanceIDs      []string
+	SecurityGroupIDs []string
+	Tags             map[string]string
+}
+
+// LaunchTemplate is the cloud representation of a launch template,
+// with the security groups of its latest and default versions
+type LaunchTemplate struct {
+	ID               string
+	Name             string
+	CreatedAt        int64
+	SecurityGroupIDs []string
+	Tags             map[string]string
+}
+
+// AutoscalingGroupOptions describes an autoscaling group made from an
+// existing instance, with Tags propagated to launched instances
+type AutoscalingGroupOptions struct {
+	Name            string
+	InstanceID      string
+	MinSize         int
+	MaxSize         int
+	DesiredCapacity int
+	DefaultCooldown int
+	Tags            map[string]string
+
+	// MixedInstances is only given when the group should use a
+	// mixed-instances policy rather than the instance's own type and
+	// market
+	MixedInstances *MixedInstancesOptions
+}
+
+// MixedInstancesOptions make up a mixed-instances policy
+type MixedInstancesOptions struct {
+	InstanceTypes          []string
+	OnDemandBaseCapacity   int
+	SpotPercentage         int
+	SpotMaxPrice           string
+	SpotAllocationStrategy string
+}
+
+// ScalingPolicyOptions describes a simple "ChangeInCapacity" scaling
+// policy
+type ScalingPolicyOptions struct {
+	Name                 string
+	AutoscalingGroupName string
+	Cooldown             int
+	Adjustment           int
+}
+
+// MetricAlarmOptions describes a CloudWatch metric alarm
+type MetricAlarmOptions struct {
+	Name               string
+	MetricName         string
+	Namespace          string
+	Statistic          string
+	ComparisonOperator string
+	Period             int
+	EvaluationPeriods  int
+	Threshold          float64
+	ActionARNs         []string
+}
+
+// LifecycleHookOptions describes an autoscaling lifecycle hook
+type LifecycleHookOptions struct {
+	Name                  string
+	AutoscalingGroupName  string
+	Transition            string
+	DefaultResult         string
+	HeartbeatTimeout      int
+	NotificationTargetARN string
+	RoleARN               string
+}
+
+// LifecycleAction identifies a pending autoscaling lifecycle action
+type LifecycleAction struct {
+	AutoscalingGroupName string
+	HookName             string
+	Token                string
+	InstanceID           string
+}
+
+// NewLifecycleAction makes a *LifecycleAction for the one received via
+// SNS
+func NewLifecycleAction(ala *pudding.AutoscalingLifecycleAction) *LifecycleAction {
+	return &LifecycleAction{
+		AutoscalingGroupName: ala.AutoScalingGroupName,
+		HookName:             ala.LifecycleHookName,
+		Token:                ala.LifecycleActionToken,
+		InstanceID:           ala.EC2InstanceID,
+	}
+}
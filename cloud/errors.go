@@ -0,0 +1,58 @@
+package cloud
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+)
+
+var (
+	errNoLatestImage = fmt.Errorf("no latest image available matching filter")
+)
+
+// Error is an API error with an AWS-style error code, as returned by
+// the fake
+type Error struct {
+	Code    string
+	Message string
+}
+
+// Error provides the code and message
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s: %s", e.Code, e.Message)
+}
+
+// ErrorCode returns the AWS error code of the given error, e.g.
+// "InvalidGroup.Duplicate", or "" if it isn't an API error
+func ErrorCode(err error) string {
+	switch e := err.(type) {
+	case *Error:
+		return e.Code
+	case awserr.Error:
+		return e.Code()
+	}
+
+	return ""
+}
+
+// IsAPIError returns whether the error was returned by the API itself,
+// as opposed to being a network or other client-side error
+func IsAPIError(err error) bool {
+	code := ErrorCode(err)
+	return code != "" && code != "RequestError"
+}
+
+// IsNetworkError returns whether the error means that the API couldn't
+// be reached, which is assumed to be temporary
+func IsNetworkError(err error) bool {
+	switch e := err.(type) {
+	case *url.Error, *net.OpError:
+		return true
+	case awserr.Error:
+		return e.Code() == "RequestError"
+	}
+
+	return false
+}
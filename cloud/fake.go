@@ -0,0 +1,618 @@
+package cloud
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/travis-ci/pudding"
+)
+
+// Fake is an in-memory Cloud for testing without AWS.  Its exported
+// fields may be inspected and seeded directly, and Errors may be used
+// to make a method fail by name, e.g. Errors["RunInstance"].
+type Fake struct {
+	mutex  sync.Mutex
+	region string
+	nextID int
+
+	Instances         map[string]*Instance
+	Images            map[string]*Image
+	SecurityGroups    map[string]*SecurityGroup
+	Ingress           map[string][]*pudding.IngressRule
+	AutoscalingGroups map[string]*AutoscalingGroupOptions
+	LaunchTemplates   map[string]*LaunchTemplate
+	ScalingPolicies   map[string]*ScalingPolicyOptions
+	MetricAlarms      map[string]*MetricAlarmOptions
+	LifecycleHooks    map[string]*LifecycleHookOptions
+
+	CompletedLifecycleActions []*LifecycleAction
+	LifecycleHeartbeats       []*LifecycleAction
+
+	// UserData is kept by instance id, and ConfirmedSubscriptions maps
+	// topic ARNs to the token used to confirm them
+	UserData               map[string][]byte
+	ConfirmedSubscriptions map[string]string
+
+	Errors map[string]error `json:"-"`
+}
+
+// NewFake creates an empty *Fake for the given region
+func NewFake(region string) *Fake {
+	return &Fake{
+		region: region,
+
+		Instances:         map[string]*Instance{},
+		Images:            map[string]*Image{},
+		SecurityGroups:    map[string]*SecurityGroup{},
+		Ingress:           map[string][]*pudding.IngressRule{},
+		AutoscalingGroups: map[string]*AutoscalingGroupOptions{},
+		LaunchTemplates:   map[string]*LaunchTemplate{},
+		ScalingPolicies:   map[string]*ScalingPolicyOptions{},
+		MetricAlarms:      map[string]*MetricAlarmOptions{},
+		LifecycleHooks:    map[string]*LifecycleHookOptions{},
+
+		CompletedLifecycleActions: []*LifecycleAction{},
+		LifecycleHeartbeats:       []*LifecycleAction{},
+
+		UserData:               map[string][]byte{},
+		ConfirmedSubscriptions: map[string]string{},
+
+		Errors: map[string]error{},
+	}
+}
+
+// Region returns the name of the region
+func (f *Fake) Region() string {
+	return f.region
+}
+
+// DescribeInstances returns the instances with the given ids, if any,
+// that match the filter
+func (f *Fake) DescribeInstances(ids []string, filter Filter) ([]*Instance, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if err := f.Errors["DescribeInstances"]; err != nil {
+		return nil, err
+	}
+
+	instances := []*Instance{}
+	for _, inst := range f.Instances {
+		if !idMatches(ids, inst.ID) {
+			continue
+		}
+
+		if !filterMatches(filter, map[string]string{
+			"instance-id":         inst.ID,
+			"instance-state-name": inst.State,
+			"instance-type":       inst.Type,
+			"image-id":            inst.ImageID,
+		}, inst.Tags) {
+			continue
+		}
+
+		instances = append(instances, inst)
+	}
+
+	return instances, nil
+}
+
+// RunInstance adds a running instance
+func (f *Fake) RunInstance(opts *LaunchOptions) (*Instance, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if err := f.Errors["RunInstance"]; err != nil {
+		return nil, err
+	}
+
+	f.nextID++
+
+	inst := &Instance{
+		ID:               fmt.Sprintf("i-%08x", f.nextID),
+		Type:             opts.InstanceType,
+		ImageID:          opts.ImageID,
+		PrivateIP:        fmt.Sprintf("10.0.%d.%d", f.nextID/256, f.nextID%256),
+		LaunchTime:       time.Now().UTC().Format(time.RFC3339),
+		AvailabilityZone: f.region + "a",
+		Region:           f.region,
+		State:            "running",
+		SubnetID:         opts.SubnetID,
+		SecurityGroupIDs: opts.SecurityGroupIDs,
+		Tags:             map[string]string{},
+	}
+
+	if opts.Market == pudding.MarketSpot {
+		inst.Lifecycle = pudding.MarketSpot
+	}
+
+	for key, value := range opts.Tags {
+		inst.Tags[key] = value
+	}
+
+	f.Instances[inst.ID] = inst
+	f.UserData[inst.ID] = opts.UserData
+	return inst, nil
+}
+
+// CreateTags sets tags on instances and images
+func (f *Fake) CreateTags(ids []string, tags map[string]string) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if err := f.Errors["CreateTags"]; err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		var resourceTags map[string]string
+
+		if inst, ok := f.Instances[id]; ok {
+			resourceTags = inst.Tags
+		} else if img, ok := f.Images[id]; ok {
+			resourceTags = img.Tags
+		} else {
+			return &Error{Code: "InvalidID", Message: fmt.Sprintf("unknown resource %q", id)}
+		}
+
+		for key, value := range tags {
+			resourceTags[key] = value
+		}
+	}
+
+	return nil
+}
+
+// TerminateInstances marks the instances as terminated
+func (f *Fake) TerminateInstances(ids []string) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if err := f.Errors["TerminateInstances"]; err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		inst, ok := f.Instances[id]
+		if !ok {
+			return &Error{Code: "InvalidInstanceID.NotFound", Message: fmt.Sprintf("unknown instance %q", id)}
+		}
+
+		inst.State = "terminated"
+	}
+
+	return nil
+}
+
+// DescribeImages returns the images with the given ids, if any, that
+// match the filter
+func (f *Fake) DescribeImages(ids []string, filter Filter) ([]*Image, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if err := f.Errors["DescribeImages"]; err != nil {
+		return nil, err
+	}
+
+	images := []*Image{}
+	for _, img := range f.Images {
+		if !idMatches(ids, img.ID) {
+			continue
+		}
+
+		if !filterMatches(filter, map[string]string{
+			"image-id": img.ID,
+			"name":     img.Name,
+			"state":    img.State,
+		}, img.Tags) {
+			continue
+		}
+
+		regionImg := *img
+		if regionImg.Region == "" {
+			regionImg.Region = f.region
+		}
+
+		images = append(images, &regionImg)
+	}
+
+	return images, nil
+}
+
+// DescribeSecurityGroups returns the security groups that match the
+// filter
+func (f *Fake) DescribeSecurityGroups(filter Filter) ([]*SecurityGroup, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if err := f.Errors["DescribeSecurityGroups"]; err != nil {
+		return nil, err
+	}
+
+	groups := []*SecurityGroup{}
+	for _, sg := range f.SecurityGroups {
+		if !filterMatches(filter, map[string]string{
+			"group-id":   sg.ID,
+			"group-name": sg.Name,
+		}, map[string]string{}) {
+			continue
+		}
+
+		groups = append(groups, sg)
+	}
+
+	return groups, nil
+}
+
+// CreateSecurityGroup adds a security group, failing like EC2 does
+// when the name is already taken
+func (f *Fake) CreateSecurityGroup(name, description string) (*SecurityGroup, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if err := f.Errors["CreateSecurityGroup"]; err != nil {
+		return nil, err
+	}
+
+	for _, sg := range f.SecurityGroups {
+		if sg.Name == name {
+			return nil, &Error{
+				Code:    "InvalidGroup.Duplicate",
+				Message: fmt.Sprintf("the security group %q already exists", name),
+			}
+		}
+	}
+
+	f.nextID++
+
+	sg := &SecurityGroup{ID: fmt.Sprintf("sg-%08x", f.nextID), Name: name}
+	f.SecurityGroups[sg.ID] = sg
+	return sg, nil
+}
+
+// AuthorizeSecurityGroupIngress records the ingress rules for the
+// security group
+func (f *Fake) AuthorizeSecurityGroupIngress(groupID string, rules []*pudding.IngressRule) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if err := f.Errors["AuthorizeSecurityGroupIngress"]; err != nil {
+		return err
+	}
+
+	if _, ok := f.SecurityGroups[groupID]; !ok {
+		return &Error{Code: "InvalidGroup.NotFound", Message: fmt.Sprintf("unknown security group %q", groupID)}
+	}
+
+	f.Ingress[groupID] = append(f.Ingress[groupID], rules...)
+	return nil
+}
+
+// DeleteSecurityGroup removes the security group
+func (f *Fake) DeleteSecurityGroup(groupID string) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if err := f.Errors["DeleteSecurityGroup"]; err != nil {
+		return err
+	}
+
+	if _, ok := f.SecurityGroups[groupID]; !ok {
+		return &Error{Code: "InvalidGroup.NotFound", Message: fmt.Sprintf("unknown security group %q", groupID)}
+	}
+
+	delete(f.SecurityGroups, groupID)
+	delete(f.Ingress, groupID)
+	return nil
+}
+
+// CreateAutoscalingGroup records the autoscaling group
+func (f *Fake) CreateAutoscalingGroup(opts *AutoscalingGroupOptions) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if err := f.Errors["CreateAutoscalingGroup"]; err != nil {
+		return err
+	}
+
+	if _, ok := f.AutoscalingGroups[opts.Name]; ok {
+		return &Error{
+			Code:    "AlreadyExists",
+			Message: fmt.Sprintf("the autoscaling group %q already exists", opts.Name),
+		}
+	}
+
+	f.AutoscalingGroups[opts.Name] = opts
+
+	// mixed-instances groups launch from a launch template made from
+	// the instance
+	if opts.MixedInstances != nil {
+		f.nextID++
+
+		lt := &LaunchTemplate{
+			ID:               fmt.Sprintf("lt-%08x", f.nextID),
+			Name:             fmt.Sprintf("%s-lt", opts.Name),
+			CreatedAt:        time.Now().UTC().Unix(),
+			SecurityGroupIDs: []string{},
+			Tags: map[string]string{
+				LaunchTemplateAutoscalingGroupTag: opts.Name,
+			},
+		}
+		if inst, ok := f.Instances[opts.InstanceID]; ok {
+			lt.SecurityGroupIDs = append(lt.SecurityGroupIDs, inst.SecurityGroupIDs...)
+		}
+
+		f.LaunchTemplates[lt.ID] = lt
+	}
+
+	return nil
+}
+
+// DescribeAutoscalingGroups returns the recorded autoscaling groups,
+// whose instances are those tagged with their name the way autoscaling
+// tags them, and whose security groups are those of the instance each
+// was made from
+func (f *Fake) DescribeAutoscalingGroups() ([]*AutoscalingGroup, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if err := f.Errors["DescribeAutoscalingGroups"]; err != nil {
+		return nil, err
+	}
+
+	names := []string{}
+	for name := range f.AutoscalingGroups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	groups := []*AutoscalingGroup{}
+	for _, name := range names {
+		opts := f.AutoscalingGroups[name]
+
+		asg := &AutoscalingGroup{
+			Name:             name,
+			InstanceIDs:      []string{},
+			SecurityGroupIDs: []string{},
+			Tags:             map[string]string{},
+		}
+
+		for key, value := range opts.Tags {
+			asg.Tags[key] = value
+		}
+
+		if inst, ok := f.Instances[opts.InstanceID]; ok {
+			asg.SecurityGroupIDs = append(asg.SecurityGroupIDs, inst.SecurityGroupIDs...)
+		}
+
+		for _, inst := range f.Instances {
+			if inst.State != "terminated" && inst.Tags[AutoscalingGroupNameTag] == name {
+				asg.InstanceIDs = append(asg.InstanceIDs, inst.ID)
+			}
+		}
+		sort.Strings(asg.InstanceIDs)
+
+		groups = append(groups, asg)
+	}
+
+	return groups, nil
+}
+
+// DescribeLaunchTemplates returns the recorded launch templates
+func (f *Fake) DescribeLaunchTemplates() ([]*LaunchTemplate, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if err := f.Errors["DescribeLaunchTemplates"]; err != nil {
+		return nil, err
+	}
+
+	IDs := []string{}
+	for ID := range f.LaunchTemplates {
+		IDs = append(IDs, ID)
+	}
+	sort.Strings(IDs)
+
+	templates := []*LaunchTemplate{}
+	for _, ID := range IDs {
+		templates = append(templates, f.LaunchTemplates[ID])
+	}
+
+	return templates, nil
+}
+
+// DeleteLaunchTemplate forgets the launch template
+func (f *Fake) DeleteLaunchTemplate(ID string) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if err := f.Errors["DeleteLaunchTemplate"]; err != nil {
+		return err
+	}
+
+	if _, ok := f.LaunchTemplates[ID]; !ok {
+		return &Error{Code: "InvalidLaunchTemplateId.NotFound", Message: fmt.Sprintf("unknown launch template %q", ID)}
+	}
+
+	delete(f.LaunchTemplates, ID)
+	return nil
+}
+
+// LaunchAutoscalingGroupInstance adds a running instance to the
+// autoscaling group the way a scale-out would, made like the instance
+// the group was made from and tagged with the group's tags
+func (f *Fake) LaunchAutoscalingGroupInstance(name string) (*Instance, error) {
+	f.mutex.Lock()
+	opts, ok := f.AutoscalingGroups[name]
+	if !ok {
+		f.mutex.Unlock()
+		return nil, &Error{Code: "ValidationError", Message: fmt.Sprintf("unknown autoscaling group %q", name)}
+	}
+
+	source, ok := f.Instances[opts.InstanceID]
+	if !ok {
+		f.mutex.Unlock()
+		return nil, &Error{Code: "InvalidInstanceID.NotFound", Message: fmt.Sprintf("unknown instance %q", opts.InstanceID)}
+	}
+
+	launch := &LaunchOptions{
+		ImageID:          source.ImageID,
+		InstanceType:     source.Type,
+		UserData:         f.UserData[source.ID],
+		SecurityGroupIDs: source.SecurityGroupIDs,
+		SubnetID:         source.SubnetID,
+		Tags:             map[string]string{AutoscalingGroupNameTag: name},
+	}
+	for key, value := range opts.Tags {
+		launch.Tags[key] = value
+	}
+	f.mutex.Unlock()
+
+	return f.RunInstance(launch)
+}
+
+// PutScalingPolicy records the scaling policy and returns a made-up
+// ARN
+func (f *Fake) PutScalingPolicy(opts *ScalingPolicyOptions) (string, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if err := f.Errors["PutScalingPolicy"]; err != nil {
+		return "", err
+	}
+
+	f.ScalingPolicies[opts.Name] = opts
+	return fmt.Sprintf("arn:aws:autoscaling:%s:000000000000:scalingPolicy:%s", f.region, opts.Name), nil
+}
+
+// PutMetricAlarm records the metric alarm
+func (f *Fake) PutMetricAlarm(opts *MetricAlarmOptions) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if err := f.Errors["PutMetricAlarm"]; err != nil {
+		return err
+	}
+
+	f.MetricAlarms[opts.Name] = opts
+	return nil
+}
+
+// PutLifecycleHook records the lifecycle hook
+func (f *Fake) PutLifecycleHook(opts *LifecycleHookOptions) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if err := f.Errors["PutLifecycleHook"]; err != nil {
+		return err
+	}
+
+	f.LifecycleHooks[opts.Name] = opts
+	return nil
+}
+
+// CompleteLifecycleAction records the completed lifecycle action
+func (f *Fake) CompleteLifecycleAction(action *LifecycleAction, result string) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if err := f.Errors["CompleteLifecycleAction"]; err != nil {
+		return err
+	}
+
+	f.CompletedLifecycleActions = append(f.CompletedLifecycleActions, action)
+	return nil
+}
+
+// RecordLifecycleActionHeartbeat records the lifecycle action heartbeat
+func (f *Fake) RecordLifecycleActionHeartbeat(action *LifecycleAction) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if err := f.Errors["RecordLifecycleActionHeartbeat"]; err != nil {
+		return err
+	}
+
+	f.LifecycleHeartbeats = append(f.LifecycleHeartbeats, action)
+	return nil
+}
+
+// ConfirmSubscription records the confirmed subscription
+func (f *Fake) ConfirmSubscription(topicARN, token string) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if err := f.Errors["ConfirmSubscription"]; err != nil {
+		return err
+	}
+
+	f.ConfirmedSubscriptions[topicARN] = token
+	return nil
+}
+
+func idMatches(ids []string, id string) bool {
+	if len(ids) == 0 {
+		return true
+	}
+
+	for _, candidate := range ids {
+		if candidate == id {
+			return true
+		}
+	}
+
+	return false
+}
+
+// filterMatches supports the filter names used by pudding: the given
+// attributes, "tag:KEY", and "tag-key", with values matched as globs
+// the way EC2 does
+func filterMatches(filter Filter, attrs, tags map[string]string) bool {
+	for name, values := range filter {
+		switch {
+		case name == "tag-key":
+			ok := false
+			for _, value := range values {
+				for key := range tags {
+					if globMatches(value, key) {
+						ok = true
+					}
+				}
+			}
+			if !ok {
+				return false
+			}
+		case strings.HasPrefix(name, "tag:"):
+			tagValue, ok := tags[strings.TrimPrefix(name, "tag:")]
+			if !ok || !anyGlobMatches(values, tagValue) {
+				return false
+			}
+		default:
+			attr, ok := attrs[name]
+			if !ok || !anyGlobMatches(values, attr) {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+func anyGlobMatches(patterns []string, value string) bool {
+	for _, pattern := range patterns {
+		if globMatches(pattern, value) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func globMatches(pattern, value string) bool {
+	ok, err := path.Match(pattern, value)
+	return err == nil && ok
+}
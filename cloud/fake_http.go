@@ -0,0 +1,351 @@
+package cloud
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+
+	"github.com/travis-ci/pudding"
+)
+
+var (
+	cloudType = reflect.TypeOf((*Cloud)(nil)).Elem()
+	errorType = reflect.TypeOf((*error)(nil)).Elem()
+)
+
+// fakeCall is the body of a call to a FakeHandler, with one JSON value
+// per method argument
+type fakeCall struct {
+	Args []json.RawMessage `json:"args"`
+}
+
+// fakeReply is the body of the response to a call, with one JSON value
+// per non-error method result
+type fakeReply struct {
+	Results []json.RawMessage `json:"results"`
+	Error   *Error            `json:"error,omitempty"`
+}
+
+// FakeHandler serves a Fake per region over HTTP so that pudding may
+// be run against it as a local endpoint.  Cloud methods are called via
+// `POST /{region}/{method}`, the state of the region is dumped via
+// `GET /{region}`, and instances, images, and security groups may be
+// seeded via `PUT /{region}` with a body of the same form.
+type FakeHandler struct {
+	mutex sync.Mutex
+	fakes map[string]*Fake
+}
+
+// NewFakeHandler creates a *FakeHandler without any regions, which are
+// added as they are used
+func NewFakeHandler() *FakeHandler {
+	return &FakeHandler{fakes: map[string]*Fake{}}
+}
+
+// Fake returns the *Fake for the region, creating it if absent
+func (h *FakeHandler) Fake(region string) *Fake {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	f, ok := h.fakes[region]
+	if !ok {
+		f = NewFake(region)
+		h.fakes[region] = f
+	}
+
+	return f
+}
+
+// ServeHTTP dispatches calls to the Fake for the region in the path
+func (h *FakeHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	parts := strings.Split(strings.Trim(req.URL.Path, "/"), "/")
+
+	switch {
+	case req.Method == "GET" && len(parts) == 1 && parts[0] != "":
+		h.serveState(w, h.Fake(parts[0]))
+	case req.Method == "PUT" && len(parts) == 1 && parts[0] != "":
+		h.serveSeed(w, req, h.Fake(parts[0]))
+	case req.Method == "POST" && len(parts) == 2:
+		h.serveCall(w, req, h.Fake(parts[0]), parts[1])
+	default:
+		http.NotFound(w, req)
+	}
+}
+
+func (h *FakeHandler) serveState(w http.ResponseWriter, f *Fake) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(f)
+}
+
+func (h *FakeHandler) serveSeed(w http.ResponseWriter, req *http.Request, f *Fake) {
+	seed := &Fake{}
+	err := json.NewDecoder(req.Body).Decode(seed)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	f.mutex.Lock()
+	for ID, inst := range seed.Instances {
+		f.Instances[ID] = inst
+	}
+	for ID, img := range seed.Images {
+		f.Images[ID] = img
+	}
+	for ID, sg := range seed.SecurityGroups {
+		f.SecurityGroups[ID] = sg
+	}
+	f.mutex.Unlock()
+
+	h.serveState(w, f)
+}
+
+func (h *FakeHandler) serveCall(w http.ResponseWriter, req *http.Request, f *Fake, name string) {
+	if _, ok := cloudType.MethodByName(name); !ok {
+		http.Error(w, fmt.Sprintf("unknown method %q", name), http.StatusNotFound)
+		return
+	}
+
+	call := &fakeCall{}
+	err := json.NewDecoder(req.Body).Decode(call)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	method := reflect.ValueOf(f).MethodByName(name)
+	if len(call.Args) != method.Type().NumIn() {
+		http.Error(w, fmt.Sprintf("%s takes %d args", name, method.Type().NumIn()), http.StatusBadRequest)
+		return
+	}
+
+	in := []reflect.Value{}
+	for i, raw := range call.Args {
+		arg := reflect.New(method.Type().In(i))
+		err = json.Unmarshal(raw, arg.Interface())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		in = append(in, arg.Elem())
+	}
+
+	reply := &fakeReply{Results: []json.RawMessage{}}
+	for _, out := range method.Call(in) {
+		if out.Type() == errorType {
+			if !out.IsNil() {
+				reply.Error = &Error{Code: ErrorCode(out.Interface().(error)), Message: out.Interface().(error).Error()}
+			}
+			continue
+		}
+
+		result, err := json.Marshal(out.Interface())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		reply.Results = append(reply.Results, result)
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(reply)
+}
+
+// Remote is a Cloud that calls a FakeHandler over HTTP
+type Remote struct {
+	url    string
+	region string
+	client *http.Client
+}
+
+// NewRemote creates a *Remote for the region of the FakeHandler
+// served at the given base URL
+func NewRemote(baseURL, region string) *Remote {
+	return &Remote{
+		url:    strings.TrimRight(baseURL, "/"),
+		region: region,
+		client: &http.Client{},
+	}
+}
+
+func (r *Remote) call(name string, args []interface{}, results ...interface{}) error {
+	call := &fakeCall{Args: []json.RawMessage{}}
+	for _, arg := range args {
+		raw, err := json.Marshal(arg)
+		if err != nil {
+			return err
+		}
+		call.Args = append(call.Args, raw)
+	}
+
+	body, err := json.Marshal(call)
+	if err != nil {
+		return err
+	}
+
+	resp, err := r.client.Post(fmt.Sprintf("%s/%s/%s", r.url, r.region, name),
+		"application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("fake cloud responded to %s with %s", name, resp.Status)
+	}
+
+	reply := &fakeReply{}
+	err = json.NewDecoder(resp.Body).Decode(reply)
+	if err != nil {
+		return err
+	}
+
+	if reply.Error != nil {
+		return reply.Error
+	}
+
+	for i, result := range results {
+		if i >= len(reply.Results) {
+			break
+		}
+
+		err = json.Unmarshal(reply.Results[i], result)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Region returns the name of the region
+func (r *Remote) Region() string {
+	return r.region
+}
+
+// DescribeInstances calls DescribeInstances on the fake
+func (r *Remote) DescribeInstances(ids []string, f Filter) ([]*Instance, error) {
+	instances := []*Instance{}
+	err := r.call("DescribeInstances", []interface{}{ids, f}, &instances)
+	return instances, err
+}
+
+// RunInstance calls RunInstance on the fake
+func (r *Remote) RunInstance(opts *LaunchOptions) (*Instance, error) {
+	inst := &Instance{}
+	err := r.call("RunInstance", []interface{}{opts}, &inst)
+	if err != nil {
+		return nil, err
+	}
+	return inst, nil
+}
+
+// CreateTags calls CreateTags on the fake
+func (r *Remote) CreateTags(ids []string, tags map[string]string) error {
+	return r.call("CreateTags", []interface{}{ids, tags})
+}
+
+// TerminateInstances calls TerminateInstances on the fake
+func (r *Remote) TerminateInstances(ids []string) error {
+	return r.call("TerminateInstances", []interface{}{ids})
+}
+
+// DescribeImages calls DescribeImages on the fake
+func (r *Remote) DescribeImages(ids []string, f Filter) ([]*Image, error) {
+	images := []*Image{}
+	err := r.call("DescribeImages", []interface{}{ids, f}, &images)
+	return images, err
+}
+
+// DescribeSecurityGroups calls DescribeSecurityGroups on the fake
+func (r *Remote) DescribeSecurityGroups(f Filter) ([]*SecurityGroup, error) {
+	groups := []*SecurityGroup{}
+	err := r.call("DescribeSecurityGroups", []interface{}{f}, &groups)
+	return groups, err
+}
+
+// CreateSecurityGroup calls CreateSecurityGroup on the fake
+func (r *Remote) CreateSecurityGroup(name, description string) (*SecurityGroup, error) {
+	sg := &SecurityGroup{}
+	err := r.call("CreateSecurityGroup", []interface{}{name, description}, &sg)
+	if err != nil {
+		return nil, err
+	}
+	return sg, nil
+}
+
+// AuthorizeSecurityGroupIngress calls AuthorizeSecurityGroupIngress on
+// the fake
+func (r *Remote) AuthorizeSecurityGroupIngress(groupID string, rules []*pudding.IngressRule) error {
+	return r.call("AuthorizeSecurityGroupIngress", []interface{}{groupID, rules})
+}
+
+// DeleteSecurityGroup calls DeleteSecurityGroup on the fake
+func (r *Remote) DeleteSecurityGroup(groupID string) error {
+	return r.call("DeleteSecurityGroup", []interface{}{groupID})
+}
+
+// CreateAutoscalingGroup calls CreateAutoscalingGroup on the fake
+func (r *Remote) CreateAutoscalingGroup(opts *AutoscalingGroupOptions) error {
+	return r.call("CreateAutoscalingGroup", []interface{}{opts})
+}
+
+// DescribeAutoscalingGroups calls DescribeAutoscalingGroups on the
+// fake
+func (r *Remote) DescribeAutoscalingGroups() ([]*AutoscalingGroup, error) {
+	groups := []*AutoscalingGroup{}
+	err := r.call("DescribeAutoscalingGroups", []interface{}{}, &groups)
+	return groups, err
+}
+
+// DescribeLaunchTemplates calls DescribeLaunchTemplates on the fake
+func (r *Remote) DescribeLaunchTemplates() ([]*LaunchTemplate, error) {
+	templates := []*LaunchTemplate{}
+	err := r.call("DescribeLaunchTemplates", []interface{}{}, &templates)
+	return templates, err
+}
+
+// DeleteLaunchTemplate calls DeleteLaunchTemplate on the fake
+func (r *Remote) DeleteLaunchTemplate(ID string) error {
+	return r.call("DeleteLaunchTemplate", []interface{}{ID})
+}
+
+// PutScalingPolicy calls PutScalingPolicy on the fake
+func (r *Remote) PutScalingPolicy(opts *ScalingPolicyOptions) (string, error) {
+	arn := ""
+	err := r.call("PutScalingPolicy", []interface{}{opts}, &arn)
+	return arn, err
+}
+
+// PutMetricAlarm calls PutMetricAlarm on the fake
+func (r *Remote) PutMetricAlarm(opts *MetricAlarmOptions) error {
+	return r.call("PutMetricAlarm", []interface{}{opts})
+}
+
+// PutLifecycleHook calls PutLifecycleHook on the fake
+func (r *Remote) PutLifecycleHook(opts *LifecycleHookOptions) error {
+	return r.call("PutLifecycleHook", []interface{}{opts})
+}
+
+// CompleteLifecycleAction calls CompleteLifecycleAction on the fake
+func (r *Remote) CompleteLifecycleAction(action *LifecycleAction, result string) error {
+	return r.call("CompleteLifecycleAction", []interface{}{action, result})
+}
+
+// RecordLifecycleActionHeartbeat calls RecordLifecycleActionHeartbeat
+// on the fake
+func (r *Remote) RecordLifecycleActionHeartbeat(action *LifecycleAction) error {
+	return r.call("RecordLifecycleActionHeartbeat", []interface{}{action})
+}
+
+// ConfirmSubscription calls ConfirmSubscription on the fake
+func (r *Remote) ConfirmSubscription(topicARN, token string) error {
+	return r.call("ConfirmSubscription", []interface{}{topicARN, token})
+}
@@ -0,0 +1,99 @@
+package cloud
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRemoteCallsFakeHandler(t *testing.T) {
+	h := NewFakeHandler()
+	ts := httptest.NewServer(h)
+	defer ts.Close()
+
+	r := NewRemote(ts.URL, "eu-west-1")
+
+	inst, err := r.RunInstance(&LaunchOptions{
+		ImageID:      "ami-abcd123",
+		InstanceType: "c3.2xlarge",
+		UserData:     []byte("#include http://example.org\n"),
+		Tags:         map[string]string{"role": "worker"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f := h.Fake("eu-west-1")
+	if _, ok := f.Instances[inst.ID]; !ok {
+		t.Fatalf("expected instance %q in the fake", inst.ID)
+	}
+
+	if string(f.UserData[inst.ID]) != "#include http://example.org\n" {
+		t.Fatalf("unexpected user data %q", f.UserData[inst.ID])
+	}
+
+	instances, err := r.DescribeInstances(nil, Filter{"tag:role": []string{"worker"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(instances) != 1 || instances[0].Tags["role"] != "worker" {
+		t.Fatalf("unexpected instances %#v", instances)
+	}
+
+	if len(h.Fake("us-east-1").Instances) != 0 {
+		t.Fatalf("expected regions to be kept apart")
+	}
+
+	_, err = r.CreateSecurityGroup("pudding-org-prod", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = r.CreateSecurityGroup("pudding-org-prod", "")
+	if ErrorCode(err) != "InvalidGroup.Duplicate" {
+		t.Fatalf("expected duplicate group error, got %v", err)
+	}
+}
+
+func TestFakeHandlerSeedsState(t *testing.T) {
+	h := NewFakeHandler()
+	ts := httptest.NewServer(h)
+	defer ts.Close()
+
+	req, err := http.NewRequest("PUT", ts.URL+"/us-east-1",
+		strings.NewReader(`{"Images":{"ami-abcd123":{"ID":"ami-abcd123","Tags":{"role":"worker"}}}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status %v", resp.StatusCode)
+	}
+
+	images, err := NewRemote(ts.URL, "us-east-1").DescribeImages([]string{"ami-abcd123"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(images) != 1 || images[0].Tags["role"] != "worker" {
+		t.Fatalf("unexpected images %#v", images)
+	}
+
+	resp, err = http.Post(ts.URL+"/us-east-1/ServeHTTP", "application/json", strings.NewReader(`{}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected methods outside of Cloud to be refused, got %v", resp.StatusCode)
+	}
+}
@@ -0,0 +1,98 @@
+package cloud
+
+import (
+	"testing"
+
+	"github.com/travis-ci/pudding"
+)
+
+func TestFakeRunInstanceTagsAndFilters(t *testing.T) {
+	f := NewFake("us-west-2")
+
+	inst, err := f.RunInstance(&LaunchOptions{
+		ImageID:      "ami-abcd123",
+		InstanceType: "c3.2xlarge",
+		Market:       pudding.MarketSpot,
+		Tags:         map[string]string{"role": "worker", "site": "org"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if inst.Region != "us-west-2" || inst.AvailabilityZone != "us-west-2a" {
+		t.Fatalf("unexpected placement %q %q", inst.Region, inst.AvailabilityZone)
+	}
+
+	if inst.Lifecycle != pudding.MarketSpot {
+		t.Fatalf("expected spot lifecycle, got %q", inst.Lifecycle)
+	}
+
+	instances, err := GetInstancesWithFilter(f, Filter{
+		"tag:role":            []string{"work*"},
+		"instance-state-name": []string{"running"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := instances[inst.ID]; !ok || len(instances) != 1 {
+		t.Fatalf("expected only %q, got %v", inst.ID, instances)
+	}
+
+	err = f.TerminateInstances([]string{inst.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	instances, err = GetInstancesWithFilter(f, Filter{"instance-state-name": []string{"running"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(instances) != 0 {
+		t.Fatalf("expected no running instances, got %v", instances)
+	}
+}
+
+func TestFakeCreateSecurityGroupDuplicate(t *testing.T) {
+	f := NewFake("us-east-1")
+
+	_, err := f.CreateSecurityGroup("pudding-abcd", "pudding-abcd")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = f.CreateSecurityGroup("pudding-abcd", "pudding-abcd")
+	if ErrorCode(err) != "InvalidGroup.Duplicate" {
+		t.Fatalf("expected duplicate group error, got %v", err)
+	}
+
+	if !IsAPIError(err) || IsNetworkError(err) {
+		t.Fatalf("expected API error, got %v", err)
+	}
+}
+
+func TestFetchLatestAMIWithFilter(t *testing.T) {
+	f := NewFake("us-east-1")
+	f.Images["ami-1"] = &Image{ID: "ami-1", Name: "travis-worker-1445385600", Tags: map[string]string{"active": "true", "role": "worker"}}
+	f.Images["ami-2"] = &Image{ID: "ami-2", Name: "travis-worker-1445472000", Tags: map[string]string{"active": "true", "role": "worker"}}
+	f.Images["ami-3"] = &Image{ID: "ami-3", Name: "travis-worker-1445558400", Tags: map[string]string{"role": "worker"}}
+
+	img, err := ResolveAMI(f, "", Filter{"tag:role": []string{"worker"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if img.ID != "ami-2" {
+		t.Fatalf("expected ami-2, got %q", img.ID)
+	}
+
+	img, err = ResolveAMI(f, "ami-3", Filter{"tag:role": []string{"worker"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if img.ID != "ami-3" {
+		t.Fatalf("expected ami-3, got %q", img.ID)
+	}
+}
@@ -0,0 +1,81 @@
+package cloud
+
+import "sort"
+
+// ResolveAMI attempts to get an image by id, falling back to fetching
+// the most recently provisioned image via FetchLatestAMIWithFilter
+func ResolveAMI(c Cloud, ID string, f Filter) (*Image, error) {
+	if ID != "" {
+		images, err := c.DescribeImages([]string{ID}, Filter{})
+		if err != nil {
+			return nil, err
+		}
+		for _, img := range images {
+			if img.ID == ID {
+				return img, nil
+			}
+		}
+	}
+
+	return FetchLatestAMIWithFilter(c, f)
+}
+
+// FetchLatestAMIWithFilter looks up all images matching the given
+// filter (with `tag:active=true` added), then sorts by the image
+// name which is assumed to contain a timestamp, then returns the
+// most recent image.
+func FetchLatestAMIWithFilter(c Cloud, f Filter) (*Image, error) {
+	f["tag-key"] = append(f["tag-key"], "active")
+
+	allImages, err := c.DescribeImages([]string{}, f)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(allImages) == 0 {
+		return nil, errNoLatestImage
+	}
+
+	imgNames := []string{}
+	imgMap := map[string]*Image{}
+
+	for _, img := range allImages {
+		imgNames = append(imgNames, img.Name)
+		imgMap[img.Name] = img
+	}
+
+	sort.Strings(imgNames)
+	return imgMap[imgNames[len(imgNames)-1]], nil
+}
+
+// GetInstancesWithFilter fetches all instances that match the
+// given filter
+func GetInstancesWithFilter(c Cloud, f Filter) (map[string]*Instance, error) {
+	all, err := c.DescribeInstances([]string{}, f)
+	if err != nil {
+		return nil, err
+	}
+
+	instances := map[string]*Instance{}
+	for _, inst := range all {
+		instances[inst.ID] = inst
+	}
+
+	return instances, nil
+}
+
+// GetImagesWithFilter fetches all images that match the
+// given filter
+func GetImagesWithFilter(c Cloud, f Filter) (map[string]*Image, error) {
+	all, err := c.DescribeImages([]string{}, f)
+	if err != nil {
+		return nil, err
+	}
+
+	images := map[string]*Image{}
+	for _, img := range all {
+		images[img.ID] = img
+	}
+
+	return images, nil
+}
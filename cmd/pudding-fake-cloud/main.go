@@ -0,0 +1,36 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"os"
+
+	"github.com/codegangsta/cli"
+	"github.com/travis-ci/pudding"
+	"github.com/travis-ci/pudding/cloud"
+)
+
+func main() {
+	app := cli.NewApp()
+	app.Usage = "Pretending to be the cloud"
+	app.Author = "Travis CI"
+	app.Email = "contact+pudding-fake-cloud@travis-ci.org"
+	app.Version = pudding.VersionString
+	app.Compiled = pudding.GeneratedTime()
+	app.Flags = []cli.Flag{
+		cli.StringFlag{
+			Name:   "a, addr",
+			Value:  ":42152",
+			EnvVar: "PUDDING_FAKE_CLOUD_ADDR",
+		},
+	}
+	app.Action = runFakeCloud
+	app.Run(os.Args)
+}
+
+func runFakeCloud(c *cli.Context) {
+	addr := c.String("addr")
+
+	log.Printf("fake cloud listening on %s", addr)
+	log.Fatal(http.ListenAndServe(addr, cloud.NewFakeHandler()))
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+
+	"github.com/codegangsta/cli"
+	"github.com/travis-ci/pudding"
+	"github.com/travis-ci/pudding/secrets"
+)
+
+func main() {
+	app := cli.NewApp()
+	app.Usage = "Encrypting a JSON object of secrets from stdin for the file secrets provider"
+	app.Author = "Travis CI"
+	app.Email = "contact+pudding-secrets-file@travis-ci.org"
+	app.Version = pudding.VersionString
+	app.Compiled = pudding.GeneratedTime()
+	app.Flags = []cli.Flag{
+		pudding.EncryptionKeysFlag,
+	}
+	app.Action = runSecretsFile
+	app.Run(os.Args)
+}
+
+func runSecretsFile(c *cli.Context) {
+	kr, err := pudding.ParseKeyring(c.String("encryption-keys"))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	secretsJSON, err := ioutil.ReadAll(os.Stdin)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	contents, err := secrets.EncryptFileContents(secretsJSON, kr)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	fmt.Println(contents)
+}
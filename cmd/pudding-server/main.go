@@ -2,6 +2,7 @@ package main
 
 import (
 	"os"
+	"strings"
 
 	"github.com/codegangsta/cli"
 	"github.com/travis-ci/pudding"
@@ -43,18 +44,67 @@ func main() {
 			Value:  "instance-lifecycle-transitions",
 			EnvVar: "PUDDING_INSTANCE_LIFECYCLE_TRANSITIONS_QUEUE_NAME",
 		},
+		cli.StringFlag{
+			Name:   "required-tags",
+			Usage:  "comma-delimited tag keys that every instance and autoscaling group build must include",
+			EnvVar: "PUDDING_REQUIRED_TAGS",
+		},
 		cli.StringFlag{
 			Name:   "A, auth-token",
 			Value:  "swordfish",
 			EnvVar: "PUDDING_AUTH_TOKEN",
 		},
+		cli.StringFlag{
+			Name:   "team-tokens",
+			Usage:  "comma-delimited {team}={token} pairs of auth tokens whose instance builds count against the team's quotas",
+			EnvVar: "PUDDING_TEAM_TOKENS",
+		},
+		cli.StringFlag{
+			Name:   "instance-build-quotas",
+			Usage:  "JSON array of instance build quotas per team, site, env, and queue",
+			EnvVar: "PUDDING_INSTANCE_BUILD_QUOTAS",
+		},
+		cli.StringFlag{
+			Name:   "approval-policies",
+			Usage:  "JSON array of policies marking the instance builds that are held until approved",
+			EnvVar: "PUDDING_APPROVAL_POLICIES",
+		},
+		cli.StringFlag{
+			Name:   "approver-tokens",
+			Usage:  "comma-delimited {approver}={token} pairs of the only auth tokens that may decide approvals",
+			EnvVar: "PUDDING_APPROVER_TOKENS",
+		},
+		cli.StringFlag{
+			Name:   "build-policies",
+			Usage:  "JSON array of policies that instance and autoscaling group builds must follow",
+			EnvVar: "PUDDING_BUILD_POLICIES",
+		},
+		cli.StringFlag{
+			Name:   "instance-identity-certs",
+			Usage:  "PEM-encoded AWS certificates used to verify instance identity document signatures",
+			EnvVar: "PUDDING_INSTANCE_IDENTITY_CERTS",
+		},
+		cli.StringFlag{
+			Name:   "instance-identity-accounts",
+			Usage:  "comma-delimited ids of the AWS accounts whose instances may check in",
+			EnvVar: "PUDDING_INSTANCE_IDENTITY_ACCOUNTS",
+		},
+		cli.BoolFlag{
+			Name:   "require-instance-identity",
+			Usage:  "refuse instance build creds for heartbeats and lifecycle transitions of instances",
+			EnvVar: "PUDDING_REQUIRE_INSTANCE_IDENTITY",
+		},
 		pudding.SlackHookPathFlag,
 		pudding.SlackUsernameFlag,
 		pudding.SlackChannelFlag,
 		pudding.SlackIconFlag,
 		pudding.SentryDSNFlag,
+		pudding.EncryptionKeysFlag,
+		pudding.EncryptionMigrationFlag,
 		pudding.InstanceExpiryFlag,
 		pudding.ImageExpiryFlag,
+		pudding.AWSRegionFlag,
+		pudding.AWSRegionsFlag,
 		pudding.DebugFlag,
 	}
 	app.Action = runServer
@@ -70,6 +120,12 @@ func runServer(c *cli.Context) {
 		AuthToken: c.String("auth-token"),
 		Debug:     c.Bool("debug"),
 
+		TeamTokens:          c.String("team-tokens"),
+		InstanceBuildQuotas: c.String("instance-build-quotas"),
+		ApprovalPolicies:    c.String("approval-policies"),
+		ApproverTokens:      c.String("approver-tokens"),
+		BuildPolicies:       c.String("build-policies"),
+
 		RedisURL: c.String("redis-url"),
 
 		SlackHookPath:       c.String("slack-hook-path"),
@@ -79,9 +135,19 @@ func runServer(c *cli.Context) {
 
 		SentryDSN: c.String("sentry-dsn"),
 
+		EncryptionKeys:      c.String("encryption-keys"),
+		EncryptionMigration: c.Bool("encryption-migration"),
+
 		InstanceExpiry: c.Int("instance-expiry"),
 		ImageExpiry:    c.Int("image-expiry"),
 
+		AWSRegion:  c.String("aws-region"),
+		AWSRegions: c.String("aws-regions"),
+
+		InstanceIdentityCerts:    c.String("instance-identity-certs"),
+		InstanceIdentityAccounts: c.String("instance-identity-accounts"),
+		RequireInstanceIdentity:  c.Bool("require-instance-identity"),
+
 		QueueNames: map[string]string{
 			"instance-builds":                c.String("instance-builds-queue-name"),
 			"instance-terminations":          c.String("instance-terminations-queue-name"),
@@ -89,5 +155,15 @@ func runServer(c *cli.Context) {
 			"sns-messages":                   c.String("sns-messages-queue-name"),
 			"instance-lifecycle-transitions": c.String("instance-lifecycle-transitions-queue-name"),
 		},
+
+		RequiredTags: func() []string {
+			tags := []string{}
+			for _, key := range strings.Split(c.String("required-tags"), ",") {
+				if key = strings.TrimSpace(key); key != "" {
+					tags = append(tags, key)
+				}
+			}
+			return tags
+		}(),
 	})
 }
@@ -47,10 +47,17 @@ func main() {
 			Name:   "S, aws-secret",
 			EnvVar: "AWS_SECRET_ACCESS_KEY",
 		},
+		pudding.AWSRegionFlag,
+		pudding.AWSRegionsFlag,
 		cli.StringFlag{
-			Name:   "R, aws-region",
-			Value:  "us-east-1",
-			EnvVar: "AWS_DEFAULT_REGION",
+			Name:   "account-roles",
+			Usage:  "comma-delimited {site}[:{env}]={role_arn} pairs of roles to assume for sites in other AWS accounts",
+			EnvVar: "PUDDING_ACCOUNT_ROLES",
+		},
+		cli.StringFlag{
+			Name:   "fake-cloud-url",
+			Usage:  "base URL of a pudding-fake-cloud endpoint to use instead of AWS",
+			EnvVar: "PUDDING_FAKE_CLOUD_URL",
 		},
 		cli.StringFlag{
 			Name: "instance-rsa",
@@ -67,16 +74,135 @@ func main() {
 		cli.StringFlag{
 			Name: "T, init-script-template",
 		},
+		cli.IntFlag{
+			Name:   "init-script-expiry",
+			Value:  3600,
+			Usage:  "number of seconds for which an init script may be fetched with its temporary auth",
+			EnvVar: "PUDDING_TEMPORARY_INIT_EXPIRY",
+		},
+		cli.IntFlag{
+			Name:   "init-script-max-uses",
+			Value:  1,
+			Usage:  "number of times an init script may be fetched with its temporary auth",
+			EnvVar: "PUDDING_INIT_SCRIPT_MAX_USES",
+		},
+		cli.IntFlag{
+			Name:   "init-script-shared-expiry",
+			Value:  604800,
+			Usage:  "number of seconds for which an init script shared with an autoscaling group may be fetched after the group was last seen",
+			EnvVar: "PUDDING_INIT_SCRIPT_SHARED_EXPIRY",
+		},
+		cli.StringFlag{
+			Name:   "secrets-provider",
+			Value:  "env",
+			Usage:  "where init script templates look up secrets, being env, file, or vault",
+			EnvVar: "PUDDING_SECRETS_PROVIDER",
+		},
+		cli.StringFlag{
+			Name:   "secrets-allowlist",
+			Value:  "RSA_KEY_*",
+			Usage:  "comma-delimited keys and PREFIX_* patterns that init script templates may look up",
+			EnvVar: "PUDDING_SECRETS_ALLOWLIST",
+		},
+		cli.StringFlag{
+			Name:   "secrets-file",
+			Usage:  "path to the encrypted secrets file for the file secrets provider",
+			EnvVar: "PUDDING_SECRETS_FILE",
+		},
+		cli.StringFlag{
+			Name:   "secrets-vault-addr",
+			Usage:  "base URL of the Vault-compatible store for the vault secrets provider",
+			EnvVar: "PUDDING_SECRETS_VAULT_ADDR",
+		},
+		cli.StringFlag{
+			Name:   "secrets-vault-token",
+			Usage:  "token for the vault secrets provider",
+			EnvVar: "PUDDING_SECRETS_VAULT_TOKEN",
+		},
+		cli.StringFlag{
+			Name:   "secrets-vault-path",
+			Value:  "secret/data/pudding",
+			Usage:  "path of the KV v2 secret holding the secrets for the vault secrets provider",
+			EnvVar: "PUDDING_SECRETS_VAULT_PATH",
+		},
 		cli.IntFlag{
 			Name:   "I, mini-worker-interval",
 			Value:  30,
 			Usage:  "interval in seconds for the mini worker loop",
 			EnvVar: "PUDDING_MINI_WORKER_INTERVAL",
 		},
+		cli.IntFlag{
+			Name:   "instance-ttl-warning",
+			Value:  900,
+			Usage:  "seconds before their expiry to warn about instances launched with a ttl",
+			EnvVar: "PUDDING_INSTANCE_TTL_WARNING",
+		},
+		cli.IntFlag{
+			Name:   "lifecycle-heartbeat-interval",
+			Value:  300,
+			Usage:  "interval in seconds between heartbeats for pending lifecycle actions (0 disables)",
+			EnvVar: "PUDDING_LIFECYCLE_HEARTBEAT_INTERVAL",
+		},
+		cli.IntFlag{
+			Name:   "lifecycle-action-timeout",
+			Value:  3600,
+			Usage:  "age in seconds after which pending lifecycle actions are resolved (0 disables)",
+			EnvVar: "PUDDING_LIFECYCLE_ACTION_TIMEOUT",
+		},
+		cli.StringFlag{
+			Name:   "lifecycle-launching-timeout-result",
+			Value:  "ABANDON",
+			Usage:  "result used when resolving timed out launching lifecycle actions",
+			EnvVar: "PUDDING_LIFECYCLE_LAUNCHING_TIMEOUT_RESULT",
+		},
+		cli.StringFlag{
+			Name:   "lifecycle-terminating-timeout-result",
+			Value:  "CONTINUE",
+			Usage:  "result used when resolving timed out terminating lifecycle actions",
+			EnvVar: "PUDDING_LIFECYCLE_TERMINATING_TIMEOUT_RESULT",
+		},
+		cli.IntFlag{
+			Name:   "security-group-gc-grace-period",
+			Value:  3600,
+			Usage:  "age in seconds after which unused pudding security groups are deleted (0 disables)",
+			EnvVar: "PUDDING_SECURITY_GROUP_GC_GRACE_PERIOD",
+		},
+		cli.BoolFlag{
+			Name:   "security-group-gc-dry-run",
+			Usage:  "only report the unused pudding security groups that would be deleted",
+			EnvVar: "PUDDING_SECURITY_GROUP_GC_DRY_RUN",
+		},
+		cli.IntFlag{
+			Name:   "orphan-grace-period",
+			Value:  900,
+			Usage:  "seconds after launch to reconcile instances against those pudding launched (0 disables)",
+			EnvVar: "PUDDING_ORPHAN_GRACE_PERIOD",
+		},
+		cli.StringFlag{
+			Name:   "orphan-action",
+			Value:  "report",
+			Usage:  "what to do with orphan instances: report, adopt, or terminate",
+			EnvVar: "PUDDING_ORPHAN_ACTION",
+		},
+		cli.IntFlag{
+			Name:   "orphan-max-terminations",
+			Value:  5,
+			Usage:  "most orphan instances to terminate per reconciliation",
+			EnvVar: "PUDDING_ORPHAN_MAX_TERMINATIONS",
+		},
+		cli.StringFlag{
+			Name:   "default-ingress-rules",
+			Value:  pudding.DefaultIngressRulesJSON,
+			Usage:  "JSON array of ingress rules for pudding-created security groups without site or env specific rules",
+			EnvVar: "PUDDING_DEFAULT_INGRESS_RULES",
+		},
 		pudding.SlackHookPathFlag,
 		pudding.SlackUsernameFlag,
+		pudding.SlackChannelFlag,
 		pudding.SlackIconFlag,
 		pudding.SentryDSNFlag,
+		pudding.EncryptionKeysFlag,
+		pudding.EncryptionMigrationFlag,
 		pudding.InstanceExpiryFlag,
 		pudding.ImageExpiryFlag,
 		pudding.DebugFlag,
@@ -112,23 +238,55 @@ func runWorkers(c *cli.Context) {
 		RedisPoolSize: c.String("redis-pool-size"),
 		RedisURL:      c.String("redis-url"),
 
-		AWSKey:    c.String("aws-key"),
-		AWSSecret: c.String("aws-secret"),
-		AWSRegion: c.String("aws-region"),
+		AWSKey:     c.String("aws-key"),
+		AWSSecret:  c.String("aws-secret"),
+		AWSRegion:  c.String("aws-region"),
+		AWSRegions: c.String("aws-regions"),
+
+		AccountRoles: c.String("account-roles"),
+		FakeCloudURL: c.String("fake-cloud-url"),
 
 		InstanceRSA:        instanceRSA,
 		InstanceYML:        instanceYML,
 		InstanceTagRetries: 10,
 
-		InitScriptTemplate: initScriptTemplate,
-		MiniWorkerInterval: c.Int("mini-worker-interval"),
-		InstanceExpiry:     c.Int("instance-expiry"),
-		ImageExpiry:        c.Int("image-expiry"),
+		InitScriptTemplate:     initScriptTemplate,
+		InitScriptExpiry:       c.Int("init-script-expiry"),
+		InitScriptMaxUses:      c.Int("init-script-max-uses"),
+		InitScriptSharedExpiry: c.Int("init-script-shared-expiry"),
+		MiniWorkerInterval:     c.Int("mini-worker-interval"),
+		InstanceExpiry:         c.Int("instance-expiry"),
+		ImageExpiry:            c.Int("image-expiry"),
+		InstanceTTLWarning:     c.Int("instance-ttl-warning"),
 
-		SlackHookPath: c.String("slack-hook-path"),
-		SlackUsername: c.String("slack-username"),
-		SlackIcon:     c.String("slack-icon"),
+		LifecycleHeartbeatInterval:        c.Int("lifecycle-heartbeat-interval"),
+		LifecycleActionTimeout:            c.Int("lifecycle-action-timeout"),
+		LifecycleLaunchingTimeoutResult:   c.String("lifecycle-launching-timeout-result"),
+		LifecycleTerminatingTimeoutResult: c.String("lifecycle-terminating-timeout-result"),
+
+		SecurityGroupGCGracePeriod: c.Int("security-group-gc-grace-period"),
+		SecurityGroupGCDryRun:      c.Bool("security-group-gc-dry-run"),
+		DefaultIngressRules:        c.String("default-ingress-rules"),
+
+		OrphanGracePeriod:     c.Int("orphan-grace-period"),
+		OrphanAction:          c.String("orphan-action"),
+		OrphanMaxTerminations: c.Int("orphan-max-terminations"),
+
+		SlackHookPath:       c.String("slack-hook-path"),
+		SlackUsername:       c.String("slack-username"),
+		SlackIcon:           c.String("slack-icon"),
+		DefaultSlackChannel: c.String("default-slack-channel"),
 
 		SentryDSN: c.String("sentry-dsn"),
+
+		EncryptionKeys:      c.String("encryption-keys"),
+		EncryptionMigration: c.Bool("encryption-migration"),
+
+		SecretsProvider:   c.String("secrets-provider"),
+		SecretsAllowlist:  c.String("secrets-allowlist"),
+		SecretsFile:       c.String("secrets-file"),
+		SecretsVaultAddr:  c.String("secrets-vault-addr"),
+		SecretsVaultToken: c.String("secrets-vault-token"),
+		SecretsVaultPath:  c.String("secrets-vault-path"),
 	})
 }
@@ -0,0 +1,122 @@
+package db
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/garyburd/redigo/redis"
+	"github.com/travis-ci/pudding"
+)
+
+// ApprovalExpiry is the number of seconds for which approvals are kept
+// once approved or rejected
+const ApprovalExpiry = 30 * 24 * 60 * 60
+
+// ApprovalDecidedError is returned when deciding an approval that has
+// already been approved or rejected
+type ApprovalDecidedError struct {
+	ID        string
+	State     string
+	DecidedBy string
+}
+
+func (e *ApprovalDecidedError) Error() string {
+	return fmt.Sprintf("approval %s was already %s by %s", e.ID, e.State, e.DecidedBy)
+}
+
+// ApprovalFetcherStorer defines the interface for keeping instance
+// builds held for approval and deciding on them
+type ApprovalFetcherStorer interface {
+	Fetch(map[string]string) ([]*pudding.Approval, error)
+	Get(string) (*pudding.Approval, error)
+	Store(*pudding.Approval) error
+	Decide(string, string, string, string) (*pudding.Approval, error)
+	Reopen(string) error
+}
+
+// Approvals represents the approval collection
+type Approvals struct {
+	r   *redis.Pool
+	log *logrus.Logger
+}
+
+// NewApprovals creates a new *Approvals
+func NewApprovals(r *redis.Pool, log *logrus.Logger) (*Approvals, error) {
+	return &Approvals{
+		r:   r,
+		log: log,
+	}, nil
+}
+
+// Fetch returns the approvals in the given state, defaulting to those
+// awaiting approval, or in any state for "all", oldest first
+func (ap *Approvals) Fetch(f map[string]string) ([]*pudding.Approval, error) {
+	conn := ap.r.Get()
+	defer conn.Close()
+
+	all, err := FetchApprovals(conn)
+	if err != nil {
+		return nil, err
+	}
+
+	state := f["state"]
+	if state == "" {
+		state = pudding.ApprovalStateAwaiting
+	}
+
+	approvals := []*pudding.Approval{}
+	for _, a := range all {
+		if state == "all" || a.State == state {
+			approvals = append(approvals, a)
+		}
+	}
+
+	sort.Sort(approvalsByRequestedAt(approvals))
+	return approvals, nil
+}
+
+// Get returns the approval with the given id, or nil if there is none
+func (ap *Approvals) Get(ID string) (*pudding.Approval, error) {
+	conn := ap.r.Get()
+	defer conn.Close()
+
+	return FetchApproval(conn, ID)
+}
+
+// Store keeps an instance build held for approval
+func (ap *Approvals) Store(a *pudding.Approval) error {
+	conn := ap.r.Get()
+	defer conn.Close()
+
+	return StoreApproval(conn, a)
+}
+
+// Decide approves or rejects the approval with the given id, returning
+// nil if there is none
+func (ap *Approvals) Decide(ID, state, decidedBy, reason string) (*pudding.Approval, error) {
+	conn := ap.r.Get()
+	defer conn.Close()
+
+	return DecideApproval(conn, ID, state, decidedBy, reason, time.Now().UTC().Unix(), ApprovalExpiry)
+}
+
+// Reopen puts the approval with the given id back to awaiting approval
+func (ap *Approvals) Reopen(ID string) error {
+	conn := ap.r.Get()
+	defer conn.Close()
+
+	return ReopenApproval(conn, ID)
+}
+
+type approvalsByRequestedAt []*pudding.Approval
+
+func (s approvalsByRequestedAt) Len() int      { return len(s) }
+func (s approvalsByRequestedAt) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s approvalsByRequestedAt) Less(i, j int) bool {
+	if s[i].RequestedAt == s[j].RequestedAt {
+		return s[i].ID < s[j].ID
+	}
+	return s[i].RequestedAt < s[j].RequestedAt
+}
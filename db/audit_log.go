@@ -0,0 +1,123 @@
+package db
+
+import (
+	"strconv"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/garyburd/redigo/redis"
+	"github.com/travis-ci/pudding"
+)
+
+const (
+	// AuditLogDefaultLimit is the number of audit entries fetched when
+	// no "limit" filter param is given
+	AuditLogDefaultLimit = 100
+
+	auditLogPageSize = 500
+)
+
+// AuditRecorder defines the interface for appending to the audit log
+type AuditRecorder interface {
+	Record(*pudding.AuditEntry) error
+}
+
+// AuditRecorderFetcher is the extension of AuditRecorder that also
+// fetches from the audit log
+type AuditRecorderFetcher interface {
+	AuditRecorder
+	Fetch(map[string]string) ([]*pudding.AuditEntry, error)
+}
+
+// AuditLog represents the append-only audit log of API calls and
+// worker actions
+type AuditLog struct {
+	r   *redis.Pool
+	log *logrus.Logger
+}
+
+// NewAuditLog creates a new *AuditLog
+func NewAuditLog(r *redis.Pool, log *logrus.Logger) (*AuditLog, error) {
+	return &AuditLog{
+		r:   r,
+		log: log,
+	}, nil
+}
+
+// Record appends the entry to the audit log, assigning its id
+func (al *AuditLog) Record(e *pudding.AuditEntry) error {
+	conn := al.r.Get()
+	defer conn.Close()
+
+	return StoreAuditEntry(conn, e)
+}
+
+// Fetch returns the most recent audit entries, newest first, matching
+// the "source", "actor", "route", "action", "target", "outcome",
+// "request_id", and "job_id" filter params as well as the "since" and
+// "until" unix times, up to the "limit" filter param, where a limit of
+// 0 fetches every match
+func (al *AuditLog) Fetch(f map[string]string) ([]*pudding.AuditEntry, error) {
+	conn := al.r.Get()
+	defer conn.Close()
+
+	limit := AuditLogDefaultLimit
+	if v, ok := f["limit"]; ok {
+		l, err := strconv.Atoi(v)
+		if err == nil && l >= 0 {
+			limit = l
+		}
+	}
+
+	since, _ := strconv.ParseInt(f["since"], 10, 64)
+	until, _ := strconv.ParseInt(f["until"], 10, 64)
+
+	matched := []*pudding.AuditEntry{}
+
+	for offset := 0; ; offset += auditLogPageSize {
+		entries, err := FetchAuditEntries(conn, offset, auditLogPageSize)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, e := range entries {
+			if since > 0 && e.Time < since {
+				// entries are newest first, so the rest are older still
+				return matched, nil
+			}
+
+			if (until > 0 && e.Time > until) || !auditEntryMatches(e, f) {
+				continue
+			}
+
+			matched = append(matched, e)
+			if limit > 0 && len(matched) >= limit {
+				return matched, nil
+			}
+		}
+
+		if len(entries) < auditLogPageSize {
+			break
+		}
+	}
+
+	return matched, nil
+}
+
+func auditEntryMatches(e *pudding.AuditEntry, f map[string]string) bool {
+	for key, value := range map[string]string{
+		"source":     e.Source,
+		"actor":      e.Actor,
+		"route":      e.Route,
+		"action":     e.Action,
+		"target":     e.Target,
+		"outcome":    e.Outcome,
+		"request_id": e.RequestID,
+		"job_id":     e.JobID,
+	} {
+		if v, ok := f[key]; ok && v != "" && v != value {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,67 @@
+package db
+
+import (
+	"strconv"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/garyburd/redigo/redis"
+	"github.com/travis-ci/pudding"
+)
+
+// AutoscalingEventHistoryLength is the maximum number of events kept
+// per autoscaling group
+const AutoscalingEventHistoryLength = 100
+
+// AutoscalingEventFetcher defines the interface for fetching the
+// autoscaling event history of an autoscaling group
+type AutoscalingEventFetcher interface {
+	Fetch(map[string]string) ([]*pudding.AutoscalingEvent, error)
+}
+
+// AutoscalingEvents represents the autoscaling event history collection
+type AutoscalingEvents struct {
+	r   *redis.Pool
+	log *logrus.Logger
+}
+
+// NewAutoscalingEvents creates a new AutoscalingEvents collection
+func NewAutoscalingEvents(r *redis.Pool, log *logrus.Logger) (*AutoscalingEvents, error) {
+	return &AutoscalingEvents{
+		r:   r,
+		log: log,
+	}, nil
+}
+
+// Fetch returns a slice of autoscaling events for the "asg" filter
+// param, optionally with "event" and "limit" filter params
+func (ae *AutoscalingEvents) Fetch(f map[string]string) ([]*pudding.AutoscalingEvent, error) {
+	conn := ae.r.Get()
+	defer conn.Close()
+
+	limit := AutoscalingEventHistoryLength
+	if v, ok := f["limit"]; ok {
+		l, err := strconv.Atoi(v)
+		if err == nil && l > 0 && l < limit {
+			limit = l
+		}
+	}
+
+	events, err := FetchAutoscalingEvents(conn, f["asg"], limit)
+	if err != nil {
+		return nil, err
+	}
+
+	event, ok := f["event"]
+	if !ok {
+		return events, nil
+	}
+
+	filtered := []*pudding.AutoscalingEvent{}
+	for _, e := range events {
+		if e.Event == event || e.EventName() == event {
+			filtered = append(filtered, e)
+		}
+	}
+
+	return filtered, nil
+}
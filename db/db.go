@@ -1,15 +1,18 @@
 package db
 
 import (
+	"encoding/json"
 	"fmt"
 	"net/url"
 	"reflect"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/garyburd/redigo/redis"
-	"github.com/goamz/goamz/ec2"
 	"github.com/travis-ci/pudding"
+	"github.com/travis-ci/pudding/cloud"
 )
 
 // BuildRedisPool builds a *redis.Pool given a redis URL yey ☃
@@ -75,6 +78,11 @@ func FetchInstances(conn redis.Conn, f map[string]string) ([]*pudding.Instance,
 			return nil, err
 		}
 
+		inst.Tags, err = instanceTagsFromHash(reply)
+		if err != nil {
+			return nil, err
+		}
+
 		failedChecks := 0
 		for key, value := range f {
 			switch key {
@@ -94,6 +102,18 @@ func FetchInstances(conn redis.Conn, f map[string]string) ([]*pudding.Instance,
 				if inst.Queue != value {
 					failedChecks++
 				}
+			case "region":
+				if inst.Region != value {
+					failedChecks++
+				}
+			case "build_team":
+				if inst.BuildTeam != value {
+					failedChecks++
+				}
+			default:
+				if strings.HasPrefix(key, pudding.TagKeyPrefix) && inst.Tags[strings.TrimPrefix(key, pudding.TagKeyPrefix)] != value {
+					failedChecks++
+				}
 			}
 		}
 
@@ -102,9 +122,163 @@ func FetchInstances(conn redis.Conn, f map[string]string) ([]*pudding.Instance,
 		}
 	}
 
+	return applyInstanceExpiries(conn, instances)
+}
+
+// applyInstanceExpiries replaces the expiry tagged on instances with
+// any set since, e.g. when extending their ttl
+func applyInstanceExpiries(conn redis.Conn, instances []*pudding.Instance) ([]*pudding.Instance, error) {
+	if len(instances) == 0 {
+		return instances, nil
+	}
+
+	args := []interface{}{fmt.Sprintf("%s:instance_expiries", pudding.RedisNamespace)}
+	for _, inst := range instances {
+		args = append(args, inst.InstanceID)
+	}
+
+	expiries, err := redis.Values(conn.Do("HMGET", args...))
+	if err != nil {
+		return nil, err
+	}
+
+	for i, inst := range instances {
+		expiresAt, err := redis.Int64(expiries[i], nil)
+		if err == nil {
+			inst.ExpiresAt = expiresAt
+		}
+	}
+
 	return instances, nil
 }
 
+// SetInstanceExpiry sets the unix time at which an instance expires,
+// overriding the expiry it was tagged with until the tag is updated to
+// match
+func SetInstanceExpiry(conn redis.Conn, instanceID string, expiresAt int64) error {
+	err := conn.Send("MULTI")
+	if err != nil {
+		return err
+	}
+
+	for _, key := range []string{"instance_expiries", "instance_expiry_tag_syncs"} {
+		err = conn.Send("HSET", fmt.Sprintf("%s:%s", pudding.RedisNamespace, key), instanceID, expiresAt)
+		if err != nil {
+			conn.Do("DISCARD")
+			return err
+		}
+	}
+
+	_, err = conn.Do("EXEC")
+	return err
+}
+
+// FetchInstanceExpiryTagSyncs returns the expiries set since the
+// instances were tagged, by instance id, whose tags are yet to be
+// updated
+func FetchInstanceExpiryTagSyncs(conn redis.Conn) (map[string]int64, error) {
+	values, err := redis.StringMap(conn.Do("HGETALL", fmt.Sprintf("%s:instance_expiry_tag_syncs", pudding.RedisNamespace)))
+	if err != nil {
+		return nil, err
+	}
+
+	syncs := map[string]int64{}
+	for instanceID, value := range values {
+		expiresAt, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			continue
+		}
+		syncs[instanceID] = expiresAt
+	}
+
+	return syncs, nil
+}
+
+// ForgetInstanceExpiryTagSync removes the pending update of the
+// instance's expiry tag, unless the expiry has been set again since
+func ForgetInstanceExpiryTagSync(conn redis.Conn, instanceID string, expiresAt int64) error {
+	key := fmt.Sprintf("%s:instance_expiry_tag_syncs", pudding.RedisNamespace)
+
+	for {
+		_, err := conn.Do("WATCH", key)
+		if err != nil {
+			return err
+		}
+
+		current, err := redis.Int64(conn.Do("HGET", key, instanceID))
+		if err == redis.ErrNil || (err == nil && current != expiresAt) {
+			_, err = conn.Do("UNWATCH")
+			return err
+		}
+		if err != nil {
+			conn.Do("UNWATCH")
+			return err
+		}
+
+		err = conn.Send("MULTI")
+		if err != nil {
+			conn.Do("UNWATCH")
+			return err
+		}
+
+		err = conn.Send("HDEL", key, instanceID)
+		if err != nil {
+			conn.Do("DISCARD")
+			return err
+		}
+
+		reply, err := conn.Do("EXEC")
+		if err != nil {
+			return err
+		}
+
+		if reply != nil {
+			return nil
+		}
+	}
+}
+
+// InstanceExpiryActionClaimed returns whether the action has been
+// claimed for the instance expiring at the given time
+func InstanceExpiryActionClaimed(conn redis.Conn, action, instanceID string, expiresAt int64) (bool, error) {
+	return redis.Bool(conn.Do("EXISTS",
+		fmt.Sprintf("%s:instance_expiry_%s:%s:%d", pudding.RedisNamespace, action, instanceID, expiresAt)))
+}
+
+// ClaimInstanceExpiryAction returns whether the action, e.g. a warning
+// or termination, has yet to be taken for the instance expiring at the
+// given time, claiming it for the given number of seconds if so
+func ClaimInstanceExpiryAction(conn redis.Conn, action, instanceID string, expiresAt int64, expiry int) (bool, error) {
+	reply, err := conn.Do("SET",
+		fmt.Sprintf("%s:instance_expiry_%s:%s:%d", pudding.RedisNamespace, action, instanceID, expiresAt),
+		time.Now().UTC().Unix(), "EX", expiry, "NX")
+	if err != nil {
+		return false, err
+	}
+
+	return reply != nil, nil
+}
+
+func instanceTagsFromHash(reply []interface{}) (map[string]string, error) {
+	values, err := redis.StringMap(reply, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var tags map[string]string
+	for key, value := range values {
+		if !strings.HasPrefix(key, pudding.TagKeyPrefix) {
+			continue
+		}
+		if tags == nil {
+			tags = map[string]string{}
+		}
+		tags[strings.TrimPrefix(key, pudding.TagKeyPrefix)] = value
+	}
+
+	return tags, nil
+}
+
 // SetInstanceAttributes sets key-value pair attributes on the
 // given instance's hash
 func SetInstanceAttributes(conn redis.Conn, instanceID string, attrs map[string]string) error {
@@ -118,11 +292,42 @@ func SetInstanceAttributes(conn redis.Conn, instanceID string, attrs map[string]
 	return err
 }
 
-// StoreInstances stores the ec2 representation of an instance
-// given a redis conn and slice of ec2 instances, as well as an
+// SetExpiringInstanceAttributes is SetInstanceAttributes for an
+// instance that may not have been synced yet, expiring its hash as
+// syncing would so that it does not outlive an instance never synced
+func SetExpiringInstanceAttributes(conn redis.Conn, instanceID string, attrs map[string]string, expiry int) error {
+	err := conn.Send("MULTI")
+	if err != nil {
+		return err
+	}
+
+	instanceAttrsKey := fmt.Sprintf("%s:instance:%s", pudding.RedisNamespace, instanceID)
+	hmSet := []interface{}{instanceAttrsKey}
+	for key, value := range attrs {
+		hmSet = append(hmSet, key, value)
+	}
+
+	err = conn.Send("HMSET", hmSet...)
+	if err != nil {
+		conn.Do("DISCARD")
+		return err
+	}
+
+	err = conn.Send("EXPIRE", instanceAttrsKey, expiry)
+	if err != nil {
+		conn.Do("DISCARD")
+		return err
+	}
+
+	_, err = conn.Do("EXEC")
+	return err
+}
+
+// StoreInstances stores the cloud representation of an instance
+// given a redis conn and map of cloud instances, as well as an
 // expiry integer that is used to to run EXPIRE on all sets and
 // hashes involved
-func StoreInstances(conn redis.Conn, instances map[string]ec2.Instance, expiry int) error {
+func StoreInstances(conn redis.Conn, instances map[string]*cloud.Instance, expiry int) error {
 	err := conn.Send("MULTI")
 	if err != nil {
 		return err
@@ -136,6 +341,72 @@ func StoreInstances(conn redis.Conn, instances map[string]ec2.Instance, expiry i
 		return err
 	}
 
+	return storeInstances(conn, instanceSetKey, instances, expiry)
+}
+
+// StoreRegionInstances is StoreInstances for the instances of a single
+// region, replacing only those previously stored for the region so
+// that each region may be synced independently
+func StoreRegionInstances(conn redis.Conn, region string, instances map[string]*cloud.Instance, expiry int) error {
+	instanceSetKey := fmt.Sprintf("%s:instances", pudding.RedisNamespace)
+
+	stale, err := staleRegionMembers(conn, instanceSetKey, "instance", region, func(ID string) bool {
+		_, ok := instances[ID]
+		return ok
+	})
+	if err != nil {
+		return err
+	}
+
+	err = conn.Send("MULTI")
+	if err != nil {
+		return err
+	}
+
+	if len(stale) > 0 {
+		err = conn.Send("SREM", append([]interface{}{instanceSetKey}, stale...)...)
+		if err != nil {
+			conn.Do("DISCARD")
+			return err
+		}
+	}
+
+	return storeInstances(conn, instanceSetKey, instances, expiry)
+}
+
+// staleRegionMembers returns the members of the set whose hashes are
+// either gone or of the given region and not kept
+func staleRegionMembers(conn redis.Conn, setKey, hashPrefix, region string, kept func(string) bool) ([]interface{}, error) {
+	IDs, err := redis.Strings(conn.Do("SMEMBERS", setKey))
+	if err != nil {
+		return nil, err
+	}
+
+	stale := []interface{}{}
+
+	for _, ID := range IDs {
+		if kept(ID) {
+			continue
+		}
+
+		memberRegion, err := redis.String(conn.Do("HGET", fmt.Sprintf("%s:%s:%s", pudding.RedisNamespace, hashPrefix, ID), "region"))
+		if err != nil && err != redis.ErrNil {
+			return nil, err
+		}
+
+		if err == redis.ErrNil || memberRegion == region {
+			stale = append(stale, ID)
+		}
+	}
+
+	return stale, nil
+}
+
+// storeInstances sends the instances within a MULTI begun by the
+// caller and EXECs it
+func storeInstances(conn redis.Conn, instanceSetKey string, instances map[string]*cloud.Instance, expiry int) error {
+	var err error
+
 	for ID, inst := range instances {
 		instanceAttrsKey := fmt.Sprintf("%s:instance:%s", pudding.RedisNamespace, ID)
 
@@ -147,20 +418,29 @@ func StoreInstances(conn redis.Conn, instances map[string]ec2.Instance, expiry i
 
 		hmSet := []interface{}{
 			instanceAttrsKey,
-			"instance_id", inst.InstanceId,
-			"instance_type", inst.InstanceType,
-			"image_id", inst.ImageId,
-			"ip", inst.IPAddress,
-			"private_ip", inst.PrivateIPAddress,
+			"instance_id", inst.ID,
+			"instance_type", inst.Type,
+			"image_id", inst.ImageID,
+			"ip", inst.IP,
+			"private_ip", inst.PrivateIP,
 			"launch_time", inst.LaunchTime,
+			"region", inst.Region,
 		}
 
-		for _, tag := range inst.Tags {
-			switch tag.Key {
-			case "queue", "env", "site", "role":
-				hmSet = append(hmSet, tag.Key, tag.Value)
+		for key, value := range inst.Tags {
+			switch key {
+			case "queue", "env", "site", "role", "market", "requested_spot_max_price", "canary", "build_id", "build_team", "slack_channel":
+				hmSet = append(hmSet, key, value)
+			case "expires_at":
+				if _, err := strconv.ParseInt(value, 10, 64); err == nil {
+					hmSet = append(hmSet, key, value)
+				}
 			case "Name":
-				hmSet = append(hmSet, "name", tag.Value)
+				hmSet = append(hmSet, "name", value)
+			default:
+				if !strings.HasPrefix(key, "aws:") {
+					hmSet = append(hmSet, pudding.TagKeyPrefix+key, value)
+				}
 			}
 		}
 
@@ -188,7 +468,7 @@ func StoreInstances(conn redis.Conn, instances map[string]ec2.Instance, expiry i
 }
 
 // RemoveInstances removes the given instances from the instance
-// set
+// set along with their hashes
 func RemoveInstances(conn redis.Conn, IDs []string) error {
 	err := conn.Send("MULTI")
 	if err != nil {
@@ -203,6 +483,30 @@ func RemoveInstances(conn redis.Conn, IDs []string) error {
 			conn.Do("DISCARD")
 			return err
 		}
+
+		err = conn.Send("DEL", fmt.Sprintf("%s:instance:%s", pudding.RedisNamespace, ID))
+		if err != nil {
+			conn.Do("DISCARD")
+			return err
+		}
+
+		err = conn.Send("DEL", fmt.Sprintf("%s:instance_identity:%s", pudding.RedisNamespace, ID))
+		if err != nil {
+			conn.Do("DISCARD")
+			return err
+		}
+
+		err = conn.Send("HDEL", fmt.Sprintf("%s:instance_expiries", pudding.RedisNamespace), ID)
+		if err != nil {
+			conn.Do("DISCARD")
+			return err
+		}
+
+		err = conn.Send("HDEL", fmt.Sprintf("%s:instance_expiry_tag_syncs", pudding.RedisNamespace), ID)
+		if err != nil {
+			conn.Do("DISCARD")
+			return err
+		}
 	}
 
 	_, err = conn.Do("EXEC")
@@ -224,6 +528,21 @@ func FetchImages(conn redis.Conn, f map[string]string) ([]*pudding.Image, error)
 		}
 	}
 
+	catalog, err := redis.StringMap(conn.Do("HGETALL", fmt.Sprintf("%s:image_catalog", pudding.RedisNamespace)))
+	if err != nil {
+		return nil, err
+	}
+
+	pins, err := redis.StringMap(conn.Do("HGETALL", fmt.Sprintf("%s:image_pins", pudding.RedisNamespace)))
+	if err != nil {
+		return nil, err
+	}
+
+	deprecations, err := redis.StringMap(conn.Do("HGETALL", fmt.Sprintf("%s:image_deprecations", pudding.RedisNamespace)))
+	if err != nil {
+		return nil, err
+	}
+
 	images := []*pudding.Image{}
 
 	for _, key := range keys {
@@ -238,6 +557,8 @@ func FetchImages(conn redis.Conn, f map[string]string) ([]*pudding.Image, error)
 			return nil, err
 		}
 
+		applyImageCatalog(img, catalog, pins, deprecations)
+
 		failedChecks := 0
 		for key, value := range f {
 			switch key {
@@ -249,6 +570,10 @@ func FetchImages(conn redis.Conn, f map[string]string) ([]*pudding.Image, error)
 				if img.Role != value {
 					failedChecks++
 				}
+			case "region":
+				if img.Region != value {
+					failedChecks++
+				}
 			}
 		}
 
@@ -260,11 +585,47 @@ func FetchImages(conn redis.Conn, f map[string]string) ([]*pudding.Image, error)
 	return images, nil
 }
 
-// StoreImages stores the ec2 representation of an image
-// given a redis conn and slice of ec2 images, as well as an
+// applyImageCatalog overrides the tag-derived Active flag if the image
+// catalog knows about the image's role in its region, and sets Pinned
+// and Deprecated
+func applyImageCatalog(img *pudding.Image, catalog, pins, deprecations map[string]string) {
+	inScope := func(scope string) bool {
+		return strings.HasPrefix(scope, img.Role+":") && strings.HasSuffix(scope, ":"+img.Region)
+	}
+	catalogued := false
+	active := false
+
+	for scope, imageID := range catalog {
+		if !inScope(scope) {
+			continue
+		}
+		catalogued = true
+		if imageID == img.ImageID {
+			active = true
+		}
+	}
+
+	if catalogued {
+		img.Active = active
+	}
+
+	for scope, imageID := range pins {
+		if inScope(scope) && imageID == img.ImageID {
+			img.Pinned = true
+		}
+	}
+
+	if reason, ok := deprecations[img.ImageID]; ok {
+		img.Deprecated = true
+		img.DeprecationReason = reason
+	}
+}
+
+// StoreImages stores the cloud representation of an image
+// given a redis conn and map of cloud images, as well as an
 // expiry integer that is used to to run EXPIRE on all sets and
 // hashes involved
-func StoreImages(conn redis.Conn, images map[string]ec2.Image, expiry int) error {
+func StoreImages(conn redis.Conn, images map[string]*cloud.Image, expiry int) error {
 	err := conn.Send("MULTI")
 	if err != nil {
 		return err
@@ -278,6 +639,44 @@ func StoreImages(conn redis.Conn, images map[string]ec2.Image, expiry int) error
 		return err
 	}
 
+	return storeImages(conn, imageSetKey, images, expiry)
+}
+
+// StoreRegionImages is StoreImages for the images of a single region,
+// replacing only those previously stored for the region so that each
+// region may be synced independently
+func StoreRegionImages(conn redis.Conn, region string, images map[string]*cloud.Image, expiry int) error {
+	imageSetKey := fmt.Sprintf("%s:images", pudding.RedisNamespace)
+
+	stale, err := staleRegionMembers(conn, imageSetKey, "image", region, func(ID string) bool {
+		_, ok := images[ID]
+		return ok
+	})
+	if err != nil {
+		return err
+	}
+
+	err = conn.Send("MULTI")
+	if err != nil {
+		return err
+	}
+
+	if len(stale) > 0 {
+		err = conn.Send("SREM", append([]interface{}{imageSetKey}, stale...)...)
+		if err != nil {
+			conn.Do("DISCARD")
+			return err
+		}
+	}
+
+	return storeImages(conn, imageSetKey, images, expiry)
+}
+
+// storeImages sends the images within a MULTI begun by the caller and
+// EXECs it
+func storeImages(conn redis.Conn, imageSetKey string, images map[string]*cloud.Image, expiry int) error {
+	var err error
+
 	for ID, img := range images {
 		imageAttrsKey := fmt.Sprintf("%s:image:%s", pudding.RedisNamespace, ID)
 
@@ -289,17 +688,18 @@ func StoreImages(conn redis.Conn, images map[string]ec2.Image, expiry int) error
 
 		hmSet := []interface{}{
 			imageAttrsKey,
-			"image_id", img.Id,
+			"image_id", img.ID,
 			"name", img.Name,
 			"state", img.State,
+			"region", img.Region,
 		}
 
-		for _, tag := range img.Tags {
-			switch tag.Key {
+		for key, value := range img.Tags {
+			switch key {
 			case "role":
-				hmSet = append(hmSet, tag.Key, tag.Value)
+				hmSet = append(hmSet, key, value)
 			case "active":
-				hmSet = append(hmSet, tag.Key, true)
+				hmSet = append(hmSet, key, true)
 			}
 		}
 
@@ -355,7 +755,7 @@ func StoreInstanceLifecycleAction(conn redis.Conn, a *pudding.AutoscalingLifecyc
 		return err
 	}
 
-	transition := strings.ToLower(strings.Replace(a.LifecycleTransition, "autoscaling:EC2_INSTANCE_", "", 1))
+	transition := pudding.LifecycleTransitionName(a.LifecycleTransition)
 	instSetKey := fmt.Sprintf("%s:instance_%s", pudding.RedisNamespace, transition)
 	hashKey := fmt.Sprintf("%s:instance_%s:%s", pudding.RedisNamespace, transition, a.EC2InstanceID)
 
@@ -365,11 +765,21 @@ func StoreInstanceLifecycleAction(conn redis.Conn, a *pudding.AutoscalingLifecyc
 		return err
 	}
 
+	storedAt := a.StoredAt
+	if storedAt == 0 {
+		storedAt = time.Now().UTC().Unix()
+	}
+
 	hmSet := []interface{}{
 		hashKey,
 		"lifecycle_action_token", a.LifecycleActionToken,
 		"auto_scaling_group_name", a.AutoScalingGroupName,
 		"lifecycle_hook_name", a.LifecycleHookName,
+		"lifecycle_transition", a.LifecycleTransition,
+		"ec2_instance_id", a.EC2InstanceID,
+		"region", a.Region,
+		"account_id", a.AccountID,
+		"stored_at", storedAt,
 	}
 
 	err = conn.Send("HMSET", hmSet...)
@@ -399,25 +809,1555 @@ func FetchInstanceLifecycleAction(conn redis.Conn, transition, instanceID string
 	return ala, err
 }
 
-// WipeInstanceLifecycleAction cleans up the keys for a given lifecycle action
-func WipeInstanceLifecycleAction(conn redis.Conn, transition, instanceID string) error {
-	err := conn.Send("MULTI")
+// FetchInstanceLifecycleActions retrieves all stored
+// pudding.AutoscalingLifecycleAction entries for a given transition
+func FetchInstanceLifecycleActions(conn redis.Conn, transition string) ([]*pudding.AutoscalingLifecycleAction, error) {
+	instanceIDs, err := redis.Strings(conn.Do("SMEMBERS", fmt.Sprintf("%s:instance_%s", pudding.RedisNamespace, transition)))
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	err = conn.Send("SREM", fmt.Sprintf("%s:instance_%s", pudding.RedisNamespace, transition), instanceID)
-	if err != nil {
-		conn.Do("DISCARD")
-		return err
-	}
+	actions := []*pudding.AutoscalingLifecycleAction{}
 
-	err = conn.Send("DEL", fmt.Sprintf("%s:instance_%s:%s", pudding.RedisNamespace, transition, instanceID))
-	if err != nil {
-		conn.Do("DISCARD")
-		return err
-	}
+	for _, instanceID := range instanceIDs {
+		attrs, err := redis.Values(conn.Do("HGETALL", fmt.Sprintf("%s:instance_%s:%s", pudding.RedisNamespace, transition, instanceID)))
+		if err != nil {
+			return nil, err
+		}
 
-	_, err = conn.Do("EXEC")
-	return err
+		if len(attrs) == 0 {
+			continue
+		}
+
+		ala := &pudding.AutoscalingLifecycleAction{}
+		err = redis.ScanStruct(attrs, ala)
+		if err != nil {
+			return nil, err
+		}
+
+		if ala.EC2InstanceID == "" {
+			ala.EC2InstanceID = instanceID
+		}
+
+		actions = append(actions, ala)
+	}
+
+	return actions, nil
+}
+
+// SetInstanceLifecycleActionAttributes sets key-value pair attributes
+// on the given lifecycle action's hash
+func SetInstanceLifecycleActionAttributes(conn redis.Conn, transition, instanceID string, attrs map[string]string) error {
+	hmSet := []interface{}{fmt.Sprintf("%s:instance_%s:%s", pudding.RedisNamespace, transition, instanceID)}
+	for key, value := range attrs {
+		hmSet = append(hmSet, key, value)
+	}
+
+	_, err := conn.Do("HMSET", hmSet...)
+	return err
+}
+
+// WipeInstanceLifecycleAction cleans up the keys for a given lifecycle action
+func WipeInstanceLifecycleAction(conn redis.Conn, transition, instanceID string) error {
+	err := conn.Send("MULTI")
+	if err != nil {
+		return err
+	}
+
+	err = conn.Send("SREM", fmt.Sprintf("%s:instance_%s", pudding.RedisNamespace, transition), instanceID)
+	if err != nil {
+		conn.Do("DISCARD")
+		return err
+	}
+
+	err = conn.Send("DEL", fmt.Sprintf("%s:instance_%s:%s", pudding.RedisNamespace, transition, instanceID))
+	if err != nil {
+		conn.Do("DISCARD")
+		return err
+	}
+
+	_, err = conn.Do("EXEC")
+	return err
+}
+
+// StoreAutoscalingEvent prepends a pudding.AutoscalingEvent to the
+// history list for its autoscaling group, keeping at most maxLen
+// entries
+func StoreAutoscalingEvent(conn redis.Conn, e *pudding.AutoscalingEvent, maxLen int) error {
+	return storeCappedHistory(conn,
+		fmt.Sprintf("%s:autoscaling_group_events:%s", pudding.RedisNamespace, e.AutoScalingGroupName), e, maxLen)
+}
+
+// storeCappedHistory prepends the JSON of v to the history list at key,
+// keeping at most maxLen entries
+func storeCappedHistory(conn redis.Conn, key string, v interface{}, maxLen int) error {
+	entryJSON, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	err = conn.Send("MULTI")
+	if err != nil {
+		return err
+	}
+
+	err = sendCappedHistory(conn, key, string(entryJSON), maxLen)
+	if err != nil {
+		return err
+	}
+
+	_, err = conn.Do("EXEC")
+	return err
+}
+
+// sendCappedHistory sends the prepending of the entry to the history
+// list at key and its trimming to at most maxLen entries within a
+// MULTI begun by the caller, which is DISCARDed on failure
+func sendCappedHistory(conn redis.Conn, key, entry string, maxLen int) error {
+	err := conn.Send("LPUSH", key, entry)
+	if err != nil {
+		conn.Do("DISCARD")
+		return err
+	}
+
+	err = conn.Send("LTRIM", key, 0, maxLen-1)
+	if err != nil {
+		conn.Do("DISCARD")
+		return err
+	}
+
+	return nil
+}
+
+// FetchAutoscalingEvents retrieves the most recent
+// pudding.AutoscalingEvent entries for a given autoscaling group,
+// newest first
+func FetchAutoscalingEvents(conn redis.Conn, asgName string, limit int) ([]*pudding.AutoscalingEvent, error) {
+	eventJSONs, err := redis.Strings(conn.Do("LRANGE",
+		fmt.Sprintf("%s:autoscaling_group_events:%s", pudding.RedisNamespace, asgName), 0, limit-1))
+	if err != nil {
+		return nil, err
+	}
+
+	events := []*pudding.AutoscalingEvent{}
+
+	for _, eventJSON := range eventJSONs {
+		e := &pudding.AutoscalingEvent{}
+		err = json.Unmarshal([]byte(eventJSON), e)
+		if err != nil {
+			return nil, err
+		}
+
+		events = append(events, e)
+	}
+
+	return events, nil
+}
+
+// StoreInstanceEvent prepends a pudding.EC2Event to the history list
+// for its instance, keeping at most maxLen entries
+func StoreInstanceEvent(conn redis.Conn, e *pudding.EC2Event, maxLen int) error {
+	return storeCappedHistory(conn,
+		fmt.Sprintf("%s:instance_events:%s", pudding.RedisNamespace, e.InstanceID()), e, maxLen)
+}
+
+// FetchInstanceEvents retrieves the most recent pudding.EC2Event
+// entries for a given instance, newest first
+func FetchInstanceEvents(conn redis.Conn, instanceID string, limit int) ([]*pudding.EC2Event, error) {
+	eventJSONs, err := redis.Strings(conn.Do("LRANGE",
+		fmt.Sprintf("%s:instance_events:%s", pudding.RedisNamespace, instanceID), 0, limit-1))
+	if err != nil {
+		return nil, err
+	}
+
+	events := []*pudding.EC2Event{}
+
+	for _, eventJSON := range eventJSONs {
+		e := &pudding.EC2Event{}
+		err = json.Unmarshal([]byte(eventJSON), e)
+		if err != nil {
+			return nil, err
+		}
+
+		events = append(events, e)
+	}
+
+	return events, nil
+}
+
+// StoreAuditEntry assigns the next audit entry id and prepends the
+// pudding.AuditEntry to the audit log, which is never trimmed
+func StoreAuditEntry(conn redis.Conn, e *pudding.AuditEntry) error {
+	ID, err := redis.Int64(conn.Do("INCR", fmt.Sprintf("%s:audit_seq", pudding.RedisNamespace)))
+	if err != nil {
+		return err
+	}
+	e.ID = ID
+
+	entryJSON, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	_, err = conn.Do("LPUSH", fmt.Sprintf("%s:audit", pudding.RedisNamespace), string(entryJSON))
+	return err
+}
+
+// FetchAuditEntries retrieves count pudding.AuditEntry entries from
+// the audit log starting at offset, newest first
+func FetchAuditEntries(conn redis.Conn, offset, count int) ([]*pudding.AuditEntry, error) {
+	entryJSONs, err := redis.Strings(conn.Do("LRANGE",
+		fmt.Sprintf("%s:audit", pudding.RedisNamespace), offset, offset+count-1))
+	if err != nil {
+		return nil, err
+	}
+
+	entries := []*pudding.AuditEntry{}
+
+	for _, entryJSON := range entryJSONs {
+		e := &pudding.AuditEntry{}
+		err = json.Unmarshal([]byte(entryJSON), e)
+		if err != nil {
+			return nil, err
+		}
+
+		entries = append(entries, e)
+	}
+
+	return entries, nil
+}
+
+// WatchInstanceBuildLaunches watches the instances launched within the
+// scopes of instance build quotas, so that RecordInstanceBuildLaunches
+// records nothing should any of them change meanwhile
+func WatchInstanceBuildLaunches(conn redis.Conn, scopes []string) error {
+	keys := []interface{}{}
+	for _, scope := range scopes {
+		keys = append(keys, fmt.Sprintf("%s:instance_build_launches:%s", pudding.RedisNamespace, scope))
+	}
+
+	_, err := conn.Do("WATCH", keys...)
+	return err
+}
+
+// RecordInstanceBuildLaunches adds the instances requested by a build
+// to those launched within the scopes of instance build quotas,
+// forgetting any launched more than an hour ago.  It returns false
+// without recording anything if the watched launches have changed.
+func RecordInstanceBuildLaunches(conn redis.Conn, scopes []string, buildID string, count int, now int64) (bool, error) {
+	err := conn.Send("MULTI")
+	if err != nil {
+		return false, err
+	}
+
+	for _, scope := range scopes {
+		key := fmt.Sprintf("%s:instance_build_launches:%s", pudding.RedisNamespace, scope)
+
+		for _, cmd := range [][]interface{}{
+			{"ZADD", key, now, fmt.Sprintf("%d:%s", count, buildID)},
+			{"ZREMRANGEBYSCORE", key, "-inf", fmt.Sprintf("(%d", now-3600)},
+			{"EXPIRE", key, 3600},
+		} {
+			err = conn.Send(cmd[0].(string), cmd[1:]...)
+			if err != nil {
+				conn.Do("DISCARD")
+				return false, err
+			}
+		}
+	}
+
+	reply, err := conn.Do("EXEC")
+	if err != nil {
+		return false, err
+	}
+
+	return reply != nil, nil
+}
+
+// ForgetInstanceBuildLaunches removes the instances requested by a
+// build from those launched within the scope of an instance build
+// quota, such as when the build could not be enqueued
+func ForgetInstanceBuildLaunches(conn redis.Conn, scope, buildID string, count int) error {
+	_, err := conn.Do("ZREM", fmt.Sprintf("%s:instance_build_launches:%s", pudding.RedisNamespace, scope),
+		fmt.Sprintf("%d:%s", count, buildID))
+	return err
+}
+
+// FetchInstanceBuildLaunches returns the number of instances requested
+// by each build within the scope of an instance build quota since the
+// given time
+func FetchInstanceBuildLaunches(conn redis.Conn, scope string, since int64) (map[string]int, error) {
+	members, err := redis.Strings(conn.Do("ZRANGEBYSCORE",
+		fmt.Sprintf("%s:instance_build_launches:%s", pudding.RedisNamespace, scope), since, "+inf"))
+	if err != nil {
+		return nil, err
+	}
+
+	launches := map[string]int{}
+	for _, member := range members {
+		parts := strings.SplitN(member, ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+
+		count, err := strconv.Atoi(parts[0])
+		if err != nil {
+			continue
+		}
+
+		launches[parts[1]] += count
+	}
+
+	return launches, nil
+}
+
+// StoreApproval stores an approval, replacing any with the same id
+func StoreApproval(conn redis.Conn, a *pudding.Approval) error {
+	approvalJSON, err := json.Marshal(a)
+	if err != nil {
+		return err
+	}
+
+	err = conn.Send("MULTI")
+	if err != nil {
+		return err
+	}
+
+	err = conn.Send("SET", fmt.Sprintf("%s:approval:%s", pudding.RedisNamespace, a.ID), string(approvalJSON))
+	if err != nil {
+		conn.Do("DISCARD")
+		return err
+	}
+
+	err = conn.Send("SADD", fmt.Sprintf("%s:approvals", pudding.RedisNamespace), a.ID)
+	if err != nil {
+		conn.Do("DISCARD")
+		return err
+	}
+
+	_, err = conn.Do("EXEC")
+	return err
+}
+
+// FetchApproval retrieves the approval with the given id, or nil if
+// there is none
+func FetchApproval(conn redis.Conn, ID string) (*pudding.Approval, error) {
+	approvalJSON, err := redis.Bytes(conn.Do("GET", fmt.Sprintf("%s:approval:%s", pudding.RedisNamespace, ID)))
+	if err == redis.ErrNil {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	a := &pudding.Approval{}
+	err = json.Unmarshal(approvalJSON, a)
+	return a, err
+}
+
+// FetchApprovals retrieves every approval, forgetting the ids of any
+// that have expired
+func FetchApprovals(conn redis.Conn) ([]*pudding.Approval, error) {
+	setKey := fmt.Sprintf("%s:approvals", pudding.RedisNamespace)
+
+	IDs, err := redis.Strings(conn.Do("SMEMBERS", setKey))
+	if err != nil {
+		return nil, err
+	}
+
+	approvals := []*pudding.Approval{}
+
+	for _, ID := range IDs {
+		a, err := FetchApproval(conn, ID)
+		if err != nil {
+			return nil, err
+		}
+
+		if a == nil {
+			_, err = conn.Do("SREM", setKey, ID)
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		approvals = append(approvals, a)
+	}
+
+	return approvals, nil
+}
+
+// ReopenApproval puts an approval back to awaiting approval, forgetting
+// its decision and no longer expiring, such as when its approved build
+// could not be enqueued
+func ReopenApproval(conn redis.Conn, ID string) error {
+	a, err := FetchApproval(conn, ID)
+	if err != nil || a == nil {
+		return err
+	}
+
+	a.State = pudding.ApprovalStateAwaiting
+	a.DecidedBy = ""
+	a.DecidedAt = 0
+	a.Reason = ""
+
+	return StoreApproval(conn, a)
+}
+
+// DecideApproval approves or rejects an approval that is still
+// awaiting approval, after which it expires.  The approval is watched
+// while deciding so that only one decision is ever made, with any
+// later ones resulting in an *ApprovalDecidedError.
+func DecideApproval(conn redis.Conn, ID, state, decidedBy, reason string, now int64, expiry int) (*pudding.Approval, error) {
+	key := fmt.Sprintf("%s:approval:%s", pudding.RedisNamespace, ID)
+
+	for {
+		_, err := conn.Do("WATCH", key)
+		if err != nil {
+			return nil, err
+		}
+
+		a, err := FetchApproval(conn, ID)
+		if err != nil || a == nil {
+			conn.Do("UNWATCH")
+			return nil, err
+		}
+
+		if a.State != pudding.ApprovalStateAwaiting {
+			conn.Do("UNWATCH")
+			return nil, &ApprovalDecidedError{ID: ID, State: a.State, DecidedBy: a.DecidedBy}
+		}
+
+		a.State = state
+		a.DecidedBy = decidedBy
+		a.DecidedAt = now
+		a.Reason = reason
+
+		approvalJSON, err := json.Marshal(a)
+		if err != nil {
+			conn.Do("UNWATCH")
+			return nil, err
+		}
+
+		err = conn.Send("MULTI")
+		if err != nil {
+			conn.Do("UNWATCH")
+			return nil, err
+		}
+
+		err = conn.Send("SET", key, string(approvalJSON), "EX", expiry)
+		if err != nil {
+			conn.Do("DISCARD")
+			return nil, err
+		}
+
+		reply, err := conn.Do("EXEC")
+		if err != nil {
+			return nil, err
+		}
+
+		if reply != nil {
+			return a, nil
+		}
+	}
+}
+
+// PromoteImage makes the promoted image the active image for the
+// promotion's scope, pinning the scope if requested, and records the
+// promotion in a history list of at most maxLen entries
+func PromoteImage(conn redis.Conn, p *pudding.ImagePromotion, maxLen int) error {
+	scope := p.Scope()
+	pinsKey := fmt.Sprintf("%s:image_pins", pudding.RedisNamespace)
+
+	reason, err := redis.String(conn.Do("HGET", fmt.Sprintf("%s:image_deprecations", pudding.RedisNamespace), p.ImageID))
+	if err == nil {
+		return &ImageDeprecatedError{ImageID: p.ImageID, Reason: reason}
+	}
+	if err != redis.ErrNil {
+		return err
+	}
+
+	pinned, err := redis.String(conn.Do("HGET", pinsKey, scope))
+	if err != nil && err != redis.ErrNil {
+		return err
+	}
+
+	if pinned != "" && pinned != p.ImageID && !p.Pin {
+		return &ImagePinnedError{Scope: scope, ImageID: pinned}
+	}
+
+	promotionJSON, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+
+	err = conn.Send("MULTI")
+	if err != nil {
+		return err
+	}
+
+	err = conn.Send("HSET", fmt.Sprintf("%s:image_catalog", pudding.RedisNamespace), scope, p.ImageID)
+	if err != nil {
+		conn.Do("DISCARD")
+		return err
+	}
+
+	if p.Pin {
+		err = conn.Send("HSET", pinsKey, scope, p.ImageID)
+		if err != nil {
+			conn.Do("DISCARD")
+			return err
+		}
+	}
+
+	err = sendCappedHistory(conn, fmt.Sprintf("%s:image_promotions", pudding.RedisNamespace), string(promotionJSON), maxLen)
+	if err != nil {
+		return err
+	}
+
+	_, err = conn.Do("EXEC")
+	return err
+}
+
+// UnpinImage removes the pin for the given image catalog scope,
+// leaving the active image as-is
+func UnpinImage(conn redis.Conn, scope string) error {
+	_, err := conn.Do("HDEL", fmt.Sprintf("%s:image_pins", pudding.RedisNamespace), scope)
+	return err
+}
+
+// FetchImagePromotions retrieves the most recent
+// pudding.ImagePromotion entries, newest first
+func FetchImagePromotions(conn redis.Conn, limit int) ([]*pudding.ImagePromotion, error) {
+	promotionJSONs, err := redis.Strings(conn.Do("LRANGE",
+		fmt.Sprintf("%s:image_promotions", pudding.RedisNamespace), 0, limit-1))
+	if err != nil {
+		return nil, err
+	}
+
+	promotions := []*pudding.ImagePromotion{}
+
+	for _, promotionJSON := range promotionJSONs {
+		p := &pudding.ImagePromotion{}
+		err = json.Unmarshal([]byte(promotionJSON), p)
+		if err != nil {
+			return nil, err
+		}
+
+		promotions = append(promotions, p)
+	}
+
+	return promotions, nil
+}
+
+// DeprecateImage marks an image as deprecated so that builds refuse it
+func DeprecateImage(conn redis.Conn, imageID, reason string) error {
+	_, err := conn.Do("HSET", fmt.Sprintf("%s:image_deprecations", pudding.RedisNamespace), imageID, reason)
+	return err
+}
+
+// UndeprecateImage removes the deprecation mark from an image
+func UndeprecateImage(conn redis.Conn, imageID string) error {
+	_, err := conn.Do("HDEL", fmt.Sprintf("%s:image_deprecations", pudding.RedisNamespace), imageID)
+	return err
+}
+
+// FetchImageDeprecation returns the deprecation reason for an image
+// and whether the image is deprecated at all
+func FetchImageDeprecation(conn redis.Conn, imageID string) (string, bool, error) {
+	reason, err := redis.String(conn.Do("HGET", fmt.Sprintf("%s:image_deprecations", pudding.RedisNamespace), imageID))
+	if err == redis.ErrNil {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+
+	return reason, true, nil
+}
+
+// ResolveCatalogImage returns the id of the active image in the most
+// specific image catalog scope for the given role, site, and env in
+// the given region, or an empty string if the catalog has nothing to
+// say.  A more specific scope takes precedence over a pinned one, as
+// pins only hold back promotions in their own scope, and within a
+// scope the pin takes precedence over the active image.
+func ResolveCatalogImage(conn redis.Conn, role, site, env, region string) (string, error) {
+	for _, scope := range pudding.ImageCatalogScopes(role, site, env, region) {
+		for _, key := range []string{"image_pins", "image_catalog"} {
+			imageID, err := redis.String(conn.Do("HGET", fmt.Sprintf("%s:%s", pudding.RedisNamespace, key), scope))
+			if err == redis.ErrNil {
+				continue
+			}
+			if err != nil {
+				return "", err
+			}
+
+			return imageID, nil
+		}
+	}
+
+	return "", nil
+}
+
+// SetImageCanary stores a pudding.ImageCanary for its scope, replacing
+// any previous canary in the scope
+func SetImageCanary(conn redis.Conn, c *pudding.ImageCanary) error {
+	reason, deprecated, err := FetchImageDeprecation(conn, c.ImageID)
+	if err != nil {
+		return err
+	}
+
+	if deprecated {
+		return &ImageDeprecatedError{ImageID: c.ImageID, Reason: reason}
+	}
+
+	canaryJSON, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+
+	_, err = conn.Do("HSET", fmt.Sprintf("%s:image_canaries", pudding.RedisNamespace), c.Scope(), string(canaryJSON))
+	return err
+}
+
+// RemoveImageCanary removes the canary for the given image catalog scope
+func RemoveImageCanary(conn redis.Conn, scope string) error {
+	_, err := conn.Do("HDEL", fmt.Sprintf("%s:image_canaries", pudding.RedisNamespace), scope)
+	return err
+}
+
+// FetchImageCanaries retrieves all pudding.ImageCanary entries,
+// sorted by scope
+func FetchImageCanaries(conn redis.Conn) ([]*pudding.ImageCanary, error) {
+	canaryJSONs, err := redis.StringMap(conn.Do("HGETALL", fmt.Sprintf("%s:image_canaries", pudding.RedisNamespace)))
+	if err != nil {
+		return nil, err
+	}
+
+	scopes := []string{}
+	for scope := range canaryJSONs {
+		scopes = append(scopes, scope)
+	}
+	sort.Strings(scopes)
+
+	canaries := []*pudding.ImageCanary{}
+
+	for _, scope := range scopes {
+		c := &pudding.ImageCanary{}
+		err = json.Unmarshal([]byte(canaryJSONs[scope]), c)
+		if err != nil {
+			return nil, err
+		}
+
+		canaries = append(canaries, c)
+	}
+
+	return canaries, nil
+}
+
+// ResolveImageCanary returns the pudding.ImageCanary in the most
+// specific image catalog scope for the given role, site, and env in
+// the given region, or nil if there is none
+func ResolveImageCanary(conn redis.Conn, role, site, env, region string) (*pudding.ImageCanary, error) {
+	for _, scope := range pudding.ImageCatalogScopes(role, site, env, region) {
+		canaryJSON, err := redis.String(conn.Do("HGET", fmt.Sprintf("%s:image_canaries", pudding.RedisNamespace), scope))
+		if err == redis.ErrNil {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		c := &pudding.ImageCanary{}
+		err = json.Unmarshal([]byte(canaryJSON), c)
+		return c, err
+	}
+
+	return nil, nil
+}
+
+// StoreInstanceImageRecord stores the launch bits of a
+// pudding.InstanceImageRecord in a set and hash, the latter of which
+// expires after expiry seconds
+func StoreInstanceImageRecord(conn redis.Conn, rec *pudding.InstanceImageRecord, expiry int) error {
+	err := conn.Send("MULTI")
+	if err != nil {
+		return err
+	}
+
+	hashKey := fmt.Sprintf("%s:instance_image:%s", pudding.RedisNamespace, rec.InstanceID)
+
+	err = conn.Send("SADD", fmt.Sprintf("%s:instance_images", pudding.RedisNamespace), rec.InstanceID)
+	if err != nil {
+		conn.Do("DISCARD")
+		return err
+	}
+
+	hmSet := []interface{}{
+		hashKey,
+		"instance_id", rec.InstanceID,
+		"image_id", rec.ImageID,
+		"role", rec.Role,
+		"site", rec.Site,
+		"env", rec.Env,
+		"region", rec.Region,
+		"canary", rec.Canary,
+		"launched_at", rec.LaunchedAt,
+	}
+
+	err = conn.Send("HMSET", hmSet...)
+	if err != nil {
+		conn.Do("DISCARD")
+		return err
+	}
+
+	err = conn.Send("EXPIRE", hashKey, expiry)
+	if err != nil {
+		conn.Do("DISCARD")
+		return err
+	}
+
+	_, err = conn.Do("EXEC")
+	return err
+}
+
+// RecordInstanceHeartbeat updates the pudding.InstanceImageRecord of
+// the given instance, if any, with a heartbeat at the given time
+func RecordInstanceHeartbeat(conn redis.Conn, instanceID string, now time.Time) error {
+	hashKey := fmt.Sprintf("%s:instance_image:%s", pudding.RedisNamespace, instanceID)
+
+	exists, err := redis.Bool(conn.Do("EXISTS", hashKey))
+	if err != nil || !exists {
+		return err
+	}
+
+	err = conn.Send("MULTI")
+	if err != nil {
+		return err
+	}
+
+	err = conn.Send("HSET", hashKey, "last_heartbeat_at", now.Unix())
+	if err != nil {
+		conn.Do("DISCARD")
+		return err
+	}
+
+	err = conn.Send("HINCRBY", hashKey, "heartbeat_count", 1)
+	if err != nil {
+		conn.Do("DISCARD")
+		return err
+	}
+
+	_, err = conn.Do("EXEC")
+	return err
+}
+
+// FetchInstanceImageRecords retrieves all unexpired
+// pudding.InstanceImageRecord entries, cleaning up the set members of
+// expired ones along the way
+func FetchInstanceImageRecords(conn redis.Conn) ([]*pudding.InstanceImageRecord, error) {
+	setKey := fmt.Sprintf("%s:instance_images", pudding.RedisNamespace)
+
+	instanceIDs, err := redis.Strings(conn.Do("SMEMBERS", setKey))
+	if err != nil {
+		return nil, err
+	}
+
+	records := []*pudding.InstanceImageRecord{}
+
+	for _, instanceID := range instanceIDs {
+		attrs, err := redis.Values(conn.Do("HGETALL", fmt.Sprintf("%s:instance_image:%s", pudding.RedisNamespace, instanceID)))
+		if err != nil {
+			return nil, err
+		}
+
+		if len(attrs) == 0 {
+			_, err = conn.Do("SREM", setKey, instanceID)
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		rec := &pudding.InstanceImageRecord{}
+		err = redis.ScanStruct(attrs, rec)
+		if err != nil {
+			return nil, err
+		}
+
+		records = append(records, rec)
+	}
+
+	return records, nil
+}
+
+// StoreSecurityGroupGCReport stores the most recent
+// pudding.SecurityGroupGCReport
+func StoreSecurityGroupGCReport(conn redis.Conn, report *pudding.SecurityGroupGCReport) error {
+	reportJSON, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+
+	_, err = conn.Do("SET", fmt.Sprintf("%s:security_group_gc_report", pudding.RedisNamespace), string(reportJSON))
+	return err
+}
+
+// FetchSecurityGroupGCReport retrieves the most recent
+// pudding.SecurityGroupGCReport, or nil if there is none
+func FetchSecurityGroupGCReport(conn redis.Conn) (*pudding.SecurityGroupGCReport, error) {
+	reportJSON, err := redis.String(conn.Do("GET", fmt.Sprintf("%s:security_group_gc_report", pudding.RedisNamespace)))
+	if err == redis.ErrNil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	report := &pudding.SecurityGroupGCReport{}
+	err = json.Unmarshal([]byte(reportJSON), report)
+	return report, err
+}
+
+// StoreInstanceLaunchRecord stores a pudding.InstanceLaunchRecord in
+// a set and hash, the latter of which expires after expiry seconds, and
+// marks its instance build as known for as long
+func StoreInstanceLaunchRecord(conn redis.Conn, rec *pudding.InstanceLaunchRecord, expiry int) error {
+	err := conn.Send("MULTI")
+	if err != nil {
+		return err
+	}
+
+	hashKey := fmt.Sprintf("%s:instance_launch:%s", pudding.RedisNamespace, rec.InstanceID)
+
+	err = conn.Send("SADD", fmt.Sprintf("%s:instance_launches", pudding.RedisNamespace), rec.InstanceID)
+	if err != nil {
+		conn.Do("DISCARD")
+		return err
+	}
+
+	hmSet := []interface{}{
+		hashKey,
+		"instance_id", rec.InstanceID,
+		"instance_build_id", rec.InstanceBuildID,
+		"account_id", rec.AccountID,
+		"region", rec.Region,
+		"role", rec.Role,
+		"site", rec.Site,
+		"env", rec.Env,
+		"queue", rec.Queue,
+		"launched_at", rec.LaunchedAt,
+		"seen_at", rec.SeenAt,
+	}
+
+	err = conn.Send("HMSET", hmSet...)
+	if err != nil {
+		conn.Do("DISCARD")
+		return err
+	}
+
+	err = conn.Send("EXPIRE", hashKey, expiry)
+	if err != nil {
+		conn.Do("DISCARD")
+		return err
+	}
+
+	err = conn.Send("SET", fmt.Sprintf("%s:known_instance_build:%s", pudding.RedisNamespace, rec.InstanceBuildID), rec.LaunchedAt, "EX", expiry)
+	if err != nil {
+		conn.Do("DISCARD")
+		return err
+	}
+
+	_, err = conn.Do("EXEC")
+	return err
+}
+
+// FetchInstanceLaunchRecords retrieves all unexpired
+// pudding.InstanceLaunchRecord entries, cleaning up the set members of
+// expired ones along the way
+func FetchInstanceLaunchRecords(conn redis.Conn) ([]*pudding.InstanceLaunchRecord, error) {
+	setKey := fmt.Sprintf("%s:instance_launches", pudding.RedisNamespace)
+
+	instanceIDs, err := redis.Strings(conn.Do("SMEMBERS", setKey))
+	if err != nil {
+		return nil, err
+	}
+
+	records := []*pudding.InstanceLaunchRecord{}
+
+	for _, instanceID := range instanceIDs {
+		attrs, err := redis.Values(conn.Do("HGETALL", fmt.Sprintf("%s:instance_launch:%s", pudding.RedisNamespace, instanceID)))
+		if err != nil {
+			return nil, err
+		}
+
+		if len(attrs) == 0 {
+			_, err = conn.Do("SREM", setKey, instanceID)
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		rec := &pudding.InstanceLaunchRecord{}
+		err = redis.ScanStruct(attrs, rec)
+		if err != nil {
+			return nil, err
+		}
+
+		records = append(records, rec)
+	}
+
+	return records, nil
+}
+
+// FetchInstanceLaunchRecord returns the launch record of an instance,
+// or nil if there is none
+func FetchInstanceLaunchRecord(conn redis.Conn, instanceID string) (*pudding.InstanceLaunchRecord, error) {
+	attrs, err := redis.Values(conn.Do("HGETALL", fmt.Sprintf("%s:instance_launch:%s", pudding.RedisNamespace, instanceID)))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(attrs) == 0 {
+		return nil, nil
+	}
+
+	rec := &pudding.InstanceLaunchRecord{}
+	err = redis.ScanStruct(attrs, rec)
+	return rec, err
+}
+
+// RemoveInstanceLaunchRecord forgets the launch of an instance, e.g.
+// once it is gone
+func RemoveInstanceLaunchRecord(conn redis.Conn, instanceID string) error {
+	err := conn.Send("MULTI")
+	if err != nil {
+		return err
+	}
+
+	err = conn.Send("SREM", fmt.Sprintf("%s:instance_launches", pudding.RedisNamespace), instanceID)
+	if err != nil {
+		conn.Do("DISCARD")
+		return err
+	}
+
+	err = conn.Send("DEL", fmt.Sprintf("%s:instance_launch:%s", pudding.RedisNamespace, instanceID))
+	if err != nil {
+		conn.Do("DISCARD")
+		return err
+	}
+
+	_, err = conn.Do("EXEC")
+	return err
+}
+
+// ClaimInstanceReconcilerEnabledAt records now as when reconciliation
+// was enabled unless already recorded, returning the recorded time and
+// whether it was recorded just now
+func ClaimInstanceReconcilerEnabledAt(conn redis.Conn, now int64) (int64, bool, error) {
+	key := fmt.Sprintf("%s:instance_reconciler_enabled_at", pudding.RedisNamespace)
+
+	claimed, err := redis.Bool(conn.Do("SETNX", key, now))
+	if err != nil {
+		return 0, false, err
+	}
+
+	if claimed {
+		return now, true, nil
+	}
+
+	enabledAt, err := redis.Int64(conn.Do("GET", key))
+	return enabledAt, false, err
+}
+
+// RecordKnownInstanceBuild marks a build as known for expiry seconds,
+// e.g. the autoscaling group builds whose instances carry its id
+func RecordKnownInstanceBuild(conn redis.Conn, buildID string, now int64, expiry int) error {
+	_, err := conn.Do("SET", fmt.Sprintf("%s:known_instance_build:%s", pudding.RedisNamespace, buildID), now, "EX", expiry)
+	return err
+}
+
+// FetchKnownInstanceBuilds returns which of the given builds are known
+func FetchKnownInstanceBuilds(conn redis.Conn, buildIDs []string) (map[string]bool, error) {
+	known := map[string]bool{}
+	if len(buildIDs) == 0 {
+		return known, nil
+	}
+
+	args := []interface{}{}
+	for _, buildID := range buildIDs {
+		args = append(args, fmt.Sprintf("%s:known_instance_build:%s", pudding.RedisNamespace, buildID))
+	}
+
+	values, err := redis.Values(conn.Do("MGET", args...))
+	if err != nil {
+		return nil, err
+	}
+
+	for i, value := range values {
+		if value != nil {
+			known[buildIDs[i]] = true
+		}
+	}
+
+	return known, nil
+}
+
+// StoreOrphanInstanceReport stores the most recent
+// pudding.OrphanInstanceReport
+func StoreOrphanInstanceReport(conn redis.Conn, report *pudding.OrphanInstanceReport) error {
+	reportJSON, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+
+	_, err = conn.Do("SET", fmt.Sprintf("%s:orphan_instance_report", pudding.RedisNamespace), string(reportJSON))
+	return err
+}
+
+// FetchOrphanInstanceReport retrieves the most recent
+// pudding.OrphanInstanceReport, or nil if there is none
+func FetchOrphanInstanceReport(conn redis.Conn) (*pudding.OrphanInstanceReport, error) {
+	reportJSON, err := redis.String(conn.Do("GET", fmt.Sprintf("%s:orphan_instance_report", pudding.RedisNamespace)))
+	if err == redis.ErrNil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	report := &pudding.OrphanInstanceReport{}
+	err = json.Unmarshal([]byte(reportJSON), report)
+	return report, err
+}
+
+// InitScriptRecord is everything stored for an instance build's init
+// script, of which the instance auth is kept for the life of the
+// instance and the rest until ExpiresAt
+type InitScriptRecord struct {
+	InstanceBuildID string
+	Script          string
+	InstanceAuth    string
+	InitScriptAuth  string
+	MaxUses         int
+	ExpiresAt       int64
+}
+
+// encryptionContext is what the value in the given hash field is
+// encrypted for, so that it can't be decrypted from another field
+func encryptionContext(hash, ID string) string {
+	return fmt.Sprintf("%s:%s", hash, ID)
+}
+
+// StoreInitScript stores the base64-encoded, gzipped init script for
+// an instance build along with the creds used to fetch it, all of
+// which are encrypted with the keyring
+func StoreInitScript(conn redis.Conn, rec *InitScriptRecord, kr *pudding.Keyring) error {
+	encrypted := map[string]string{}
+	for hash, value := range map[string]string{
+		"init-scripts":      rec.Script,
+		"auths":             rec.InstanceAuth,
+		"init_script_auths": rec.InitScriptAuth,
+	} {
+		v, err := kr.Encrypt(value, encryptionContext(hash, rec.InstanceBuildID))
+		if err != nil {
+			return err
+		}
+		encrypted[hash] = v
+	}
+
+	err := conn.Send("MULTI")
+	if err != nil {
+		return err
+	}
+
+	for _, cmd := range [][]interface{}{
+		{"HSET", fmt.Sprintf("%s:init-scripts", pudding.RedisNamespace), rec.InstanceBuildID, encrypted["init-scripts"]},
+		{"HSET", fmt.Sprintf("%s:auths", pudding.RedisNamespace), rec.InstanceBuildID, encrypted["auths"]},
+		{"HSET", fmt.Sprintf("%s:init_script_auths", pudding.RedisNamespace), rec.InstanceBuildID, encrypted["init_script_auths"]},
+		{"HSET", fmt.Sprintf("%s:init_script_uses", pudding.RedisNamespace), rec.InstanceBuildID, rec.MaxUses},
+		{"ZADD", fmt.Sprintf("%s:init_script_expiries", pudding.RedisNamespace), rec.ExpiresAt, rec.InstanceBuildID},
+	} {
+		err = conn.Send(cmd[0].(string), cmd[1:]...)
+		if err != nil {
+			conn.Do("DISCARD")
+			return err
+		}
+	}
+
+	_, err = conn.Do("EXEC")
+	return err
+}
+
+// UseInitScriptAuth returns whether the init script auth creds match
+// and have neither expired nor been used up, using up one of the
+// remaining uses when they do
+func UseInitScriptAuth(conn redis.Conn, ID, auth string, now int64, kr *pudding.Keyring) (bool, error) {
+	dbAuth, err := redis.String(conn.Do("HGET", fmt.Sprintf("%s:init_script_auths", pudding.RedisNamespace), ID))
+	if err == redis.ErrNil {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	dbAuth, err = kr.Decrypt(dbAuth, encryptionContext("init_script_auths", ID))
+	if err != nil {
+		return false, err
+	}
+
+	if !authsMatch(dbAuth, auth) {
+		return false, nil
+	}
+
+	// every instance an autoscaling group launches fetches the init
+	// script of the instance it was made from, for as long as it exists
+	shared, err := redis.Bool(conn.Do("EXISTS", fmt.Sprintf("%s:init_script_autoscaling_groups:%s", pudding.RedisNamespace, ID)))
+	if err != nil {
+		return false, err
+	}
+
+	if shared {
+		return true, nil
+	}
+
+	expiresAt, err := redis.Float64(conn.Do("ZSCORE", fmt.Sprintf("%s:init_script_expiries", pudding.RedisNamespace), ID))
+	if err == redis.ErrNil {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	if int64(expiresAt) <= now {
+		return false, nil
+	}
+
+	remaining, err := redis.Int(conn.Do("HINCRBY", fmt.Sprintf("%s:init_script_uses", pudding.RedisNamespace), ID, -1))
+	if err != nil {
+		return false, err
+	}
+
+	return remaining >= 0, nil
+}
+
+// StoreInitScriptInstanceID records the instance booted with an
+// instance build's init script
+func StoreInitScriptInstanceID(conn redis.Conn, ID, instanceID string) error {
+	_, err := conn.Do("HSET", fmt.Sprintf("%s:init_script_instances", pudding.RedisNamespace), ID, instanceID)
+	return err
+}
+
+// FetchInitScriptInstanceID returns the instance booted with an
+// instance build's init script, or "" if unknown
+func FetchInitScriptInstanceID(conn redis.Conn, ID string) (string, error) {
+	instanceID, err := redis.String(conn.Do("HGET", fmt.Sprintf("%s:init_script_instances", pudding.RedisNamespace), ID))
+	if err == redis.ErrNil {
+		return "", nil
+	}
+	return instanceID, err
+}
+
+// StoreInitScriptAutoscalingGroup records that the autoscaling group
+// made from the instance booted with an instance build's init script
+// launches its instances with the same init script, which is then
+// neither used up, expired, nor purged until the record expires
+func StoreInitScriptAutoscalingGroup(conn redis.Conn, ID, asgName, asgBuildID string, expiry int) error {
+	err := conn.Send("MULTI")
+	if err != nil {
+		return err
+	}
+
+	asgsKey := fmt.Sprintf("%s:init_script_autoscaling_groups:%s", pudding.RedisNamespace, ID)
+
+	for _, cmd := range [][]interface{}{
+		{"HSET", asgsKey, asgName, asgBuildID},
+		{"EXPIRE", asgsKey, expiry},
+		{"SET", fmt.Sprintf("%s:autoscaling_group_init_script:%s", pudding.RedisNamespace, asgName), ID, "EX", expiry},
+	} {
+		err = conn.Send(cmd[0].(string), cmd[1:]...)
+		if err != nil {
+			conn.Do("DISCARD")
+			return err
+		}
+	}
+
+	_, err = conn.Do("EXEC")
+	return err
+}
+
+// RefreshInitScriptAutoscalingGroup extends the record of the init
+// script shared with the given autoscaling group, if any, for as long
+// as the group is around
+func RefreshInitScriptAutoscalingGroup(conn redis.Conn, asgName string, expiry int) error {
+	asgKey := fmt.Sprintf("%s:autoscaling_group_init_script:%s", pudding.RedisNamespace, asgName)
+
+	ID, err := redis.String(conn.Do("GET", asgKey))
+	if err == redis.ErrNil {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	err = conn.Send("MULTI")
+	if err != nil {
+		return err
+	}
+
+	for _, key := range []string{asgKey, fmt.Sprintf("%s:init_script_autoscaling_groups:%s", pudding.RedisNamespace, ID)} {
+		err = conn.Send("EXPIRE", key, expiry)
+		if err != nil {
+			conn.Do("DISCARD")
+			return err
+		}
+	}
+
+	_, err = conn.Do("EXEC")
+	return err
+}
+
+// FetchInitScriptAutoscalingGroups returns the names of the
+// autoscaling groups launching instances with an instance build's init
+// script, mapped to their autoscaling group build ids
+func FetchInitScriptAutoscalingGroups(conn redis.Conn, ID string) (map[string]string, error) {
+	return redis.StringMap(conn.Do("HGETALL", fmt.Sprintf("%s:init_script_autoscaling_groups:%s", pudding.RedisNamespace, ID)))
+}
+
+// StoreInitScriptFetch prepends a pudding.InitScriptFetch to the
+// history list for its init script, keeping at most maxLen entries
+func StoreInitScriptFetch(conn redis.Conn, f *pudding.InitScriptFetch, maxLen int) error {
+	fetchJSON, err := json.Marshal(f)
+	if err != nil {
+		return err
+	}
+
+	err = conn.Send("MULTI")
+	if err != nil {
+		return err
+	}
+
+	key := fmt.Sprintf("%s:init_script_fetches:%s", pudding.RedisNamespace, f.InstanceBuildID)
+
+	err = sendCappedHistory(conn, key, string(fetchJSON), maxLen)
+	if err != nil {
+		return err
+	}
+
+	err = conn.Send("EXPIRE", key, InitScriptFetchExpiry)
+	if err != nil {
+		conn.Do("DISCARD")
+		return err
+	}
+
+	_, err = conn.Do("EXEC")
+	return err
+}
+
+// FetchInitScriptFetches retrieves the most recent
+// pudding.InitScriptFetch entries for an init script, newest first
+func FetchInitScriptFetches(conn redis.Conn, ID string, limit int) ([]*pudding.InitScriptFetch, error) {
+	values, err := redis.Strings(conn.Do("LRANGE",
+		fmt.Sprintf("%s:init_script_fetches:%s", pudding.RedisNamespace, ID), 0, limit-1))
+	if err != nil {
+		return nil, err
+	}
+
+	fetches := []*pudding.InitScriptFetch{}
+	for _, v := range values {
+		f := &pudding.InitScriptFetch{}
+		err = json.Unmarshal([]byte(v), f)
+		if err != nil {
+			return nil, err
+		}
+		fetches = append(fetches, f)
+	}
+
+	return fetches, nil
+}
+
+// PurgeInitScripts removes the init scripts and init script auth
+// creds that expired before now, along with any stored without an
+// expiry, and returns the ids of the instance builds purged.  The init
+// scripts shared with autoscaling groups are left alone, as are the
+// instance auth creds, which are used for as long as the instance is
+// around and are purged by PurgeInstanceAuths.
+func PurgeInitScripts(conn redis.Conn, now int64) ([]string, error) {
+	scriptsKey := fmt.Sprintf("%s:init-scripts", pudding.RedisNamespace)
+	expiriesKey := fmt.Sprintf("%s:init_script_expiries", pudding.RedisNamespace)
+
+	IDs, err := redis.Strings(conn.Do("ZRANGEBYSCORE", expiriesKey, "-inf", now))
+	if err != nil {
+		return nil, err
+	}
+
+	scriptIDs, err := redis.Strings(conn.Do("HKEYS", scriptsKey))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, ID := range scriptIDs {
+		_, err = redis.Float64(conn.Do("ZSCORE", expiriesKey, ID))
+		if err == redis.ErrNil {
+			IDs = append(IDs, ID)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	unshared := []string{}
+	for _, ID := range IDs {
+		shared, err := redis.Bool(conn.Do("EXISTS", fmt.Sprintf("%s:init_script_autoscaling_groups:%s", pudding.RedisNamespace, ID)))
+		if err != nil {
+			return nil, err
+		}
+
+		if !shared {
+			unshared = append(unshared, ID)
+		}
+	}
+	IDs = unshared
+
+	if len(IDs) == 0 {
+		return IDs, nil
+	}
+
+	err = conn.Send("MULTI")
+	if err != nil {
+		return nil, err
+	}
+
+	for _, ID := range IDs {
+		for _, cmd := range [][]interface{}{
+			{"HDEL", scriptsKey, ID},
+			{"HDEL", fmt.Sprintf("%s:init_script_auths", pudding.RedisNamespace), ID},
+			{"HDEL", fmt.Sprintf("%s:init_script_uses", pudding.RedisNamespace), ID},
+			{"ZREM", expiriesKey, ID},
+		} {
+			err = conn.Send(cmd[0].(string), cmd[1:]...)
+			if err != nil {
+				conn.Do("DISCARD")
+				return nil, err
+			}
+		}
+	}
+
+	_, err = conn.Do("EXEC")
+	if err != nil {
+		return nil, err
+	}
+
+	return IDs, nil
+}
+
+// PurgeInstanceAuths removes the instance auth creds of the instance
+// builds whose init scripts have been purged, once the instance booted
+// with them is no longer among the synced instances or was never
+// launched, and returns the ids of the instance builds purged
+func PurgeInstanceAuths(conn redis.Conn) ([]string, error) {
+	authsKey := fmt.Sprintf("%s:auths", pudding.RedisNamespace)
+	instancesKey := fmt.Sprintf("%s:init_script_instances", pudding.RedisNamespace)
+
+	authIDs, err := redis.Strings(conn.Do("HKEYS", authsKey))
+	if err != nil {
+		return nil, err
+	}
+
+	IDs := []string{}
+	for _, ID := range authIDs {
+		hasScript, err := redis.Bool(conn.Do("HEXISTS", fmt.Sprintf("%s:init-scripts", pudding.RedisNamespace), ID))
+		if err != nil {
+			return nil, err
+		}
+
+		if hasScript {
+			continue
+		}
+
+		instanceID, err := FetchInitScriptInstanceID(conn, ID)
+		if err != nil {
+			return nil, err
+		}
+
+		if instanceID != "" {
+			running, err := redis.Bool(conn.Do("SISMEMBER", fmt.Sprintf("%s:instances", pudding.RedisNamespace), instanceID))
+			if err != nil {
+				return nil, err
+			}
+
+			if running {
+				continue
+			}
+		}
+
+		IDs = append(IDs, ID)
+	}
+
+	if len(IDs) == 0 {
+		return IDs, nil
+	}
+
+	err = conn.Send("MULTI")
+	if err != nil {
+		return nil, err
+	}
+
+	for _, ID := range IDs {
+		for _, key := range []string{authsKey, instancesKey} {
+			err = conn.Send("HDEL", key, ID)
+			if err != nil {
+				conn.Do("DISCARD")
+				return nil, err
+			}
+		}
+	}
+
+	_, err = conn.Do("EXEC")
+	if err != nil {
+		return nil, err
+	}
+
+	return IDs, nil
+}
+
+// RekeyInitScripts re-encrypts the init scripts and auths not yet
+// encrypted with the primary key of the keyring, including any stored
+// as plaintext, and returns the number of entries re-encrypted along
+// with the "{hash}:{id}" of those that could not be decrypted, which
+// are skipped.  Each hash is watched while being re-encrypted so that
+// entries purged or replaced in the meantime are left alone until the
+// next run.
+func RekeyInitScripts(conn redis.Conn, kr *pudding.Keyring) (int, []string, error) {
+	if kr == nil {
+		return 0, nil, nil
+	}
+
+	n := 0
+	failed := []string{}
+
+	for _, hash := range []string{"init-scripts", "auths", "init_script_auths"} {
+		hashKey := fmt.Sprintf("%s:%s", pudding.RedisNamespace, hash)
+
+		_, err := conn.Do("WATCH", hashKey)
+		if err != nil {
+			return n, failed, err
+		}
+
+		values, err := redis.StringMap(conn.Do("HGETALL", hashKey))
+		if err != nil {
+			conn.Do("UNWATCH")
+			return n, failed, err
+		}
+
+		hmSet := []interface{}{hashKey}
+		for ID, value := range values {
+			if !kr.NeedsRekey(value) {
+				continue
+			}
+
+			plaintext, err := kr.Decrypt(value, encryptionContext(hash, ID))
+			if err != nil {
+				failed = append(failed, encryptionContext(hash, ID))
+				continue
+			}
+
+			encrypted, err := kr.Encrypt(plaintext, encryptionContext(hash, ID))
+			if err != nil {
+				conn.Do("UNWATCH")
+				return n, failed, err
+			}
+
+			hmSet = append(hmSet, ID, encrypted)
+		}
+
+		if len(hmSet) == 1 {
+			_, err = conn.Do("UNWATCH")
+			if err != nil {
+				return n, failed, err
+			}
+			continue
+		}
+
+		err = conn.Send("MULTI")
+		if err != nil {
+			conn.Do("UNWATCH")
+			return n, failed, err
+		}
+
+		err = conn.Send("HMSET", hmSet...)
+		if err != nil {
+			conn.Do("DISCARD")
+			return n, failed, err
+		}
+
+		reply, err := conn.Do("EXEC")
+		if err != nil {
+			return n, failed, err
+		}
+
+		if reply != nil {
+			n += (len(hmSet) - 1) / 2
+		}
+	}
+
+	return n, failed, nil
+}
+
+// StoreInstanceIdentity stores the identity issued to an instance,
+// replacing any issued before
+func StoreInstanceIdentity(conn redis.Conn, ident *pudding.InstanceIdentity) error {
+	err := conn.Send("MULTI")
+	if err != nil {
+		return err
+	}
+
+	hashKey := fmt.Sprintf("%s:instance_identity:%s", pudding.RedisNamespace, ident.InstanceID)
+
+	err = conn.Send("DEL", hashKey)
+	if err != nil {
+		conn.Do("DISCARD")
+		return err
+	}
+
+	hmSet := []interface{}{
+		hashKey,
+		"instance_id", ident.InstanceID,
+		"instance_build_id", ident.InstanceBuildID,
+		"account_id", ident.AccountID,
+		"region", ident.Region,
+		"verified", ident.Verified,
+		"issued_at", ident.IssuedAt,
+		"token_hash", ident.TokenHash,
+	}
+
+	err = conn.Send("HMSET", hmSet...)
+	if err != nil {
+		conn.Do("DISCARD")
+		return err
+	}
+
+	_, err = conn.Do("EXEC")
+	return err
+}
+
+// FetchInstanceIdentity retrieves the identity issued to an instance,
+// or nil if there is none
+func FetchInstanceIdentity(conn redis.Conn, instanceID string) (*pudding.InstanceIdentity, error) {
+	attrs, err := redis.Values(conn.Do("HGETALL", fmt.Sprintf("%s:instance_identity:%s", pudding.RedisNamespace, instanceID)))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(attrs) == 0 {
+		return nil, nil
+	}
+
+	ident := &pudding.InstanceIdentity{}
+	err = redis.ScanStruct(attrs, ident)
+	return ident, err
 }
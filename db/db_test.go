@@ -7,3 +7,21 @@ func TestNothing(t *testing.T) {
 		t.Fail()
 	}
 }
+
+func TestAuthsMatch(t *testing.T) {
+	for _, tc := range []struct {
+		dbAuth, auth string
+		expected     bool
+	}{
+		{"swordfish", "swordfish", true},
+		{"swordfish", " swordfish\n", true},
+		{"swordfish", "nope", false},
+		{"swordfish", "swordfis", false},
+		{"swordfish", "", false},
+		{"", "", false},
+	} {
+		if authsMatch(tc.dbAuth, tc.auth) != tc.expected {
+			t.Fatalf("expected auths %q and %q to match: %v", tc.dbAuth, tc.auth, tc.expected)
+		}
+	}
+}
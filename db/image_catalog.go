@@ -0,0 +1,215 @@
+package db
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/garyburd/redigo/redis"
+	"github.com/travis-ci/pudding"
+)
+
+// ImagePromotionHistoryLength is the maximum number of image
+// promotions kept
+const ImagePromotionHistoryLength = 500
+
+const (
+	// InstanceImageRecordExpiry is the number of seconds for which the
+	// image and heartbeats of an instance are kept
+	InstanceImageRecordExpiry = 7 * 24 * 60 * 60
+
+	// ImageCanaryReportGrace is the number of seconds within which a
+	// heartbeat is considered recent, and after launch an instance is
+	// expected to have sent one
+	ImageCanaryReportGrace = 15 * 60
+)
+
+// ImagePinnedError is returned when promoting an image in a scope
+// that is pinned to another image
+type ImagePinnedError struct {
+	Scope   string
+	ImageID string
+}
+
+func (e *ImagePinnedError) Error() string {
+	return fmt.Sprintf("image catalog scope %q is pinned to %s", e.Scope, e.ImageID)
+}
+
+// ImageDeprecatedError is returned when using a deprecated image
+type ImageDeprecatedError struct {
+	ImageID string
+	Reason  string
+}
+
+func (e *ImageDeprecatedError) Error() string {
+	if e.Reason == "" {
+		return fmt.Sprintf("image %s is deprecated", e.ImageID)
+	}
+	return fmt.Sprintf("image %s is deprecated: %s", e.ImageID, e.Reason)
+}
+
+// ImageCatalogManager defines the interface for managing which images
+// are active, pinned, and deprecated
+type ImageCatalogManager interface {
+	Promote(*pudding.ImagePromotion) error
+	Unpin(role, site, env, region string) error
+	Deprecate(imageID, reason string) error
+	Undeprecate(imageID string) error
+	FetchDeprecation(imageID string) (string, bool, error)
+	FetchPromotions(map[string]string) ([]*pudding.ImagePromotion, error)
+	SetCanary(*pudding.ImageCanary) error
+	RemoveCanary(role, site, env, region string) error
+	FetchCanaries() ([]*pudding.ImageCanary, error)
+	CanaryReport(role, site, env, region string) (*pudding.ImageCanaryReport, error)
+	RecordHeartbeat(instanceID string) error
+}
+
+// ImageCatalog represents the image catalog
+type ImageCatalog struct {
+	r   *redis.Pool
+	log *logrus.Logger
+}
+
+// NewImageCatalog creates a new ImageCatalog
+func NewImageCatalog(r *redis.Pool, log *logrus.Logger) (*ImageCatalog, error) {
+	return &ImageCatalog{
+		r:   r,
+		log: log,
+	}, nil
+}
+
+// Promote makes the promotion's image active for its scope
+func (ic *ImageCatalog) Promote(p *pudding.ImagePromotion) error {
+	conn := ic.r.Get()
+	defer conn.Close()
+
+	return PromoteImage(conn, p, ImagePromotionHistoryLength)
+}
+
+// Unpin removes the pin for the given role, site, env, and region
+func (ic *ImageCatalog) Unpin(role, site, env, region string) error {
+	conn := ic.r.Get()
+	defer conn.Close()
+
+	return UnpinImage(conn, pudding.ImageCatalogScope(role, site, env, region))
+}
+
+// Deprecate marks an image as deprecated
+func (ic *ImageCatalog) Deprecate(imageID, reason string) error {
+	conn := ic.r.Get()
+	defer conn.Close()
+
+	return DeprecateImage(conn, imageID, reason)
+}
+
+// Undeprecate removes the deprecation mark from an image
+func (ic *ImageCatalog) Undeprecate(imageID string) error {
+	conn := ic.r.Get()
+	defer conn.Close()
+
+	return UndeprecateImage(conn, imageID)
+}
+
+// FetchDeprecation returns the deprecation reason for an image and
+// whether the image is deprecated at all
+func (ic *ImageCatalog) FetchDeprecation(imageID string) (string, bool, error) {
+	conn := ic.r.Get()
+	defer conn.Close()
+
+	return FetchImageDeprecation(conn, imageID)
+}
+
+// FetchPromotions returns the promotion history, optionally with
+// "image_id", "role", "site", "env", and "region" filter params
+func (ic *ImageCatalog) FetchPromotions(f map[string]string) ([]*pudding.ImagePromotion, error) {
+	conn := ic.r.Get()
+	defer conn.Close()
+
+	promotions, err := FetchImagePromotions(conn, ImagePromotionHistoryLength)
+	if err != nil {
+		return nil, err
+	}
+
+	filtered := []*pudding.ImagePromotion{}
+
+	for _, p := range promotions {
+		failedChecks := 0
+		for key, value := range f {
+			switch key {
+			case "image_id":
+				if p.ImageID != value {
+					failedChecks++
+				}
+			case "role":
+				if p.Role != value {
+					failedChecks++
+				}
+			case "site":
+				if p.Site != value {
+					failedChecks++
+				}
+			case "env":
+				if p.Env != value {
+					failedChecks++
+				}
+			case "region":
+				if p.Region != value {
+					failedChecks++
+				}
+			}
+		}
+
+		if failedChecks == 0 {
+			filtered = append(filtered, p)
+		}
+	}
+
+	return filtered, nil
+}
+
+// SetCanary stores the canary for its scope
+func (ic *ImageCatalog) SetCanary(c *pudding.ImageCanary) error {
+	conn := ic.r.Get()
+	defer conn.Close()
+
+	return SetImageCanary(conn, c)
+}
+
+// RemoveCanary removes the canary for the given role, site, env, and
+// region
+func (ic *ImageCatalog) RemoveCanary(role, site, env, region string) error {
+	conn := ic.r.Get()
+	defer conn.Close()
+
+	return RemoveImageCanary(conn, pudding.ImageCatalogScope(role, site, env, region))
+}
+
+// FetchCanaries returns all canaries
+func (ic *ImageCatalog) FetchCanaries() ([]*pudding.ImageCanary, error) {
+	conn := ic.r.Get()
+	defer conn.Close()
+
+	return FetchImageCanaries(conn)
+}
+
+// CanaryReport compares the canary instances of a role with the rest,
+// limited to the given site, env, and region unless empty
+func (ic *ImageCatalog) CanaryReport(role, site, env, region string) (*pudding.ImageCanaryReport, error) {
+	conn := ic.r.Get()
+	defer conn.Close()
+
+	records, err := FetchInstanceImageRecords(conn)
+	if err != nil {
+		return nil, err
+	}
+
+	return pudding.NewImageCanaryReport(role, site, env, region, records, time.Now().UTC(), ImageCanaryReportGrace), nil
+}
+
+// RecordHeartbeat records a heartbeat for the given instance
+func (ic *ImageCatalog) RecordHeartbeat(instanceID string) error {
+	conn := ic.r.Get()
+	defer conn.Close()
+
+	return RecordInstanceHeartbeat(conn, instanceID, time.Now().UTC())
+}
@@ -3,15 +3,15 @@ package db
 import (
 	"github.com/Sirupsen/logrus"
 	"github.com/garyburd/redigo/redis"
-	"github.com/goamz/goamz/ec2"
 	"github.com/travis-ci/pudding"
+	"github.com/travis-ci/pudding/cloud"
 )
 
 // ImageFetcherStorer defines the interface for fetching and
 // storing the internal image representation
 type ImageFetcherStorer interface {
 	Fetch(map[string]string) ([]*pudding.Image, error)
-	Store(map[string]ec2.Image) error
+	Store(string, map[string]*cloud.Image) error
 }
 
 // Images represents the instance collection
@@ -38,10 +38,11 @@ func (i *Images) Fetch(f map[string]string) ([]*pudding.Image, error) {
 	return FetchImages(conn, f)
 }
 
-// Store accepts the ec2 representation of an image and stores it
-func (i *Images) Store(images map[string]ec2.Image) error {
+// Store accepts the cloud representation of the images in a region and
+// stores them in place of those previously stored for the region
+func (i *Images) Store(region string, images map[string]*cloud.Image) error {
 	conn := i.r.Get()
 	defer conn.Close()
 
-	return StoreImages(conn, images, i.Expiry)
+	return StoreRegionImages(conn, region, images, i.Expiry)
 }
@@ -8,12 +8,23 @@ import (
 	"fmt"
 	"io/ioutil"
 	"strings"
+	"time"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/garyburd/redigo/redis"
 	"github.com/travis-ci/pudding"
 )
 
+const (
+	// InitScriptFetchHistoryLength is the maximum number of fetches
+	// kept per init script
+	InitScriptFetchHistoryLength = 20
+
+	// InitScriptFetchExpiry is the number of seconds for which the
+	// fetches of an init script are kept after the most recent one
+	InitScriptFetchExpiry = 7 * 24 * 60 * 60
+)
+
 // InstanceBuildAuther is the interface used to authenticate
 // against temporary auth creds for download of init scripts via
 // cloud-init on the remote instance
@@ -21,24 +32,40 @@ type InstanceBuildAuther interface {
 	HasValidAuth(string, string) bool
 }
 
-// InitScriptGetterAuther is the extension of InstanceBuildAuther
-// that performs the fetching of the init script for cloud-init
-type InitScriptGetterAuther interface {
+// InitScriptAuther is the extension of InstanceBuildAuther that
+// also checks and uses up the limited, expiring creds used only for
+// the download of init scripts
+type InitScriptAuther interface {
 	InstanceBuildAuther
+	UseInitScriptAuth(string, string) bool
+}
+
+// InitScriptGetterAuther is the extension of InitScriptAuther
+// that performs the fetching of the init script for cloud-init and
+// keeps track of who fetched it
+type InitScriptGetterAuther interface {
+	InitScriptAuther
 	Get(string) (string, error)
+	InstanceID(string) (string, error)
+	AutoscalingGroups(string) (map[string]string, error)
+	RecordFetch(*pudding.InitScriptFetch) error
+	FetchFetches(string) ([]*pudding.InitScriptFetch, error)
 }
 
 // InitScripts represents the internal init scripts collection
 type InitScripts struct {
 	r   *redis.Pool
 	log *logrus.Logger
+	kr  *pudding.Keyring
 }
 
-// NewInitScripts creates a new *InitScripts
-func NewInitScripts(r *redis.Pool, log *logrus.Logger) (*InitScripts, error) {
+// NewInitScripts creates a new *InitScripts, which decrypts init
+// scripts and auths with the given keyring
+func NewInitScripts(r *redis.Pool, log *logrus.Logger, kr *pudding.Keyring) (*InitScripts, error) {
 	return &InitScripts{
 		r:   r,
 		log: log,
+		kr:  kr,
 	}, nil
 }
 
@@ -53,6 +80,11 @@ func (is *InitScripts) Get(ID string) (string, error) {
 		return "", err
 	}
 
+	b64Script, err = is.kr.Decrypt(b64Script, encryptionContext("init-scripts", ID))
+	if err != nil {
+		return "", err
+	}
+
 	b, err := base64.StdEncoding.DecodeString(string(b64Script))
 	if err != nil {
 		return "", err
@@ -89,13 +121,88 @@ func (is *InitScripts) HasValidAuth(ID, auth string) bool {
 		return false
 	}
 
-	is.log.WithFields(logrus.Fields{
-		"instance_build_id": ID,
-		"auth":              auth,
-		"db_auth":           dbAuth,
-	}).Debug("comparing auths")
+	dbAuth, err = is.kr.Decrypt(dbAuth, encryptionContext("auths", ID))
+	if err != nil {
+		is.log.WithFields(logrus.Fields{
+			"err":  err,
+			"hash": hKey,
+			"key":  ID,
+		}).Error("failed to decrypt auth from database")
+		return false
+	}
+
+	return authsMatch(dbAuth, auth)
+}
+
+// UseInitScriptAuth checks the provided init script auth creds
+// against what is stored in redis for the given init script id, and
+// uses up one of the remaining uses if they match and have not
+// expired
+func (is *InitScripts) UseInitScriptAuth(ID, auth string) bool {
+	conn := is.r.Get()
+	defer conn.Close()
+
+	ok, err := UseInitScriptAuth(conn, ID, auth, time.Now().UTC().Unix(), is.kr)
+	if err != nil {
+		is.log.WithFields(logrus.Fields{
+			"err": err,
+			"key": ID,
+		}).Error("failed to use init script auth")
+		return false
+	}
+
+	if !ok {
+		is.log.WithField("instance_build_id", ID).Warn("refusing init script auth that is wrong, expired, or used up")
+	}
+
+	return ok
+}
+
+// InstanceID returns the id of the instance booted with the given
+// init script, if known
+func (is *InitScripts) InstanceID(ID string) (string, error) {
+	conn := is.r.Get()
+	defer conn.Close()
+
+	return FetchInitScriptInstanceID(conn, ID)
+}
+
+// AutoscalingGroups returns the names of the autoscaling groups whose
+// instances boot with the given init script, mapped to their
+// autoscaling group build ids
+func (is *InitScripts) AutoscalingGroups(ID string) (map[string]string, error) {
+	conn := is.r.Get()
+	defer conn.Close()
+
+	return FetchInitScriptAutoscalingGroups(conn, ID)
+}
+
+// RecordFetch stores the audit record of an init script fetch
+func (is *InitScripts) RecordFetch(f *pudding.InitScriptFetch) error {
+	conn := is.r.Get()
+	defer conn.Close()
+
+	return StoreInitScriptFetch(conn, f, InitScriptFetchHistoryLength)
+}
+
+// FetchFetches returns the audit records of the fetches of the given
+// init script, newest first
+func (is *InitScripts) FetchFetches(ID string) ([]*pudding.InitScriptFetch, error) {
+	conn := is.r.Get()
+	defer conn.Close()
+
+	return FetchInitScriptFetches(conn, ID, InitScriptFetchHistoryLength)
+}
+
+// authsMatch compares in constant time, where ConstantTimeCompare
+// returns 1 for equal values and 0 otherwise, and an empty auth never
+// matches
+func authsMatch(dbAuth, auth string) bool {
+	if strings.TrimSpace(dbAuth) == "" {
+		return false
+	}
 
-	return 0 == subtle.ConstantTimeCompare(
+	return 1 == subtle.ConstantTimeCompare(
 		[]byte(strings.TrimSpace(dbAuth)),
 		[]byte(strings.TrimSpace(auth)),
 	)
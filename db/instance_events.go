@@ -0,0 +1,67 @@
+package db
+
+import (
+	"strconv"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/garyburd/redigo/redis"
+	"github.com/travis-ci/pudding"
+)
+
+// InstanceEventHistoryLength is the maximum number of EC2 events kept
+// per instance
+const InstanceEventHistoryLength = 50
+
+// InstanceEventFetcher defines the interface for fetching the EC2
+// event history of an instance
+type InstanceEventFetcher interface {
+	Fetch(map[string]string) ([]*pudding.EC2Event, error)
+}
+
+// InstanceEvents represents the instance EC2 event history collection
+type InstanceEvents struct {
+	r   *redis.Pool
+	log *logrus.Logger
+}
+
+// NewInstanceEvents creates a new InstanceEvents collection
+func NewInstanceEvents(r *redis.Pool, log *logrus.Logger) (*InstanceEvents, error) {
+	return &InstanceEvents{
+		r:   r,
+		log: log,
+	}, nil
+}
+
+// Fetch returns a slice of EC2 events for the "instance_id" filter
+// param, optionally with "detail_type" and "limit" filter params
+func (ie *InstanceEvents) Fetch(f map[string]string) ([]*pudding.EC2Event, error) {
+	conn := ie.r.Get()
+	defer conn.Close()
+
+	limit := InstanceEventHistoryLength
+	if v, ok := f["limit"]; ok {
+		l, err := strconv.Atoi(v)
+		if err == nil && l > 0 && l < limit {
+			limit = l
+		}
+	}
+
+	events, err := FetchInstanceEvents(conn, f["instance_id"], limit)
+	if err != nil {
+		return nil, err
+	}
+
+	detailType, ok := f["detail_type"]
+	if !ok {
+		return events, nil
+	}
+
+	filtered := []*pudding.EC2Event{}
+	for _, e := range events {
+		if e.DetailType == detailType {
+			filtered = append(filtered, e)
+		}
+	}
+
+	return filtered, nil
+}
@@ -0,0 +1,66 @@
+package db
+
+import (
+	"github.com/Sirupsen/logrus"
+	"github.com/garyburd/redigo/redis"
+	"github.com/travis-ci/pudding"
+)
+
+// InstanceIdentityFetcherStorer defines the interface for keeping the
+// identities issued to instances and checking their tokens
+type InstanceIdentityFetcherStorer interface {
+	Fetch(string) (*pudding.InstanceIdentity, error)
+	Store(*pudding.InstanceIdentity) error
+	HasValidToken(string, string, string) bool
+}
+
+// InstanceIdentities represents the instance identity collection
+type InstanceIdentities struct {
+	r   *redis.Pool
+	log *logrus.Logger
+}
+
+// NewInstanceIdentities creates a new *InstanceIdentities
+func NewInstanceIdentities(r *redis.Pool, log *logrus.Logger) (*InstanceIdentities, error) {
+	return &InstanceIdentities{
+		r:   r,
+		log: log,
+	}, nil
+}
+
+// Fetch returns the identity issued to the instance, or nil if there
+// is none
+func (ii *InstanceIdentities) Fetch(instanceID string) (*pudding.InstanceIdentity, error) {
+	conn := ii.r.Get()
+	defer conn.Close()
+
+	return FetchInstanceIdentity(conn, instanceID)
+}
+
+// Store keeps the identity issued to an instance, replacing any
+// issued before
+func (ii *InstanceIdentities) Store(ident *pudding.InstanceIdentity) error {
+	conn := ii.r.Get()
+	defer conn.Close()
+
+	return StoreInstanceIdentity(conn, ident)
+}
+
+// HasValidToken checks the provided token against the hash of the one
+// issued to the instance while booting from the given instance build
+func (ii *InstanceIdentities) HasValidToken(instanceID, instanceBuildID, token string) bool {
+	ident, err := ii.Fetch(instanceID)
+	if err != nil {
+		ii.log.WithFields(logrus.Fields{
+			"err":         err,
+			"instance_id": instanceID,
+		}).Error("failed to fetch instance identity")
+		return false
+	}
+
+	if ident == nil || ident.InstanceBuildID != instanceBuildID {
+		return false
+	}
+
+	return authsMatch(ident.TokenHash, pudding.HashInstanceToken(token))
+}
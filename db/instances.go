@@ -3,15 +3,16 @@ package db
 import (
 	"github.com/Sirupsen/logrus"
 	"github.com/garyburd/redigo/redis"
-	"github.com/goamz/goamz/ec2"
 	"github.com/travis-ci/pudding"
+	"github.com/travis-ci/pudding/cloud"
 )
 
 // InstanceFetcherStorer defines the interface for fetching and
 // storing the internal instance representation
 type InstanceFetcherStorer interface {
 	Fetch(map[string]string) ([]*pudding.Instance, error)
-	Store(map[string]ec2.Instance) error
+	Store(string, map[string]*cloud.Instance) error
+	SetExpiry(string, int64) error
 }
 
 // Instances represents the instance collection
@@ -38,10 +39,19 @@ func (i *Instances) Fetch(f map[string]string) ([]*pudding.Instance, error) {
 	return FetchInstances(conn, f)
 }
 
-// Store accepts the ec2 representation of an instance and stores it
-func (i *Instances) Store(instances map[string]ec2.Instance) error {
+// Store accepts the cloud representation of the instances in a region
+// and stores them in place of those previously stored for the region
+func (i *Instances) Store(region string, instances map[string]*cloud.Instance) error {
 	conn := i.r.Get()
 	defer conn.Close()
 
-	return StoreInstances(conn, instances, i.Expiry)
+	return StoreRegionInstances(conn, region, instances, i.Expiry)
+}
+
+// SetExpiry sets the unix time at which an instance expires
+func (i *Instances) SetExpiry(instanceID string, expiresAt int64) error {
+	conn := i.r.Get()
+	defer conn.Close()
+
+	return SetInstanceExpiry(conn, instanceID, expiresAt)
 }
@@ -0,0 +1,78 @@
+package db
+
+import (
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/garyburd/redigo/redis"
+	"github.com/travis-ci/pudding"
+)
+
+// LifecycleActionFetcher defines the interface for fetching the
+// internal pending lifecycle action representation
+type LifecycleActionFetcher interface {
+	Fetch(map[string]string) ([]*pudding.InstanceLifecycleAction, error)
+}
+
+// LifecycleActions represents the pending lifecycle action collection
+type LifecycleActions struct {
+	r   *redis.Pool
+	log *logrus.Logger
+}
+
+// NewLifecycleActions creates a new LifecycleActions collection
+func NewLifecycleActions(r *redis.Pool, log *logrus.Logger) (*LifecycleActions, error) {
+	return &LifecycleActions{
+		r:   r,
+		log: log,
+	}, nil
+}
+
+// Fetch returns a slice of pending lifecycle actions, optionally with
+// "transition", "asg", and "instance_id" filter params
+func (la *LifecycleActions) Fetch(f map[string]string) ([]*pudding.InstanceLifecycleAction, error) {
+	conn := la.r.Get()
+	defer conn.Close()
+
+	transitions := pudding.InstanceLifecycleTransitions
+	if transition, ok := f["transition"]; ok {
+		transitions = []string{transition}
+	}
+
+	now := time.Now().UTC()
+	actions := []*pudding.InstanceLifecycleAction{}
+
+	for _, transition := range transitions {
+		alas, err := FetchInstanceLifecycleActions(conn, transition)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, ala := range alas {
+			ila := pudding.NewInstanceLifecycleAction(ala, now)
+			if ila.Transition == "" {
+				ila.Transition = transition
+			}
+
+			failedChecks := 0
+			for key, value := range f {
+				switch key {
+				case "asg":
+					if ila.AutoScalingGroupName != value {
+						failedChecks++
+					}
+				case "instance_id":
+					if ila.InstanceID != value {
+						failedChecks++
+					}
+				}
+			}
+
+			if failedChecks == 0 {
+				actions = append(actions, ila)
+			}
+		}
+	}
+
+	return actions, nil
+}
@@ -0,0 +1,50 @@
+package db
+
+import (
+	"github.com/Sirupsen/logrus"
+	"github.com/garyburd/redigo/redis"
+	"github.com/travis-ci/pudding"
+)
+
+const (
+	// InstanceLaunchRecordExpiry is the number of seconds for which the
+	// launch of an instance is remembered without it being seen in EC2
+	InstanceLaunchRecordExpiry = 7 * 24 * 60 * 60
+)
+
+// OrphanInstanceReportFetcherStorer defines the interface for fetching
+// and storing the orphan instance report
+type OrphanInstanceReportFetcherStorer interface {
+	Fetch() (*pudding.OrphanInstanceReport, error)
+	Store(*pudding.OrphanInstanceReport) error
+}
+
+// OrphanInstanceReports represents the orphan instance report
+type OrphanInstanceReports struct {
+	r   *redis.Pool
+	log *logrus.Logger
+}
+
+// NewOrphanInstanceReports creates a new OrphanInstanceReports
+func NewOrphanInstanceReports(r *redis.Pool, log *logrus.Logger) (*OrphanInstanceReports, error) {
+	return &OrphanInstanceReports{
+		r:   r,
+		log: log,
+	}, nil
+}
+
+// Fetch returns the most recent report, or nil if there is none
+func (oir *OrphanInstanceReports) Fetch() (*pudding.OrphanInstanceReport, error) {
+	conn := oir.r.Get()
+	defer conn.Close()
+
+	return FetchOrphanInstanceReport(conn)
+}
+
+// Store replaces the most recent report
+func (oir *OrphanInstanceReports) Store(report *pudding.OrphanInstanceReport) error {
+	conn := oir.r.Get()
+	defer conn.Close()
+
+	return StoreOrphanInstanceReport(conn, report)
+}
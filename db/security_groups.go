@@ -0,0 +1,45 @@
+package db
+
+import (
+	"github.com/Sirupsen/logrus"
+	"github.com/garyburd/redigo/redis"
+	"github.com/travis-ci/pudding"
+)
+
+// SecurityGroupGCReportFetcherStorer defines the interface for
+// fetching and storing the security group garbage collection report
+type SecurityGroupGCReportFetcherStorer interface {
+	Fetch() (*pudding.SecurityGroupGCReport, error)
+	Store(*pudding.SecurityGroupGCReport) error
+}
+
+// SecurityGroupGCReports represents the security group garbage
+// collection report
+type SecurityGroupGCReports struct {
+	r   *redis.Pool
+	log *logrus.Logger
+}
+
+// NewSecurityGroupGCReports creates a new SecurityGroupGCReports
+func NewSecurityGroupGCReports(r *redis.Pool, log *logrus.Logger) (*SecurityGroupGCReports, error) {
+	return &SecurityGroupGCReports{
+		r:   r,
+		log: log,
+	}, nil
+}
+
+// Fetch returns the most recent report, or nil if there is none
+func (sgr *SecurityGroupGCReports) Fetch() (*pudding.SecurityGroupGCReport, error) {
+	conn := sgr.r.Get()
+	defer conn.Close()
+
+	return FetchSecurityGroupGCReport(conn)
+}
+
+// Store replaces the most recent report
+func (sgr *SecurityGroupGCReports) Store(report *pudding.SecurityGroupGCReport) error {
+	conn := sgr.r.Get()
+	defer conn.Close()
+
+	return StoreSecurityGroupGCReport(conn, report)
+}
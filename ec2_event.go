@@ -0,0 +1,90 @@
+package pudding
+
+import "strings"
+
+const (
+	// EC2EventSpotInterruption is the detail type of a spot instance
+	// interruption warning, sent two minutes before the instance is
+	// reclaimed
+	EC2EventSpotInterruption = "EC2 Spot Instance Interruption Warning"
+	// EC2EventStateChange is the detail type of an instance
+	// state-change notification
+	EC2EventStateChange = "EC2 Instance State-change Notification"
+	// EC2EventRebalanceRecommendation is the detail type of an instance
+	// rebalance recommendation, sent when a spot instance is at
+	// elevated risk of interruption
+	EC2EventRebalanceRecommendation = "EC2 Instance Rebalance Recommendation"
+)
+
+// EC2Event is an EventBridge-style SNS message payload of the form:
+//
+//	{
+//	  "version":"0",
+//	  "id":"uuid string",
+//	  "detail-type":"detail type string, e.g.: EC2 Spot Instance Interruption Warning",
+//	  "source":"aws.ec2",
+//	  "account":"account id string",
+//	  "time":"iso 8601 timestamp string",
+//	  "region":"region string",
+//	  "resources":["instance arn string"],
+//	  "detail":{
+//	    "instance-id":"instance id string",
+//	    "instance-action":"action string, e.g.: terminate",
+//	    "state":"state string, e.g.: shutting-down"
+//	  }
+//	}
+type EC2Event struct {
+	Version    string         `json:"version"`
+	ID         string         `json:"id"`
+	DetailType string         `json:"detail-type"`
+	Source     string         `json:"source"`
+	Account    string         `json:"account"`
+	Time       string         `json:"time"`
+	Region     string         `json:"region"`
+	Resources  []string       `json:"resources"`
+	Detail     EC2EventDetail `json:"detail"`
+}
+
+// EC2EventDetail is the "detail" bit of an EC2Event, the fields of
+// which are only present for some detail types
+type EC2EventDetail struct {
+	InstanceID     string `json:"instance-id"`
+	InstanceAction string `json:"instance-action,omitempty"`
+	State          string `json:"state,omitempty"`
+}
+
+// IsEC2Event returns whether the event looks like an EC2 event
+// delivered via EventBridge
+func (e *EC2Event) IsEC2Event() bool {
+	return e.Source == "aws.ec2" && e.DetailType != ""
+}
+
+// InstanceID returns the id of the instance the event is about,
+// falling back to the resource ARNs if absent from the detail
+func (e *EC2Event) InstanceID() string {
+	if e.Detail.InstanceID != "" {
+		return e.Detail.InstanceID
+	}
+
+	for _, resource := range e.Resources {
+		if idx := strings.LastIndex(resource, "instance/"); idx > -1 {
+			return resource[idx+len("instance/"):]
+		}
+	}
+
+	return ""
+}
+
+// IsStopping returns whether the event is a state-change notification
+// to a state in which the instance can no longer take work
+func (e *EC2Event) IsStopping() bool {
+	if e.DetailType != EC2EventStateChange {
+		return false
+	}
+
+	switch e.Detail.State {
+	case "shutting-down", "stopping", "stopped", "terminated":
+		return true
+	}
+	return false
+}
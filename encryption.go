@@ -0,0 +1,218 @@
+package pudding
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"io"
+	"strings"
+)
+
+const (
+	// EncryptedValuePrefix marks values stored with envelope
+	// encryption, which are otherwise taken to be plaintext
+	EncryptedValuePrefix = "pudding:enc:v1:"
+)
+
+// Keyring holds the keys used for envelope encryption of secrets at
+// rest, of which the primary key encrypts and all of them decrypt.
+// A nil *Keyring stores secrets as plaintext, which is only meant for
+// local development.
+type Keyring struct {
+	primary   string
+	keys      map[string][]byte
+	migrating bool
+}
+
+// ParseKeyring parses a comma-delimited list of {id}:{base64 key}
+// pairs, the first of which is the primary key.  Keys must be 32 bytes
+// for AES-256.  An empty string results in a nil *Keyring.
+func ParseKeyring(s string) (*Keyring, error) {
+	if strings.TrimSpace(s) == "" {
+		return nil, nil
+	}
+
+	kr := &Keyring{keys: map[string][]byte{}}
+
+	for _, pair := range strings.Split(s, ",") {
+		parts := strings.SplitN(strings.TrimSpace(pair), ":", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, errInvalidEncryptionKey
+		}
+
+		key, err := base64.StdEncoding.DecodeString(parts[1])
+		if err != nil || len(key) != 32 {
+			return nil, errInvalidEncryptionKey
+		}
+
+		if _, ok := kr.keys[parts[0]]; ok {
+			return nil, errInvalidEncryptionKey
+		}
+
+		if kr.primary == "" {
+			kr.primary = parts[0]
+		}
+		kr.keys[parts[0]] = key
+	}
+
+	return kr, nil
+}
+
+// PrimaryKeyID returns the id of the key used for encryption, or ""
+// when storing plaintext
+func (kr *Keyring) PrimaryKeyID() string {
+	if kr == nil {
+		return ""
+	}
+	return kr.primary
+}
+
+// AllowPlaintext has Decrypt pass values which aren't encrypted through
+// as-is, which is only meant for migrating plaintext values stored
+// before keys were configured
+func (kr *Keyring) AllowPlaintext() {
+	if kr == nil {
+		return
+	}
+	kr.migrating = true
+}
+
+// Encrypt encrypts the value with a new data key, which is itself
+// encrypted with the primary key and stored alongside as
+// {prefix}{key id}:{base64 data key}:{base64 value}.  The context,
+// being where the value is stored, is authenticated along with the key
+// id so that the value can't be decrypted as if stored elsewhere.
+func (kr *Keyring) Encrypt(plaintext, context string) (string, error) {
+	if kr == nil {
+		return plaintext, nil
+	}
+
+	dataKey := make([]byte, 32)
+	_, err := io.ReadFull(rand.Reader, dataKey)
+	if err != nil {
+		return "", err
+	}
+
+	aad := additionalData(kr.primary, context)
+
+	sealedKey, err := seal(kr.keys[kr.primary], dataKey, aad)
+	if err != nil {
+		return "", err
+	}
+
+	sealedValue, err := seal(dataKey, []byte(plaintext), aad)
+	if err != nil {
+		return "", err
+	}
+
+	return EncryptedValuePrefix + strings.Join([]string{
+		kr.primary,
+		base64.StdEncoding.EncodeToString(sealedKey),
+		base64.StdEncoding.EncodeToString(sealedValue),
+	}, ":"), nil
+}
+
+// Decrypt reverses Encrypt with whichever key the value was encrypted
+// with, given the same context.  Plaintext values are refused once
+// keys are configured, unless AllowPlaintext was called.
+func (kr *Keyring) Decrypt(value, context string) (string, error) {
+	if !strings.HasPrefix(value, EncryptedValuePrefix) {
+		if kr != nil && !kr.migrating {
+			return "", errPlaintextValue
+		}
+		return value, nil
+	}
+
+	parts := strings.Split(strings.TrimPrefix(value, EncryptedValuePrefix), ":")
+	if len(parts) != 3 {
+		return "", errMalformedEncryptedValue
+	}
+
+	if kr == nil {
+		return "", errUnknownEncryptionKey
+	}
+
+	key, ok := kr.keys[parts[0]]
+	if !ok {
+		return "", errUnknownEncryptionKey
+	}
+
+	sealedKey, err := base64.StdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", errMalformedEncryptedValue
+	}
+
+	sealedValue, err := base64.StdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", errMalformedEncryptedValue
+	}
+
+	aad := additionalData(parts[0], context)
+
+	dataKey, err := open(key, sealedKey, aad)
+	if err != nil {
+		return "", err
+	}
+
+	plaintext, err := open(dataKey, sealedValue, aad)
+	if err != nil {
+		return "", err
+	}
+
+	return string(plaintext), nil
+}
+
+// NeedsRekey returns whether the value is not yet encrypted with the
+// primary key, which is never the case when storing plaintext
+func (kr *Keyring) NeedsRekey(value string) bool {
+	if kr == nil {
+		return false
+	}
+	return !strings.HasPrefix(value, EncryptedValuePrefix+kr.primary+":")
+}
+
+func additionalData(keyID, context string) []byte {
+	return []byte(keyID + ":" + context)
+}
+
+func seal(key, plaintext, aad []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	_, err = io.ReadFull(rand.Reader, nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	return gcm.Seal(nonce, nonce, plaintext, aad), nil
+}
+
+func open(key, sealed, aad []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(sealed) < gcm.NonceSize() {
+		return nil, errMalformedEncryptedValue
+	}
+
+	plaintext, err := gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], aad)
+	if err != nil {
+		return nil, errMalformedEncryptedValue
+	}
+
+	return plaintext, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -3,15 +3,42 @@ package pudding
 import "fmt"
 
 var (
-	errEmptyEnv          = fmt.Errorf("empty \"env\" param")
-	errEmptyInstanceID   = fmt.Errorf("empty \"instance_id\" param")
-	errEmptyInstanceType = fmt.Errorf("empty \"instance_type\" param")
-	errEmptyQueue        = fmt.Errorf("empty \"queue\" param")
-	errEmptyRole         = fmt.Errorf("empty \"role\" param")
-	errEmptyRoleARN      = fmt.Errorf("empty \"role_arn\" param")
-	errEmptySite         = fmt.Errorf("empty \"site\" param")
-	errEmptyTopicARN     = fmt.Errorf("empty \"topic_arn\" param")
+	errEmptyApprovalPolicy = fmt.Errorf("approval policy must have a site, env, queue, or instance_types")
+	errEmptyEnv            = fmt.Errorf("empty \"env\" param")
+	errEmptyImageID        = fmt.Errorf("empty \"image_id\" param")
+	errEmptyIngressSource  = fmt.Errorf("ingress rule must have cidrs or source_security_group_ids")
+	errEmptyInstanceID     = fmt.Errorf("empty \"instance_id\" param")
+	errEmptyInstanceType   = fmt.Errorf("empty \"instance_type\" param")
+	errEmptyQueue          = fmt.Errorf("empty \"queue\" param")
+	errEmptyRole           = fmt.Errorf("empty \"role\" param")
+	errEmptyRoleARN        = fmt.Errorf("empty \"role_arn\" param")
+	errEmptySite           = fmt.Errorf("empty \"site\" param")
+	errEmptyTopicARN       = fmt.Errorf("empty \"topic_arn\" param")
 
-	errInvalidInstanceCount = fmt.Errorf("count must be more than 0")
-	errInvalidState         = fmt.Errorf("state must be pending, started, or finished")
+	errInvalidBuildPolicyPattern        = fmt.Errorf("build policy instance_types must be valid patterns")
+	errInvalidCanaryWeight              = fmt.Errorf("weight must be between 1 and 100")
+	errInvalidEncryptionKey             = fmt.Errorf("encryption keys must be {id}:{base64 32-byte key} with unique ids")
+	errInvalidIngressPortRange          = fmt.Errorf("ingress rule port range must be within 0-65535")
+	errInvalidIngressProtocol           = fmt.Errorf("ingress rule protocol must be tcp, udp, icmp, or -1")
+	errInvalidInstanceBuildQuota        = fmt.Errorf("instance build quota limits must not be negative")
+	errInvalidInstanceCount             = fmt.Errorf("count must be more than 0")
+	errInvalidInstanceIdentityCert      = fmt.Errorf("instance identity certs must be PEM-encoded RSA certificates")
+	errInvalidInstanceIdentitySignature = fmt.Errorf("instance identity document signature is invalid")
+	errInvalidLifecycleActionResult     = fmt.Errorf("result must be CONTINUE or ABANDON")
+	errInvalidMarket                    = fmt.Errorf("market must be on-demand or spot")
+	errInvalidOnDemandBaseCapacity      = fmt.Errorf("on_demand_base_capacity must not be negative")
+	errInvalidRegion                    = fmt.Errorf("region must be a known aws region")
+	errInvalidSpotPercentage            = fmt.Errorf("spot_percentage must be between 0 and 100")
+	errInvalidTagKey                    = fmt.Errorf("tag keys must be 1-128 characters and not start with \"aws:\"")
+	errInvalidTagValue                  = fmt.Errorf("tag values must be at most 256 characters")
+	errInvalidState                     = fmt.Errorf("state must be pending, started, or finished")
+	errInvalidTransition                = fmt.Errorf("transition must be launching or terminating")
+	errInvalidTTL                       = fmt.Errorf("ttl and expires_at must not be negative, and only one may be given")
+	errManagedSecurityGroupIngressRules = fmt.Errorf("ingress_rules may not be given with managed_security_group")
+
+	errMalformedEncryptedValue = fmt.Errorf("encrypted value is malformed or was tampered with")
+	errPlaintextValue          = fmt.Errorf("value is not encrypted, which is only allowed while migrating plaintext values")
+	errReservedTagKey          = fmt.Errorf("tags must not include keys reserved by pudding")
+	errUnknownEncryptionKey    = fmt.Errorf("value is encrypted with an unknown key")
+	errWorldOpenSSH            = fmt.Errorf("ingress rules must not open ssh to the world unless \"allow_world_open_ssh\" is set")
 )
@@ -7,14 +7,26 @@ export INSTANCE_ID="$(curl -s 'http://169.254.169.254/latest/meta-data/instance-
 mkdir -p /app
 cd /app
 
+# check in with the instance identity document to get a token for this
+# instance alone, which is used instead of the instance build creds
+IDENTITY_DOCUMENT="$(curl -s 'http://169.254.169.254/latest/dynamic/instance-identity/document')"
+IDENTITY_SIGNATURE="$(curl -s 'http://169.254.169.254/latest/dynamic/instance-identity/signature' | tr -d '\n')"
+INSTANCE_TOKEN="$(
+  python -c 'import json, sys; print(json.dumps({"document": sys.argv[1], "signature": sys.argv[2]}))' \
+    "$IDENTITY_DOCUMENT" "$IDENTITY_SIGNATURE" |
+  curl -s -X POST -d @- "{{ .InstanceIdentityURL }}?l=cloud-init-$LINENO" |
+  sed -n 's/.*"token":"\([^"]*\)".*/\1/p'
+)"
+
 cat > id_rsa <<EOF
-{{ env_for `RSA_KEY` `site` `env` | uncompress }}
+{{ secret `RSA_KEY` `site` `env` | uncompress }}
 EOF
 
 cat > start-hook <<EOF
 #!/bin/bash
 exec curl \\
   -s \\
+  -u "$INSTANCE_ID:$INSTANCE_TOKEN" \\
   -X POST \\
   -d '{"instance_id":"$INSTANCE_ID"}' \\
   "{{ .InstanceLaunchURL }}?l=cloud-init-$LINENO&slack-channel={{ .SlackChannel }}"
@@ -27,6 +39,7 @@ cat > stop-hook <<EOF
 #!/bin/bash
 exec curl \\
   -s \\
+  -u "$INSTANCE_ID:$INSTANCE_TOKEN" \\
   -X POST \\
   -d '{"instance_id":"$INSTANCE_ID"}' \\
   "{{ .InstanceTerminateURL }}?l=cloud-init-$LINENO&slack-channel={{ .SlackChannel }}"
@@ -58,6 +58,19 @@ var (
 		Usage:  "expiry in seconds for image attributes",
 		EnvVar: "PUDDING_IMAGE_EXPIRY",
 	}
+	// AWSRegionFlag is the flag used for the default region of builds
+	AWSRegionFlag = cli.StringFlag{
+		Name:   "R, aws-region",
+		Value:  "us-east-1",
+		EnvVar: "AWS_DEFAULT_REGION",
+	}
+	// AWSRegionsFlag is the flag used for the regions besides the
+	// default that builds may target and that are synced
+	AWSRegionsFlag = cli.StringFlag{
+		Name:   "aws-regions",
+		Usage:  "comma-delimited regions besides aws-region that builds may target and that are synced",
+		EnvVar: "PUDDING_AWS_REGIONS",
+	}
 	// SlackHookPathFlag is the incoming webhook path for slack integration
 	SlackHookPathFlag = cli.StringFlag{
 		Name:   "slack-hook-path",
@@ -91,6 +104,20 @@ var (
 		Value:  os.Getenv("SENTRY_DSN"),
 		EnvVar: "PUDDING_SENTRY_DSN",
 	}
+	// EncryptionKeysFlag is the flag used for the keys with which init
+	// scripts and auths are encrypted at rest
+	EncryptionKeysFlag = cli.StringFlag{
+		Name:   "encryption-keys",
+		Usage:  "comma-delimited {id}:{base64 32-byte key} pairs, the first of which encrypts, or empty for plaintext",
+		EnvVar: "PUDDING_ENCRYPTION_KEYS",
+	}
+	// EncryptionMigrationFlag is the flag used to keep reading init
+	// scripts and auths stored as plaintext before keys were configured
+	EncryptionMigrationFlag = cli.BoolFlag{
+		Name:   "encryption-migration",
+		Usage:  "read values stored as plaintext until they are encrypted by the init-script-rekey mini worker",
+		EnvVar: "PUDDING_ENCRYPTION_MIGRATION",
+	}
 	// DebugFlag enables debug logging
 	DebugFlag = cli.BoolFlag{
 		Name:   "debug",
@@ -7,4 +7,11 @@ type Image struct {
 	Active  bool   `json:"active" redis:"active"`
 	Name    string `json:"name" redis:"name"`
 	State   string `json:"state" redis:"state"`
+	Region  string `json:"region" redis:"region"`
+
+	// Pinned, Deprecated, and DeprecationReason come from the image
+	// catalog rather than EC2 tags
+	Pinned            bool   `json:"pinned,omitempty" redis:"-"`
+	Deprecated        bool   `json:"deprecated,omitempty" redis:"-"`
+	DeprecationReason string `json:"deprecation_reason,omitempty" redis:"-"`
 }
@@ -0,0 +1,176 @@
+package pudding
+
+import "time"
+
+// ImageCanariesCollectionSingular is the singular representation
+// used in jsonapi bodies
+type ImageCanariesCollectionSingular struct {
+	ImageCanaries *ImageCanary `json:"image_canaries"`
+}
+
+// ImageCanariesCollection is the collection representation used
+// in jsonapi bodies
+type ImageCanariesCollection struct {
+	ImageCanaries []*ImageCanary `json:"image_canaries"`
+}
+
+// ImageCanary is a candidate image that gets Weight percent of the
+// instance builds for a role in a region, optionally scoped to a site
+// and env, which would otherwise use the image catalog
+type ImageCanary struct {
+	ImageID   string `json:"image_id"`
+	Role      string `json:"role"`
+	Site      string `json:"site,omitempty"`
+	Env       string `json:"env,omitempty"`
+	Region    string `json:"region"`
+	Weight    int    `json:"weight"`
+	CreatedAt int64  `json:"created_at"`
+}
+
+// Hydrate is used to overwrite "null" defaults that result from
+// serialize/deserialize via JSON
+func (c *ImageCanary) Hydrate() {
+	if c.CreatedAt == 0 {
+		c.CreatedAt = time.Now().UTC().Unix()
+	}
+}
+
+// Validate performs multiple validity checks and returns a slice
+// of all errors found
+func (c *ImageCanary) Validate() []error {
+	errors := []error{}
+	if c.ImageID == "" {
+		errors = append(errors, errEmptyImageID)
+	}
+	if c.Role == "" {
+		errors = append(errors, errEmptyRole)
+	}
+	if !IsValidRegion(c.Region) {
+		errors = append(errors, errInvalidRegion)
+	}
+	if c.Weight < 1 || c.Weight > 100 {
+		errors = append(errors, errInvalidCanaryWeight)
+	}
+
+	return errors
+}
+
+// Scope returns the image catalog scope of the canary
+func (c *ImageCanary) Scope() string {
+	return ImageCatalogScope(c.Role, c.Site, c.Env, c.Region)
+}
+
+// InstanceImageRecord tracks which image an instance was built with,
+// along with its heartbeats, so that canary images may be compared
+// with the rest
+type InstanceImageRecord struct {
+	InstanceID      string `json:"instance_id" redis:"instance_id"`
+	ImageID         string `json:"image_id" redis:"image_id"`
+	Role            string `json:"role" redis:"role"`
+	Site            string `json:"site" redis:"site"`
+	Env             string `json:"env" redis:"env"`
+	Region          string `json:"region" redis:"region"`
+	Canary          bool   `json:"canary" redis:"canary"`
+	LaunchedAt      int64  `json:"launched_at" redis:"launched_at"`
+	LastHeartbeatAt int64  `json:"last_heartbeat_at" redis:"last_heartbeat_at"`
+	HeartbeatCount  int    `json:"heartbeat_count" redis:"heartbeat_count"`
+}
+
+// ImageHealthStats summarizes the heartbeats of a set of instances
+type ImageHealthStats struct {
+	ImageIDs []string `json:"image_ids"`
+
+	// Instances is the total count, of which Heartbeating have sent at
+	// least one heartbeat, Recent have sent one within the grace
+	// period, and Silent have never sent one despite being older than
+	// the grace period
+	Instances    int `json:"instances"`
+	Heartbeating int `json:"heartbeating"`
+	Recent       int `json:"recent"`
+	Silent       int `json:"silent"`
+
+	// MeanLifetime is the mean number of seconds between launch and
+	// last heartbeat of the instances that have sent any
+	MeanLifetime int64 `json:"mean_lifetime"`
+}
+
+// ImageCanaryReport compares the canary instances of a role with the
+// rest, optionally limited to a site, env, and region
+type ImageCanaryReport struct {
+	Role     string            `json:"role"`
+	Site     string            `json:"site,omitempty"`
+	Env      string            `json:"env,omitempty"`
+	Region   string            `json:"region,omitempty"`
+	Canary   *ImageHealthStats `json:"canary"`
+	Baseline *ImageHealthStats `json:"baseline"`
+}
+
+// NewImageCanaryReport builds an *ImageCanaryReport from the given
+// records of the role and, unless empty, the site, env, and region,
+// where grace is the number of seconds within which a heartbeat is
+// considered recent and after launch an instance is expected to have
+// sent one
+func NewImageCanaryReport(role, site, env, region string, records []*InstanceImageRecord, now time.Time, grace int64) *ImageCanaryReport {
+	canary := &imageHealthAccumulator{stats: &ImageHealthStats{ImageIDs: []string{}}, seen: map[string]bool{}}
+	baseline := &imageHealthAccumulator{stats: &ImageHealthStats{ImageIDs: []string{}}, seen: map[string]bool{}}
+
+	for _, rec := range records {
+		if rec.Role != role ||
+			(site != "" && rec.Site != site) ||
+			(env != "" && rec.Env != env) ||
+			(region != "" && rec.Region != region) {
+			continue
+		}
+
+		if rec.Canary {
+			canary.add(rec, now.Unix(), grace)
+		} else {
+			baseline.add(rec, now.Unix(), grace)
+		}
+	}
+
+	return &ImageCanaryReport{
+		Role:     role,
+		Site:     site,
+		Env:      env,
+		Region:   region,
+		Canary:   canary.finish(),
+		Baseline: baseline.finish(),
+	}
+}
+
+type imageHealthAccumulator struct {
+	stats    *ImageHealthStats
+	seen     map[string]bool
+	lifetime int64
+}
+
+func (a *imageHealthAccumulator) add(rec *InstanceImageRecord, now, grace int64) {
+	if !a.seen[rec.ImageID] {
+		a.seen[rec.ImageID] = true
+		a.stats.ImageIDs = append(a.stats.ImageIDs, rec.ImageID)
+	}
+
+	a.stats.Instances++
+
+	if rec.HeartbeatCount == 0 {
+		if now-rec.LaunchedAt > grace {
+			a.stats.Silent++
+		}
+		return
+	}
+
+	a.stats.Heartbeating++
+	a.lifetime += rec.LastHeartbeatAt - rec.LaunchedAt
+
+	if now-rec.LastHeartbeatAt <= grace {
+		a.stats.Recent++
+	}
+}
+
+func (a *imageHealthAccumulator) finish() *ImageHealthStats {
+	if a.stats.Heartbeating > 0 {
+		a.stats.MeanLifetime = a.lifetime / int64(a.stats.Heartbeating)
+	}
+	return a.stats
+}
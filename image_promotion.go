@@ -0,0 +1,87 @@
+package pudding
+
+import (
+	"strings"
+	"time"
+)
+
+// ImagePromotionsCollectionSingular is the singular representation
+// used in jsonapi bodies
+type ImagePromotionsCollectionSingular struct {
+	ImagePromotions *ImagePromotion `json:"image_promotions"`
+}
+
+// ImagePromotionsCollection is the collection representation used
+// in jsonapi bodies
+type ImagePromotionsCollection struct {
+	ImagePromotions []*ImagePromotion `json:"image_promotions"`
+}
+
+// ImagePromotion records an image being made the active image for a
+// role in a region, optionally scoped to a site and env
+type ImagePromotion struct {
+	ImageID    string `json:"image_id"`
+	Role       string `json:"role"`
+	Site       string `json:"site,omitempty"`
+	Env        string `json:"env,omitempty"`
+	Region     string `json:"region"`
+	Pin        bool   `json:"pin"`
+	Reason     string `json:"reason,omitempty"`
+	PromotedAt int64  `json:"promoted_at"`
+}
+
+// Hydrate is used to overwrite "null" defaults that result from
+// serialize/deserialize via JSON
+func (p *ImagePromotion) Hydrate() {
+	if p.PromotedAt == 0 {
+		p.PromotedAt = time.Now().UTC().Unix()
+	}
+}
+
+// Validate performs multiple validity checks and returns a slice
+// of all errors found
+func (p *ImagePromotion) Validate() []error {
+	errors := []error{}
+	if p.ImageID == "" {
+		errors = append(errors, errEmptyImageID)
+	}
+	if p.Role == "" {
+		errors = append(errors, errEmptyRole)
+	}
+	if !IsValidRegion(p.Region) {
+		errors = append(errors, errInvalidRegion)
+	}
+
+	return errors
+}
+
+// Scope returns the image catalog scope of the promotion
+func (p *ImagePromotion) Scope() string {
+	return ImageCatalogScope(p.Role, p.Site, p.Env, p.Region)
+}
+
+// ImageCatalogScope returns the key under which an image is active
+// for the given role, site, env, and region, of which site and env
+// may be empty
+func ImageCatalogScope(role, site, env, region string) string {
+	return strings.Join([]string{role, site, env, region}, ":")
+}
+
+// ImageCatalogScopes returns the scopes to consult when resolving an
+// image for the given role, site, and env in the given region, most
+// specific first, as images only ever exist in a single region
+func ImageCatalogScopes(role, site, env, region string) []string {
+	seen := map[string]bool{}
+	scopes := []string{}
+
+	for _, s := range [][]string{{site, env}, {site, ""}, {"", env}, {"", ""}} {
+		scope := ImageCatalogScope(role, s[0], s[1], region)
+		if seen[scope] {
+			continue
+		}
+		seen[scope] = true
+		scopes = append(scopes, scope)
+	}
+
+	return scopes
+}
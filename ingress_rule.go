@@ -0,0 +1,128 @@
+package pudding
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+var (
+	worldCIDRs = map[string]bool{"0.0.0.0/0": true, "::/0": true}
+
+	// DefaultIngressRulesJSON is used when neither the instance build
+	// nor the site and env config declare any ingress rules, allowing
+	// SSH from private networks only
+	DefaultIngressRulesJSON = `[{"protocol":"tcp","from_port":22,"to_port":22,"cidrs":["10.0.0.0/8","172.16.0.0/12","192.168.0.0/16"]}]`
+)
+
+// IngressRule is an inbound rule for a pudding-created security group
+type IngressRule struct {
+	Protocol               string   `json:"protocol"`
+	FromPort               int      `json:"from_port"`
+	ToPort                 int      `json:"to_port"`
+	CIDRs                  []string `json:"cidrs,omitempty"`
+	SourceSecurityGroupIDs []string `json:"source_security_group_ids,omitempty"`
+}
+
+// Validate performs multiple validity checks and returns a slice
+// of all errors found
+func (r *IngressRule) Validate() []error {
+	errors := []error{}
+
+	switch r.Protocol {
+	case "tcp", "udp":
+		if r.FromPort < 0 || r.ToPort > 65535 || r.FromPort > r.ToPort {
+			errors = append(errors, errInvalidIngressPortRange)
+		}
+	case "icmp", "-1":
+	default:
+		errors = append(errors, errInvalidIngressProtocol)
+	}
+
+	if len(r.CIDRs) == 0 && len(r.SourceSecurityGroupIDs) == 0 {
+		errors = append(errors, errEmptyIngressSource)
+	}
+
+	return errors
+}
+
+// IsWorldOpenSSH returns whether the rule allows SSH from anywhere
+func (r *IngressRule) IsWorldOpenSSH() bool {
+	if r.Protocol != "tcp" && r.Protocol != "-1" {
+		return false
+	}
+
+	if r.Protocol == "tcp" && (r.FromPort > 22 || r.ToPort < 22) {
+		return false
+	}
+
+	for _, cidr := range r.CIDRs {
+		if worldCIDRs[cidr] {
+			return true
+		}
+	}
+
+	return false
+}
+
+// String returns a short description of the rule, e.g.
+// "tcp:22-22 from 10.0.0.0/8"
+func (r *IngressRule) String() string {
+	return fmt.Sprintf("%s:%d-%d from %s", r.Protocol, r.FromPort, r.ToPort,
+		strings.Join(append(append([]string{}, r.CIDRs...), r.SourceSecurityGroupIDs...), ","))
+}
+
+// ParseIngressRules parses a JSON array of ingress rules
+func ParseIngressRules(s string) ([]*IngressRule, error) {
+	rules := []*IngressRule{}
+	err := json.Unmarshal([]byte(s), &rules)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, rule := range rules {
+		if errs := rule.Validate(); len(errs) > 0 {
+			return nil, &MultiError{Errors: errs}
+		}
+	}
+
+	return rules, nil
+}
+
+// IngressRulesFor returns the ingress rules for the build's security
+// group, preferring the build's own rules, then those configured for
+// the site and env via PUDDING_INGRESS_RULES_{SITE}_{ENV} or
+// PUDDING_INGRESS_RULES_{SITE}, and finally the given defaults.  The
+// managed security group shared by every build for the site and env
+// never takes the rules of the build that happens to create it.
+// Whichever rules apply, SSH may only be open to the world when the
+// build allows it.
+func IngressRulesFor(b *InstanceBuild, defaults []*IngressRule) ([]*IngressRule, error) {
+	rules, err := ingressRulesFor(b, defaults)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, rule := range rules {
+		if rule.IsWorldOpenSSH() && (!b.AllowWorldOpenSSH || b.ManagedSecurityGroup) {
+			return nil, errWorldOpenSSH
+		}
+	}
+
+	return rules, nil
+}
+
+func ingressRulesFor(b *InstanceBuild, defaults []*IngressRule) ([]*IngressRule, error) {
+	if len(b.IngressRules) > 0 && !b.ManagedSecurityGroup {
+		return b.IngressRules, nil
+	}
+
+	envFor := MakeInstanceBuildEnvForFunc(b)
+	for _, filters := range [][]string{{"site", "env"}, {"site"}} {
+		if v := envFor("PUDDING_INGRESS_RULES", filters...); v != "" {
+			return ParseIngressRules(v)
+		}
+	}
+
+	return defaults, nil
+}
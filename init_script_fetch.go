@@ -0,0 +1,19 @@
+package pudding
+
+// InitScriptFetchesCollection is the collection representation used
+// in jsonapi bodies
+type InitScriptFetchesCollection struct {
+	InitScriptFetches []*InitScriptFetch `json:"init_script_fetches"`
+}
+
+// InitScriptFetch is the audit record of an attempt to fetch the init
+// script for an instance build, whether allowed or not
+type InitScriptFetch struct {
+	InstanceBuildID string `json:"instance_build_id"`
+	InstanceID      string `json:"instance_id,omitempty"`
+	IP              string `json:"ip"`
+	UserAgent       string `json:"user_agent,omitempty"`
+	Auth            string `json:"auth"`
+	Allowed         bool   `json:"allowed"`
+	FetchedAt       int64  `json:"fetched_at"`
+}
@@ -14,4 +14,16 @@ type Instance struct {
 	Site          string `json:"site" redis:"site"`
 	Role          string `json:"role" redis:"role"`
 	ExpectedState string `json:"expected_state,omitempty" redis:"expected_state"`
+	Market        string `json:"market,omitempty" redis:"market"`
+	// RequestedSpotMaxPrice is the maximum price the spot instance was
+	// requested with, not the price it was launched at
+	RequestedSpotMaxPrice string `json:"requested_spot_max_price,omitempty" redis:"requested_spot_max_price"`
+	Canary                bool   `json:"canary,omitempty" redis:"canary"`
+	BuildID               string `json:"build_id,omitempty" redis:"build_id"`
+	Region                string `json:"region,omitempty" redis:"region"`
+	BuildTeam             string `json:"build_team,omitempty" redis:"build_team"`
+	ExpiresAt             int64  `json:"expires_at,omitempty" redis:"expires_at"`
+	SlackChannel          string `json:"slack_channel,omitempty" redis:"slack_channel"`
+
+	Tags map[string]string `json:"tags,omitempty" redis:"-"`
 }
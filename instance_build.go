@@ -8,6 +8,13 @@ import (
 	"github.com/gorilla/feeds"
 )
 
+const (
+	// MarketOnDemand is the market for regular on-demand instances
+	MarketOnDemand = "on-demand"
+	// MarketSpot is the market for spot instances
+	MarketSpot = "spot"
+)
+
 // InstanceBuildsCollectionSingular is the singular representation
 // used in jsonapi bodies
 type InstanceBuildsCollectionSingular struct {
@@ -24,12 +31,15 @@ type InstanceBuildsCollection struct {
 // to build the instance
 type InstanceBuild struct {
 	Role            string `json:"role,omitempty"`
+	Region          string `json:"region,omitempty"`
 	Site            string `json:"site"`
 	Env             string `json:"env"`
 	AMI             string `json:"ami"`
 	InstanceID      string `json:"instance_id,omitempty"`
 	NameTemplate    string `json:"name_template,omitempty"`
 	InstanceType    string `json:"instance_type"`
+	Market          string `json:"market,omitempty"`
+	SpotMaxPrice    string `json:"spot_max_price,omitempty"`
 	SlackChannel    string `json:"slack_channel"`
 	Count           int    `json:"count"`
 	Queue           string `json:"queue"`
@@ -39,6 +49,41 @@ type InstanceBuild struct {
 	State           string `json:"state,omitempty"`
 	ID              string `json:"id,omitempty"`
 	BootInstance    bool   `json:"boot_instance"`
+	Canary          bool   `json:"canary,omitempty"`
+
+	// TTL is the number of seconds after which the instance is
+	// terminated, which the server turns into ExpiresAt, the unix time
+	// at which it is terminated.  At most one of them may be given.
+	TTL       int   `json:"ttl,omitempty"`
+	ExpiresAt int64 `json:"expires_at,omitempty"`
+
+	// Team is the team whose token requested the build, which is set
+	// by the server and tagged on the instance to count it against the
+	// team's quotas
+	Team string `json:"team,omitempty"`
+
+	// ManagedSecurityGroup means that the instance should use the
+	// security group shared by all builds for the site and env rather
+	// than one of its own when SecurityGroupID is empty
+	ManagedSecurityGroup bool `json:"managed_security_group,omitempty"`
+
+	// InstanceTypes are acceptable alternatives to InstanceType, tried
+	// in order when there is no capacity for the preceding type
+	InstanceTypes []string `json:"instance_types,omitempty"`
+
+	// OnDemandFallback means that a spot build should try every
+	// candidate instance type again on-demand when there is no spot
+	// capacity for any of them, rather than fail
+	OnDemandFallback bool `json:"on_demand_fallback,omitempty"`
+
+	// IngressRules are the inbound rules for the security group created
+	// for the build, overriding any configured for the site and env
+	IngressRules      []*IngressRule `json:"ingress_rules,omitempty"`
+	AllowWorldOpenSSH bool           `json:"allow_world_open_ssh,omitempty"`
+
+	// Tags are applied to the instance in addition to those set by
+	// pudding itself
+	Tags map[string]string `json:"tags,omitempty"`
 }
 
 // NewInstanceBuild creates a new *InstanceBuild, along with
@@ -64,6 +109,10 @@ func (b *InstanceBuild) Hydrate() {
 	if b.NameTemplate == "" {
 		b.NameTemplate = "{{.Role}}-{{.Site}}-{{.Env}}-{{.Queue}}-{{.InstanceIDWithoutPrefix}}"
 	}
+
+	if b.Market == "" {
+		b.Market = MarketOnDemand
+	}
 }
 
 // Validate performs multiple validity checks and returns a slice
@@ -91,38 +140,80 @@ func (b *InstanceBuild) Validate() []error {
 	if b.Count < 1 {
 		errors = append(errors, errInvalidInstanceCount)
 	}
+	if b.Market != "" && b.Market != MarketOnDemand && b.Market != MarketSpot {
+		errors = append(errors, errInvalidMarket)
+	}
+	if b.Region != "" && !IsValidRegion(b.Region) {
+		errors = append(errors, errInvalidRegion)
+	}
+	if b.TTL < 0 || b.ExpiresAt < 0 || (b.TTL > 0 && b.ExpiresAt > 0) {
+		errors = append(errors, errInvalidTTL)
+	}
+	errors = append(errors, ValidateTags(b.Tags)...)
+	for _, rule := range b.IngressRules {
+		errors = append(errors, rule.Validate()...)
+		if rule.IsWorldOpenSSH() && !b.AllowWorldOpenSSH {
+			errors = append(errors, errWorldOpenSSH)
+		}
+	}
+	if b.ManagedSecurityGroup && len(b.IngressRules) > 0 {
+		errors = append(errors, errManagedSecurityGroupIngressRules)
+	}
 
 	return errors
 }
 
+// CandidateInstanceTypes returns InstanceType followed by any
+// InstanceTypes not already seen, in the order they should be tried
+func (b *InstanceBuild) CandidateInstanceTypes() []string {
+	seen := map[string]bool{}
+	types := []string{}
+
+	for _, t := range append([]string{b.InstanceType}, b.InstanceTypes...) {
+		if t == "" || seen[t] {
+			continue
+		}
+		seen[t] = true
+		types = append(types, t)
+	}
+
+	return types
+}
+
 // InstanceIDWithoutPrefix returns the InstanceID without "i-"
 func (b *InstanceBuild) InstanceIDWithoutPrefix() string {
 	return strings.TrimPrefix(b.InstanceID, "i-")
 }
 
+// KeyFor suffixes the key with the upcased values of the given build
+// attributes, e.g. KeyFor(`API_HOSTNAME`, `site`, `env`) => `API_HOSTNAME_ORG_PROD`
+func (b *InstanceBuild) KeyFor(key string, filters ...string) string {
+	for _, filter := range filters {
+		v := ""
+		switch filter {
+		case "site":
+			v = b.Site
+		case "env":
+			v = b.Env
+		case "queue":
+			v = b.Queue
+		case "role":
+			v = b.Role
+		}
+
+		if v == "" {
+			continue
+		}
+
+		key = fmt.Sprintf("%s_%s", key, strings.ToUpper(v))
+	}
+	return key
+}
+
 // MakeInstanceBuildEnvForFunc creates a function that provides a func suitable for template.Funcs that looks up an env var *for*
 // something or somethings, e.g.: {{ env_for `API_HOSTNAME` `site` `env` }} => os.Getenv(`API_HOSTNAME_ORG_PROD`)
 func MakeInstanceBuildEnvForFunc(b *InstanceBuild) func(string, ...string) string {
 	return func(key string, filters ...string) string {
-		for _, filter := range filters {
-			v := ""
-			switch filter {
-			case "site":
-				v = b.Site
-			case "env":
-				v = b.Env
-			case "queue":
-				v = b.Queue
-			case "role":
-				v = b.Role
-			}
-
-			if v == "" {
-				continue
-			}
-
-			key = fmt.Sprintf("%s_%s", key, strings.ToUpper(v))
-		}
-		return os.Getenv(key)
+		return os.Getenv(b.KeyFor(key, filters...))
 	}
 }
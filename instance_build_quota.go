@@ -0,0 +1,124 @@
+package pudding
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// InstanceBuildQuota limits the instance builds within its scope of
+// team, site, env, and queue, any of which may be empty to match all
+// of them.  Zero limits and empty instance types are unlimited.
+type InstanceBuildQuota struct {
+	Team  string `json:"team,omitempty"`
+	Site  string `json:"site,omitempty"`
+	Env   string `json:"env,omitempty"`
+	Queue string `json:"queue,omitempty"`
+
+	// MaxInstances is the most instances that may be running or
+	// pending at once
+	MaxInstances int `json:"max_instances,omitempty"`
+	// MaxLaunchesPerHour is the most instances that may be requested
+	// within any hour
+	MaxLaunchesPerHour int `json:"max_launches_per_hour,omitempty"`
+	// InstanceTypes are the only instance types that may be requested
+	InstanceTypes []string `json:"instance_types,omitempty"`
+}
+
+// ParseInstanceBuildQuotas parses a JSON array of quotas, with an
+// empty string resulting in no quotas
+func ParseInstanceBuildQuotas(s string) ([]*InstanceBuildQuota, error) {
+	quotas := []*InstanceBuildQuota{}
+	if strings.TrimSpace(s) == "" {
+		return quotas, nil
+	}
+
+	err := json.Unmarshal([]byte(s), &quotas)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, q := range quotas {
+		if q.MaxInstances < 0 || q.MaxLaunchesPerHour < 0 {
+			return nil, errInvalidInstanceBuildQuota
+		}
+	}
+
+	return quotas, nil
+}
+
+// Matches returns whether the instance build requested by the team
+// falls within the scope of the quota
+func (q *InstanceBuildQuota) Matches(team string, b *InstanceBuild) bool {
+	for _, pair := range [][2]string{
+		{q.Team, team},
+		{q.Site, b.Site},
+		{q.Env, b.Env},
+		{q.Queue, b.Queue},
+	} {
+		if pair[0] != "" && pair[0] != pair[1] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Scope describes what the quota applies to, e.g.
+// "team=ci site=org env=* queue=*"
+func (q *InstanceBuildQuota) Scope() string {
+	parts := []string{}
+	for _, pair := range [][2]string{
+		{"team", q.Team},
+		{"site", q.Site},
+		{"env", q.Env},
+		{"queue", q.Queue},
+	} {
+		value := pair[1]
+		if value == "" {
+			value = "*"
+		}
+		parts = append(parts, fmt.Sprintf("%s=%s", pair[0], value))
+	}
+
+	return strings.Join(parts, " ")
+}
+
+// InstanceFilters returns the instance filters matching the scope
+func (q *InstanceBuildQuota) InstanceFilters() map[string]string {
+	f := map[string]string{}
+	for key, value := range map[string]string{
+		"build_team": q.Team,
+		"site":       q.Site,
+		"env":        q.Env,
+		"queue":      q.Queue,
+	} {
+		if value != "" {
+			f[key] = value
+		}
+	}
+
+	return f
+}
+
+// DisallowedInstanceTypes returns the instance types requested by the
+// build which are not allowed by the quota
+func (q *InstanceBuildQuota) DisallowedInstanceTypes(b *InstanceBuild) []string {
+	if len(q.InstanceTypes) == 0 {
+		return []string{}
+	}
+
+	allowed := map[string]bool{}
+	for _, instanceType := range q.InstanceTypes {
+		allowed[instanceType] = true
+	}
+
+	disallowed := []string{}
+	for _, instanceType := range append([]string{b.InstanceType}, b.InstanceTypes...) {
+		if !allowed[instanceType] {
+			disallowed = append(disallowed, instanceType)
+		}
+	}
+
+	return disallowed
+}
@@ -0,0 +1,146 @@
+package pudding
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"strings"
+)
+
+// InstanceIdentityRequest is what an instance sends when checking in,
+// being its EC2 instance identity document and the signature of it,
+// as served at
+// http://169.254.169.254/latest/dynamic/instance-identity/{document,signature}
+type InstanceIdentityRequest struct {
+	Document  string `json:"document"`
+	Signature string `json:"signature"`
+}
+
+// InstanceIdentityDocument is the part of the EC2 instance identity
+// document used by pudding
+type InstanceIdentityDocument struct {
+	InstanceID   string `json:"instanceId"`
+	AccountID    string `json:"accountId"`
+	Region       string `json:"region"`
+	ImageID      string `json:"imageId"`
+	InstanceType string `json:"instanceType"`
+	PendingTime  string `json:"pendingTime"`
+}
+
+// InstanceIdentitiesCollection is the collection representation used
+// in jsonapi bodies
+type InstanceIdentitiesCollection struct {
+	InstanceIdentities []*InstanceIdentity `json:"instance_identities"`
+}
+
+// InstanceIdentity is the per-instance credential issued when an
+// instance checks in, of which only the hash of the token is kept
+type InstanceIdentity struct {
+	InstanceID      string `json:"instance_id" redis:"instance_id"`
+	InstanceBuildID string `json:"instance_build_id" redis:"instance_build_id"`
+	AccountID       string `json:"account_id,omitempty" redis:"account_id"`
+	Region          string `json:"region,omitempty" redis:"region"`
+	Verified        bool   `json:"verified" redis:"verified"`
+	IssuedAt        int64  `json:"issued_at" redis:"issued_at"`
+	Token           string `json:"token,omitempty" redis:"-"`
+	TokenHash       string `json:"-" redis:"token_hash"`
+}
+
+// ParseInstanceIdentityCerts parses the PEM-encoded AWS certificates
+// used to verify instance identity document signatures, which differ
+// by region
+func ParseInstanceIdentityCerts(pemString string) ([]*x509.Certificate, error) {
+	certs := []*x509.Certificate{}
+	rest := []byte(strings.TrimSpace(pemString))
+
+	for len(rest) > 0 {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			return nil, errInvalidInstanceIdentityCert
+		}
+
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+
+		if _, ok := cert.PublicKey.(*rsa.PublicKey); !ok {
+			return nil, errInvalidInstanceIdentityCert
+		}
+
+		certs = append(certs, cert)
+	}
+
+	return certs, nil
+}
+
+// ParseInstanceIdentityAccounts parses the comma-delimited 12-digit
+// ids of the AWS accounts whose instances may check in
+func ParseInstanceIdentityAccounts(s string) (map[string]bool, error) {
+	accounts := map[string]bool{}
+
+	for _, accountID := range strings.Split(s, ",") {
+		accountID = strings.TrimSpace(accountID)
+		if accountID == "" {
+			continue
+		}
+
+		if len(accountID) != 12 || strings.Trim(accountID, "0123456789") != "" {
+			return nil, fmt.Errorf("invalid account id %q", accountID)
+		}
+		accounts[accountID] = true
+	}
+
+	return accounts, nil
+}
+
+// ParseInstanceIdentityDocument parses an instance identity document
+// without verifying it
+func ParseInstanceIdentityDocument(document string) (*InstanceIdentityDocument, error) {
+	doc := &InstanceIdentityDocument{}
+	err := json.Unmarshal([]byte(document), doc)
+	if err != nil {
+		return nil, err
+	}
+
+	if doc.InstanceID == "" {
+		return nil, errEmptyInstanceID
+	}
+
+	return doc, nil
+}
+
+// VerifyInstanceIdentityDocument checks the base64-encoded SHA256 RSA
+// signature of an instance identity document against the given
+// certificates before parsing it
+func VerifyInstanceIdentityDocument(document, signature string, certs []*x509.Certificate) (*InstanceIdentityDocument, error) {
+	sig, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(signature), ""))
+	if err != nil {
+		return nil, errInvalidInstanceIdentitySignature
+	}
+
+	digest := sha256.Sum256([]byte(document))
+
+	for _, cert := range certs {
+		err = rsa.VerifyPKCS1v15(cert.PublicKey.(*rsa.PublicKey), crypto.SHA256, digest[:], sig)
+		if err == nil {
+			return ParseInstanceIdentityDocument(document)
+		}
+	}
+
+	return nil, errInvalidInstanceIdentitySignature
+}
+
+// HashInstanceToken returns the hex-encoded SHA256 hash of an
+// instance token, which is what gets stored
+func HashInstanceToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,47 @@
+package pudding
+
+import (
+	"strings"
+	"time"
+)
+
+// InstanceLifecycleAction is the internal representation of a pending
+// autoscaling lifecycle action for an instance
+type InstanceLifecycleAction struct {
+	InstanceID           string `json:"instance_id"`
+	Transition           string `json:"transition"`
+	AutoScalingGroupName string `json:"auto_scaling_group_name"`
+	LifecycleHookName    string `json:"lifecycle_hook_name"`
+	LifecycleActionToken string `json:"lifecycle_action_token"`
+	StoredAt             int64  `json:"stored_at,omitempty"`
+	HeartbeatAt          int64  `json:"heartbeat_at,omitempty"`
+	Age                  int64  `json:"age"`
+}
+
+// NewInstanceLifecycleAction builds an *InstanceLifecycleAction from a
+// stored *AutoscalingLifecycleAction, calculating the age in seconds
+// relative to the given time
+func NewInstanceLifecycleAction(a *AutoscalingLifecycleAction, now time.Time) *InstanceLifecycleAction {
+	ila := &InstanceLifecycleAction{
+		InstanceID:           a.EC2InstanceID,
+		Transition:           LifecycleTransitionName(a.LifecycleTransition),
+		AutoScalingGroupName: a.AutoScalingGroupName,
+		LifecycleHookName:    a.LifecycleHookName,
+		LifecycleActionToken: a.LifecycleActionToken,
+		StoredAt:             a.StoredAt,
+		HeartbeatAt:          a.HeartbeatAt,
+	}
+
+	if a.StoredAt > 0 {
+		ila.Age = now.Unix() - a.StoredAt
+	}
+
+	return ila
+}
+
+// LifecycleTransitionName converts an autoscaling lifecycle transition
+// such as "autoscaling:EC2_INSTANCE_LAUNCHING" into the short form used
+// throughout pudding, e.g. "launching"
+func LifecycleTransitionName(lifecycleTransition string) string {
+	return strings.ToLower(strings.Replace(lifecycleTransition, "autoscaling:EC2_INSTANCE_", "", 1))
+}
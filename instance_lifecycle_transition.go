@@ -1,8 +1,70 @@
 package pudding
 
+import "strings"
+
+const (
+	// LifecycleActionResultContinue is the lifecycle action result that
+	// allows an autoscaling group to proceed with a transition
+	LifecycleActionResultContinue = "CONTINUE"
+	// LifecycleActionResultAbandon is the lifecycle action result that
+	// causes an autoscaling group to give up on an instance
+	LifecycleActionResultAbandon = "ABANDON"
+)
+
+var (
+	// InstanceLifecycleTransitions are the transitions for which
+	// pending lifecycle actions are tracked
+	InstanceLifecycleTransitions = []string{"launching", "terminating"}
+)
+
 // InstanceLifecycleTransition is an event received from instances when launching and terminating
 type InstanceLifecycleTransition struct {
 	ID         string `json:"id,omitempty"`
 	InstanceID string `json:"instance_id"`
 	Transition string `json:"transition"`
+	Result     string `json:"result,omitempty"`
+}
+
+// Hydrate is used to overwrite "null" defaults that result from
+// serialize/deserialize via JSON
+func (t *InstanceLifecycleTransition) Hydrate() {
+	t.Result = strings.ToUpper(strings.TrimSpace(t.Result))
+	if t.Result == "" {
+		t.Result = LifecycleActionResultContinue
+	}
+}
+
+// Validate performs multiple validity checks and returns a slice
+// of all errors found
+func (t *InstanceLifecycleTransition) Validate() []error {
+	errors := []error{}
+	if t.InstanceID == "" {
+		errors = append(errors, errEmptyInstanceID)
+	}
+	if !IsValidInstanceLifecycleTransition(t.Transition) {
+		errors = append(errors, errInvalidTransition)
+	}
+	if !IsValidLifecycleActionResult(t.Result) {
+		errors = append(errors, errInvalidLifecycleActionResult)
+	}
+
+	return errors
+}
+
+// IsValidInstanceLifecycleTransition checks if the given string is one
+// of the InstanceLifecycleTransitions
+func IsValidInstanceLifecycleTransition(transition string) bool {
+	for _, t := range InstanceLifecycleTransitions {
+		if t == transition {
+			return true
+		}
+	}
+
+	return false
+}
+
+// IsValidLifecycleActionResult checks if the given string is a result
+// accepted by CompleteLifecycleAction
+func IsValidLifecycleActionResult(result string) bool {
+	return result == LifecycleActionResultContinue || result == LifecycleActionResultAbandon
 }
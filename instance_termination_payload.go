@@ -1,10 +1,13 @@
 package pudding
 
 // InstanceTerminationPayload is the representation used when
-// enqueueing an instance termination to the background workers
+// enqueueing an instance termination to the background workers, where
+// AccountID and Region locate instances pudding has no record of
 type InstanceTerminationPayload struct {
 	JID          string `json:"jid,omitempty"`
 	Retry        bool   `json:"retry,omitempty"`
 	InstanceID   string `json:"instance_id"`
 	SlackChannel string `json:"slack_channel"`
+	AccountID    string `json:"account_id,omitempty"`
+	Region       string `json:"region,omitempty"`
 }
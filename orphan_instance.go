@@ -0,0 +1,78 @@
+package pudding
+
+const (
+	// OrphanKindUntagged is an instance pudding launched which has
+	// since lost the tags by which it is synced
+	OrphanKindUntagged = "untagged"
+
+	// OrphanKindUnknownBuild is an instance tagged with a build_id of
+	// which pudding has no record
+	OrphanKindUnknownBuild = "unknown-build"
+
+	// OrphanKindMissing is an instance pudding launched for a build
+	// which never appeared in EC2
+	OrphanKindMissing = "missing"
+
+	// OrphanActionReport leaves orphans be, OrphanActionAdopt tags or
+	// records them so that pudding knows them again, and
+	// OrphanActionTerminate gets rid of them
+	OrphanActionReport    = "report"
+	OrphanActionAdopt     = "adopt"
+	OrphanActionTerminate = "terminate"
+)
+
+// IsValidOrphanAction checks if the given string is one of the
+// OrphanAction* consts
+func IsValidOrphanAction(action string) bool {
+	return action == OrphanActionReport || action == OrphanActionAdopt || action == OrphanActionTerminate
+}
+
+// InstanceLaunchRecord is what pudding remembers of each instance it
+// launched, by which instances in EC2 are reconciled
+type InstanceLaunchRecord struct {
+	InstanceID      string `json:"instance_id" redis:"instance_id"`
+	InstanceBuildID string `json:"instance_build_id" redis:"instance_build_id"`
+	AccountID       string `json:"account_id,omitempty" redis:"account_id"`
+	Region          string `json:"region,omitempty" redis:"region"`
+	Role            string `json:"role" redis:"role"`
+	Site            string `json:"site" redis:"site"`
+	Env             string `json:"env" redis:"env"`
+	Queue           string `json:"queue" redis:"queue"`
+	LaunchedAt      int64  `json:"launched_at" redis:"launched_at"`
+	SeenAt          int64  `json:"seen_at,omitempty" redis:"seen_at"`
+}
+
+// Tags returns the tags by which the instance is synced
+func (rec *InstanceLaunchRecord) Tags() map[string]string {
+	return map[string]string{
+		"role":     rec.Role,
+		"site":     rec.Site,
+		"env":      rec.Env,
+		"queue":    rec.Queue,
+		"build_id": rec.InstanceBuildID,
+	}
+}
+
+// OrphanInstanceReport is the outcome of reconciling the instances in
+// EC2 against those pudding launched
+type OrphanInstanceReport struct {
+	RunAt       int64             `json:"run_at"`
+	Action      string            `json:"action"`
+	GracePeriod int               `json:"grace_period"`
+	Orphans     []*OrphanInstance `json:"orphans"`
+}
+
+// OrphanInstance is one instance found during reconciliation, where
+// Kind is one of the OrphanKind* consts and Action is one of
+// "reported", "adopted", "terminating", or "failed", with Error saying
+// why an orphan wasn't terminated or why acting on it failed
+type OrphanInstance struct {
+	Kind            string `json:"kind"`
+	InstanceID      string `json:"instance_id"`
+	InstanceBuildID string `json:"instance_build_id,omitempty"`
+	AccountID       string `json:"account_id,omitempty"`
+	Region          string `json:"region,omitempty"`
+	LaunchedAt      int64  `json:"launched_at,omitempty"`
+	Action          string `json:"action"`
+	Error           string `json:"error,omitempty"`
+}
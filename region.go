@@ -0,0 +1,79 @@
+package pudding
+
+import (
+	"fmt"
+	"strings"
+)
+
+var (
+	// KnownRegions are the names of the AWS regions that may be given
+	// for builds and in worker configuration
+	KnownRegions = []string{
+		"ap-east-1",
+		"ap-northeast-1",
+		"ap-northeast-2",
+		"ap-northeast-3",
+		"ap-south-1",
+		"ap-southeast-1",
+		"ap-southeast-2",
+		"ca-central-1",
+		"eu-central-1",
+		"eu-north-1",
+		"eu-south-1",
+		"eu-west-1",
+		"eu-west-2",
+		"eu-west-3",
+		"me-south-1",
+		"sa-east-1",
+		"us-east-1",
+		"us-east-2",
+		"us-west-1",
+		"us-west-2",
+	}
+)
+
+// IsValidRegion returns whether the given name is a known AWS region
+func IsValidRegion(name string) bool {
+	for _, region := range KnownRegions {
+		if region == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// RegionFromARN returns the region part of an ARN such as
+// "arn:aws:sns:us-east-1:123456789012:pudding", or "" if it has none
+func RegionFromARN(arn string) string {
+	parts := strings.Split(arn, ":")
+	if len(parts) < 4 || parts[0] != "arn" {
+		return ""
+	}
+
+	return parts[3]
+}
+
+// ParseRegions returns the set of the given region and the
+// comma-delimited regions besides it, all of which must be known
+func ParseRegions(region, regions string) (map[string]bool, error) {
+	if !IsValidRegion(region) {
+		return nil, fmt.Errorf("invalid region %q", region)
+	}
+
+	parsed := map[string]bool{region: true}
+
+	for _, name := range strings.Split(regions, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+
+		if !IsValidRegion(name) {
+			return nil, fmt.Errorf("invalid region %q", name)
+		}
+		parsed[name] = true
+	}
+
+	return parsed, nil
+}
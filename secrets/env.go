@@ -0,0 +1,25 @@
+package secrets
+
+import "os"
+
+// Env looks up secrets in the process environment
+type Env struct{}
+
+// NewEnv creates a new *Env
+func NewEnv() *Env {
+	return &Env{}
+}
+
+// Name is "env"
+func (e *Env) Name() string {
+	return "env"
+}
+
+// Get returns the env var named by the key
+func (e *Env) Get(key string) (string, error) {
+	v, ok := os.LookupEnv(key)
+	if !ok {
+		return "", ErrNotFound
+	}
+	return v, nil
+}
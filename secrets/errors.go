@@ -0,0 +1,8 @@
+package secrets
+
+import "fmt"
+
+var (
+	errMissingKeyring  = fmt.Errorf("encryption keys are required for secrets files")
+	errUnencryptedFile = fmt.Errorf("secrets file is not encrypted")
+)
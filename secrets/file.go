@@ -0,0 +1,80 @@
+package secrets
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"strings"
+
+	"github.com/travis-ci/pudding"
+)
+
+// fileEncryptionContext is what secrets files are encrypted for, so
+// that they can't be swapped with other encrypted values
+const fileEncryptionContext = "secrets-file"
+
+// File looks up secrets in a JSON object of keys to values, encrypted
+// as a whole with a pudding.Keyring, which is read once when created
+type File struct {
+	path    string
+	secrets map[string]string
+}
+
+// NewFile reads and decrypts the secrets file at path
+func NewFile(path string, kr *pudding.Keyring) (*File, error) {
+	if kr == nil {
+		return nil, errMissingKeyring
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	value := strings.TrimSpace(string(b))
+	if !strings.HasPrefix(value, pudding.EncryptedValuePrefix) {
+		return nil, errUnencryptedFile
+	}
+
+	plaintext, err := kr.Decrypt(value, fileEncryptionContext)
+	if err != nil {
+		return nil, err
+	}
+
+	f := &File{path: path, secrets: map[string]string{}}
+	err = json.Unmarshal([]byte(plaintext), &f.secrets)
+	if err != nil {
+		return nil, err
+	}
+
+	return f, nil
+}
+
+// EncryptFileContents encrypts a JSON object of keys to values in the
+// form read by NewFile
+func EncryptFileContents(secretsJSON []byte, kr *pudding.Keyring) (string, error) {
+	if kr == nil {
+		return "", errMissingKeyring
+	}
+
+	secrets := map[string]string{}
+	err := json.Unmarshal(secretsJSON, &secrets)
+	if err != nil {
+		return "", err
+	}
+
+	return kr.Encrypt(string(secretsJSON), fileEncryptionContext)
+}
+
+// Name is "file"
+func (f *File) Name() string {
+	return "file"
+}
+
+// Get returns the value of the key in the file
+func (f *File) Get(key string) (string, error) {
+	v, ok := f.secrets[key]
+	if !ok {
+		return "", ErrNotFound
+	}
+	return v, nil
+}
@@ -0,0 +1,53 @@
+// Package secrets is the pluggable source of the secrets rendered into
+// init scripts, with providers backed by the environment, an encrypted
+// file, or a Vault-compatible HTTP store.
+package secrets
+
+import (
+	"fmt"
+	"strings"
+)
+
+var (
+	// ErrNotFound is returned by providers for keys they don't have
+	ErrNotFound = fmt.Errorf("secret not found")
+)
+
+// Provider looks up secrets by key, e.g. "RSA_KEY_ORG_PROD"
+type Provider interface {
+	Name() string
+	Get(key string) (string, error)
+}
+
+// Allowlist is the set of keys that may be looked up, where entries
+// ending in "*" match any key with the preceding prefix
+type Allowlist []string
+
+// ParseAllowlist parses a comma-delimited list of keys and prefixes
+func ParseAllowlist(s string) Allowlist {
+	al := Allowlist{}
+	for _, entry := range strings.Split(s, ",") {
+		if entry = strings.TrimSpace(entry); entry != "" {
+			al = append(al, entry)
+		}
+	}
+	return al
+}
+
+// Allows returns whether the key may be looked up
+func (al Allowlist) Allows(key string) bool {
+	for _, entry := range al {
+		if strings.HasSuffix(entry, "*") {
+			if strings.HasPrefix(key, strings.TrimSuffix(entry, "*")) {
+				return true
+			}
+			continue
+		}
+
+		if entry == key {
+			return true
+		}
+	}
+
+	return false
+}
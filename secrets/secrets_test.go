@@ -0,0 +1,121 @@
+package secrets
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/travis-ci/pudding"
+)
+
+func TestAllowlist(t *testing.T) {
+	al := ParseAllowlist(" RSA_KEY_* , API_HOSTNAME,,")
+
+	for key, allowed := range map[string]bool{
+		"RSA_KEY_ORG_PROD":      true,
+		"RSA_KEY":               false,
+		"API_HOSTNAME":          true,
+		"API_HOSTNAME_ORG_PROD": false,
+		"AWS_SECRET_ACCESS_KEY": false,
+	} {
+		if al.Allows(key) != allowed {
+			t.Errorf("expected Allows(%q) to be %v", key, allowed)
+		}
+	}
+}
+
+func TestVault(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("X-Vault-Token") != "swordfish" {
+			http.Error(w, `{"errors":["permission denied"]}`, http.StatusForbidden)
+			return
+		}
+
+		if req.URL.Path != "/v1/secret/data/pudding" {
+			http.Error(w, `{"errors":[]}`, http.StatusNotFound)
+			return
+		}
+
+		w.Write([]byte(`{"data":{"data":{"RSA_KEY_ORG_PROD":"sekrit"},"metadata":{"version":3}}}`))
+	}))
+	defer ts.Close()
+
+	v := NewVault(ts.URL+"/", "swordfish", "/secret/data/pudding")
+
+	value, err := v.Get("RSA_KEY_ORG_PROD")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if value != "sekrit" {
+		t.Fatalf("expected %q, got %q", "sekrit", value)
+	}
+
+	_, err = v.Get("RSA_KEY_COM_PROD")
+	if err != ErrNotFound {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+
+	_, err = NewVault(ts.URL, "swordfish", "secret/data/nope").Get("RSA_KEY_ORG_PROD")
+	if err != ErrNotFound {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+
+	_, err = NewVault(ts.URL, "nope", "secret/data/pudding").Get("RSA_KEY_ORG_PROD")
+	if err == nil || err == ErrNotFound {
+		t.Fatalf("expected an error for a bad token, got %v", err)
+	}
+}
+
+func TestFile(t *testing.T) {
+	kr, err := pudding.ParseKeyring("test:" + base64.StdEncoding.EncodeToString([]byte("pudding-secrets-test-key-32bytes")))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	contents, err := EncryptFileContents([]byte(`{"RSA_KEY_ORG_PROD":"sekrit"}`), kr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir("", "pudding-secrets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "secrets")
+	err = ioutil.WriteFile(path, []byte(contents+"\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := NewFile(path, kr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	value, err := f.Get("RSA_KEY_ORG_PROD")
+	if err != nil || value != "sekrit" {
+		t.Fatalf("expected %q, got %q (%v)", "sekrit", value, err)
+	}
+
+	_, err = f.Get("RSA_KEY_COM_PROD")
+	if err != ErrNotFound {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+
+	err = ioutil.WriteFile(path, []byte(`{"RSA_KEY_ORG_PROD":"sekrit"}`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = NewFile(path, kr)
+	if err != errUnencryptedFile {
+		t.Fatalf("expected plaintext files to be refused, got %v", err)
+	}
+}
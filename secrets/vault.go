@@ -0,0 +1,77 @@
+package secrets
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Vault looks up secrets as the fields of a single secret in a
+// Vault-compatible KV version 2 HTTP store, e.g. the fields of
+// "secret/data/pudding" at https://vault.example.com
+type Vault struct {
+	addr  string
+	token string
+	path  string
+	c     *http.Client
+}
+
+// NewVault creates a new *Vault for the secret at path, which includes
+// the mount and "data", e.g. "secret/data/pudding"
+func NewVault(addr, token, path string) *Vault {
+	return &Vault{
+		addr:  strings.TrimRight(addr, "/"),
+		token: token,
+		path:  strings.Trim(path, "/"),
+		c:     &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// Name is "vault"
+func (v *Vault) Name() string {
+	return "vault"
+}
+
+// Get returns the field of the secret named by the key, reading the
+// secret anew each time so that changes are picked up
+func (v *Vault) Get(key string) (string, error) {
+	req, err := http.NewRequest("GET", fmt.Sprintf("%s/v1/%s", v.addr, v.path), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-Vault-Token", v.token)
+
+	resp, err := v.c.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return "", ErrNotFound
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("vault responded %v for %s", resp.StatusCode, v.path)
+	}
+
+	body := &struct {
+		Data struct {
+			Data map[string]string `json:"data"`
+		} `json:"data"`
+	}{}
+
+	err = json.NewDecoder(resp.Body).Decode(body)
+	if err != nil {
+		return "", err
+	}
+
+	value, ok := body.Data.Data[key]
+	if !ok {
+		return "", ErrNotFound
+	}
+
+	return value, nil
+}
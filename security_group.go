@@ -0,0 +1,80 @@
+package pudding
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	// SecurityGroupNamePrefix is the prefix of the names of all
+	// security groups created by pudding
+	SecurityGroupNamePrefix = "pudding-"
+
+	managedSecurityGroupNamePrefix = SecurityGroupNamePrefix + "managed-"
+)
+
+// SecurityGroupGCReport is the outcome of a security group garbage
+// collection run
+type SecurityGroupGCReport struct {
+	RunAt           int64                    `json:"run_at"`
+	DryRun          bool                     `json:"dry_run"`
+	GracePeriod     int                      `json:"grace_period"`
+	Groups          []*SecurityGroupGCEntry  `json:"groups"`
+	LaunchTemplates []*LaunchTemplateGCEntry `json:"launch_templates"`
+}
+
+// SecurityGroupGCEntry is what happened to one security group during a
+// garbage collection run, where Action is one of "kept", "deleted",
+// "would-delete", or "failed"
+type SecurityGroupGCEntry struct {
+	ID        string `json:"id"`
+	Name      string `json:"name"`
+	Region    string `json:"region,omitempty"`
+	AccountID string `json:"account_id,omitempty"`
+	CreatedAt int64  `json:"created_at,omitempty"`
+	InUse     bool   `json:"in_use"`
+	Action    string `json:"action"`
+	Error     string `json:"error,omitempty"`
+}
+
+// LaunchTemplateGCEntry is what happened to the launch template of a
+// mixed-instances autoscaling group during a garbage collection run,
+// where Action is one of "deleted", "would-delete", or "failed"
+type LaunchTemplateGCEntry struct {
+	ID                   string `json:"id"`
+	Name                 string `json:"name"`
+	AutoscalingGroupName string `json:"auto_scaling_group_name"`
+	Region               string `json:"region,omitempty"`
+	AccountID            string `json:"account_id,omitempty"`
+	CreatedAt            int64  `json:"created_at,omitempty"`
+	Action               string `json:"action"`
+	Error                string `json:"error,omitempty"`
+}
+
+// ManagedSecurityGroupName returns the name of the security group
+// shared by all instance builds for a site and env
+func ManagedSecurityGroupName(site, env string) string {
+	return fmt.Sprintf("%s%s-%s", managedSecurityGroupNamePrefix, site, env)
+}
+
+// SecurityGroupCreatedAt extracts the creation time from the name of a
+// per-build security group, e.g. "pudding-1445385600-0xc820123456",
+// returning false for managed or otherwise unrecognized names
+func SecurityGroupCreatedAt(name string) (int64, bool) {
+	if !strings.HasPrefix(name, SecurityGroupNamePrefix) || strings.HasPrefix(name, managedSecurityGroupNamePrefix) {
+		return 0, false
+	}
+
+	parts := strings.Split(name, "-")
+	if len(parts) != 3 {
+		return 0, false
+	}
+
+	createdAt, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return 0, false
+	}
+
+	return createdAt, true
+}
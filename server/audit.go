@@ -0,0 +1,208 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/gorilla/mux"
+	"github.com/travis-ci/pudding"
+	"github.com/travis-ci/pudding/server/jsonapi"
+)
+
+const (
+	// jobIDHeader is set by handlers that enqueue a job, so that the
+	// job may be found in the audit log and by the client
+	jobIDHeader = "Pudding-Job-ID"
+
+	maxAuditBodyBytes       = 64 * 1024
+	maxAuditSummaryFields   = 20
+	maxAuditSummaryValueLen = 64
+)
+
+var (
+	auditRedactedKeyRegexp = regexp.MustCompile("(?i:auth|document|key|password|rsa|secret|signature|token|user_data)")
+	auditTargetVars        = []string{"instance_id", "image_id", "name", "role", "uuid", "approval_id"}
+)
+
+type auditResponseWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *auditResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *auditResponseWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// ifAudited records every call to a mutating route in the audit log,
+// whether allowed or not, along with who made it and what came of it
+func (srv *server) ifAudited(f func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if req.Method == "GET" || req.Method == "HEAD" {
+			f(w, req)
+			return
+		}
+
+		body, err := ioutil.ReadAll(io.LimitReader(req.Body, maxAuditBodyBytes))
+		if err != nil {
+			jsonapi.Error(w, err, http.StatusBadRequest)
+			return
+		}
+		req.Body = ioutil.NopCloser(io.MultiReader(bytes.NewReader(body), req.Body))
+
+		aw := &auditResponseWriter{ResponseWriter: w}
+		f(aw, req)
+
+		srv.recordAPICall(req, aw, body)
+	}
+}
+
+func (srv *server) recordAPICall(req *http.Request, aw *auditResponseWriter, body []byte) {
+	e := &pudding.AuditEntry{
+		Time:      time.Now().UTC().Unix(),
+		Source:    "api",
+		Actor:     auditActor(req),
+		Method:    req.Method,
+		Path:      req.URL.RequestURI(),
+		Target:    auditTarget(req),
+		Summary:   summarizeAuditBody(body),
+		RequestID: req.Header.Get("X-Request-ID"),
+		JobID:     aw.Header().Get(jobIDHeader),
+		Status:    aw.status,
+		Outcome:   pudding.AuditOutcomeOK,
+	}
+
+	if route := mux.CurrentRoute(req); route != nil {
+		e.Route = route.GetName()
+	}
+
+	switch {
+	case aw.status == http.StatusUnauthorized || aw.status == http.StatusForbidden:
+		e.Outcome = pudding.AuditOutcomeDenied
+	case aw.status >= 400:
+		e.Outcome = pudding.AuditOutcomeError
+	}
+
+	err := srv.al.Record(e)
+	if err != nil {
+		srv.log.WithFields(logrus.Fields{
+			"err":   err,
+			"route": e.Route,
+			"path":  e.Path,
+		}).Error("failed to record audit entry")
+	}
+}
+
+// auditActor identifies the caller by the kind of auth used, along
+// with the instance build or instance it is limited to
+func auditActor(req *http.Request) string {
+	switch req.Header.Get(internalAuthKindHeader) {
+	case authKindToken:
+		if team := req.Header.Get(internalTeamHeader); team != "" {
+			return fmt.Sprintf("token:%s", team)
+		}
+		return "token"
+	case authKindInstanceBuild:
+		return fmt.Sprintf("instance-build:%s", mux.Vars(req)["uuid"])
+	case authKindInstance:
+		return fmt.Sprintf("instance:%s", req.Header.Get(internalInstanceIDHeader))
+	case authKindApprover:
+		return fmt.Sprintf("approver:%s", req.Header.Get(internalApproverHeader))
+	}
+
+	return "anonymous"
+}
+
+func auditTarget(req *http.Request) string {
+	vars := mux.Vars(req)
+	for _, key := range auditTargetVars {
+		if v, ok := vars[key]; ok && v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// summarizeAuditBody flattens the scalar fields of a JSON body, up to
+// two levels deep, into a short "key=value" list with anything that
+// looks like a secret redacted
+func summarizeAuditBody(body []byte) string {
+	if len(bytes.TrimSpace(body)) == 0 {
+		return ""
+	}
+
+	var doc interface{}
+	err := json.Unmarshal(body, &doc)
+	if err != nil {
+		return fmt.Sprintf("(%d bytes, not json)", len(body))
+	}
+
+	fields := map[string]string{}
+	summarizeAuditValue(fields, "", doc, 0)
+
+	keys := []string{}
+	for key := range fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	parts := []string{}
+	for i, key := range keys {
+		if i >= maxAuditSummaryFields {
+			parts = append(parts, "...")
+			break
+		}
+		parts = append(parts, fmt.Sprintf("%s=%s", key, fields[key]))
+	}
+
+	return strings.Join(parts, " ")
+}
+
+func summarizeAuditValue(fields map[string]string, key string, value interface{}, depth int) {
+	if key != "" && auditRedactedKeyRegexp.MatchString(key) {
+		fields[key] = "[redacted]"
+		return
+	}
+
+	switch v := value.(type) {
+	case map[string]interface{}:
+		if depth >= 2 {
+			fields[key] = "{...}"
+			return
+		}
+		for subkey, subvalue := range v {
+			if key != "" {
+				subkey = key + "." + subkey
+			}
+			summarizeAuditValue(fields, subkey, subvalue, depth+1)
+		}
+	case []interface{}:
+		fields[key] = fmt.Sprintf("[%d]", len(v))
+	case nil:
+		fields[key] = "null"
+	default:
+		s := fmt.Sprintf("%v", v)
+		if len(s) > maxAuditSummaryValueLen {
+			s = s[:maxAuditSummaryValueLen] + "..."
+		}
+		fields[key] = s
+	}
+}
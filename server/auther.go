@@ -11,42 +11,87 @@ import (
 	"github.com/garyburd/redigo/redis"
 	"github.com/gorilla/feeds"
 	"github.com/gorilla/mux"
+	"github.com/travis-ci/pudding"
 	"github.com/travis-ci/pudding/db"
 )
 
 const (
-	internalAuthHeader = "Pudding-Internal-Is-Authorized"
+	internalAuthHeader       = "Pudding-Internal-Is-Authorized"
+	internalAuthKindHeader   = "Pudding-Internal-Auth-Kind"
+	internalInstanceIDHeader = "Pudding-Internal-Instance-ID"
+	internalTeamHeader       = "Pudding-Internal-Team"
+	internalApproverHeader   = "Pudding-Internal-Approver"
+
+	authKindToken         = "token"
+	authKindApprover      = "approver"
+	authKindInstanceBuild = "instance-build"
+	authKindInstance      = "instance"
 )
 
 var (
 	basicAuthValueRegexp = regexp.MustCompile("(?i:^basic[= ])")
-	uuidPathRegexp       = regexp.MustCompile("(?:instance-builds|instance-launches|instance-terminations|init-scripts)/(.*)")
+	uuidPathRegexp       = regexp.MustCompile("(?:instance-builds|instance-launches|instance-terminations|instance-heartbeats|instance-identities|init-scripts)/(.*)")
 )
 
 type serverAuther struct {
-	Token string
-	is    db.InstanceBuildAuther
-	log   *logrus.Logger
-	rt    string
+	Token          string
+	TeamTokens     pudding.TeamTokens
+	ApproverTokens pudding.TeamTokens
+	is             db.InitScriptAuther
+	ii             db.InstanceIdentityFetcherStorer
+	log            *logrus.Logger
+	rt             string
 }
 
-func newServerAuther(token string, r *redis.Pool, log *logrus.Logger) (*serverAuther, error) {
+func newServerAuther(token string, teamTokens, approverTokens pudding.TeamTokens, r *redis.Pool, log *logrus.Logger, kr *pudding.Keyring) (*serverAuther, error) {
 	sa := &serverAuther{
-		Token: token,
-		log:   log,
-		rt:    feeds.NewUUID().String(),
+		Token:          token,
+		TeamTokens:     teamTokens,
+		ApproverTokens: approverTokens,
+		log:            log,
+		rt:             feeds.NewUUID().String(),
 	}
 
-	is, err := db.NewInitScripts(r, log)
+	is, err := db.NewInitScripts(r, log, kr)
+	if err != nil {
+		return nil, err
+	}
+
+	ii, err := db.NewInstanceIdentities(r, log)
 	if err != nil {
 		return nil, err
 	}
 
 	sa.is = is
+	sa.ii = ii
 	return sa, nil
 }
 
+// Authenticate allows requests with the token or a team token, the instance build
+// basic auth creds, or the basic auth creds of an instance identity
+// issued to an instance booted from the instance build
 func (sa *serverAuther) Authenticate(w http.ResponseWriter, req *http.Request) bool {
+	return sa.authenticate(w, req, sa.is.HasValidAuth, true, false)
+}
+
+// AuthenticateApprover is Authenticate, additionally allowing requests
+// with an approver token
+func (sa *serverAuther) AuthenticateApprover(w http.ResponseWriter, req *http.Request) bool {
+	return sa.authenticate(w, req, sa.is.HasValidAuth, true, true)
+}
+
+// AuthenticateInitScript allows requests with the token or the init
+// script basic auth creds, using up one of the remaining uses of the
+// latter
+func (sa *serverAuther) AuthenticateInitScript(w http.ResponseWriter, req *http.Request) bool {
+	return sa.authenticate(w, req, sa.is.UseInitScriptAuth, false, false)
+}
+
+func (sa *serverAuther) authenticate(w http.ResponseWriter, req *http.Request, validAuth func(string, string) bool, allowInstance, allowApprover bool) bool {
+	for _, header := range []string{internalAuthHeader, internalAuthKindHeader, internalInstanceIDHeader, internalTeamHeader, internalApproverHeader} {
+		req.Header.Del(header)
+	}
+
 	vars := mux.Vars(req)
 
 	sa.log.WithFields(logrus.Fields{
@@ -63,13 +108,28 @@ func (sa *serverAuther) Authenticate(w http.ResponseWriter, req *http.Request) b
 	}
 
 	authHeader := req.Header.Get("Authorization")
-	sa.log.WithField("authorization", authHeader).Debug("raw authorization header")
 
-	if authHeader != "" && (sa.hasValidTokenAuth(authHeader) || sa.hasValidInstanceBuildBasicAuth(authHeader, instanceBuildID)) {
+	authKind, instanceID, name := "", "", ""
+	if authHeader != "" {
+		authKind, instanceID, name = sa.authKind(authHeader, instanceBuildID, validAuth, allowInstance, allowApprover)
+	}
+
+	if authKind != "" {
 		req.Header.Set(internalAuthHeader, sa.rt)
+		req.Header.Set(internalAuthKindHeader, authKind)
+		if instanceID != "" {
+			req.Header.Set(internalInstanceIDHeader, instanceID)
+		}
+		if authKind == authKindToken && name != "" {
+			req.Header.Set(internalTeamHeader, name)
+		}
+		if authKind == authKindApprover {
+			req.Header.Set(internalApproverHeader, name)
+		}
 		sa.log.WithFields(logrus.Fields{
 			"request_id":        req.Header.Get("X-Request-ID"),
 			"instance_build_id": instanceBuildID,
+			"auth_kind":         authKind,
 		}).Debug("allowing authorized request yey")
 		return true
 	}
@@ -88,8 +148,11 @@ func (sa *serverAuther) Authenticate(w http.ResponseWriter, req *http.Request) b
 }
 
 func (sa *serverAuther) hasValidTokenAuth(authHeader string) bool {
-	authHeaderBytes := []byte(authHeader)
-	if subtle.ConstantTimeCompare(authHeaderBytes, []byte("token "+sa.Token)) == 0 || subtle.ConstantTimeCompare(authHeaderBytes, []byte("token="+sa.Token)) == 0 {
+	if sa.Token == "" {
+		return false
+	}
+
+	if secretsMatch(authHeader, "token "+sa.Token) || secretsMatch(authHeader, "token="+sa.Token) {
 		sa.log.Debug("token auth matches yey")
 		return true
 	}
@@ -98,27 +161,94 @@ func (sa *serverAuther) hasValidTokenAuth(authHeader string) bool {
 	return false
 }
 
-func (sa *serverAuther) hasValidInstanceBuildBasicAuth(authHeader, instanceBuildID string) bool {
+// secretsMatch compares in constant time.  ConstantTimeCompare returns 1
+// for equal values and 0 otherwise, so anything but 1 is a mismatch.
+func secretsMatch(given, expected string) bool {
+	return subtle.ConstantTimeCompare([]byte(given), []byte(expected)) == 1
+}
+
+// teamTokenAuth returns the team whose token is given, if any
+func (sa *serverAuther) teamTokenAuth(authHeader string) string {
+	if !strings.HasPrefix(authHeader, "token ") && !strings.HasPrefix(authHeader, "token=") {
+		return ""
+	}
+
+	team := sa.TeamTokens.TeamFor(authHeader[len("token "):])
+	if team != "" {
+		sa.log.WithField("team", team).Debug("team token auth matches yey")
+	}
+	return team
+}
+
+// approverTokenAuth returns the approver whose token is given, if any
+func (sa *serverAuther) approverTokenAuth(authHeader string) string {
+	if !strings.HasPrefix(authHeader, "token ") && !strings.HasPrefix(authHeader, "token=") {
+		return ""
+	}
+
+	return sa.ApproverTokens.TeamFor(authHeader[len("token "):])
+}
+
+// authKind returns the kind of auth in the header, if valid, along
+// with the instance, team, or approver it belongs to, if any
+func (sa *serverAuther) authKind(authHeader, instanceBuildID string, validAuth func(string, string) bool, allowInstance, allowApprover bool) (string, string, string) {
+	if sa.hasValidTokenAuth(authHeader) {
+		return authKindToken, "", ""
+	}
+
+	if team := sa.teamTokenAuth(authHeader); team != "" {
+		return authKindToken, "", team
+	}
+
+	if allowApprover {
+		if approver := sa.approverTokenAuth(authHeader); approver != "" {
+			return authKindApprover, "", approver
+		}
+	}
+
+	user, pass, ok := sa.basicAuthParts(authHeader)
+	if !ok {
+		return "", "", ""
+	}
+
+	if allowInstance && strings.HasPrefix(user, "i-") {
+		sa.log.WithFields(logrus.Fields{
+			"instance_id":       user,
+			"instance_build_id": instanceBuildID,
+		}).Debug("checking instance identity basic auth against database")
+		if sa.ii.HasValidToken(user, instanceBuildID, pass) {
+			return authKindInstance, user, ""
+		}
+		return "", "", ""
+	}
+
+	sa.log.WithFields(logrus.Fields{
+		"instance_build_id": instanceBuildID,
+	}).Debug("checking basic auth against database")
+	if validAuth(instanceBuildID, pass) {
+		return authKindInstanceBuild, "", ""
+	}
+
+	return "", "", ""
+}
+
+func (sa *serverAuther) basicAuthParts(authHeader string) (string, string, bool) {
 	if !basicAuthValueRegexp.MatchString(authHeader) {
-		return false
+		return "", "", false
 	}
 
 	b64Auth := basicAuthValueRegexp.ReplaceAllString(authHeader, "")
 	decoded, err := base64.StdEncoding.DecodeString(b64Auth)
 	if err != nil {
 		sa.log.WithField("err", err).Error("failed to base64 decade basic auth header")
-		return false
+		return "", "", false
 	}
 
 	authParts := strings.Split(string(decoded), ":")
 	if len(authParts) != 2 {
 		sa.log.Error("basic auth does not contain two parts")
-		return false
+		return "", "", false
 	}
 
-	sa.log.WithFields(logrus.Fields{
-		"basic_auth":        authParts[1],
-		"instance_build_id": instanceBuildID,
-	}).Debug("checking basic auth against database")
-	return sa.is.HasValidAuth(instanceBuildID, authParts[1])
+	return authParts[0], authParts[1], true
 }
@@ -5,6 +5,7 @@ import (
 	"time"
 
 	"github.com/garyburd/redigo/redis"
+	"github.com/gorilla/feeds"
 	"github.com/travis-ci/pudding"
 	"github.com/travis-ci/pudding/db"
 )
@@ -22,23 +23,22 @@ func newAutoscalingGroupBuilder(r *redis.Pool, queueName string) (*autoscalingGr
 	}, nil
 }
 
-func (asgb *autoscalingGroupBuilder) Build(b *pudding.AutoscalingGroupBuild) (*pudding.AutoscalingGroupBuild, error) {
+func (asgb *autoscalingGroupBuilder) Build(b *pudding.AutoscalingGroupBuild) (string, error) {
 	conn := asgb.r.Get()
 	defer func() { _ = conn.Close() }()
 
 	buildPayload := &pudding.AutoscalingGroupBuildPayload{
 		Args:       []*pudding.AutoscalingGroupBuild{b},
 		Queue:      asgb.QueueName,
-		JID:        b.ID,
+		JID:        feeds.NewUUID().String(),
 		Retry:      false,
 		EnqueuedAt: float64(time.Now().UTC().Unix()),
 	}
 
 	buildPayloadJSON, err := json.Marshal(buildPayload)
 	if err != nil {
-		return nil, err
+		return "", err
 	}
 
-	err = db.EnqueueJob(conn, asgb.QueueName, string(buildPayloadJSON))
-	return b, err
+	return buildPayload.JID, db.EnqueueJob(conn, asgb.QueueName, string(buildPayloadJSON))
 }
@@ -6,6 +6,23 @@ type Config struct {
 	AuthToken string
 	Debug     bool
 
+	// TeamTokens are the auth tokens of teams, as parsed by
+	// pudding.ParseTeamTokens
+	TeamTokens string
+	// InstanceBuildQuotas limit the instance builds per team, site,
+	// env, and queue, as parsed by pudding.ParseInstanceBuildQuotas
+	InstanceBuildQuotas string
+	// ApprovalPolicies mark the instance builds that are held until
+	// approved, as parsed by pudding.ParseApprovalPolicies
+	ApprovalPolicies string
+	// ApproverTokens are the auth tokens of whoever may decide
+	// approvals, as parsed by pudding.ParseTeamTokens, which are
+	// required with ApprovalPolicies
+	ApproverTokens string
+	// BuildPolicies are the rules that instance and autoscaling group
+	// builds must follow, as parsed by pudding.ParseBuildPolicies
+	BuildPolicies string
+
 	RedisURL string
 
 	SlackHookPath       string
@@ -15,8 +32,41 @@ type Config struct {
 
 	SentryDSN string
 
+	// EncryptionKeys are the keys with which init scripts and auths are
+	// encrypted at rest, as parsed by pudding.ParseKeyring
+	EncryptionKeys string
+	// EncryptionMigration allows reading values stored as plaintext
+	// despite EncryptionKeys
+	EncryptionMigration bool
+
 	InstanceExpiry int
 	ImageExpiry    int
 
+	// AWSRegion is the region of builds, image promotions, and image
+	// canaries that name none
+	AWSRegion string
+	// AWSRegions are the comma-delimited regions besides AWSRegion that
+	// builds, image promotions, and image canaries may name, as
+	// configured for the workers
+	AWSRegions string
+
+	// InstanceIdentityCerts are the PEM-encoded certificates used to
+	// verify the identity documents of instances checking in, without
+	// which instances may not check in
+	InstanceIdentityCerts string
+	// InstanceIdentityAccounts are the comma-delimited ids of the AWS
+	// accounts whose instances may check in, which are required along
+	// with InstanceIdentityCerts
+	InstanceIdentityAccounts string
+	// RequireInstanceIdentity refuses instance build creds for
+	// heartbeats and lifecycle transitions, so that only the instance
+	// itself may make them after checking in, and so requires
+	// InstanceIdentityCerts
+	RequireInstanceIdentity bool
+
 	QueueNames map[string]string
+
+	// RequiredTags are the tag keys that every instance and autoscaling
+	// group build must include
+	RequiredTags []string
 }
@@ -0,0 +1,177 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/travis-ci/pudding"
+	"github.com/travis-ci/pudding/db"
+)
+
+// instanceBuildQuotaError explains which quota an instance build
+// would exceed, and with which status to respond
+type instanceBuildQuotaError struct {
+	status int
+	msg    string
+}
+
+func (e *instanceBuildQuotaError) Error() string {
+	return e.msg
+}
+
+// instanceBuildQuotas enforces the instance build quotas before builds
+// are enqueued, counting the running instances in the instance store
+// along with those requested within the last hour that are not yet
+// running
+type instanceBuildQuotas struct {
+	quotas []*pudding.InstanceBuildQuota
+	i      db.InstanceFetcherStorer
+	r      *redis.Pool
+}
+
+func newInstanceBuildQuotas(r *redis.Pool, i db.InstanceFetcherStorer, quotas []*pudding.InstanceBuildQuota) (*instanceBuildQuotas, error) {
+	return &instanceBuildQuotas{
+		quotas: quotas,
+		i:      i,
+		r:      r,
+	}, nil
+}
+
+// Reserve checks the build requested by the team against every quota
+// matching it, recording its launches if it fits within all of them,
+// or else returning an *instanceBuildQuotaError for the first one
+// exceeded.  The launches are watched while checking, with the check
+// starting over should another reservation be recorded meanwhile.
+func (ibq *instanceBuildQuotas) Reserve(team string, b *pudding.InstanceBuild) error {
+	conn := ibq.r.Get()
+	defer func() { _ = conn.Close() }()
+
+	for {
+		reserved, err := ibq.reserve(conn, team, b)
+		if err != nil || reserved {
+			return err
+		}
+	}
+}
+
+func (ibq *instanceBuildQuotas) reserve(conn redis.Conn, team string, b *pudding.InstanceBuild) (bool, error) {
+	now := time.Now().UTC().Unix()
+	counted := []*pudding.InstanceBuildQuota{}
+	scopes := []string{}
+
+	for _, q := range ibq.quotas {
+		if !q.Matches(team, b) {
+			continue
+		}
+
+		if disallowed := q.DisallowedInstanceTypes(b); len(disallowed) > 0 {
+			return false, &instanceBuildQuotaError{
+				status: http.StatusForbidden,
+				msg: fmt.Sprintf("quota %q does not allow instance types %s",
+					q.Scope(), strings.Join(disallowed, ", ")),
+			}
+		}
+
+		if q.MaxInstances == 0 && q.MaxLaunchesPerHour == 0 {
+			continue
+		}
+
+		counted = append(counted, q)
+		scopes = append(scopes, q.Scope())
+	}
+
+	if len(counted) == 0 {
+		return true, nil
+	}
+
+	err := db.WatchInstanceBuildLaunches(conn, scopes)
+	if err != nil {
+		return false, err
+	}
+
+	for _, q := range counted {
+		err = ibq.check(conn, q, b, now)
+		if err != nil {
+			conn.Do("UNWATCH")
+			return false, err
+		}
+	}
+
+	return db.RecordInstanceBuildLaunches(conn, scopes, b.ID, b.Count, now)
+}
+
+// check returns an *instanceBuildQuotaError if the build would exceed
+// the limits of the quota
+func (ibq *instanceBuildQuotas) check(conn redis.Conn, q *pudding.InstanceBuildQuota, b *pudding.InstanceBuild, now int64) error {
+	launches, err := db.FetchInstanceBuildLaunches(conn, q.Scope(), now-3600)
+	if err != nil {
+		return err
+	}
+
+	if q.MaxLaunchesPerHour > 0 {
+		launched := 0
+		for _, count := range launches {
+			launched += count
+		}
+
+		if launched+b.Count > q.MaxLaunchesPerHour {
+			return &instanceBuildQuotaError{
+				status: http.StatusTooManyRequests,
+				msg: fmt.Sprintf("quota %q allows at most %d launches per hour, with %d in the last hour and %d requested",
+					q.Scope(), q.MaxLaunchesPerHour, launched, b.Count),
+			}
+		}
+	}
+
+	if q.MaxInstances > 0 {
+		instances, err := ibq.i.Fetch(q.InstanceFilters())
+		if err != nil {
+			return err
+		}
+
+		running := map[string]int{}
+		for _, inst := range instances {
+			running[inst.BuildID]++
+		}
+
+		current := len(instances)
+		for buildID, count := range launches {
+			if count > running[buildID] {
+				current += count - running[buildID]
+			}
+		}
+
+		if current+b.Count > q.MaxInstances {
+			return &instanceBuildQuotaError{
+				status: http.StatusTooManyRequests,
+				msg: fmt.Sprintf("quota %q allows at most %d instances, with %d running or pending and %d requested",
+					q.Scope(), q.MaxInstances, current, b.Count),
+			}
+		}
+	}
+
+	return nil
+}
+
+// Release forgets the launches recorded by Reserve for the build
+// requested by the team, such as when it could not be enqueued
+func (ibq *instanceBuildQuotas) Release(team string, b *pudding.InstanceBuild) error {
+	conn := ibq.r.Get()
+	defer func() { _ = conn.Close() }()
+
+	for _, q := range ibq.quotas {
+		if !q.Matches(team, b) || (q.MaxInstances == 0 && q.MaxLaunchesPerHour == 0) {
+			continue
+		}
+
+		err := db.ForgetInstanceBuildLaunches(conn, q.Scope(), b.ID, b.Count)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
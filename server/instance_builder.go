@@ -5,6 +5,7 @@ import (
 	"time"
 
 	"github.com/garyburd/redigo/redis"
+	"github.com/gorilla/feeds"
 	"github.com/travis-ci/pudding"
 	"github.com/travis-ci/pudding/db"
 )
@@ -22,23 +23,22 @@ func newInstanceBuilder(r *redis.Pool, queueName string) (*instanceBuilder, erro
 	}, nil
 }
 
-func (ib *instanceBuilder) Build(b *pudding.InstanceBuild) (*pudding.InstanceBuild, error) {
+func (ib *instanceBuilder) Build(b *pudding.InstanceBuild) (string, error) {
 	conn := ib.r.Get()
 	defer func() { _ = conn.Close() }()
 
 	buildPayload := &pudding.InstanceBuildPayload{
 		Args:       []*pudding.InstanceBuild{b},
 		Queue:      ib.QueueName,
-		JID:        b.ID,
+		JID:        feeds.NewUUID().String(),
 		Retry:      true,
 		EnqueuedAt: float64(time.Now().UTC().Unix()),
 	}
 
 	buildPayloadJSON, err := json.Marshal(buildPayload)
 	if err != nil {
-		return nil, err
+		return "", err
 	}
 
-	err = db.EnqueueJob(conn, ib.QueueName, string(buildPayloadJSON))
-	return b, err
+	return buildPayload.JID, db.EnqueueJob(conn, ib.QueueName, string(buildPayloadJSON))
 }
@@ -22,7 +22,7 @@ func newInstanceTerminator(r *redis.Pool, queueName string) (*instanceTerminator
 	}, nil
 }
 
-func (it *instanceTerminator) Terminate(instanceID, slackChannel string) error {
+func (it *instanceTerminator) Terminate(instanceID, slackChannel string) (string, error) {
 	conn := it.r.Get()
 	defer func() { _ = conn.Close() }()
 
@@ -35,8 +35,8 @@ func (it *instanceTerminator) Terminate(instanceID, slackChannel string) error {
 
 	buildPayloadJSON, err := json.Marshal(buildPayload)
 	if err != nil {
-		return err
+		return "", err
 	}
 
-	return db.EnqueueJob(conn, it.QueueName, string(buildPayloadJSON))
+	return buildPayload.JID, db.EnqueueJob(conn, it.QueueName, string(buildPayloadJSON))
 }
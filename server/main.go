@@ -1,6 +1,9 @@
 package server
 
-import "log"
+import (
+	"log"
+	"net/http"
+)
 
 // Main is the whole shebang
 func Main(cfg *Config) {
@@ -12,3 +15,17 @@ func Main(cfg *Config) {
 	srv.Setup()
 	srv.Run()
 }
+
+// NewHandler builds the server without listening, so that the routes
+// may be served by something else such as an httptest server.  The
+// shutdown route is disabled.
+func NewHandler(cfg *Config) (http.Handler, error) {
+	srv, err := newServer(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	srv.Setup()
+	srv.skipGracefulClose = true
+	return srv, nil
+}
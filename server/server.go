@@ -1,9 +1,16 @@
 package server
 
 import (
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"net"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/braintree/manners"
@@ -24,16 +31,54 @@ var (
 	errMissingInstanceID      = fmt.Errorf("missing instance id")
 	errKaboom                 = fmt.Errorf("simulated kaboom ʕノ•ᴥ•ʔノ ︵ ┻━┻")
 	// errNotImplemented         = fmt.Errorf("not implemented nope nope nope")
-	errUnknownInstance = fmt.Errorf("unknown instance")
+	errUnknownInstance          = fmt.Errorf("unknown instance")
+	errUnknownLifecycleAction   = fmt.Errorf("unknown lifecycle action")
+	errNoSecurityGroupGCReport  = fmt.Errorf("no security group gc report yet")
+	errNoOrphanInstanceReport   = fmt.Errorf("no orphan instance report yet")
+	errInstanceIdentityExists   = fmt.Errorf("instance identity already issued")
+	errInstanceMismatch         = fmt.Errorf("instance does not belong to instance build")
+	errNoInstanceIdentityCerts  = fmt.Errorf("instance identity documents cannot be verified without instance identity certs")
+	errNoIdentityAccounts       = fmt.Errorf("instance identity certs require instance identity accounts")
+	errInstanceIdentityAccount  = fmt.Errorf("instance identity document account is not configured")
+	errInstanceIdentityRegion   = fmt.Errorf("instance identity document region is not configured")
+	errNotAuthorizedForInstance = fmt.Errorf("not authorized for instance")
+	errNotAuthorizedForTeam     = fmt.Errorf("team tokens may only be used for the team's own builds and instances")
+	errApprovalExists           = fmt.Errorf("instance build is already held for approval")
+	errMissingReason            = fmt.Errorf("missing reason")
+	errNotAuthorizedForApproval = fmt.Errorf("approvals may only be decided with an approver token")
+	errNoApprovers              = fmt.Errorf("approval policies need approver tokens to decide them")
+	errSelfApproval             = fmt.Errorf("approvals must be decided by someone other than whoever requested the build")
+	errUnknownApproval          = fmt.Errorf("unknown approval")
+	errNoBuildsToCheck          = fmt.Errorf("expected instance_builds or autoscaling_group_builds")
+	errExpiresAtInPast          = fmt.Errorf("expires_at must be in the future")
+	errInvalidTTLExtension      = fmt.Errorf("ttl must be a positive number of seconds")
+)
+
+var (
+	// teamTokenRoutes are the only routes on which team tokens are
+	// accepted, with those for an instance limited to the instances
+	// launched for the team
+	teamTokenRoutes = map[string]bool{
+		"autoscaling-group-builds-create": true,
+		"instances":                       true,
+		"instances-by-id":                 true,
+		"delete-instances-by-id":          true,
+		"instance-events":                 true,
+		"instance-ttl-extensions-create":  true,
+		"instance-builds-create":          true,
+		"policy-checks-create":            true,
+	}
 )
 
 const (
 	stateOutOfServiceMsg = "is out of service :arrow_down:"
 	stateInServiceMsg    = "is in service :arrow_up:"
+	stateAbandonedMsg    = "is being abandoned :skull:"
 )
 
 func init() {
-	expvarplus.AddToEnvWhitelist("BUILDPACK_URL",
+	expvarplus.AddToEnvWhitelist("AWS_DEFAULT_REGION",
+		"BUILDPACK_URL",
 		"DEBUG",
 		"DYNO",
 		"GENERATED",
@@ -43,10 +88,16 @@ func init() {
 		"REVISION",
 		"VERSION",
 
+		"PUDDING_APPROVAL_POLICIES",
+		"PUDDING_AWS_REGIONS",
+		"PUDDING_BUILD_POLICIES",
 		"PUDDING_DEFAULT_SLACK_CHANNEL",
+		"PUDDING_INIT_SCRIPT_MAX_USES",
 		"PUDDING_INIT_SCRIPT_TEMPLATE",
+		"PUDDING_INSTANCE_BUILD_QUOTAS",
 		"PUDDING_INSTANCE_BUILDS_QUEUE_NAME",
 		"PUDDING_INSTANCE_EXPIRY",
+		"PUDDING_INSTANCE_IDENTITY_CERTS",
 		"PUDDING_INSTANCE_RSA",
 		"PUDDING_INSTANCE_TERMINATIONS_QUEUE_NAME",
 		"PUDDING_INSTANCE_YML",
@@ -54,6 +105,7 @@ func init() {
 		"PUDDING_PROCESS_ID",
 		"PUDDING_REDIS_POOL_SIZE",
 		"PUDDING_REDIS_URL",
+		"PUDDING_REQUIRE_INSTANCE_IDENTITY",
 		"PUDDING_SENTRY_DSN",
 		"PUDDING_SLACK_TEAM",
 		"PUDDING_TEMPORARY_INIT_EXPIRY",
@@ -69,10 +121,30 @@ type server struct {
 	snsHandler *snsHandler
 	iltHandler *instanceLifecycleTransitionHandler
 	terminator *instanceTerminator
+	quotas     *instanceBuildQuotas
 	auther     *serverAuther
 	is         db.InitScriptGetterAuther
+	ii         db.InstanceIdentityFetcherStorer
 	i          db.InstanceFetcherStorer
 	img        db.ImageFetcherStorer
+	la         db.LifecycleActionFetcher
+	ae         db.AutoscalingEventFetcher
+	ie         db.InstanceEventFetcher
+	ic         db.ImageCatalogManager
+	sgr        db.SecurityGroupGCReportFetcherStorer
+	oir        db.OrphanInstanceReportFetcherStorer
+	al         db.AuditRecorderFetcher
+	ap         db.ApprovalFetcherStorer
+
+	awsRegion        string
+	awsRegions       map[string]bool
+	requiredTags     []string
+	approvalPolicies []*pudding.ApprovalPolicy
+	buildPolicies    []*pudding.BuildPolicy
+
+	identityCerts           []*x509.Certificate
+	identityAccounts        map[string]bool
+	requireInstanceIdentity bool
 
 	skipGracefulClose bool
 
@@ -92,6 +164,18 @@ func newServer(cfg *Config) (*server, error) {
 		return nil, err
 	}
 
+	kr, err := pudding.ParseKeyring(cfg.EncryptionKeys)
+	if err != nil {
+		return nil, err
+	}
+
+	if kr == nil {
+		log.Warn("no encryption keys configured, reading init scripts and auths as plaintext")
+	} else if cfg.EncryptionMigration {
+		log.Warn("reading init scripts and auths stored as plaintext until they are encrypted")
+		kr.AllowPlaintext()
+	}
+
 	builder, err := newInstanceBuilder(r, cfg.QueueNames["instance-builds"])
 	if err != nil {
 		return nil, err
@@ -127,12 +211,117 @@ func newServer(cfg *Config) (*server, error) {
 		return nil, err
 	}
 
-	is, err := db.NewInitScripts(r, log)
+	is, err := db.NewInitScripts(r, log, kr)
+	if err != nil {
+		return nil, err
+	}
+
+	ii, err := db.NewInstanceIdentities(r, log)
+	if err != nil {
+		return nil, err
+	}
+
+	identityCerts := []*x509.Certificate{}
+	if cfg.InstanceIdentityCerts != "" {
+		identityCerts, err = pudding.ParseInstanceIdentityCerts(cfg.InstanceIdentityCerts)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if cfg.RequireInstanceIdentity && len(identityCerts) == 0 {
+		return nil, errNoInstanceIdentityCerts
+	}
+
+	identityAccounts, err := pudding.ParseInstanceIdentityAccounts(cfg.InstanceIdentityAccounts)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(identityCerts) > 0 && len(identityAccounts) == 0 {
+		return nil, errNoIdentityAccounts
+	}
+
+	la, err := db.NewLifecycleActions(r, log)
+	if err != nil {
+		return nil, err
+	}
+
+	ae, err := db.NewAutoscalingEvents(r, log)
+	if err != nil {
+		return nil, err
+	}
+
+	ie, err := db.NewInstanceEvents(r, log)
+	if err != nil {
+		return nil, err
+	}
+
+	ic, err := db.NewImageCatalog(r, log)
+	if err != nil {
+		return nil, err
+	}
+
+	sgr, err := db.NewSecurityGroupGCReports(r, log)
+	if err != nil {
+		return nil, err
+	}
+
+	oir, err := db.NewOrphanInstanceReports(r, log)
+	if err != nil {
+		return nil, err
+	}
+
+	al, err := db.NewAuditLog(r, log)
+	if err != nil {
+		return nil, err
+	}
+
+	ap, err := db.NewApprovals(r, log)
+	if err != nil {
+		return nil, err
+	}
+
+	approvalPolicies, err := pudding.ParseApprovalPolicies(cfg.ApprovalPolicies)
+	if err != nil {
+		return nil, err
+	}
+
+	buildPolicies, err := pudding.ParseBuildPolicies(cfg.BuildPolicies)
+	if err != nil {
+		return nil, err
+	}
+
+	awsRegions, err := pudding.ParseRegions(cfg.AWSRegion, cfg.AWSRegions)
+	if err != nil {
+		return nil, err
+	}
+
+	teamTokens, err := pudding.ParseTeamTokens(cfg.TeamTokens)
+	if err != nil {
+		return nil, err
+	}
+
+	approverTokens, err := pudding.ParseTeamTokens(cfg.ApproverTokens)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(approvalPolicies) > 0 && len(approverTokens) == 0 {
+		return nil, errNoApprovers
+	}
+
+	quotaList, err := pudding.ParseInstanceBuildQuotas(cfg.InstanceBuildQuotas)
+	if err != nil {
+		return nil, err
+	}
+
+	quotas, err := newInstanceBuildQuotas(r, i, quotaList)
 	if err != nil {
 		return nil, err
 	}
 
-	auther, err := newServerAuther(cfg.AuthToken, r, log)
+	auther, err := newServerAuther(cfg.AuthToken, teamTokens, approverTokens, r, log, kr)
 	if err != nil {
 		return nil, err
 	}
@@ -154,11 +343,31 @@ func newServer(cfg *Config) (*server, error) {
 		snsHandler: snsHandler,
 		iltHandler: iltHandler,
 		terminator: terminator,
+		quotas:     quotas,
 		is:         is,
+		ii:         ii,
 		i:          i,
 		img:        img,
+		la:         la,
+		ae:         ae,
+		ie:         ie,
+		ic:         ic,
+		sgr:        sgr,
+		oir:        oir,
+		al:         al,
+		ap:         ap,
 		log:        log,
 
+		awsRegion:        cfg.AWSRegion,
+		awsRegions:       awsRegions,
+		requiredTags:     cfg.RequiredTags,
+		approvalPolicies: approvalPolicies,
+		buildPolicies:    buildPolicies,
+
+		identityCerts:           identityCerts,
+		identityAccounts:        identityAccounts,
+		requireInstanceIdentity: cfg.RequireInstanceIdentity,
+
 		skipGracefulClose: false,
 
 		n: negroni.New(),
@@ -195,9 +404,14 @@ func (srv *server) setupRoutes() {
 
 	srv.r.HandleFunc(`/autoscaling-group-builds`, srv.ifAuth(srv.handleAutoscalingGroupBuildsCreate)).Methods("POST").Name("autoscaling-group-builds-create")
 
+	srv.r.HandleFunc(`/autoscaling-groups/{name}/events`, srv.ifAuth(srv.handleAutoscalingGroupEvents)).Methods("GET").Name("autoscaling-group-events")
+
 	srv.r.HandleFunc(`/instances`, srv.ifAuth(srv.handleInstances)).Methods("GET").Name("instances")
+	srv.r.HandleFunc(`/instances/orphan-report`, srv.ifAuth(srv.handleOrphanInstanceReport)).Methods("GET").Name("instances-orphan-report")
 	srv.r.HandleFunc(`/instances/{instance_id}`, srv.ifAuth(srv.handleInstanceByIDFetch)).Methods("GET").Name("instances-by-id")
 	srv.r.HandleFunc(`/instances/{instance_id}`, srv.ifAuth(srv.handleInstanceByIDTerminate)).Methods("DELETE").Name("delete-instances-by-id")
+	srv.r.HandleFunc(`/instances/{instance_id}/events`, srv.ifAuth(srv.handleInstanceEvents)).Methods("GET").Name("instance-events")
+	srv.r.HandleFunc(`/instances/{instance_id}/ttl-extensions`, srv.ifAuth(srv.handleInstanceTTLExtensionsCreate)).Methods("POST").Name("instance-ttl-extensions-create")
 
 	srv.r.HandleFunc(`/instance-builds`, srv.ifAuth(srv.handleInstanceBuildsCreate)).Methods("POST").Name("instance-builds-create")
 	srv.r.HandleFunc(`/instance-builds/{uuid}`, srv.ifAuth(srv.handleInstanceBuildUpdateByID)).Methods("PATCH").Name("instance-builds-update-by-id")
@@ -208,11 +422,37 @@ func (srv *server) setupRoutes() {
 
 	srv.r.HandleFunc(`/instance-heartbeats/{uuid}`, srv.ifAuth(srv.handleInstanceHeartbeat)).Methods("POST").Name("instance-heartbeats")
 
-	srv.r.HandleFunc(`/init-scripts/{uuid}`, srv.ifAuth(srv.handleInitScripts)).Methods("GET").Name("init-scripts")
+	srv.r.HandleFunc(`/instance-identities/{uuid}`, srv.ifAuth(srv.handleInstanceIdentitiesCreate)).Methods("POST").Name("instance-identities-create")
+
+	srv.r.HandleFunc(`/init-scripts/{uuid}`, srv.ifInitScriptAuth(srv.handleInitScripts)).Methods("GET").Name("init-scripts")
+	srv.r.HandleFunc(`/init-scripts/{uuid}/fetches`, srv.ifAuth(srv.handleInitScriptFetches)).Methods("GET").Name("init-script-fetches")
 
-	srv.r.HandleFunc(`/sns-messages`, srv.handleSNSMessages).Name("sns-messages")
+	srv.r.HandleFunc(`/sns-messages`, srv.ifAudited(srv.handleSNSMessages)).Name("sns-messages")
 
 	srv.r.HandleFunc(`/images`, srv.ifAuth(srv.handleImages)).Methods("GET").Name("images")
+
+	srv.r.HandleFunc(`/image-promotions`, srv.ifAuth(srv.handleImagePromotions)).Methods("GET").Name("image-promotions")
+	srv.r.HandleFunc(`/image-promotions`, srv.ifAuth(srv.handleImagePromotionsCreate)).Methods("POST").Name("image-promotions-create")
+	srv.r.HandleFunc(`/image-canaries`, srv.ifAuth(srv.handleImageCanaries)).Methods("GET").Name("image-canaries")
+	srv.r.HandleFunc(`/image-canaries`, srv.ifAuth(srv.handleImageCanariesCreate)).Methods("PUT").Name("image-canaries-create")
+	srv.r.HandleFunc(`/image-canaries/{role}`, srv.ifAuth(srv.handleImageCanaryDelete)).Methods("DELETE").Name("image-canaries-delete")
+	srv.r.HandleFunc(`/image-canaries/{role}/report`, srv.ifAuth(srv.handleImageCanaryReport)).Methods("GET").Name("image-canaries-report")
+	srv.r.HandleFunc(`/image-pins/{role}`, srv.ifAuth(srv.handleImagePinDelete)).Methods("DELETE").Name("image-pins-delete")
+	srv.r.HandleFunc(`/image-deprecations/{image_id}`, srv.ifAuth(srv.handleImageDeprecationCreate)).Methods("PUT").Name("image-deprecations-create")
+	srv.r.HandleFunc(`/image-deprecations/{image_id}`, srv.ifAuth(srv.handleImageDeprecationDelete)).Methods("DELETE").Name("image-deprecations-delete")
+
+	srv.r.HandleFunc(`/security-groups/gc-report`, srv.ifAuth(srv.handleSecurityGroupGCReport)).Methods("GET").Name("security-groups-gc-report")
+
+	srv.r.HandleFunc(`/policy-checks`, srv.ifAuth(srv.handlePolicyChecksCreate)).Methods("POST").Name("policy-checks-create")
+
+	srv.r.HandleFunc(`/audit`, srv.ifAuth(srv.handleAudit)).Methods("GET").Name("audit")
+
+	srv.r.HandleFunc(`/approvals`, srv.ifApproverAuth(srv.handleApprovals)).Methods("GET").Name("approvals")
+	srv.r.HandleFunc(`/approvals/{approval_id}/approve`, srv.ifApproverAuth(srv.handleApprovalApprove)).Methods("POST").Name("approvals-approve")
+	srv.r.HandleFunc(`/approvals/{approval_id}/reject`, srv.ifApproverAuth(srv.handleApprovalReject)).Methods("POST").Name("approvals-reject")
+
+	srv.r.HandleFunc(`/lifecycle-actions`, srv.ifAuth(srv.handleLifecycleActions)).Methods("GET").Name("lifecycle-actions")
+	srv.r.HandleFunc(`/lifecycle-actions/{transition}/{instance_id}`, srv.ifAuth(srv.handleLifecycleActionComplete)).Methods("POST").Name("lifecycle-actions-complete")
 }
 
 func (srv *server) setupMiddleware() {
@@ -228,14 +468,70 @@ func (srv *server) setupMiddleware() {
 }
 
 func (srv *server) ifAuth(f func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
+	return srv.ifAudited(func(w http.ResponseWriter, req *http.Request) {
+		if !srv.auther.Authenticate(w, req) || !srv.authorizedForTeam(w, req) {
+			return
+		}
+
+		f(w, req)
+	})
+}
+
+func (srv *server) ifApproverAuth(f func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
+	return srv.ifAudited(func(w http.ResponseWriter, req *http.Request) {
+		if !srv.auther.AuthenticateApprover(w, req) || !srv.authorizedForTeam(w, req) {
+			return
+		}
+
+		f(w, req)
+	})
+}
+
+// authorizedForTeam responds with an error and returns false if the
+// request was made with a team token for a route other than those in
+// teamTokenRoutes, or for an instance not launched for the team
+func (srv *server) authorizedForTeam(w http.ResponseWriter, req *http.Request) bool {
+	team := req.Header.Get(internalTeamHeader)
+	if team == "" {
+		return true
+	}
+
+	route := mux.CurrentRoute(req)
+	if route == nil || !teamTokenRoutes[route.GetName()] {
+		jsonapi.Error(w, errNotAuthorizedForTeam, http.StatusForbidden)
+		return false
+	}
+
+	instanceID, ok := mux.Vars(req)["instance_id"]
+	if !ok {
+		return true
+	}
+
+	instances, err := srv.i.Fetch(map[string]string{"instance_id": instanceID})
+	if err != nil {
+		jsonapi.Error(w, err, http.StatusInternalServerError)
+		return false
+	}
+
+	if len(instances) < 1 || instances[0].BuildTeam != team {
+		jsonapi.Error(w, errNotAuthorizedForTeam, http.StatusForbidden)
+		return false
+	}
+
+	return true
+}
+
+func (srv *server) ifInitScriptAuth(f func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, req *http.Request) {
-		if !srv.auther.Authenticate(w, req) {
+		if !srv.auther.AuthenticateInitScript(w, req) {
+			srv.recordInitScriptFetch(req, false)
 			return
 		}
 
 		f(w, req)
 	}
 }
+
 func (srv *server) handleGetRoot(w http.ResponseWriter, req *http.Request) {
 	w.Header().Set("Content-Type", "text-plain; charset=utf-8")
 	w.WriteHeader(http.StatusOK)
@@ -255,13 +551,23 @@ func (srv *server) handleKaboom(w http.ResponseWriter, req *http.Request) {
 
 func (srv *server) handleInstances(w http.ResponseWriter, req *http.Request) {
 	f := map[string]string{}
-	for _, qv := range []string{"env", "site", "role", "queue"} {
+	for _, qv := range []string{"env", "site", "role", "queue", "region", "build_team"} {
 		v := req.FormValue(qv)
 		if v != "" {
 			f[qv] = v
 		}
 	}
 
+	for key, values := range req.Form {
+		if strings.HasPrefix(key, pudding.TagKeyPrefix) && len(values) > 0 && values[0] != "" {
+			f[key] = values[0]
+		}
+	}
+
+	if team := req.Header.Get(internalTeamHeader); team != "" {
+		f["build_team"] = team
+	}
+
 	instances, err := srv.i.Fetch(f)
 	if err != nil {
 		jsonapi.Error(w, err, http.StatusInternalServerError)
@@ -298,15 +604,59 @@ func (srv *server) handleInstanceByIDTerminate(w http.ResponseWriter, req *http.
 		return
 	}
 
-	err := srv.terminator.Terminate(instanceID, req.FormValue("slack-channel"))
+	jid, err := srv.terminator.Terminate(instanceID, req.FormValue("slack-channel"))
 	if err != nil {
 		jsonapi.Error(w, err, http.StatusInternalServerError)
 		return
 	}
 
+	w.Header().Set(jobIDHeader, jid)
+
 	jsonapi.Respond(w, map[string]string{"ok": "working on that"}, http.StatusAccepted)
 }
 
+// handleInstanceTTLExtensionsCreate pushes back the expiry of an
+// instance by the given ttl, counting from now if it has no expiry or
+// has already expired
+func (srv *server) handleInstanceTTLExtensionsCreate(w http.ResponseWriter, req *http.Request) {
+	instanceID := mux.Vars(req)["instance_id"]
+
+	ttl, err := strconv.Atoi(req.FormValue("ttl"))
+	if err != nil || ttl < 1 {
+		jsonapi.Error(w, errInvalidTTLExtension, http.StatusBadRequest)
+		return
+	}
+
+	instances, err := srv.i.Fetch(map[string]string{"instance_id": instanceID})
+	if err != nil {
+		jsonapi.Error(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	if len(instances) < 1 {
+		jsonapi.Error(w, errUnknownInstance, http.StatusNotFound)
+		return
+	}
+
+	instance := instances[0]
+
+	expiresAt := instance.ExpiresAt
+	if now := time.Now().UTC().Unix(); expiresAt < now {
+		expiresAt = now
+	}
+	instance.ExpiresAt = expiresAt + int64(ttl)
+
+	err = srv.i.SetExpiry(instanceID, instance.ExpiresAt)
+	if err != nil {
+		jsonapi.Error(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	jsonapi.Respond(w, map[string][]*pudding.Instance{
+		"instances": []*pudding.Instance{instance},
+	}, http.StatusOK)
+}
+
 func (srv *server) handleInstanceBuildsCreate(w http.ResponseWriter, req *http.Request) {
 	payload := &pudding.InstanceBuildsCollectionSingular{
 		InstanceBuilds: pudding.NewInstanceBuild(),
@@ -334,23 +684,225 @@ func (srv *server) handleInstanceBuildsCreate(w http.ResponseWriter, req *http.R
 		build.SlackChannel = srv.slackChannel
 	}
 
-	validationErrors := build.Validate()
+	validationErrors := srv.instanceBuildErrors(build)
 	if len(validationErrors) > 0 {
 		jsonapi.Errors(w, validationErrors, http.StatusBadRequest)
 		return
 	}
 
-	build, err = srv.builder.Build(build)
+	if !srv.allowBuildImage(w, build.AMI) {
+		return
+	}
+
+	build.Team = req.Header.Get(internalTeamHeader)
+
+	if policies := pudding.MatchingApprovalPolicies(srv.approvalPolicies, build); len(policies) > 0 {
+		build.State = pudding.ApprovalStateAwaiting
+		if !srv.holdForApproval(w, req, &pudding.Approval{
+			ID:            build.ID,
+			Policies:      policies,
+			InstanceBuild: build,
+		}) {
+			return
+		}
+
+		jsonapi.Respond(w, &pudding.InstanceBuildsCollection{
+			InstanceBuilds: []*pudding.InstanceBuild{build},
+		}, http.StatusAccepted)
+		return
+	}
+
+	if !srv.reserveQuotas(w, build) {
+		return
+	}
+
+	jid, err := srv.builder.Build(build)
 	if err != nil {
+		srv.releaseQuotas(build)
 		jsonapi.Error(w, err, http.StatusInternalServerError)
 		return
 	}
 
+	w.Header().Set(jobIDHeader, jid)
+
 	jsonapi.Respond(w, &pudding.InstanceBuildsCollection{
 		InstanceBuilds: []*pudding.InstanceBuild{build},
 	}, http.StatusAccepted)
 }
 
+// instanceBuildErrors returns every reason for rejecting the instance
+// build on submission, being its own validation errors, missing
+// required tags, and build policy violations
+func (srv *server) instanceBuildErrors(build *pudding.InstanceBuild) []error {
+	errors := build.Validate()
+	if build.ExpiresAt > 0 && build.ExpiresAt <= time.Now().UTC().Unix() {
+		errors = append(errors, errExpiresAtInPast)
+	}
+	if err := srv.regionError(build.Region); err != nil {
+		errors = append(errors, err)
+	}
+	if missing := pudding.MissingRequiredTags(build.Tags, srv.requiredTags); len(missing) > 0 {
+		errors = append(errors, fmt.Errorf("missing required tags: %s", strings.Join(missing, ", ")))
+	}
+
+	return append(errors, pudding.CheckInstanceBuildPolicies(srv.buildPolicies, build)...)
+}
+
+// autoscalingGroupBuildErrors is instanceBuildErrors for autoscaling
+// group builds
+func (srv *server) autoscalingGroupBuildErrors(build *pudding.AutoscalingGroupBuild) []error {
+	errors := build.Validate()
+	if err := srv.regionError(build.Region); err != nil {
+		errors = append(errors, err)
+	}
+	if missing := pudding.MissingRequiredTags(build.Tags, srv.requiredTags); len(missing) > 0 {
+		errors = append(errors, fmt.Errorf("missing required tags: %s", strings.Join(missing, ", ")))
+	}
+
+	return append(errors, pudding.CheckAutoscalingGroupBuildPolicies(srv.buildPolicies, build)...)
+}
+
+// regionError returns an error if the given region, which may be
+// empty for the default, is known but not configured, leaving unknown
+// regions to the validation of whatever names them
+func (srv *server) regionError(region string) error {
+	if region == "" || !pudding.IsValidRegion(region) || srv.awsRegions[region] {
+		return nil
+	}
+
+	return fmt.Errorf("region %q is not configured", region)
+}
+
+// regionOrDefault returns the given region, or the default region if
+// it is empty
+func (srv *server) regionOrDefault(region string) string {
+	if region == "" {
+		return srv.awsRegion
+	}
+
+	return region
+}
+
+// allowBuildImage responds with an error and returns false if the
+// image given explicitly for a build is deprecated, rather than
+// leaving the build to fail in the workers
+func (srv *server) allowBuildImage(w http.ResponseWriter, imageID string) bool {
+	if imageID == "" {
+		return true
+	}
+
+	reason, deprecated, err := srv.ic.FetchDeprecation(imageID)
+	if err != nil {
+		jsonapi.Error(w, err, http.StatusInternalServerError)
+		return false
+	}
+
+	if deprecated {
+		jsonapi.Error(w, &db.ImageDeprecatedError{ImageID: imageID, Reason: reason}, http.StatusConflict)
+		return false
+	}
+
+	return true
+}
+
+// reserveQuotas responds with an error and returns false if the build
+// would exceed any instance build quota
+func (srv *server) reserveQuotas(w http.ResponseWriter, build *pudding.InstanceBuild) bool {
+	err := srv.quotas.Reserve(build.Team, build)
+	if quotaErr, ok := err.(*instanceBuildQuotaError); ok {
+		jsonapi.Error(w, quotaErr, quotaErr.status)
+		return false
+	}
+
+	if err != nil {
+		jsonapi.Error(w, err, http.StatusInternalServerError)
+		return false
+	}
+
+	return true
+}
+
+// autoscalingGroupQuotaBuild is the instance build that the
+// autoscaling group build counts as against instance build quotas,
+// requesting as many instances as the group may grow to of its mixed
+// instance types, or else of the type of the instance it is made from
+func (srv *server) autoscalingGroupQuotaBuild(b *pudding.AutoscalingGroupBuild) *pudding.InstanceBuild {
+	qb := &pudding.InstanceBuild{
+		ID:    b.ID,
+		Site:  b.Site,
+		Env:   b.Env,
+		Queue: b.Queue,
+		Role:  b.Role,
+		Count: b.MaxSize,
+		Team:  b.Team,
+	}
+
+	if len(b.InstanceTypes) > 0 {
+		qb.InstanceType = b.InstanceTypes[0]
+		qb.InstanceTypes = b.InstanceTypes[1:]
+		return qb
+	}
+
+	instances, err := srv.i.Fetch(map[string]string{"instance_id": b.InstanceID})
+	if err != nil {
+		srv.log.WithFields(logrus.Fields{
+			"err":         err,
+			"instance_id": b.InstanceID,
+		}).Error("failed to fetch autoscaling group build instance")
+	}
+
+	if len(instances) > 0 {
+		qb.InstanceType = instances[0].InstanceType
+	}
+
+	return qb
+}
+
+// releaseQuotas forgets the reservation made by reserveQuotas for a
+// build that could not be enqueued
+func (srv *server) releaseQuotas(build *pudding.InstanceBuild) {
+	err := srv.quotas.Release(build.Team, build)
+	if err != nil {
+		srv.log.WithFields(logrus.Fields{
+			"err":               err,
+			"instance_build_id": build.ID,
+		}).Error("failed to release instance build quotas")
+	}
+}
+
+// holdForApproval stores the build of the approval as awaiting
+// approval instead of enqueueing it, responding with an error and
+// returning false if it can't
+func (srv *server) holdForApproval(w http.ResponseWriter, req *http.Request, a *pudding.Approval) bool {
+	existing, err := srv.ap.Get(a.ID)
+	if err != nil {
+		jsonapi.Error(w, err, http.StatusInternalServerError)
+		return false
+	}
+
+	if existing != nil {
+		jsonapi.Error(w, errApprovalExists, http.StatusConflict)
+		return false
+	}
+
+	a.State = pudding.ApprovalStateAwaiting
+	a.RequestedBy = auditActor(req)
+	a.RequestedAt = time.Now().UTC().Unix()
+
+	err = srv.ap.Store(a)
+	if err != nil {
+		jsonapi.Error(w, err, http.StatusInternalServerError)
+		return false
+	}
+
+	srv.log.WithFields(logrus.Fields{
+		"build_id": a.ID,
+		"policies": a.Policies,
+	}).Info("holding build for approval")
+
+	return true
+}
+
 func (srv *server) handleInstanceHeartbeat(w http.ResponseWriter, req *http.Request) {
 	instanceID := req.FormValue("instance-id")
 	if instanceID == "" {
@@ -358,6 +910,11 @@ func (srv *server) handleInstanceHeartbeat(w http.ResponseWriter, req *http.Requ
 		return
 	}
 
+	if !srv.authorizedForInstance(req, instanceID) {
+		jsonapi.Error(w, errNotAuthorizedForInstance, http.StatusForbidden)
+		return
+	}
+
 	instances, err := srv.i.Fetch(map[string]string{"instance_id": instanceID})
 	if err != nil {
 		jsonapi.Error(w, err, http.StatusInternalServerError)
@@ -371,6 +928,14 @@ func (srv *server) handleInstanceHeartbeat(w http.ResponseWriter, req *http.Requ
 
 	instance := instances[0]
 
+	err = srv.ic.RecordHeartbeat(instanceID)
+	if err != nil {
+		srv.log.WithFields(logrus.Fields{
+			"err":         err,
+			"instance_id": instanceID,
+		}).Warn("failed to record instance heartbeat")
+	}
+
 	if instance.ExpectedState == "" {
 		instance.ExpectedState = "up"
 	}
@@ -453,18 +1018,43 @@ func (srv *server) handleAutoscalingGroupBuildsCreate(w http.ResponseWriter, req
 		build.SlackChannel = srv.slackChannel
 	}
 
-	validationErrors := build.Validate()
+	validationErrors := srv.autoscalingGroupBuildErrors(build)
 	if len(validationErrors) > 0 {
 		jsonapi.Errors(w, validationErrors, http.StatusBadRequest)
 		return
 	}
 
-	build, err = srv.asgBuilder.Build(build)
-	if err != nil {
+	build.Team = req.Header.Get(internalTeamHeader)
+
+	if policies := pudding.MatchingAutoscalingGroupApprovalPolicies(srv.approvalPolicies, build); len(policies) > 0 {
+		if !srv.holdForApproval(w, req, &pudding.Approval{
+			ID:                    build.ID,
+			Policies:              policies,
+			AutoscalingGroupBuild: build,
+		}) {
+			return
+		}
+
+		jsonapi.Respond(w, &pudding.AutoscalingGroupBuildsCollection{
+			AutoscalingGroupBuilds: []*pudding.AutoscalingGroupBuild{build},
+		}, http.StatusAccepted)
+		return
+	}
+
+	quotaBuild := srv.autoscalingGroupQuotaBuild(build)
+	if !srv.reserveQuotas(w, quotaBuild) {
+		return
+	}
+
+	jid, err := srv.asgBuilder.Build(build)
+	if err != nil {
+		srv.releaseQuotas(quotaBuild)
 		jsonapi.Error(w, err, http.StatusInternalServerError)
 		return
 	}
 
+	w.Header().Set(jobIDHeader, jid)
+
 	jsonapi.Respond(w, &pudding.AutoscalingGroupBuildsCollection{
 		AutoscalingGroupBuilds: []*pudding.AutoscalingGroupBuild{build},
 	}, http.StatusAccepted)
@@ -489,6 +1079,18 @@ func (srv *server) handleInstanceLifecycleTransition(transition string, w http.R
 
 	t.Transition = transition
 	t.ID = feeds.NewUUID().String()
+	t.Hydrate()
+
+	validationErrors := t.Validate()
+	if len(validationErrors) > 0 {
+		jsonapi.Errors(w, validationErrors, http.StatusBadRequest)
+		return
+	}
+
+	if !srv.authorizedForInstance(req, t.InstanceID) {
+		jsonapi.Error(w, errNotAuthorizedForInstance, http.StatusForbidden)
+		return
+	}
 
 	_, err = srv.iltHandler.Handle(t)
 	if err != nil {
@@ -496,6 +1098,8 @@ func (srv *server) handleInstanceLifecycleTransition(transition string, w http.R
 		return
 	}
 
+	w.Header().Set(jobIDHeader, t.ID)
+
 	slackChannel := req.FormValue("slack-channel")
 	if slackChannel == "" {
 		slackChannel = srv.slackChannel
@@ -508,10 +1112,12 @@ func (srv *server) handleInstanceLifecycleTransition(transition string, w http.R
 		inst := instances[0]
 		notifier := pudding.NewSlackNotifier(srv.slackHookPath, srv.slackUsername, srv.slackIcon)
 		stateMsg := ""
-		switch transition {
-		case "terminating":
+		switch {
+		case t.Result == pudding.LifecycleActionResultAbandon:
+			stateMsg = stateAbandonedMsg
+		case transition == "terminating":
 			stateMsg = stateOutOfServiceMsg
-		case "launching":
+		case transition == "launching":
 			stateMsg = stateInServiceMsg
 		}
 		if stateMsg != "" {
@@ -526,6 +1132,175 @@ func (srv *server) handleInstanceLifecycleTransition(transition string, w http.R
 	jsonapi.Respond(w, map[string]string{"yay": t.InstanceID}, http.StatusOK)
 }
 
+// handleInstanceIdentitiesCreate issues a token to an instance checking
+// in with its identity document, which is verified when certificates
+// are configured.  The token is only ever returned here.
+func (srv *server) handleInstanceIdentitiesCreate(w http.ResponseWriter, req *http.Request) {
+	instanceBuildID, ok := mux.Vars(req)["uuid"]
+	if !ok {
+		jsonapi.Error(w, errMissingInstanceBuildID, http.StatusBadRequest)
+		return
+	}
+
+	if req.Header.Get(internalAuthKindHeader) == authKindInstance {
+		jsonapi.Error(w, errInstanceIdentityExists, http.StatusConflict)
+		return
+	}
+
+	if len(srv.identityCerts) == 0 {
+		jsonapi.Error(w, errNoInstanceIdentityCerts, http.StatusServiceUnavailable)
+		return
+	}
+
+	ir := &pudding.InstanceIdentityRequest{}
+	err := json.NewDecoder(req.Body).Decode(ir)
+	if err != nil {
+		jsonapi.Error(w, err, http.StatusBadRequest)
+		return
+	}
+
+	doc, err := pudding.VerifyInstanceIdentityDocument(ir.Document, ir.Signature, srv.identityCerts)
+	if err != nil {
+		jsonapi.Error(w, err, http.StatusForbidden)
+		return
+	}
+
+	if !srv.identityAccounts[doc.AccountID] {
+		jsonapi.Error(w, errInstanceIdentityAccount, http.StatusForbidden)
+		return
+	}
+
+	if !srv.awsRegions[doc.Region] {
+		jsonapi.Error(w, errInstanceIdentityRegion, http.StatusForbidden)
+		return
+	}
+
+	// with no launched instance on record, only instances launched by
+	// an autoscaling group made from the instance build may check in
+	launchedID, err := srv.is.InstanceID(instanceBuildID)
+	if err != nil {
+		jsonapi.Error(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	if launchedID != doc.InstanceID {
+		member, err := srv.isAutoscalingGroupInstance(instanceBuildID, doc.InstanceID)
+		if err != nil {
+			jsonapi.Error(w, err, http.StatusInternalServerError)
+			return
+		}
+
+		if !member {
+			jsonapi.Error(w, errInstanceMismatch, http.StatusForbidden)
+			return
+		}
+	}
+
+	// a verified document may replace an identity already issued, e.g.
+	// when the instance has lost its token while rebooting
+	tokenBytes := make([]byte, 32)
+	_, err = rand.Read(tokenBytes)
+	if err != nil {
+		jsonapi.Error(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	ident := &pudding.InstanceIdentity{
+		InstanceID:      doc.InstanceID,
+		InstanceBuildID: instanceBuildID,
+		AccountID:       doc.AccountID,
+		Region:          doc.Region,
+		Verified:        true,
+		IssuedAt:        time.Now().UTC().Unix(),
+		Token:           hex.EncodeToString(tokenBytes),
+	}
+	ident.TokenHash = pudding.HashInstanceToken(ident.Token)
+
+	err = srv.ii.Store(ident)
+	if err != nil {
+		jsonapi.Error(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	srv.log.WithFields(logrus.Fields{
+		"instance_build_id": instanceBuildID,
+		"instance_id":       ident.InstanceID,
+		"verified":          ident.Verified,
+		"ip":                requestIP(req),
+	}).Info("issued instance identity")
+
+	jsonapi.Respond(w, &pudding.InstanceIdentitiesCollection{
+		InstanceIdentities: []*pudding.InstanceIdentity{ident},
+	}, http.StatusCreated)
+}
+
+// isAutoscalingGroupInstance checks whether the instance was launched
+// by an autoscaling group made from the instance booted with the given
+// instance build's init script, going by its pending launch lifecycle
+// action or, once synced, its build_id tag
+func (srv *server) isAutoscalingGroupInstance(instanceBuildID, instanceID string) (bool, error) {
+	asgs, err := srv.is.AutoscalingGroups(instanceBuildID)
+	if err != nil || len(asgs) == 0 {
+		return false, err
+	}
+
+	actions, err := srv.la.Fetch(map[string]string{"transition": "launching", "instance_id": instanceID})
+	if err != nil {
+		return false, err
+	}
+
+	for _, action := range actions {
+		if _, ok := asgs[action.AutoScalingGroupName]; ok {
+			return true, nil
+		}
+	}
+
+	instances, err := srv.i.Fetch(map[string]string{"instance_id": instanceID})
+	if err != nil {
+		return false, err
+	}
+
+	for _, inst := range instances {
+		for _, asgBuildID := range asgs {
+			if inst.BuildID != "" && inst.BuildID == asgBuildID {
+				return true, nil
+			}
+		}
+	}
+
+	return false, nil
+}
+
+// authorizedForInstance checks whether the request may act on behalf
+// of the given instance, which instance identity creds may only do for
+// their own instance, and which instance build creds may no longer do
+// once the instance has checked in
+func (srv *server) authorizedForInstance(req *http.Request, instanceID string) bool {
+	switch req.Header.Get(internalAuthKindHeader) {
+	case authKindToken:
+		return true
+	case authKindInstance:
+		return req.Header.Get(internalInstanceIDHeader) == instanceID
+	case authKindInstanceBuild:
+		if srv.requireInstanceIdentity {
+			return false
+		}
+
+		ident, err := srv.ii.Fetch(instanceID)
+		if err != nil {
+			srv.log.WithFields(logrus.Fields{
+				"err":         err,
+				"instance_id": instanceID,
+			}).Error("failed to fetch instance identity")
+			return false
+		}
+
+		return ident == nil
+	}
+
+	return false
+}
+
 func (srv *server) handleInitScripts(w http.ResponseWriter, req *http.Request) {
 	vars := mux.Vars(req)
 	instanceBuildID, ok := vars["uuid"]
@@ -534,10 +1309,12 @@ func (srv *server) handleInitScripts(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	srv.sendInitScript(w, instanceBuildID)
+	if srv.sendInitScript(w, instanceBuildID) {
+		srv.recordInitScriptFetch(req, true)
+	}
 }
 
-func (srv *server) sendInitScript(w http.ResponseWriter, ID string) {
+func (srv *server) sendInitScript(w http.ResponseWriter, ID string) bool {
 	script, err := srv.is.Get(ID)
 	if err != nil {
 		srv.log.WithFields(logrus.Fields{
@@ -545,12 +1322,97 @@ func (srv *server) sendInitScript(w http.ResponseWriter, ID string) {
 			"id":  ID,
 		}).Error("failed to get init script")
 		jsonapi.Error(w, err, http.StatusInternalServerError)
-		return
+		return false
 	}
 
 	w.Header().Set("Content-Type", "text/x-shellscript; charset=utf-8")
 	w.WriteHeader(http.StatusOK)
-	fmt.Fprintf(w, script)
+	fmt.Fprint(w, script)
+	return true
+}
+
+// recordInitScriptFetch keeps track of when, from where, and for
+// which instance an init script was fetched, or refused
+func (srv *server) recordInitScriptFetch(req *http.Request, allowed bool) {
+	instanceBuildID := mux.Vars(req)["uuid"]
+	if instanceBuildID == "" {
+		return
+	}
+
+	authHeader := strings.ToLower(req.Header.Get("Authorization"))
+	auth := "none"
+	switch {
+	case strings.HasPrefix(authHeader, "token"):
+		auth = "token"
+	case strings.HasPrefix(authHeader, "basic"):
+		auth = "init-script"
+	}
+
+	instanceID := req.FormValue("instance-id")
+	if instanceID == "" {
+		var err error
+		instanceID, err = srv.is.InstanceID(instanceBuildID)
+		if err != nil {
+			srv.log.WithFields(logrus.Fields{
+				"err": err,
+				"id":  instanceBuildID,
+			}).Warn("failed to look up instance for init script")
+		}
+	}
+
+	f := &pudding.InitScriptFetch{
+		InstanceBuildID: instanceBuildID,
+		InstanceID:      instanceID,
+		IP:              requestIP(req),
+		UserAgent:       req.UserAgent(),
+		Auth:            auth,
+		Allowed:         allowed,
+		FetchedAt:       time.Now().UTC().Unix(),
+	}
+
+	srv.log.WithFields(logrus.Fields{
+		"instance_build_id": f.InstanceBuildID,
+		"instance_id":       f.InstanceID,
+		"ip":                f.IP,
+		"auth":              f.Auth,
+		"allowed":           f.Allowed,
+	}).Info("init script fetch")
+
+	err := srv.is.RecordFetch(f)
+	if err != nil {
+		srv.log.WithFields(logrus.Fields{
+			"err": err,
+			"id":  instanceBuildID,
+		}).Error("failed to record init script fetch")
+	}
+}
+
+func (srv *server) handleInitScriptFetches(w http.ResponseWriter, req *http.Request) {
+	fetches, err := srv.is.FetchFetches(mux.Vars(req)["uuid"])
+	if err != nil {
+		jsonapi.Error(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	jsonapi.Respond(w, &pudding.InitScriptFetchesCollection{
+		InitScriptFetches: fetches,
+	}, http.StatusOK)
+}
+
+// requestIP returns the address of the client, which is the last hop
+// in X-Forwarded-For when behind a router, as that is the one added by
+// the router and any before it may have been sent by the client
+func requestIP(req *http.Request) string {
+	if v := req.Header.Get("X-Forwarded-For"); v != "" {
+		hops := strings.Split(v, ",")
+		return strings.TrimSpace(hops[len(hops)-1])
+	}
+
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
 }
 
 func (srv *server) handleSNSMessages(w http.ResponseWriter, req *http.Request) {
@@ -568,6 +1430,8 @@ func (srv *server) handleSNSMessages(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	w.Header().Set(jobIDHeader, msg.MessageID)
+
 	jsonapi.Respond(w, map[string][]*pudding.SNSMessage{
 		"sns_messages": []*pudding.SNSMessage{msg},
 	}, http.StatusOK)
@@ -592,3 +1456,542 @@ func (srv *server) handleImages(w http.ResponseWriter, req *http.Request) {
 		"images": images,
 	}, http.StatusOK)
 }
+
+// handleAudit responds with the matching audit entries, newest first,
+// or with one JSON entry per line for export when format=jsonl
+func (srv *server) handleAudit(w http.ResponseWriter, req *http.Request) {
+	f := map[string]string{}
+	for _, qv := range []string{"source", "actor", "route", "action", "target", "outcome", "request_id", "job_id", "since", "until", "limit"} {
+		v := req.FormValue(qv)
+		if v != "" {
+			f[qv] = v
+		}
+	}
+
+	// exports include everything unless limited
+	if _, ok := f["limit"]; !ok && req.FormValue("format") == "jsonl" {
+		f["limit"] = "0"
+	}
+
+	entries, err := srv.al.Fetch(f)
+	if err != nil {
+		jsonapi.Error(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	if req.FormValue("format") != "jsonl" {
+		jsonapi.Respond(w, &pudding.AuditEntriesCollection{
+			AuditEntries: entries,
+		}, http.StatusOK)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson; charset=utf-8")
+	w.Header().Set("Content-Disposition",
+		fmt.Sprintf("attachment; filename=\"pudding-audit-%d.jsonl\"", time.Now().UTC().Unix()))
+	w.WriteHeader(http.StatusOK)
+
+	enc := json.NewEncoder(w)
+	for _, e := range entries {
+		err = enc.Encode(e)
+		if err != nil {
+			srv.log.WithField("err", err).Error("failed to write audit export")
+			return
+		}
+	}
+}
+
+func (srv *server) handleLifecycleActions(w http.ResponseWriter, req *http.Request) {
+	f := map[string]string{}
+	for _, qv := range []string{"asg", "transition", "instance_id"} {
+		v := req.FormValue(qv)
+		if v != "" {
+			f[qv] = v
+		}
+	}
+
+	actions, err := srv.la.Fetch(f)
+	if err != nil {
+		jsonapi.Error(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	jsonapi.Respond(w, map[string][]*pudding.InstanceLifecycleAction{
+		"lifecycle_actions": actions,
+	}, http.StatusOK)
+}
+
+func (srv *server) handleLifecycleActionComplete(w http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+
+	t := &pudding.InstanceLifecycleTransition{
+		ID:         feeds.NewUUID().String(),
+		InstanceID: vars["instance_id"],
+		Transition: vars["transition"],
+		Result:     req.FormValue("result"),
+	}
+
+	// manual completions must say whether the instance goes into
+	// service rather than defaulting to CONTINUE, so a missing result
+	// is left to fail validation
+	missingResult := strings.TrimSpace(t.Result) == ""
+	if !missingResult {
+		t.Hydrate()
+	}
+
+	validationErrors := t.Validate()
+	if missingResult {
+		jsonapi.Errors(w, validationErrors, http.StatusUnprocessableEntity)
+		return
+	}
+
+	if len(validationErrors) > 0 {
+		jsonapi.Errors(w, validationErrors, http.StatusBadRequest)
+		return
+	}
+
+	actions, err := srv.la.Fetch(map[string]string{
+		"transition":  t.Transition,
+		"instance_id": t.InstanceID,
+	})
+	if err != nil {
+		jsonapi.Error(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	if len(actions) < 1 {
+		jsonapi.Error(w, errUnknownLifecycleAction, http.StatusNotFound)
+		return
+	}
+
+	_, err = srv.iltHandler.Handle(t)
+	if err != nil {
+		jsonapi.Error(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set(jobIDHeader, t.ID)
+
+	jsonapi.Respond(w, map[string][]*pudding.InstanceLifecycleTransition{
+		"instance_lifecycle_transitions": []*pudding.InstanceLifecycleTransition{t},
+	}, http.StatusAccepted)
+}
+
+func (srv *server) handleAutoscalingGroupEvents(w http.ResponseWriter, req *http.Request) {
+	f := map[string]string{"asg": mux.Vars(req)["name"]}
+	for _, qv := range []string{"event", "limit"} {
+		v := req.FormValue(qv)
+		if v != "" {
+			f[qv] = v
+		}
+	}
+
+	events, err := srv.ae.Fetch(f)
+	if err != nil {
+		jsonapi.Error(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	jsonapi.Respond(w, map[string][]*pudding.AutoscalingEvent{
+		"autoscaling_events": events,
+	}, http.StatusOK)
+}
+
+func (srv *server) handleInstanceEvents(w http.ResponseWriter, req *http.Request) {
+	f := map[string]string{"instance_id": mux.Vars(req)["instance_id"]}
+	for _, qv := range []string{"detail_type", "limit"} {
+		v := req.FormValue(qv)
+		if v != "" {
+			f[qv] = v
+		}
+	}
+
+	events, err := srv.ie.Fetch(f)
+	if err != nil {
+		jsonapi.Error(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	jsonapi.Respond(w, map[string][]*pudding.EC2Event{
+		"instance_events": events,
+	}, http.StatusOK)
+}
+
+func (srv *server) handleImagePromotions(w http.ResponseWriter, req *http.Request) {
+	f := map[string]string{}
+	for _, qv := range []string{"image_id", "role", "site", "env", "region"} {
+		v := req.FormValue(qv)
+		if v != "" {
+			f[qv] = v
+		}
+	}
+
+	promotions, err := srv.ic.FetchPromotions(f)
+	if err != nil {
+		jsonapi.Error(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	jsonapi.Respond(w, &pudding.ImagePromotionsCollection{
+		ImagePromotions: promotions,
+	}, http.StatusOK)
+}
+
+func (srv *server) handleImagePromotionsCreate(w http.ResponseWriter, req *http.Request) {
+	payload := &pudding.ImagePromotionsCollectionSingular{
+		ImagePromotions: &pudding.ImagePromotion{},
+	}
+	err := json.NewDecoder(req.Body).Decode(payload)
+	if err != nil {
+		jsonapi.Error(w, err, http.StatusBadRequest)
+		return
+	}
+
+	p := payload.ImagePromotions
+	p.Hydrate()
+	p.Region = srv.regionOrDefault(p.Region)
+
+	validationErrors := p.Validate()
+	if err := srv.regionError(p.Region); err != nil {
+		validationErrors = append(validationErrors, err)
+	}
+	if len(validationErrors) > 0 {
+		jsonapi.Errors(w, validationErrors, http.StatusBadRequest)
+		return
+	}
+
+	err = srv.ic.Promote(p)
+	if err != nil {
+		switch err.(type) {
+		case *db.ImagePinnedError, *db.ImageDeprecatedError:
+			jsonapi.Error(w, err, http.StatusConflict)
+		default:
+			jsonapi.Error(w, err, http.StatusInternalServerError)
+		}
+		return
+	}
+
+	jsonapi.Respond(w, &pudding.ImagePromotionsCollection{
+		ImagePromotions: []*pudding.ImagePromotion{p},
+	}, http.StatusCreated)
+}
+
+func (srv *server) handleImagePinDelete(w http.ResponseWriter, req *http.Request) {
+	err := srv.ic.Unpin(mux.Vars(req)["role"], req.FormValue("site"), req.FormValue("env"),
+		srv.regionOrDefault(req.FormValue("region")))
+	if err != nil {
+		jsonapi.Error(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (srv *server) handleImageDeprecationCreate(w http.ResponseWriter, req *http.Request) {
+	err := srv.ic.Deprecate(mux.Vars(req)["image_id"], req.FormValue("reason"))
+	if err != nil {
+		jsonapi.Error(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (srv *server) handleImageDeprecationDelete(w http.ResponseWriter, req *http.Request) {
+	err := srv.ic.Undeprecate(mux.Vars(req)["image_id"])
+	if err != nil {
+		jsonapi.Error(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (srv *server) handleImageCanaries(w http.ResponseWriter, req *http.Request) {
+	canaries, err := srv.ic.FetchCanaries()
+	if err != nil {
+		jsonapi.Error(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	jsonapi.Respond(w, &pudding.ImageCanariesCollection{
+		ImageCanaries: canaries,
+	}, http.StatusOK)
+}
+
+func (srv *server) handleImageCanariesCreate(w http.ResponseWriter, req *http.Request) {
+	payload := &pudding.ImageCanariesCollectionSingular{
+		ImageCanaries: &pudding.ImageCanary{},
+	}
+	err := json.NewDecoder(req.Body).Decode(payload)
+	if err != nil {
+		jsonapi.Error(w, err, http.StatusBadRequest)
+		return
+	}
+
+	c := payload.ImageCanaries
+	c.Hydrate()
+	c.Region = srv.regionOrDefault(c.Region)
+
+	validationErrors := c.Validate()
+	if err := srv.regionError(c.Region); err != nil {
+		validationErrors = append(validationErrors, err)
+	}
+	if len(validationErrors) > 0 {
+		jsonapi.Errors(w, validationErrors, http.StatusBadRequest)
+		return
+	}
+
+	err = srv.ic.SetCanary(c)
+	if err != nil {
+		switch err.(type) {
+		case *db.ImageDeprecatedError:
+			jsonapi.Error(w, err, http.StatusConflict)
+		default:
+			jsonapi.Error(w, err, http.StatusInternalServerError)
+		}
+		return
+	}
+
+	jsonapi.Respond(w, &pudding.ImageCanariesCollection{
+		ImageCanaries: []*pudding.ImageCanary{c},
+	}, http.StatusCreated)
+}
+
+func (srv *server) handleImageCanaryDelete(w http.ResponseWriter, req *http.Request) {
+	err := srv.ic.RemoveCanary(mux.Vars(req)["role"], req.FormValue("site"), req.FormValue("env"),
+		srv.regionOrDefault(req.FormValue("region")))
+	if err != nil {
+		jsonapi.Error(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (srv *server) handleImageCanaryReport(w http.ResponseWriter, req *http.Request) {
+	report, err := srv.ic.CanaryReport(mux.Vars(req)["role"],
+		req.FormValue("site"), req.FormValue("env"), req.FormValue("region"))
+	if err != nil {
+		jsonapi.Error(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	jsonapi.Respond(w, map[string]*pudding.ImageCanaryReport{
+		"image_canary_reports": report,
+	}, http.StatusOK)
+}
+
+func (srv *server) handleSecurityGroupGCReport(w http.ResponseWriter, req *http.Request) {
+	report, err := srv.sgr.Fetch()
+	if err != nil {
+		jsonapi.Error(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	if report == nil {
+		jsonapi.Error(w, errNoSecurityGroupGCReport, http.StatusNotFound)
+		return
+	}
+
+	jsonapi.Respond(w, map[string]*pudding.SecurityGroupGCReport{
+		"security_group_gc_reports": report,
+	}, http.StatusOK)
+}
+
+func (srv *server) handleOrphanInstanceReport(w http.ResponseWriter, req *http.Request) {
+	report, err := srv.oir.Fetch()
+	if err != nil {
+		jsonapi.Error(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	if report == nil {
+		jsonapi.Error(w, errNoOrphanInstanceReport, http.StatusNotFound)
+		return
+	}
+
+	jsonapi.Respond(w, map[string]*pudding.OrphanInstanceReport{
+		"orphan_instance_reports": report,
+	}, http.StatusOK)
+}
+
+func (srv *server) handleApprovals(w http.ResponseWriter, req *http.Request) {
+	approvals, err := srv.ap.Fetch(map[string]string{"state": req.FormValue("state")})
+	if err != nil {
+		jsonapi.Error(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	jsonapi.Respond(w, &pudding.ApprovalsCollection{
+		Approvals: approvals,
+	}, http.StatusOK)
+}
+
+func (srv *server) handleApprovalApprove(w http.ResponseWriter, req *http.Request) {
+	srv.decideApproval(w, req, pudding.ApprovalStateApproved)
+}
+
+func (srv *server) handleApprovalReject(w http.ResponseWriter, req *http.Request) {
+	srv.decideApproval(w, req, pudding.ApprovalStateRejected)
+}
+
+// decideApproval approves or rejects a build held for approval on
+// behalf of an approver other than whoever requested it, enqueueing
+// the build if approved.  Should the approved build exceed a quota or
+// fail to be enqueued, the approval is reopened so it may be decided
+// again.
+func (srv *server) decideApproval(w http.ResponseWriter, req *http.Request, state string) {
+	if req.Header.Get(internalAuthKindHeader) != authKindApprover {
+		jsonapi.Error(w, errNotAuthorizedForApproval, http.StatusForbidden)
+		return
+	}
+
+	reason := req.FormValue("reason")
+	if reason == "" {
+		jsonapi.Error(w, errMissingReason, http.StatusBadRequest)
+		return
+	}
+
+	approvalID := mux.Vars(req)["approval_id"]
+
+	a, err := srv.ap.Get(approvalID)
+	if err != nil {
+		jsonapi.Error(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	if a == nil {
+		jsonapi.Error(w, errUnknownApproval, http.StatusNotFound)
+		return
+	}
+
+	decidedBy := auditActor(req)
+	if decidedBy == a.RequestedBy {
+		jsonapi.Error(w, errSelfApproval, http.StatusForbidden)
+		return
+	}
+
+	a, err = srv.ap.Decide(approvalID, state, decidedBy, reason)
+	if err != nil {
+		switch err.(type) {
+		case *db.ApprovalDecidedError:
+			jsonapi.Error(w, err, http.StatusConflict)
+		default:
+			jsonapi.Error(w, err, http.StatusInternalServerError)
+		}
+		return
+	}
+
+	if a == nil {
+		jsonapi.Error(w, errUnknownApproval, http.StatusNotFound)
+		return
+	}
+
+	srv.log.WithFields(logrus.Fields{
+		"build_id":   a.ID,
+		"state":      a.State,
+		"decided_by": a.DecidedBy,
+	}).Info("decided build approval")
+
+	if state == pudding.ApprovalStateApproved && !srv.buildApproved(w, a) {
+		return
+	}
+
+	jsonapi.Respond(w, &pudding.ApprovalsCollection{
+		Approvals: []*pudding.Approval{a},
+	}, http.StatusOK)
+}
+
+// buildApproved enqueues the build of the approval, reopening the
+// approval, responding with an error, and returning false if it can't
+func (srv *server) buildApproved(w http.ResponseWriter, a *pudding.Approval) bool {
+	quotaBuild := a.InstanceBuild
+	if a.AutoscalingGroupBuild != nil {
+		quotaBuild = srv.autoscalingGroupQuotaBuild(a.AutoscalingGroupBuild)
+	}
+
+	if !srv.reserveQuotas(w, quotaBuild) {
+		srv.reopenApproval(a)
+		return false
+	}
+
+	var (
+		jid string
+		err error
+	)
+	if a.AutoscalingGroupBuild != nil {
+		jid, err = srv.asgBuilder.Build(a.AutoscalingGroupBuild)
+	} else {
+		a.InstanceBuild.State = "pending"
+		jid, err = srv.builder.Build(a.InstanceBuild)
+	}
+
+	if err != nil {
+		srv.releaseQuotas(quotaBuild)
+		srv.reopenApproval(a)
+		jsonapi.Error(w, err, http.StatusInternalServerError)
+		return false
+	}
+
+	w.Header().Set(jobIDHeader, jid)
+	return true
+}
+
+func (srv *server) reopenApproval(a *pudding.Approval) {
+	err := srv.ap.Reopen(a.ID)
+	if err != nil {
+		srv.log.WithFields(logrus.Fields{
+			"err":      err,
+			"build_id": a.ID,
+		}).Error("failed to reopen approval")
+	}
+}
+
+// handlePolicyChecksCreate checks the instance and/or autoscaling group
+// build in the body as if it had been submitted, without enqueueing it
+func (srv *server) handlePolicyChecksCreate(w http.ResponseWriter, req *http.Request) {
+	payload := map[string]json.RawMessage{}
+	err := json.NewDecoder(req.Body).Decode(&payload)
+	if err != nil {
+		jsonapi.Error(w, err, http.StatusBadRequest)
+		return
+	}
+
+	checks := []*pudding.PolicyCheck{}
+
+	if raw, ok := payload["instance_builds"]; ok {
+		build := pudding.NewInstanceBuild()
+		err = json.Unmarshal(raw, build)
+		if err != nil {
+			jsonapi.Error(w, err, http.StatusBadRequest)
+			return
+		}
+
+		if build.State == "" {
+			build.State = "pending"
+		}
+
+		checks = append(checks, pudding.NewPolicyCheck("instance_builds", build.ID, srv.instanceBuildErrors(build)))
+	}
+
+	if raw, ok := payload["autoscaling_group_builds"]; ok {
+		build := pudding.NewAutoscalingGroupBuild()
+		err = json.Unmarshal(raw, build)
+		if err != nil {
+			jsonapi.Error(w, err, http.StatusBadRequest)
+			return
+		}
+
+		checks = append(checks, pudding.NewPolicyCheck("autoscaling_group_builds", build.ID, srv.autoscalingGroupBuildErrors(build)))
+	}
+
+	if len(checks) == 0 {
+		jsonapi.Error(w, errNoBuildsToCheck, http.StatusBadRequest)
+		return
+	}
+
+	jsonapi.Respond(w, &pudding.PolicyChecksCollection{
+		PolicyChecks: checks,
+	}, http.StatusOK)
+}
@@ -2,28 +2,41 @@ package server
 
 import (
 	"bytes"
+	"compress/gzip"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
 	"encoding/json"
+	"encoding/pem"
 	"fmt"
 	"io"
+	"math/big"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"os"
 	"regexp"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/garyburd/redigo/redis"
-	"github.com/goamz/goamz/ec2"
 	"github.com/travis-ci/pudding"
+	"github.com/travis-ci/pudding/cloud"
 	"github.com/travis-ci/pudding/db"
 )
 
 var (
-	defaultTestAuthToken         = "swordfish"
-	defaultTestInstanceID        = "i-abcd123"
-	defaultTestInstanceBuildUUID = "abcd1234-abcd-abcd-abcd-abcd12345678"
-	defaultTestInstanceBuildAuth = "swordfish-9000"
+	defaultTestAuthToken            = "swordfish"
+	defaultTestInstanceID           = "i-abcd123"
+	defaultTestInstanceBuildUUID    = "abcd1234-abcd-abcd-abcd-abcd12345678"
+	defaultTestInstanceBuildAuth    = "swordfish-9000"
+	defaultTestAutoscalingGroupName = "worky-com-prod-fancy-abcd123-1445385600"
 )
 
 func init() {
@@ -32,9 +45,11 @@ func init() {
 
 func buildTestConfig() *Config {
 	return &Config{
-		Addr:      ":17321",
-		AuthToken: defaultTestAuthToken,
-		Debug:     true,
+		Addr:       ":17321",
+		AuthToken:  defaultTestAuthToken,
+		Debug:      true,
+		AWSRegion:  "us-east-1",
+		AWSRegions: "eu-west-1",
 		RedisURL: func() string {
 			v := os.Getenv("REDIS_URL")
 			if v == "" {
@@ -66,14 +81,20 @@ func ensureExampleDataPresent(redisURL string) {
 		panic(err)
 	}
 
-	err = db.StoreInstances(conn, map[string]ec2.Instance{
-		defaultTestInstanceID: ec2.Instance{
-			InstanceId:       defaultTestInstanceID,
-			InstanceType:     "c3.2xlarge",
-			ImageId:          "ami-abcd123",
-			IPAddress:        "",
-			PrivateIPAddress: "10.0.0.1",
+	err = db.StoreInstances(conn, map[string]*cloud.Instance{
+		defaultTestInstanceID: &cloud.Instance{
+			ID:               defaultTestInstanceID,
+			Type:             "c3.2xlarge",
+			ImageID:          "ami-abcd123",
+			IP:               "",
+			PrivateIP:        "10.0.0.1",
 			LaunchTime:       "1955-11-05T21:30:19+0800",
+			AvailabilityZone: "us-east-1a",
+			Region:           "us-east-1",
+			Tags: map[string]string{
+				"build_id":    defaultTestInstanceBuildUUID,
+				"cost-center": "ci",
+			},
 		},
 	}, 300)
 	if err != nil {
@@ -84,6 +105,89 @@ func ensureExampleDataPresent(redisURL string) {
 	if err != nil {
 		panic(err)
 	}
+
+	err = db.StoreAutoscalingEvent(conn, &pudding.AutoscalingEvent{
+		Event:                pudding.AutoscalingEventLaunchError,
+		AutoScalingGroupName: defaultTestAutoscalingGroupName,
+		StatusCode:           "Failed",
+		StatusMessage:        "We currently do not have sufficient c4.xlarge capacity in the Availability Zone you requested (us-east-1e).",
+	}, db.AutoscalingEventHistoryLength)
+	if err != nil {
+		panic(err)
+	}
+
+	err = db.StoreInstanceEvent(conn, &pudding.EC2Event{
+		DetailType: pudding.EC2EventSpotInterruption,
+		Source:     "aws.ec2",
+		Detail: pudding.EC2EventDetail{
+			InstanceID:     defaultTestInstanceID,
+			InstanceAction: "terminate",
+		},
+	}, db.InstanceEventHistoryLength)
+	if err != nil {
+		panic(err)
+	}
+
+	err = db.StoreInstanceImageRecord(conn, &pudding.InstanceImageRecord{
+		InstanceID: defaultTestInstanceID,
+		ImageID:    "ami-abcd123",
+		Role:       "canarytest",
+		Site:       "org",
+		Env:        "test",
+		Region:     "us-east-1",
+		Canary:     true,
+		LaunchedAt: time.Now().UTC().Unix() - 60,
+	}, db.InstanceImageRecordExpiry)
+	if err != nil {
+		panic(err)
+	}
+
+	err = db.StoreSecurityGroupGCReport(conn, &pudding.SecurityGroupGCReport{
+		RunAt:       1445385600,
+		DryRun:      true,
+		GracePeriod: 3600,
+		Groups: []*pudding.SecurityGroupGCEntry{
+			&pudding.SecurityGroupGCEntry{
+				ID:        "sg-abcd123",
+				Name:      "pudding-1445380000-0xc820123456",
+				CreatedAt: 1445380000,
+				Action:    "would-delete",
+			},
+		},
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	err = db.StoreOrphanInstanceReport(conn, &pudding.OrphanInstanceReport{
+		RunAt:       1445385600,
+		Action:      "report",
+		GracePeriod: 900,
+		Orphans: []*pudding.OrphanInstance{
+			&pudding.OrphanInstance{
+				Kind:            pudding.OrphanKindUntagged,
+				InstanceID:      "i-orphan1",
+				InstanceBuildID: defaultTestInstanceBuildUUID,
+				Region:          "us-east-1",
+				LaunchedAt:      1445380000,
+				Action:          "reported",
+			},
+		},
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	err = db.StoreInstanceLifecycleAction(conn, &pudding.AutoscalingLifecycleAction{
+		AutoScalingGroupName: defaultTestAutoscalingGroupName,
+		LifecycleTransition:  "autoscaling:EC2_INSTANCE_LAUNCHING",
+		LifecycleActionToken: "abcd1234-abcd-abcd-abcd-abcd12345679",
+		EC2InstanceID:        defaultTestInstanceID,
+		LifecycleHookName:    defaultTestAutoscalingGroupName + "-lch-launching",
+	})
+	if err != nil {
+		panic(err)
+	}
 }
 
 func buildTestServer(cfg *Config) *server {
@@ -246,6 +350,27 @@ func TestGetInstances(t *testing.T) {
 	assertNotBody(t, `{"instances":[]}`, collapsedJSON(w.Body.String()))
 }
 
+func TestGetInstancesByTag(t *testing.T) {
+	w := makeAuthenticatedRequest("GET", "/instances?tag:cost-center=ci", nil)
+	assertStatus(t, 200, w.Code)
+	assertBodyMatches(t, `"tags":{"cost-center":"ci"}`, collapsedJSON(w.Body.String()))
+	assertBodyMatches(t, fmt.Sprintf(`"build_id":"%s"`, defaultTestInstanceBuildUUID), collapsedJSON(w.Body.String()))
+
+	w = makeAuthenticatedRequest("GET", "/instances?tag:cost-center=finance", nil)
+	assertStatus(t, 200, w.Code)
+	assertBody(t, `{"instances":[]}`, collapsedJSON(w.Body.String()))
+}
+
+func TestGetInstancesByRegion(t *testing.T) {
+	w := makeAuthenticatedRequest("GET", "/instances?region=us-east-1", nil)
+	assertStatus(t, 200, w.Code)
+	assertBodyMatches(t, `"region":"us-east-1"`, collapsedJSON(w.Body.String()))
+
+	w = makeAuthenticatedRequest("GET", "/instances?region=eu-west-1", nil)
+	assertStatus(t, 200, w.Code)
+	assertBody(t, `{"instances":[]}`, collapsedJSON(w.Body.String()))
+}
+
 func TestGetInstanceByID(t *testing.T) {
 	w := makeAuthenticatedRequest("GET", "/instances/i-bogus123", nil)
 	assertStatus(t, 200, w.Code)
@@ -266,6 +391,22 @@ func TestDeleteInstanceByID(t *testing.T) {
 	assertBody(t, `{"ok":"workingonthat"}`, collapsedJSON(w.Body.String()))
 }
 
+func TestInstanceTTLExtensions(t *testing.T) {
+	w := makeAuthenticatedRequest("POST", fmt.Sprintf("/instances/%s/ttl-extensions", defaultTestInstanceID), nil)
+	assertStatus(t, 400, w.Code)
+
+	w = makeAuthenticatedRequest("POST", "/instances/i-bogus123/ttl-extensions?ttl=3600", nil)
+	assertStatus(t, 404, w.Code)
+
+	w = makeAuthenticatedRequest("POST", fmt.Sprintf("/instances/%s/ttl-extensions?ttl=3600", defaultTestInstanceID), nil)
+	assertStatus(t, 200, w.Code)
+	assertBodyMatches(t, `"expires_at":[0-9]+`, collapsedJSON(w.Body.String()))
+
+	w = makeAuthenticatedRequest("GET", fmt.Sprintf("/instances/%s", defaultTestInstanceID), nil)
+	assertStatus(t, 200, w.Code)
+	assertBodyMatches(t, `"expires_at":[0-9]+`, collapsedJSON(w.Body.String()))
+}
+
 func TestInstanceBuildsCreate(t *testing.T) {
 	w := makeAuthenticatedRequest("POST", "/instance-builds", nil)
 	assertStatus(t, 400, w.Code)
@@ -277,6 +418,172 @@ func TestInstanceBuildsCreate(t *testing.T) {
 		`"state":"pending","id":"[^"]{36}","boot_instance":true}\]}$`, collapsedJSON(w.Body.String()))
 }
 
+func TestInstanceBuildsCreateSpot(t *testing.T) {
+	w := makeAuthenticatedRequest("POST", "/instance-builds", strings.NewReader(`{
+    "instance_builds": {
+      "count": 1,
+      "site": "org",
+      "env": "test",
+      "queue": "docker",
+      "role": "worker",
+      "instance_type": "c3.4xlarge",
+      "instance_types": ["c4.4xlarge", "m4.4xlarge"],
+      "market": "spot",
+      "spot_max_price": "0.25"
+    }
+}`))
+	assertStatus(t, 202, w.Code)
+	assertBodyMatches(t, `"market":"spot","spot_max_price":"0.25"`, collapsedJSON(w.Body.String()))
+	assertBodyMatches(t, `"instance_types":\["c4.4xlarge","m4.4xlarge"\]`, collapsedJSON(w.Body.String()))
+
+	w = makeAuthenticatedRequest("POST", "/instance-builds", strings.NewReader(`{
+    "instance_builds": {
+      "count": 1,
+      "site": "org",
+      "env": "test",
+      "queue": "docker",
+      "role": "worker",
+      "instance_type": "c3.4xlarge",
+      "market": "flea"
+    }
+}`))
+	assertStatus(t, 400, w.Code)
+}
+
+func TestInstanceBuildsCreateRegion(t *testing.T) {
+	for _, tc := range []struct {
+		region string
+		status int
+	}{
+		{"eu-west-1", 202},
+		{"us-west-2", 400},
+		{"mars-north-1", 400},
+	} {
+		w := makeAuthenticatedRequest("POST", "/instance-builds", strings.NewReader(`{
+    "instance_builds": {
+      "count": 1,
+      "site": "org",
+      "env": "test",
+      "queue": "docker",
+      "role": "worker",
+      "instance_type": "c3.4xlarge",
+      "region": "`+tc.region+`"
+    }
+}`))
+		assertStatus(t, tc.status, w.Code)
+	}
+}
+
+func TestInstanceBuildsCreateIngressRules(t *testing.T) {
+	for _, tc := range []struct {
+		rules  string
+		status int
+	}{
+		{`[{"protocol":"tcp","from_port":22,"to_port":22,"cidrs":["0.0.0.0/0"]}]`, 400},
+		{`[{"protocol":"tcp","from_port":22,"to_port":22,"cidrs":["0.0.0.0/0"]}],"allow_world_open_ssh":true`, 202},
+		{`[{"protocol":"tcp","from_port":22,"to_port":22,"cidrs":["10.0.0.0/8"]}]`, 202},
+		{`[{"protocol":"tcp","from_port":443,"to_port":443,"source_security_group_ids":["sg-abcd1234"]}]`, 202},
+		{`[{"protocol":"tcp","from_port":80,"to_port":22,"cidrs":["10.0.0.0/8"]}]`, 400},
+		{`[{"protocol":"sctp","from_port":22,"to_port":22,"cidrs":["10.0.0.0/8"]}]`, 400},
+		{`[{"protocol":"tcp","from_port":22,"to_port":22}]`, 400},
+	} {
+		w := makeAuthenticatedRequest("POST", "/instance-builds", strings.NewReader(`{
+    "instance_builds": {
+      "count": 1,
+      "site": "org",
+      "env": "test",
+      "queue": "docker",
+      "role": "worker",
+      "instance_type": "c3.4xlarge",
+      "ingress_rules": `+tc.rules+`
+    }
+}`))
+		assertStatus(t, tc.status, w.Code)
+	}
+}
+
+func TestInstanceBuildsCreateTTL(t *testing.T) {
+	for _, tc := range []struct {
+		expiry string
+		status int
+	}{
+		{`"ttl": 3600`, 202},
+		{fmt.Sprintf(`"expires_at": %d`, time.Now().UTC().Unix()+3600), 202},
+		{`"ttl": -1`, 400},
+		{`"expires_at": 1`, 400},
+		{fmt.Sprintf(`"ttl": 3600, "expires_at": %d`, time.Now().UTC().Unix()+3600), 400},
+	} {
+		w := makeAuthenticatedRequest("POST", "/instance-builds", strings.NewReader(`{
+    "instance_builds": {
+      "count": 1,
+      "site": "org",
+      "env": "test",
+      "queue": "docker",
+      "role": "worker",
+      "instance_type": "c3.4xlarge",
+      `+tc.expiry+`
+    }
+}`))
+		assertStatus(t, tc.status, w.Code)
+	}
+}
+
+func TestInstanceBuildsCreateTags(t *testing.T) {
+	body := `{
+    "instance_builds": {
+      "count": 1,
+      "site": "org",
+      "env": "test",
+      "queue": "docker",
+      "role": "worker",
+      "instance_type": "c3.4xlarge",
+      "tags": {"cost-center": "ci", "team": "%s"}
+    }
+}`
+	w := makeAuthenticatedRequest("POST", "/instance-builds", strings.NewReader(fmt.Sprintf(body, "blue")))
+	assertStatus(t, 202, w.Code)
+	assertBodyMatches(t, `"tags":{"cost-center":"ci","team":"blue"}`, collapsedJSON(w.Body.String()))
+
+	w = makeAuthenticatedRequest("POST", "/instance-builds", strings.NewReader(`{
+    "instance_builds": {
+      "count": 1,
+      "site": "org",
+      "env": "test",
+      "queue": "docker",
+      "role": "worker",
+      "instance_type": "c3.4xlarge",
+      "tags": {"site": "com"}
+    }
+}`))
+	assertStatus(t, 400, w.Code)
+
+	cfg := buildTestConfig()
+	cfg.RequiredTags = []string{"team", "cost-center"}
+	srv := buildTestServer(cfg)
+
+	for _, tc := range []struct {
+		team   string
+		status int
+	}{
+		{"blue", 202},
+		{"", 400},
+	} {
+		req, err := http.NewRequest("POST", "http://example.com/instance-builds",
+			strings.NewReader(fmt.Sprintf(body, tc.team)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", fmt.Sprintf("token %s", defaultTestAuthToken))
+
+		w = httptest.NewRecorder()
+		srv.ServeHTTP(w, req)
+		assertStatus(t, tc.status, w.Code)
+		if tc.status == 400 {
+			assertBodyMatches(t, `missing required tags: team`, w.Body.String())
+		}
+	}
+}
+
 func TestInstancebuildsUpdate(t *testing.T) {
 	w := makeAuthenticatedRequest("POST", "/instance-builds", makeTestInstanceBuildsRequest())
 	assertStatus(t, 202, w.Code)
@@ -327,3 +634,1214 @@ func TestInstanceTerminationsCreate(t *testing.T) {
 	assertStatus(t, 200, w.Code)
 	assertBody(t, fmt.Sprintf(`{"yay":"%s"}`, defaultTestInstanceID), collapsedJSON(w.Body.String()))
 }
+
+func TestInstanceLaunchesCreateWithResult(t *testing.T) {
+	w := makeAuthenticatedRequest("POST", fmt.Sprintf("/instance-launches/%s", defaultTestInstanceBuildUUID),
+		strings.NewReader(fmt.Sprintf(`{"instance_id": "%s", "result": "bogus"}`, defaultTestInstanceID)))
+	assertStatus(t, 400, w.Code)
+
+	w = makeAuthenticatedRequest("POST", fmt.Sprintf("/instance-launches/%s", defaultTestInstanceBuildUUID),
+		strings.NewReader(fmt.Sprintf(`{"instance_id": "%s", "result": "abandon"}`, defaultTestInstanceID)))
+	assertStatus(t, 200, w.Code)
+	assertBody(t, fmt.Sprintf(`{"yay":"%s"}`, defaultTestInstanceID), collapsedJSON(w.Body.String()))
+}
+
+func TestGetLifecycleActions(t *testing.T) {
+	w := makeAuthenticatedRequest("GET", "/lifecycle-actions", nil)
+	assertStatus(t, 200, w.Code)
+	assertBodyMatches(t, fmt.Sprintf(`"instance_id":"%s","transition":"launching"`, defaultTestInstanceID), collapsedJSON(w.Body.String()))
+
+	w = makeAuthenticatedRequest("GET", "/lifecycle-actions?transition=terminating&asg=bogus", nil)
+	assertStatus(t, 200, w.Code)
+	assertBody(t, `{"lifecycle_actions":[]}`, collapsedJSON(w.Body.String()))
+}
+
+func TestCompleteLifecycleAction(t *testing.T) {
+	w := makeAuthenticatedRequest("POST", fmt.Sprintf("/lifecycle-actions/bogus/%s?result=ABANDON", defaultTestInstanceID), nil)
+	assertStatus(t, 400, w.Code)
+
+	w = makeAuthenticatedRequest("POST", "/lifecycle-actions/launching/i-bogus123?result=ABANDON", nil)
+	assertStatus(t, 404, w.Code)
+
+	w = makeAuthenticatedRequest("POST", fmt.Sprintf("/lifecycle-actions/launching/%s", defaultTestInstanceID), nil)
+	assertStatus(t, 422, w.Code)
+	assertBodyMatches(t, `result must be CONTINUE or ABANDON`, w.Body.String())
+
+	w = makeAuthenticatedRequest("POST", fmt.Sprintf("/lifecycle-actions/launching/%s?result=ABANDON", defaultTestInstanceID), nil)
+	assertStatus(t, 202, w.Code)
+	assertBodyMatches(t, `"transition":"launching","result":"ABANDON"`, collapsedJSON(w.Body.String()))
+}
+
+func TestGetAutoscalingGroupEvents(t *testing.T) {
+	w := makeAuthenticatedRequest("GET", fmt.Sprintf("/autoscaling-groups/%s/events?event=EC2_INSTANCE_LAUNCH_ERROR", defaultTestAutoscalingGroupName), nil)
+	assertStatus(t, 200, w.Code)
+	assertBodyMatches(t, `"Event":"autoscaling:EC2_INSTANCE_LAUNCH_ERROR"`, collapsedJSON(w.Body.String()))
+
+	w = makeAuthenticatedRequest("GET", "/autoscaling-groups/bogus/events", nil)
+	assertStatus(t, 200, w.Code)
+	assertBody(t, `{"autoscaling_events":[]}`, collapsedJSON(w.Body.String()))
+}
+
+func TestGetInstanceEvents(t *testing.T) {
+	w := makeAuthenticatedRequest("GET", fmt.Sprintf("/instances/%s/events", defaultTestInstanceID), nil)
+	assertStatus(t, 200, w.Code)
+	assertBodyMatches(t, `"detail-type":"EC2SpotInstanceInterruptionWarning"`, collapsedJSON(w.Body.String()))
+	assertBodyMatches(t, `"instance-action":"terminate"`, collapsedJSON(w.Body.String()))
+}
+
+func TestImageCatalog(t *testing.T) {
+	w := makeAuthenticatedRequest("DELETE", "/image-pins/catalogtest", nil)
+	assertStatus(t, 204, w.Code)
+
+	w = makeAuthenticatedRequest("POST", "/image-promotions", strings.NewReader(`{
+    "image_promotions": {"image_id": "ami-cafe001", "role": "catalogtest", "pin": true}
+}`))
+	assertStatus(t, 201, w.Code)
+	assertBodyMatches(t, `"image_id":"ami-cafe001","role":"catalogtest","region":"us-east-1","pin":true`, collapsedJSON(w.Body.String()))
+
+	w = makeAuthenticatedRequest("POST", "/image-promotions", strings.NewReader(`{
+    "image_promotions": {"image_id": "ami-cafe002", "role": "catalogtest"}
+}`))
+	assertStatus(t, 409, w.Code)
+
+	// images only ever exist in a single region, the pins of which are
+	// their own
+	w = makeAuthenticatedRequest("DELETE", "/image-pins/catalogtest?region=eu-west-1", nil)
+	assertStatus(t, 204, w.Code)
+
+	w = makeAuthenticatedRequest("POST", "/image-promotions", strings.NewReader(`{
+    "image_promotions": {"image_id": "ami-cafe002", "role": "catalogtest", "region": "eu-west-1", "pin": true}
+}`))
+	assertStatus(t, 201, w.Code)
+
+	w = makeAuthenticatedRequest("POST", "/image-promotions", strings.NewReader(`{
+    "image_promotions": {"image_id": "ami-cafe004", "role": "catalogtest", "region": "us-west-2"}
+}`))
+	assertStatus(t, 400, w.Code)
+	assertBodyMatches(t, `region \\"us-west-2\\" is not configured`, w.Body.String())
+
+	w = makeAuthenticatedRequest("PUT", "/image-deprecations/ami-cafe003?reason=busted", nil)
+	assertStatus(t, 204, w.Code)
+
+	w = makeAuthenticatedRequest("POST", "/image-promotions", strings.NewReader(`{
+    "image_promotions": {"image_id": "ami-cafe003", "role": "catalogtest", "pin": true}
+}`))
+	assertStatus(t, 409, w.Code)
+
+	w = makeAuthenticatedRequest("POST", "/instance-builds", strings.NewReader(`{
+    "instance_builds": {
+      "count": 1,
+      "site": "org",
+      "env": "test",
+      "queue": "docker",
+      "role": "catalogtest",
+      "instance_type": "c3.4xlarge",
+      "ami": "ami-cafe003"
+    }
+}`))
+	assertStatus(t, 409, w.Code)
+	assertBodyMatches(t, `image ami-cafe003 is deprecated: busted`, w.Body.String())
+
+	w = makeAuthenticatedRequest("DELETE", "/image-deprecations/ami-cafe003", nil)
+	assertStatus(t, 204, w.Code)
+
+	w = makeAuthenticatedRequest("POST", "/image-promotions", strings.NewReader(`{
+    "image_promotions": {"role": "catalogtest"}
+}`))
+	assertStatus(t, 400, w.Code)
+
+	w = makeAuthenticatedRequest("GET", "/image-promotions?role=catalogtest&image_id=ami-cafe001", nil)
+	assertStatus(t, 200, w.Code)
+	assertBodyMatches(t, `^{"image_promotions":\[{"image_id":"ami-cafe001"`, collapsedJSON(w.Body.String()))
+}
+
+func TestImageCanaries(t *testing.T) {
+	w := makeAuthenticatedRequest("PUT", "/image-canaries", strings.NewReader(`{
+    "image_canaries": {"image_id": "ami-abcd123", "role": "canarytest", "weight": 101}
+}`))
+	assertStatus(t, 400, w.Code)
+
+	w = makeAuthenticatedRequest("PUT", "/image-canaries", strings.NewReader(`{
+    "image_canaries": {"image_id": "ami-abcd123", "role": "canarytest", "weight": 10}
+}`))
+	assertStatus(t, 201, w.Code)
+
+	w = makeAuthenticatedRequest("GET", "/image-canaries", nil)
+	assertStatus(t, 200, w.Code)
+	assertBodyMatches(t, `{"image_id":"ami-abcd123","role":"canarytest","region":"us-east-1","weight":10,`, collapsedJSON(w.Body.String()))
+
+	w = makeAuthenticatedRequest("POST", fmt.Sprintf("/instance-heartbeats/%s?instance-id=%s", defaultTestInstanceBuildUUID, defaultTestInstanceID), nil)
+	assertStatus(t, 200, w.Code)
+
+	w = makeAuthenticatedRequest("GET", "/image-canaries/canarytest/report", nil)
+	assertStatus(t, 200, w.Code)
+	assertBodyMatches(t, `"canary":{"image_ids":\["ami-abcd123"\],"instances":1,"heartbeating":1,"recent":1,"silent":0,`, collapsedJSON(w.Body.String()))
+	assertBodyMatches(t, `"baseline":{"image_ids":\[\],"instances":0,`, collapsedJSON(w.Body.String()))
+
+	w = makeAuthenticatedRequest("GET", "/image-canaries/canarytest/report?site=org&env=test", nil)
+	assertStatus(t, 200, w.Code)
+	assertBodyMatches(t, `"role":"canarytest","site":"org","env":"test","canary":{"image_ids":\["ami-abcd123"\],"instances":1,`, collapsedJSON(w.Body.String()))
+
+	w = makeAuthenticatedRequest("GET", "/image-canaries/canarytest/report?site=com", nil)
+	assertStatus(t, 200, w.Code)
+	assertBodyMatches(t, `"canary":{"image_ids":\[\],"instances":0,`, collapsedJSON(w.Body.String()))
+
+	w = makeAuthenticatedRequest("DELETE", "/image-canaries/canarytest", nil)
+	assertStatus(t, 204, w.Code)
+}
+
+func TestGetSecurityGroupGCReport(t *testing.T) {
+	w := makeAuthenticatedRequest("GET", "/security-groups/gc-report", nil)
+	assertStatus(t, 200, w.Code)
+	assertBodyMatches(t, `"dry_run":true,"grace_period":3600,`, collapsedJSON(w.Body.String()))
+	assertBodyMatches(t, `"id":"sg-abcd123","name":"pudding-1445380000-0xc820123456","created_at":1445380000,"in_use":false,"action":"would-delete"`, collapsedJSON(w.Body.String()))
+}
+
+func TestGetOrphanInstanceReport(t *testing.T) {
+	w := makeAuthenticatedRequest("GET", "/instances/orphan-report", nil)
+	assertStatus(t, 200, w.Code)
+	assertBodyMatches(t, `"action":"report","grace_period":900,`, collapsedJSON(w.Body.String()))
+	assertBodyMatches(t, `"kind":"untagged","instance_id":"i-orphan1","instance_build_id":"[^"]{36}","region":"us-east-1","launched_at":1445380000,"action":"reported"`, collapsedJSON(w.Body.String()))
+}
+
+func TestTokenAuthRejectsOtherTokens(t *testing.T) {
+	for _, auth := range []string{
+		"token nope",
+		"token=nope",
+		"token " + defaultTestAuthToken[:len(defaultTestAuthToken)-1],
+		"token " + defaultTestAuthToken + "x",
+		"token ",
+		"token",
+	} {
+		w := makeRequestWithHeaders("GET", "/instances", nil, map[string]string{"Authorization": auth})
+		if w.Code != 403 {
+			t.Fatalf("expected %q to be refused, got %v", auth, w.Code)
+		}
+	}
+
+	for _, auth := range []string{"token " + defaultTestAuthToken, "token=" + defaultTestAuthToken} {
+		w := makeRequestWithHeaders("GET", "/instances", nil, map[string]string{"Authorization": auth})
+		if w.Code != 200 {
+			t.Fatalf("expected %q to be accepted, got %v", auth, w.Code)
+		}
+	}
+}
+
+func TestInitScriptsAuth(t *testing.T) {
+	cfg := buildTestConfig()
+	srv := buildTestServer(cfg)
+
+	u, err := url.Parse(cfg.RedisURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := redis.Dial("tcp", u.Host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	buf := &bytes.Buffer{}
+	gzw := gzip.NewWriter(buf)
+	fmt.Fprint(gzw, "#!/bin/bash\necho 100%\n")
+	gzw.Close()
+
+	expiredID := "abcd1234-abcd-abcd-abcd-abcdexpired0"
+	for _, rec := range []*db.InitScriptRecord{
+		{
+			InstanceBuildID: defaultTestInstanceBuildUUID,
+			Script:          base64.StdEncoding.EncodeToString(buf.Bytes()),
+			InstanceAuth:    defaultTestInstanceBuildAuth,
+			InitScriptAuth:  "swordfish-init",
+			MaxUses:         2,
+			ExpiresAt:       time.Now().UTC().Unix() + 60,
+		},
+		{
+			InstanceBuildID: expiredID,
+			Script:          base64.StdEncoding.EncodeToString(buf.Bytes()),
+			InstanceAuth:    defaultTestInstanceBuildAuth,
+			InitScriptAuth:  "swordfish-init",
+			MaxUses:         2,
+			ExpiresAt:       time.Now().UTC().Unix() - 1,
+		},
+	} {
+		err = db.StoreInitScript(conn, rec, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	request := func(method, path, user, pass string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(method, fmt.Sprintf("http://example.com%s", path), strings.NewReader(""))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.SetBasicAuth(user, pass)
+		// the first hop is whatever the client claims to be
+		req.Header.Set("X-Forwarded-For", "198.51.100.1, 203.0.113.7")
+
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, req)
+		return w
+	}
+
+	initScriptPath := fmt.Sprintf("/init-scripts/%s", defaultTestInstanceBuildUUID)
+
+	w := makeRequestWithHeaders("GET", initScriptPath, nil, map[string]string{"Authorization": "token nope"})
+	assertStatus(t, 403, w.Code)
+
+	w = request("GET", initScriptPath, "x", defaultTestInstanceBuildAuth)
+	assertStatus(t, 403, w.Code)
+
+	for _, status := range []int{200, 200, 403} {
+		w = request("GET", initScriptPath, "x", "swordfish-init")
+		assertStatus(t, status, w.Code)
+	}
+
+	w = request("GET", fmt.Sprintf("/init-scripts/%s", expiredID), "x", "swordfish-init")
+	assertStatus(t, 403, w.Code)
+
+	w = request("POST", fmt.Sprintf("/instance-heartbeats/%s?instance-id=%s", defaultTestInstanceBuildUUID, defaultTestInstanceID),
+		"x", "swordfish-init")
+	assertStatus(t, 403, w.Code)
+
+	w = request("POST", fmt.Sprintf("/instance-heartbeats/%s?instance-id=%s", defaultTestInstanceBuildUUID, defaultTestInstanceID),
+		"x", defaultTestInstanceBuildAuth)
+	assertStatus(t, 200, w.Code)
+
+	w = makeAuthenticatedRequest("GET", initScriptPath, nil)
+	assertStatus(t, 200, w.Code)
+	assertBody(t, "#!/bin/bash\necho 100%\n", w.Body.String())
+
+	w = makeAuthenticatedRequest("GET", fmt.Sprintf("%s/fetches", initScriptPath), nil)
+	assertStatus(t, 200, w.Code)
+	assertBodyMatches(t, `^{"init_script_fetches":\[{"instance_build_id":"`+defaultTestInstanceBuildUUID+`","ip":"","auth":"token","allowed":true,"fetched_at":\d+},`+
+		`{"instance_build_id":"[^"]+","ip":"203.0.113.7","auth":"init-script","allowed":false,`, collapsedJSON(w.Body.String()))
+
+	ids, err := db.PurgeInitScripts(conn, time.Now().UTC().Unix())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(ids) != 1 || ids[0] != expiredID {
+		t.Fatalf("expected only %q to be purged, got %v", expiredID, ids)
+	}
+
+	w = makeAuthenticatedRequest("GET", fmt.Sprintf("/init-scripts/%s", expiredID), nil)
+	assertStatus(t, 500, w.Code)
+}
+
+func TestInstanceIdentities(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certDER, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "ec2 instance identity"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}, &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "ec2 instance identity"},
+	}, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := buildTestConfig()
+	cfg.InstanceIdentityCerts = string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER}))
+
+	_, err = newServer(cfg)
+	if err != errNoIdentityAccounts {
+		t.Fatalf("expected server to refuse to start without accounts, got %v", err)
+	}
+
+	cfg.InstanceIdentityAccounts = "123456789012"
+	srv := buildTestServer(cfg)
+
+	u, err := url.Parse(cfg.RedisURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := redis.Dial("tcp", u.Host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	instanceBuildID := "abcd1234-abcd-abcd-abcd-abcdidentity0"
+	instanceID := "i-identity1"
+
+	_, err = conn.Do("DEL", fmt.Sprintf("%s:instance_identity:%s", pudding.RedisNamespace, instanceID))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = conn.Do("HSET", fmt.Sprintf("%s:auths", pudding.RedisNamespace), instanceBuildID, "swordfish-identity")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = conn.Do("HDEL", fmt.Sprintf("%s:init_script_instances", pudding.RedisNamespace), instanceBuildID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signedRequest := func(instanceID, accountID, region string) io.Reader {
+		doc := fmt.Sprintf(`{"instanceId":"%s","accountId":"%s","region":"%s"}`, instanceID, accountID, region)
+		digest := sha256.Sum256([]byte(doc))
+		sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		body, err := json.Marshal(&pudding.InstanceIdentityRequest{
+			Document:  doc,
+			Signature: base64.StdEncoding.EncodeToString(sig),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return bytes.NewReader(body)
+	}
+
+	identityRequest := func(instanceID string) io.Reader {
+		return signedRequest(instanceID, "123456789012", "us-east-1")
+	}
+
+	request := func(method, path, user, pass string, body io.Reader) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(method, fmt.Sprintf("http://example.com%s", path), body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.SetBasicAuth(user, pass)
+
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, req)
+		return w
+	}
+
+	identityPath := fmt.Sprintf("/instance-identities/%s", instanceBuildID)
+	launchesPath := fmt.Sprintf("/instance-launches/%s", instanceBuildID)
+	launchBody := func(instanceID string) io.Reader {
+		return strings.NewReader(fmt.Sprintf(`{"instance_id":"%s"}`, instanceID))
+	}
+
+	w := request("POST", identityPath, "x", "swordfish-identity",
+		strings.NewReader(`{"document":"{\"instanceId\":\"i-identity1\"}","signature":"bm9wZQ=="}`))
+	assertStatus(t, 403, w.Code)
+
+	// no launched instance is on record yet
+	w = request("POST", identityPath, "x", "swordfish-identity", identityRequest(instanceID))
+	assertStatus(t, 403, w.Code)
+
+	err = db.StoreInitScriptInstanceID(conn, instanceBuildID, instanceID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w = request("POST", identityPath, "x", "swordfish-identity", identityRequest("i-identity2"))
+	assertStatus(t, 403, w.Code)
+
+	w = request("POST", identityPath, "x", "swordfish-identity", signedRequest(instanceID, "210987654321", "us-east-1"))
+	assertStatus(t, 403, w.Code)
+	assertBodyMatches(t, errInstanceIdentityAccount.Error(), w.Body.String())
+
+	w = request("POST", identityPath, "x", "swordfish-identity", signedRequest(instanceID, "123456789012", "ap-south-1"))
+	assertStatus(t, 403, w.Code)
+	assertBodyMatches(t, errInstanceIdentityRegion.Error(), w.Body.String())
+
+	// instances launched by an autoscaling group made from the instance
+	// boot with the same init script
+	asgInstanceID := "i-identity3"
+	_, err = conn.Do("DEL", fmt.Sprintf("%s:instance_identity:%s", pudding.RedisNamespace, asgInstanceID))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = db.StoreInitScriptAutoscalingGroup(conn, instanceBuildID, "pudding-identity-asg", "asg-build-identity", 300)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = db.StoreInstanceLifecycleAction(conn, &pudding.AutoscalingLifecycleAction{
+		AutoScalingGroupName: "pudding-identity-asg",
+		LifecycleTransition:  "autoscaling:EC2_INSTANCE_LAUNCHING",
+		LifecycleActionToken: "identity-token",
+		EC2InstanceID:        asgInstanceID,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w = request("POST", identityPath, "x", "swordfish-identity", identityRequest(asgInstanceID))
+	assertStatus(t, 201, w.Code)
+
+	w = request("POST", identityPath, "x", "swordfish-identity", identityRequest("i-identity2"))
+	assertStatus(t, 403, w.Code)
+
+	w = request("POST", launchesPath, "x", "swordfish-identity", launchBody(instanceID))
+	assertStatus(t, 200, w.Code)
+
+	w = request("POST", identityPath, "x", "swordfish-identity", identityRequest(instanceID))
+	assertStatus(t, 201, w.Code)
+
+	coll := &pudding.InstanceIdentitiesCollection{}
+	err = json.Unmarshal(w.Body.Bytes(), coll)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(coll.InstanceIdentities) != 1 || coll.InstanceIdentities[0].Token == "" || !coll.InstanceIdentities[0].Verified {
+		t.Fatalf("unexpected instance identities %s", w.Body.String())
+	}
+
+	token := coll.InstanceIdentities[0].Token
+	assertNotBody(t, pudding.HashInstanceToken(token), w.Body.String())
+
+	w = request("POST", launchesPath, instanceID, token, launchBody(instanceID))
+	assertStatus(t, 200, w.Code)
+
+	w = request("POST", launchesPath, "x", "swordfish-identity", launchBody(instanceID))
+	assertStatus(t, 403, w.Code)
+
+	w = request("POST", launchesPath, instanceID, token, launchBody("i-identity2"))
+	assertStatus(t, 403, w.Code)
+
+	w = request("POST", launchesPath, instanceID, "nope", launchBody(instanceID))
+	assertStatus(t, 403, w.Code)
+
+	w = request("POST", fmt.Sprintf("/instance-launches/%s", defaultTestInstanceBuildUUID), instanceID, token, launchBody(instanceID))
+	assertStatus(t, 403, w.Code)
+
+	w = makeRequestWithHeaders("POST", launchesPath, launchBody(instanceID), map[string]string{
+		"Authorization":          "Basic " + base64.StdEncoding.EncodeToString([]byte("x:swordfish-identity")),
+		internalAuthKindHeader:   authKindInstance,
+		internalInstanceIDHeader: instanceID,
+	})
+	assertStatus(t, 403, w.Code)
+}
+
+func TestInstanceIdentitiesWithoutCerts(t *testing.T) {
+	cfg := buildTestConfig()
+	cfg.RequireInstanceIdentity = true
+
+	_, err := newServer(cfg)
+	if err != errNoInstanceIdentityCerts {
+		t.Fatalf("expected server to refuse to start, got %v", err)
+	}
+
+	u, err := url.Parse(cfg.RedisURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := redis.Dial("tcp", u.Host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	instanceBuildID := "abcd1234-abcd-abcd-abcd-abcdnocerts00"
+	_, err = conn.Do("HSET", fmt.Sprintf("%s:auths", pudding.RedisNamespace), instanceBuildID, "swordfish-nocerts")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := buildTestServer(buildTestConfig())
+
+	req, err := http.NewRequest("POST", fmt.Sprintf("http://example.com/instance-identities/%s", instanceBuildID),
+		strings.NewReader(`{"document":"{\"instanceId\":\"i-nocerts\"}","signature":"bm9wZQ=="}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth("x", "swordfish-nocerts")
+
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, req)
+	assertStatus(t, 503, w.Code)
+}
+
+func TestAudit(t *testing.T) {
+	requestID := fmt.Sprintf("audit-%d", time.Now().UnixNano())
+
+	w := makeRequestWithHeaders("DELETE", fmt.Sprintf("/instances/%s", defaultTestInstanceID), nil, map[string]string{
+		"Authorization": fmt.Sprintf("token %s", defaultTestAuthToken),
+		"X-Request-ID":  requestID,
+	})
+	assertStatus(t, 202, w.Code)
+
+	jid := w.Header().Get(jobIDHeader)
+	if jid == "" {
+		t.Fatalf("expected a %s header", jobIDHeader)
+	}
+
+	w = makeRequestWithHeaders("POST", "/instance-builds", strings.NewReader(`{
+  "instance_builds": {
+    "site": "org",
+    "env": "prod",
+    "role": "worker",
+    "queue": "docker",
+    "instance_type": "c3.2xlarge",
+    "count": 1,
+    "user_token": "sekrit"
+  }
+}`), map[string]string{
+		"Authorization": "token nope",
+		"X-Request-ID":  requestID,
+	})
+	assertStatus(t, 403, w.Code)
+
+	w = makeAuthenticatedRequest("GET", fmt.Sprintf("/audit?request_id=%s", requestID), nil)
+	assertStatus(t, 200, w.Code)
+
+	coll := &pudding.AuditEntriesCollection{}
+	err := json.Unmarshal(w.Body.Bytes(), coll)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(coll.AuditEntries) != 2 {
+		t.Fatalf("expected 2 audit entries, got %s", w.Body.String())
+	}
+
+	denied, terminated := coll.AuditEntries[0], coll.AuditEntries[1]
+
+	if denied.Route != "instance-builds-create" || denied.Actor != "anonymous" || denied.Outcome != pudding.AuditOutcomeDenied || denied.Status != 403 {
+		t.Fatalf("unexpected denied audit entry %#v", denied)
+	}
+
+	if !strings.Contains(denied.Summary, "instance_builds.site=org") || !strings.Contains(denied.Summary, "instance_builds.user_token=[redacted]") {
+		t.Fatalf("unexpected audit summary %q", denied.Summary)
+	}
+
+	if terminated.Route != "delete-instances-by-id" || terminated.Actor != "token" || terminated.Target != defaultTestInstanceID ||
+		terminated.JobID != jid || terminated.Outcome != pudding.AuditOutcomeOK || terminated.Source != "api" {
+		t.Fatalf("unexpected terminated audit entry %#v", terminated)
+	}
+
+	if terminated.ID >= denied.ID {
+		t.Fatalf("expected audit entry ids to increase, got %v then %v", terminated.ID, denied.ID)
+	}
+
+	w = makeAuthenticatedRequest("GET", fmt.Sprintf("/audit?request_id=%s&outcome=denied&format=jsonl", requestID), nil)
+	assertStatus(t, 200, w.Code)
+
+	lines := strings.Split(strings.TrimSpace(w.Body.String()), "\n")
+	if len(lines) != 1 || !strings.Contains(lines[0], `"route":"instance-builds-create"`) {
+		t.Fatalf("unexpected audit export %q", w.Body.String())
+	}
+
+	if !strings.HasPrefix(w.Header().Get("Content-Disposition"), "attachment;") {
+		t.Fatalf("expected an attachment, got %q", w.Header().Get("Content-Disposition"))
+	}
+}
+
+func TestInstanceBuildQuotas(t *testing.T) {
+	cfg := buildTestConfig()
+	cfg.TeamTokens = "ci=ci-swordfish"
+	cfg.InstanceBuildQuotas = `[
+  {"team": "ci", "max_launches_per_hour": 3, "instance_types": ["c3.2xlarge", "c3.4xlarge"]},
+  {"site": "com", "env": "quota", "queue": "limited", "max_instances": 2}
+]`
+	srv := buildTestServer(cfg)
+
+	conn, err := redis.DialURL(cfg.RedisURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	for _, q := range srv.quotas.quotas {
+		_, err = conn.Do("DEL", fmt.Sprintf("%s:instance_build_launches:%s", pudding.RedisNamespace, q.Scope()))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = db.StoreInstances(conn, map[string]*cloud.Instance{
+		"i-quota01": &cloud.Instance{
+			ID:     "i-quota01",
+			Type:   "c3.2xlarge",
+			Region: "us-east-1",
+			Tags: map[string]string{
+				"site":  "com",
+				"env":   "quota",
+				"queue": "limited",
+			},
+		},
+	}, 300)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body := `{
+    "instance_builds": {
+      "count": %d,
+      "site": "%s",
+      "env": "quota",
+      "queue": "%s",
+      "role": "worker",
+      "instance_type": "%s",
+      "team": "spoofed"
+    }
+}`
+
+	for i, tc := range []struct {
+		token        string
+		count        int
+		site         string
+		queue        string
+		instanceType string
+		status       int
+		body         string
+	}{
+		{"ci-swordfish", 1, "org", "docker", "c3.8xlarge", 403, `does not allow instance types c3.8xlarge`},
+		{"ci-swordfish", 2, "org", "docker", "c3.4xlarge", 202, `"team": "ci"`},
+		{"ci-swordfish", 2, "org", "docker", "c3.4xlarge", 429, `allows at most 3 launches per hour, with 2 in the last hour and 2 requested`},
+		{defaultTestAuthToken, 2, "org", "docker", "c3.8xlarge", 202, `"instance_type": "c3.8xlarge"`},
+		{defaultTestAuthToken, 1, "com", "limited", "c3.8xlarge", 202, `"site": "com"`},
+		{defaultTestAuthToken, 1, "com", "limited", "c3.8xlarge", 429, `allows at most 2 instances, with 2 running or pending and 1 requested`},
+		{defaultTestAuthToken, 1, "com", "other", "c3.8xlarge", 202, `"queue": "other"`},
+	} {
+		req, err := http.NewRequest("POST", "http://example.com/instance-builds",
+			strings.NewReader(fmt.Sprintf(body, tc.count, tc.site, tc.queue, tc.instanceType)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", fmt.Sprintf("token %s", tc.token))
+
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, req)
+		if w.Code != tc.status {
+			t.Fatalf("case %d: response status %v != %v: %s", i, w.Code, tc.status, w.Body.String())
+		}
+		assertBodyMatches(t, tc.body, w.Body.String())
+		if tc.token == defaultTestAuthToken && strings.Contains(w.Body.String(), "spoofed") {
+			t.Fatalf("case %d: expected team to be set by the server, got %s", i, w.Body.String())
+		}
+	}
+
+	asgBody := `{
+    "autoscaling_group_builds": {
+      "site": "%s",
+      "env": "quota",
+      "queue": "%s",
+      "role": "worky",
+      "instance_id": "i-quota01",
+      "role_arn": "arn:aws:iam::1234567899:role/pudding-test-foo",
+      "topic_arn": "arn:aws:sns:us-east-1::1234567899:pudding-test-foo",
+      "min_size": 1,
+      "max_size": %d,
+      "desired_capacity": 1,
+      "default_cooldown": 1200
+    }
+}`
+
+	for i, tc := range []struct {
+		token   string
+		site    string
+		queue   string
+		maxSize int
+		status  int
+		body    string
+	}{
+		{"ci-swordfish", "org", "docker", 2, 429, `allows at most 3 launches per hour, with 2 in the last hour and 2 requested`},
+		{defaultTestAuthToken, "com", "limited", 1, 429, `allows at most 2 instances, with 2 running or pending and 1 requested`},
+		{defaultTestAuthToken, "com", "other", 1, 202, `"queue": "other"`},
+	} {
+		req, err := http.NewRequest("POST", "http://example.com/autoscaling-group-builds",
+			strings.NewReader(fmt.Sprintf(asgBody, tc.site, tc.queue, tc.maxSize)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", fmt.Sprintf("token %s", tc.token))
+
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, req)
+		if w.Code != tc.status {
+			t.Fatalf("autoscaling group case %d: response status %v != %v: %s", i, w.Code, tc.status, w.Body.String())
+		}
+		assertBodyMatches(t, tc.body, w.Body.String())
+	}
+}
+
+func TestInstanceBuildQuotasReserveConcurrently(t *testing.T) {
+	srv := buildTestServer(nil)
+
+	q := &pudding.InstanceBuildQuota{Team: "race", MaxLaunchesPerHour: 5}
+	quotas, err := newInstanceBuildQuotas(srv.quotas.r, srv.quotas.i, []*pudding.InstanceBuildQuota{q})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := redis.DialURL(buildTestConfig().RedisURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	_, err = conn.Do("DEL", fmt.Sprintf("%s:instance_build_launches:%s", pudding.RedisNamespace, q.Scope()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	results := make(chan error, 20)
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results <- quotas.Reserve("race", &pudding.InstanceBuild{ID: fmt.Sprintf("race-%d", i), Count: 1})
+		}(i)
+	}
+	wg.Wait()
+	close(results)
+
+	reserved := 0
+	for err := range results {
+		if err == nil {
+			reserved++
+			continue
+		}
+
+		if _, ok := err.(*instanceBuildQuotaError); !ok {
+			t.Fatal(err)
+		}
+	}
+
+	if reserved != 5 {
+		t.Fatalf("expected 5 concurrent reservations to fit the quota, got %d", reserved)
+	}
+
+	released := &pudding.InstanceBuild{ID: "race-released", Count: 1}
+	err = quotas.Release("race", released)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = quotas.Reserve("race", released); err == nil {
+		t.Fatalf("expected the quota to still be used up")
+	}
+
+	launches, err := db.FetchInstanceBuildLaunches(conn, q.Scope(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for buildID := range launches {
+		err = quotas.Release("race", &pudding.InstanceBuild{ID: buildID, Count: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		break
+	}
+
+	if err = quotas.Reserve("race", released); err != nil {
+		t.Fatalf("expected a released reservation to make room, got %v", err)
+	}
+}
+
+func TestTeamTokens(t *testing.T) {
+	cfg := buildTestConfig()
+	cfg.TeamTokens = "ci=ci-swordfish"
+	srv := buildTestServer(cfg)
+
+	conn, err := redis.DialURL(cfg.RedisURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	err = db.StoreInstances(conn, map[string]*cloud.Instance{
+		"i-teamci1": &cloud.Instance{
+			ID:     "i-teamci1",
+			Type:   "c3.2xlarge",
+			Region: "us-east-1",
+			Tags:   map[string]string{"site": "org", "build_team": "ci"},
+		},
+		"i-teamops": &cloud.Instance{
+			ID:     "i-teamops",
+			Type:   "c3.2xlarge",
+			Region: "us-east-1",
+			Tags:   map[string]string{"site": "org", "build_team": "ops"},
+		},
+	}, 300)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	do := func(method, path string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(method, fmt.Sprintf("http://example.com%s", path), strings.NewReader(""))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "token ci-swordfish")
+
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, req)
+		return w
+	}
+
+	w := do("GET", "/instances")
+	assertStatus(t, 200, w.Code)
+	if !strings.Contains(w.Body.String(), "i-teamci1") || strings.Contains(w.Body.String(), "i-teamops") {
+		t.Fatalf("expected only the team's instances, got %s", w.Body.String())
+	}
+
+	assertStatus(t, 200, do("GET", "/instances/i-teamci1").Code)
+	assertStatus(t, 403, do("GET", "/instances/i-teamops").Code)
+	assertStatus(t, 403, do("DELETE", "/instances/i-teamops").Code)
+	assertStatus(t, 403, do("POST", "/instances/i-teamops/ttl-extensions?ttl=60").Code)
+	assertStatus(t, 403, do("GET", "/audit").Code)
+	assertStatus(t, 403, do("DELETE", "/image-pins/worker").Code)
+	assertStatus(t, 403, do("GET", "/approvals").Code)
+}
+
+func TestApprovals(t *testing.T) {
+	cfg := buildTestConfig()
+	cfg.TeamTokens = "ops=ops-swordfish"
+	cfg.ApprovalPolicies = `[{"env": "production"}, {"instance_types": ["c3.8xlarge"]}]`
+	cfg.InstanceBuildQuotas = `[{"env": "production", "max_launches_per_hour": 1}]`
+	cfg.QueueNames = map[string]string{
+		"instance-builds":          "approvals-test-builds",
+		"autoscaling-group-builds": "approvals-test-asg-builds",
+	}
+
+	_, err := newServer(cfg)
+	if err != errNoApprovers {
+		t.Fatalf("expected approval policies without approver tokens to be refused, got %v", err)
+	}
+
+	cfg.ApproverTokens = "alice=alice-swordfish"
+	srv := buildTestServer(cfg)
+
+	conn, err := redis.DialURL(cfg.RedisURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	queueKey := fmt.Sprintf("%s:queue:approvals-test-builds", pudding.RedisNamespace)
+	asgQueueKey := fmt.Sprintf("%s:queue:approvals-test-asg-builds", pudding.RedisNamespace)
+	for _, key := range []string{queueKey, asgQueueKey} {
+		_, err = conn.Do("DEL", key)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, q := range srv.quotas.quotas {
+		_, err = conn.Do("DEL", fmt.Sprintf("%s:instance_build_launches:%s", pudding.RedisNamespace, q.Scope()))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	do := func(method, path, token string, body io.Reader) *httptest.ResponseRecorder {
+		if body == nil {
+			body = bytes.NewReader([]byte(""))
+		}
+		req, err := http.NewRequest(method, fmt.Sprintf("http://example.com%s", path), body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", fmt.Sprintf("token %s", token))
+
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, req)
+		return w
+	}
+
+	build := func(env, instanceType string) *pudding.InstanceBuild {
+		w := do("POST", "/instance-builds", defaultTestAuthToken, strings.NewReader(fmt.Sprintf(`{
+    "instance_builds": {
+      "count": 1,
+      "site": "org",
+      "env": "%s",
+      "queue": "docker",
+      "role": "worker",
+      "instance_type": "%s"
+    }
+}`, env, instanceType)))
+		assertStatus(t, 202, w.Code)
+
+		coll := &pudding.InstanceBuildsCollection{}
+		err := json.Unmarshal(w.Body.Bytes(), coll)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return coll.InstanceBuilds[0]
+	}
+
+	queueLen := func() int {
+		n, err := redis.Int(conn.Do("LLEN", queueKey))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+
+	prod := build("production", "c3.2xlarge")
+	if prod.State != pudding.ApprovalStateAwaiting || queueLen() != 0 {
+		t.Fatalf("expected build to await approval without being enqueued, got %q and %v queued", prod.State, queueLen())
+	}
+
+	w := do("GET", "/approvals", "alice-swordfish", nil)
+	assertStatus(t, 200, w.Code)
+
+	coll := &pudding.ApprovalsCollection{}
+	err = json.Unmarshal(w.Body.Bytes(), coll)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var held *pudding.Approval
+	for _, a := range coll.Approvals {
+		if a.ID == prod.ID {
+			held = a
+		}
+	}
+
+	if held == nil || held.RequestedBy != "token" || len(held.Policies) != 1 || held.Policies[0] != "env=production" {
+		t.Fatalf("unexpected approval %#v", held)
+	}
+
+	approvePath := fmt.Sprintf("/approvals/%s/approve?reason=%s", prod.ID, url.QueryEscape("looks fine"))
+
+	assertStatus(t, 403, do("POST", approvePath, defaultTestAuthToken, nil).Code)
+	assertStatus(t, 403, do("POST", approvePath, "ops-swordfish", nil).Code)
+	assertStatus(t, 403, do("POST", "/instance-builds", "alice-swordfish", strings.NewReader(`{}`)).Code)
+	assertStatus(t, 400, do("POST", fmt.Sprintf("/approvals/%s/approve", prod.ID), "alice-swordfish", nil).Code)
+	assertStatus(t, 404, do("POST", "/approvals/nope/approve?reason=ok", "alice-swordfish", nil).Code)
+
+	w = do("POST", approvePath, "alice-swordfish", nil)
+	assertStatus(t, 200, w.Code)
+	assertBodyMatches(t, `"state": "approved"`, w.Body.String())
+	assertBodyMatches(t, `"decided_by": "approver:alice"`, w.Body.String())
+	assertBodyMatches(t, `"reason": "looks fine"`, w.Body.String())
+
+	if w.Header().Get(jobIDHeader) == "" || queueLen() != 1 {
+		t.Fatalf("expected approved build to be enqueued, got %q and %v queued", w.Header().Get(jobIDHeader), queueLen())
+	}
+
+	payload, err := redis.String(conn.Do("LINDEX", queueKey, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertBodyMatches(t, `"state":"pending"`, payload)
+	assertBodyMatches(t, fmt.Sprintf(`"jid":"%s"`, w.Header().Get(jobIDHeader)), payload)
+
+	assertStatus(t, 409, do("POST", approvePath, "alice-swordfish", nil).Code)
+
+	big := build("test", "c3.8xlarge")
+	w = do("POST", fmt.Sprintf("/approvals/%s/reject?reason=too+big", big.ID), "alice-swordfish", nil)
+	assertStatus(t, 200, w.Code)
+	assertBodyMatches(t, `"state": "rejected"`, w.Body.String())
+	assertStatus(t, 409, do("POST", fmt.Sprintf("/approvals/%s/approve?reason=changed+my+mind", big.ID), "alice-swordfish", nil).Code)
+
+	if queueLen() != 1 {
+		t.Fatalf("expected rejected build not to be enqueued, got %v queued", queueLen())
+	}
+
+	small := build("test", "c3.2xlarge")
+	if small.State != "pending" || queueLen() != 2 {
+		t.Fatalf("expected build to be enqueued without approval, got %q and %v queued", small.State, queueLen())
+	}
+
+	for state, expected := range map[string]bool{"": false, "all": true, "rejected": true} {
+		w = do("GET", fmt.Sprintf("/approvals?state=%s", state), defaultTestAuthToken, nil)
+		assertStatus(t, 200, w.Code)
+		if strings.Contains(w.Body.String(), big.ID) != expected {
+			t.Fatalf("expected %q approvals to include %q: %v, got %s", state, big.ID, expected, w.Body.String())
+		}
+	}
+
+	overQuota := build("production", "c3.2xlarge")
+	w = do("POST", fmt.Sprintf("/approvals/%s/approve?reason=ok", overQuota.ID), "alice-swordfish", nil)
+	assertStatus(t, 429, w.Code)
+
+	reopened, err := srv.ap.Get(overQuota.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if reopened == nil || reopened.State != pudding.ApprovalStateAwaiting || reopened.DecidedBy != "" || queueLen() != 2 {
+		t.Fatalf("expected approval over quota to be reopened without being enqueued, got %#v and %v queued", reopened, queueLen())
+	}
+
+	w = do("POST", "/autoscaling-group-builds", defaultTestAuthToken,
+		strings.NewReader(`{
+    "autoscaling_group_builds": {
+      "site": "com",
+      "env": "staging",
+      "queue": "fancy",
+      "role": "worky",
+      "instance_types": ["c3.4xlarge", "c3.8xlarge"],
+      "instance_id": "i-abcd123",
+      "role_arn": "arn:aws:iam::1234567899:role/pudding-test-foo",
+      "topic_arn": "arn:aws:sns:us-east-1::1234567899:pudding-test-foo",
+      "min_size": 1,
+      "max_size": 10,
+      "desired_capacity": 1,
+      "default_cooldown": 1200
+    }
+}`))
+	assertStatus(t, 202, w.Code)
+
+	asgColl := &pudding.AutoscalingGroupBuildsCollection{}
+	err = json.Unmarshal(w.Body.Bytes(), asgColl)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	asgQueueLen := func() int {
+		n, err := redis.Int(conn.Do("LLEN", asgQueueKey))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+
+	if asgQueueLen() != 0 {
+		t.Fatalf("expected autoscaling group build to await approval without being enqueued, got %v queued", asgQueueLen())
+	}
+
+	w = do("POST", fmt.Sprintf("/approvals/%s/approve?reason=ok", asgColl.AutoscalingGroupBuilds[0].ID), "alice-swordfish", nil)
+	assertStatus(t, 200, w.Code)
+	assertBodyMatches(t, `"autoscaling_group_build"`, w.Body.String())
+
+	if asgQueueLen() != 1 {
+		t.Fatalf("expected approved autoscaling group build to be enqueued, got %v queued", asgQueueLen())
+	}
+}
+
+func TestBuildPolicies(t *testing.T) {
+	cfg := buildTestConfig()
+	cfg.BuildPolicies = `[
+  {"description": "queue docker may only use c3.* or c4.*", "queue": "docker", "instance_types": ["c3.*", "c4.*"]},
+  {"site": "com", "env": "production", "require": ["subnet_id"]},
+  {"site": "org", "max": {"count": 5, "max_size": 50}}
+]`
+	srv := buildTestServer(cfg)
+
+	do := func(path, body string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest("POST", fmt.Sprintf("http://example.com%s", path), strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", fmt.Sprintf("token %s", defaultTestAuthToken))
+
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, req)
+		return w
+	}
+
+	instanceBuild := func(site, env, instanceType string, count int, subnetID string) string {
+		return fmt.Sprintf(`{
+      "count": %d,
+      "site": "%s",
+      "env": "%s",
+      "queue": "docker",
+      "role": "worker",
+      "instance_type": "%s",
+      "subnet_id": "%s"
+    }`, count, site, env, instanceType, subnetID)
+	}
+
+	asgBuild := func(site, env string, maxSize int) string {
+		return fmt.Sprintf(`{
+      "site": "%s",
+      "env": "%s",
+      "queue": "docker",
+      "role": "worker",
+      "instance_id": "i-abcd123",
+      "role_arn": "arn:aws:iam::1234567899:role/pudding-test-foo",
+      "topic_arn": "arn:aws:sns:us-east-1::1234567899:pudding-test-foo",
+      "min_size": 1,
+      "max_size": %d,
+      "instance_types": ["c4.2xlarge"]
+    }`, site, env, maxSize)
+	}
+
+	w := do("/instance-builds", fmt.Sprintf(`{"instance_builds": %s}`, instanceBuild("org", "test", "m5.large", 10, "")))
+	assertStatus(t, 400, w.Code)
+	assertBodyMatches(t, `policy \\"queue docker may only use c3.\* or c4.\*\\": instance type m5.large is not one of c3.\*, c4.\*`, w.Body.String())
+	assertBodyMatches(t, `policy \\"site=org\\": count must be at most 5`, w.Body.String())
+
+	w = do("/instance-builds", fmt.Sprintf(`{"instance_builds": %s}`, instanceBuild("com", "production", "c4.2xlarge", 1, "")))
+	assertStatus(t, 400, w.Code)
+	assertBodyMatches(t, `policy \\"site=com env=production\\": subnet_id is required`, w.Body.String())
+
+	w = do("/instance-builds", fmt.Sprintf(`{"instance_builds": %s}`, instanceBuild("com", "production", "c4.2xlarge", 1, "subnet-abcd123")))
+	assertStatus(t, 202, w.Code)
+
+	w = do("/autoscaling-group-builds", fmt.Sprintf(`{"autoscaling_group_builds": %s}`, asgBuild("org", "prod", 60)))
+	assertStatus(t, 400, w.Code)
+	assertBodyMatches(t, `policy \\"site=org\\": max_size must be at most 50`, w.Body.String())
+
+	w = do("/autoscaling-group-builds", fmt.Sprintf(`{"autoscaling_group_builds": %s}`, asgBuild("com", "production", 60)))
+	assertStatus(t, 202, w.Code)
+
+	w = do("/policy-checks", fmt.Sprintf(`{"instance_builds": %s, "autoscaling_group_builds": %s}`,
+		instanceBuild("org", "test", "c3.2xlarge", 6, ""), asgBuild("com", "production", 10)))
+	assertStatus(t, 200, w.Code)
+
+	coll := &pudding.PolicyChecksCollection{}
+	err := json.Unmarshal(w.Body.Bytes(), coll)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(coll.PolicyChecks) != 2 {
+		t.Fatalf("expected 2 policy checks, got %s", w.Body.String())
+	}
+
+	ib, asg := coll.PolicyChecks[0], coll.PolicyChecks[1]
+	if ib.Kind != "instance_builds" || ib.Valid || len(ib.Errors) != 1 || ib.Errors[0] != `policy "site=org": count must be at most 5` {
+		t.Fatalf("unexpected instance build policy check %#v", ib)
+	}
+
+	if asg.Kind != "autoscaling_group_builds" || !asg.Valid || len(asg.Errors) != 0 {
+		t.Fatalf("unexpected autoscaling group build policy check %#v", asg)
+	}
+
+	assertStatus(t, 400, do("/policy-checks", `{}`).Code)
+}
+
+func TestBuildPoliciesRefusedAtParse(t *testing.T) {
+	for policies, expected := range map[string]string{
+		`[{"site": "org"}]`:                                    `build policy "site=org" must have instance_types, require, or max rules`,
+		`[{"site": "org", "require": ["subnet"]}]`:             `build policy "site=org" requires unknown field "subnet"`,
+		`[{"site": "org", "max": {"counts": 5}}]`:              `build policy "site=org" has a max for unknown field "counts"`,
+		`[{"site": "org", "max": {"instance_type": 5}}]`:       `build policy "site=org" has a max for non-integer field "instance_type"`,
+		`[{"site": "org", "instance_types": ["c3.["]}]`:        `build policy instance_types must be valid patterns`,
+		`[{"env": "prod", "require": ["subnet_id", "-"]}]`:     `build policy "env=prod" requires unknown field "-"`,
+		`[{"queue": "docker", "max": {"boot_instance": 1}}]`:   `build policy "queue=docker" has a max for non-integer field "boot_instance"`,
+		`[{"role": "worker", "require": ["role_arn"]}, {}]`:    `build policy "\*" must have instance_types, require, or max rules`,
+		`[{"site": "com", "require": ["topic_arn", "bogus"]}]`: `build policy "site=com" requires unknown field "bogus"`,
+	} {
+		cfg := buildTestConfig()
+		cfg.BuildPolicies = policies
+
+		_, err := newServer(cfg)
+		if err == nil || !regexp.MustCompile("^"+expected+"$").MatchString(err.Error()) {
+			t.Fatalf("expected %s to be refused with %q, got %v", policies, expected, err)
+		}
+	}
+
+	cfg := buildTestConfig()
+	cfg.BuildPolicies = `[
+  {"require": ["subnet_id", "topic_arn"]},
+  {"max": {"count": 5, "max_size": 50, "ttl": 3600}}
+]`
+
+	_, err := newServer(cfg)
+	if err != nil {
+		t.Fatalf("expected fields of either kind of build to be accepted, got %v", err)
+	}
+}
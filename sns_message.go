@@ -40,5 +40,31 @@ func (m *SNSMessage) AutoscalingLifecycleAction() (*AutoscalingLifecycleAction,
 		return nil, err
 	}
 
+	if a.Region == "" {
+		a.Region = RegionFromARN(m.TopicARN)
+	}
+
 	return a, nil
 }
+
+// AutoscalingEvent attempts to unmarshal the message payload into an *AutoscalingEvent
+func (m *SNSMessage) AutoscalingEvent() (*AutoscalingEvent, error) {
+	e := &AutoscalingEvent{}
+	err := json.Unmarshal([]byte(m.Message), e)
+	if err != nil {
+		return nil, err
+	}
+
+	return e, nil
+}
+
+// EC2Event attempts to unmarshal the message payload into an *EC2Event
+func (m *SNSMessage) EC2Event() (*EC2Event, error) {
+	e := &EC2Event{}
+	err := json.Unmarshal([]byte(m.Message), e)
+	if err != nil {
+		return nil, err
+	}
+
+	return e, nil
+}
@@ -0,0 +1,83 @@
+package pudding
+
+import (
+	"sort"
+	"strings"
+)
+
+const (
+	// TagKeyPrefix is the prefix of the instance hash fields in which
+	// user tags are stored
+	TagKeyPrefix = "tag:"
+
+	maxTagKeyLength   = 128
+	maxTagValueLength = 256
+)
+
+var (
+	// ReservedTagKeys are the tags that pudding sets itself and which
+	// may not be given as user tags
+	ReservedTagKeys = map[string]bool{
+		"Name":                     true,
+		"build_id":                 true,
+		"build_team":               true,
+		"canary":                   true,
+		"env":                      true,
+		"expires_at":               true,
+		"market":                   true,
+		"queue":                    true,
+		"requested_spot_max_price": true,
+		"role":                     true,
+		"site":                     true,
+		"slack_channel":            true,
+	}
+)
+
+// ValidateTags checks user tags for reserved, empty, or overly long
+// keys and values, returning a slice of all errors found
+func ValidateTags(tags map[string]string) []error {
+	errors := []error{}
+
+	for key, value := range tags {
+		if key == "" || len(key) > maxTagKeyLength || strings.HasPrefix(key, "aws:") {
+			errors = append(errors, errInvalidTagKey)
+			continue
+		}
+		if ReservedTagKeys[key] {
+			errors = append(errors, errReservedTagKey)
+		}
+		if len(value) > maxTagValueLength {
+			errors = append(errors, errInvalidTagValue)
+		}
+	}
+
+	return errors
+}
+
+// MissingRequiredTags returns the sorted required tag keys that are
+// absent or empty in the given tags
+func MissingRequiredTags(tags map[string]string, required []string) []string {
+	missing := []string{}
+	for _, key := range required {
+		if key == "" {
+			continue
+		}
+		if tags[key] == "" {
+			missing = append(missing, key)
+		}
+	}
+
+	sort.Strings(missing)
+	return missing
+}
+
+// SortedTagKeys returns the keys of the given tags in sorted order
+func SortedTagKeys(tags map[string]string) []string {
+	keys := []string{}
+	for key := range tags {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+	return keys
+}
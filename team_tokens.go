@@ -0,0 +1,54 @@
+package pudding
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"strings"
+)
+
+// TeamTokens maps the name of a team to the auth token it uses, which
+// is accepted wherever the auth token is, with the team's instance
+// builds subject to its quotas
+type TeamTokens map[string]string
+
+// ParseTeamTokens parses comma-delimited "{team}={token}" pairs, e.g.
+// "ci=s3cr3t,infra=0th3r"
+func ParseTeamTokens(s string) (TeamTokens, error) {
+	tokens := TeamTokens{}
+	seen := map[string]bool{}
+
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" || strings.TrimSpace(parts[1]) == "" {
+			return nil, fmt.Errorf("invalid team token for %q", strings.TrimSpace(parts[0]))
+		}
+
+		team, token := strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+		if _, ok := tokens[team]; ok || seen[token] {
+			return nil, fmt.Errorf("duplicate team token for %q", team)
+		}
+
+		tokens[team] = token
+		seen[token] = true
+	}
+
+	return tokens, nil
+}
+
+// TeamFor returns the team using the given token, comparing against
+// every team's token in constant time, or "" if there is none
+func (tt TeamTokens) TeamFor(token string) string {
+	found := ""
+	for team, teamToken := range tt {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(teamToken)) == 1 {
+			found = team
+		}
+	}
+
+	return found
+}
@@ -0,0 +1,63 @@
+package workers
+
+import (
+	"github.com/travis-ci/pudding"
+	"github.com/travis-ci/pudding/cloud"
+)
+
+// awsTarget is a region in an account, along with the cloud used to
+// act on it
+type awsTarget struct {
+	AccountID string
+	Cloud     cloud.Cloud
+}
+
+// cloudFor returns the cloud for the region, using the base
+// credentials when roleARN is empty and otherwise those obtained by
+// assuming the role
+func cloudFor(cfg *internalConfig, roleARN, region string) (cloud.Cloud, error) {
+	region, err := awsRegion(cfg, region)
+	if err != nil {
+		return nil, err
+	}
+
+	return newAuditedCloud(cfg, cfg.NewCloud(roleARN, region)), nil
+}
+
+// cloudForSite returns the cloud for the region in the account mapped
+// to the site and env
+func cloudForSite(cfg *internalConfig, site, env, region string) (cloud.Cloud, error) {
+	return cloudFor(cfg, cfg.AccountRoles.RoleARNFor(site, env), region)
+}
+
+// cloudForAccount returns the cloud for the region in the given
+// account, which is the base account when the account isn't mapped
+func cloudForAccount(cfg *internalConfig, accountID, region string) (cloud.Cloud, error) {
+	if accountID == "" {
+		return cloudFor(cfg, "", region)
+	}
+
+	return cloudFor(cfg, cfg.AccountRoles.RoleARNForAccount(accountID), region)
+}
+
+// awsTargets returns every configured region in the base account and
+// in every mapped account
+func awsTargets(cfg *internalConfig) ([]*awsTarget, error) {
+	targets := []*awsTarget{}
+
+	for _, roleARN := range append([]string{""}, cfg.AccountRoles.RoleARNs()...) {
+		for _, region := range awsRegionNames(cfg) {
+			c, err := cloudFor(cfg, roleARN, region)
+			if err != nil {
+				return nil, err
+			}
+
+			targets = append(targets, &awsTarget{
+				AccountID: pudding.AccountIDFromARN(roleARN),
+				Cloud:     c,
+			})
+		}
+	}
+
+	return targets, nil
+}
@@ -0,0 +1,225 @@
+package workers
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/travis-ci/pudding"
+	"github.com/travis-ci/pudding/cloud"
+	"github.com/travis-ci/pudding/db"
+)
+
+// auditedCloud records every action taken through the cloud that
+// changes something in the audit log
+type auditedCloud struct {
+	cloud.Cloud
+
+	al    db.AuditRecorder
+	actor string
+	jid   string
+}
+
+func newAuditedCloud(cfg *internalConfig, c cloud.Cloud) cloud.Cloud {
+	if cfg.AuditLog == nil {
+		return c
+	}
+
+	return &auditedCloud{
+		Cloud: c,
+		al:    cfg.AuditLog,
+		actor: fmt.Sprintf("workers:%s", cfg.ProcessID),
+	}
+}
+
+// withJobID returns the cloud with actions recorded as part of the
+// given job, if audited
+func withJobID(c cloud.Cloud, jid string) cloud.Cloud {
+	ac, ok := c.(*auditedCloud)
+	if !ok {
+		return c
+	}
+
+	withJID := *ac
+	withJID.jid = jid
+	return &withJID
+}
+
+func (ac *auditedCloud) RunInstance(opts *cloud.LaunchOptions) (*cloud.Instance, error) {
+	inst, err := ac.Cloud.RunInstance(opts)
+
+	target := ""
+	if inst != nil {
+		target = inst.ID
+	}
+
+	ac.record("RunInstances", target, err,
+		"image_id", opts.ImageID,
+		"instance_type", opts.InstanceType,
+		"market", opts.Market,
+		"build_id", opts.Tags["build_id"],
+		"role", opts.Tags["role"])
+	return inst, err
+}
+
+func (ac *auditedCloud) CreateTags(ids []string, tags map[string]string) error {
+	err := ac.Cloud.CreateTags(ids, tags)
+
+	keys := []string{}
+	for key := range tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	summary := []string{}
+	for _, key := range keys {
+		summary = append(summary, fmt.Sprintf("tag:%s", key), tags[key])
+	}
+
+	ac.record("CreateTags", strings.Join(ids, ","), err, summary...)
+	return err
+}
+
+func (ac *auditedCloud) TerminateInstances(ids []string) error {
+	err := ac.Cloud.TerminateInstances(ids)
+	ac.record("TerminateInstances", strings.Join(ids, ","), err)
+	return err
+}
+
+func (ac *auditedCloud) CreateSecurityGroup(name, description string) (*cloud.SecurityGroup, error) {
+	sg, err := ac.Cloud.CreateSecurityGroup(name, description)
+
+	target := name
+	if sg != nil {
+		target = sg.ID
+	}
+
+	ac.record("CreateSecurityGroup", target, err, "name", name)
+	return sg, err
+}
+
+func (ac *auditedCloud) AuthorizeSecurityGroupIngress(groupID string, rules []*pudding.IngressRule) error {
+	err := ac.Cloud.AuthorizeSecurityGroupIngress(groupID, rules)
+
+	ruleStrings := []string{}
+	for _, rule := range rules {
+		sources := append(append([]string{}, rule.CIDRs...), rule.SourceSecurityGroupIDs...)
+		ruleStrings = append(ruleStrings, fmt.Sprintf("%s:%d-%d:%s",
+			rule.Protocol, rule.FromPort, rule.ToPort, strings.Join(sources, "+")))
+	}
+
+	ac.record("AuthorizeSecurityGroupIngress", groupID, err,
+		"rules", strings.Join(ruleStrings, ","))
+	return err
+}
+
+func (ac *auditedCloud) DeleteSecurityGroup(groupID string) error {
+	err := ac.Cloud.DeleteSecurityGroup(groupID)
+	ac.record("DeleteSecurityGroup", groupID, err)
+	return err
+}
+
+func (ac *auditedCloud) CreateAutoscalingGroup(opts *cloud.AutoscalingGroupOptions) error {
+	err := ac.Cloud.CreateAutoscalingGroup(opts)
+	ac.record("CreateAutoscalingGroup", opts.Name, err,
+		"instance_id", opts.InstanceID,
+		"min_size", fmt.Sprintf("%d", opts.MinSize),
+		"max_size", fmt.Sprintf("%d", opts.MaxSize))
+	return err
+}
+
+func (ac *auditedCloud) DeleteLaunchTemplate(ID string) error {
+	err := ac.Cloud.DeleteLaunchTemplate(ID)
+	ac.record("DeleteLaunchTemplate", ID, err)
+	return err
+}
+
+func (ac *auditedCloud) PutScalingPolicy(opts *cloud.ScalingPolicyOptions) (string, error) {
+	arn, err := ac.Cloud.PutScalingPolicy(opts)
+	ac.record("PutScalingPolicy", opts.Name, err,
+		"auto_scaling_group_name", opts.AutoscalingGroupName,
+		"adjustment", fmt.Sprintf("%d", opts.Adjustment),
+		"cooldown", fmt.Sprintf("%d", opts.Cooldown))
+	return arn, err
+}
+
+func (ac *auditedCloud) PutMetricAlarm(opts *cloud.MetricAlarmOptions) error {
+	err := ac.Cloud.PutMetricAlarm(opts)
+	ac.record("PutMetricAlarm", opts.Name, err,
+		"metric_name", opts.MetricName,
+		"comparison_operator", opts.ComparisonOperator,
+		"threshold", fmt.Sprintf("%v", opts.Threshold),
+		"action_arns", strings.Join(opts.ActionARNs, ","))
+	return err
+}
+
+func (ac *auditedCloud) PutLifecycleHook(opts *cloud.LifecycleHookOptions) error {
+	err := ac.Cloud.PutLifecycleHook(opts)
+	ac.record("PutLifecycleHook", opts.Name, err,
+		"auto_scaling_group_name", opts.AutoscalingGroupName,
+		"transition", opts.Transition,
+		"default_result", opts.DefaultResult)
+	return err
+}
+
+func (ac *auditedCloud) CompleteLifecycleAction(action *cloud.LifecycleAction, result string) error {
+	err := ac.Cloud.CompleteLifecycleAction(action, result)
+	ac.record("CompleteLifecycleAction", action.InstanceID, err,
+		"auto_scaling_group_name", action.AutoscalingGroupName,
+		"hook_name", action.HookName,
+		"result", result)
+	return err
+}
+
+func (ac *auditedCloud) RecordLifecycleActionHeartbeat(action *cloud.LifecycleAction) error {
+	err := ac.Cloud.RecordLifecycleActionHeartbeat(action)
+	ac.record("RecordLifecycleActionHeartbeat", action.InstanceID, err,
+		"auto_scaling_group_name", action.AutoscalingGroupName,
+		"hook_name", action.HookName)
+	return err
+}
+
+func (ac *auditedCloud) ConfirmSubscription(topicARN, token string) error {
+	err := ac.Cloud.ConfirmSubscription(topicARN, token)
+	ac.record("ConfirmSubscription", topicARN, err)
+	return err
+}
+
+// record appends to the audit log, with the summary given as
+// alternating keys and values, of which the empty ones are left out
+func (ac *auditedCloud) record(action, target string, err error, summary ...string) {
+	parts := []string{fmt.Sprintf("region=%s", ac.Region())}
+	for i := 0; i+1 < len(summary); i += 2 {
+		if summary[i+1] != "" {
+			parts = append(parts, fmt.Sprintf("%s=%s", summary[i], summary[i+1]))
+		}
+	}
+
+	e := &pudding.AuditEntry{
+		Time:    time.Now().UTC().Unix(),
+		Source:  "workers",
+		Actor:   ac.actor,
+		Action:  action,
+		Target:  target,
+		Summary: strings.Join(parts, " "),
+		JobID:   ac.jid,
+		Outcome: pudding.AuditOutcomeOK,
+	}
+
+	if err != nil {
+		e.Outcome = pudding.AuditOutcomeError
+		e.Error = err.Error()
+	}
+
+	recordErr := ac.al.Record(e)
+	if recordErr != nil {
+		log.WithFields(logrus.Fields{
+			"err":    recordErr,
+			"action": action,
+			"target": target,
+			"jid":    ac.jid,
+		}).Error("failed to record audit entry")
+	}
+}
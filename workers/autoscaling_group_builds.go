@@ -5,14 +5,14 @@ import (
 	"encoding/json"
 	"fmt"
 	"html/template"
+	"time"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/garyburd/redigo/redis"
-	"github.com/goamz/goamz/autoscaling"
-	"github.com/goamz/goamz/cloudwatch"
-	"github.com/goamz/goamz/ec2"
 	"github.com/jrallison/go-workers"
 	"github.com/travis-ci/pudding"
+	"github.com/travis-ci/pudding/cloud"
+	"github.com/travis-ci/pudding/db"
 )
 
 func init() {
@@ -49,9 +49,7 @@ type autoscalingGroupBuilderWorker struct {
 	n      []pudding.Notifier
 	jid    string
 	cfg    *internalConfig
-	ec2    *ec2.EC2
-	as     *autoscaling.AutoScaling
-	cw     *cloudwatch.CloudWatch
+	c      cloud.Cloud
 	b      *pudding.AutoscalingGroupBuild
 	name   string
 	sopARN string
@@ -59,22 +57,20 @@ type autoscalingGroupBuilderWorker struct {
 }
 
 func newAutoscalingGroupBuilderWorker(b *pudding.AutoscalingGroupBuild, cfg *internalConfig, jid string, redisConn redis.Conn) (*autoscalingGroupBuilderWorker, error) {
-	notifier := pudding.NewSlackNotifier(cfg.SlackHookPath, cfg.SlackUsername, cfg.SlackIcon)
-
-	cw, err := cloudwatch.NewCloudWatch(cfg.AWSAuth, cfg.AWSRegion.CloudWatchServicepoint)
+	c, err := cloudForSite(cfg, b.Site, b.Env, b.Region)
 	if err != nil {
 		return nil, err
 	}
+	c = withJobID(c, jid)
+	b.Region = c.Region()
 
 	return &autoscalingGroupBuilderWorker{
 		rc:  redisConn,
 		jid: jid,
 		cfg: cfg,
-		n:   []pudding.Notifier{notifier},
+		n:   []pudding.Notifier{cfg.Notifier},
 		b:   b,
-		ec2: ec2.New(cfg.AWSAuth, cfg.AWSRegion),
-		as:  autoscaling.New(cfg.AWSAuth, cfg.AWSRegion),
-		cw:  cw,
+		c:   c,
 	}, nil
 }
 
@@ -88,11 +84,29 @@ func (asgbw *autoscalingGroupBuilderWorker) Build() error {
 		return err
 	}
 
+	err = db.RecordKnownInstanceBuild(asgbw.rc, asgbw.b.ID, time.Now().UTC().Unix(), db.InstanceLaunchRecordExpiry)
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			"err": err,
+			"jid": asgbw.jid,
+		}).Warn("failed to record autoscaling group build as known")
+	}
+
+	err = asgbw.shareInitScript()
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			"err":  err,
+			"name": asg.Name,
+			"jid":  asgbw.jid,
+		}).Error("failed to share init script with autoscaling group")
+		return err
+	}
+
 	sopARN, err := asgbw.createScaleOutPolicy()
 	if err != nil {
 		log.WithFields(logrus.Fields{
 			"err":  err,
-			"name": asg.AutoScalingGroupName,
+			"name": asg.Name,
 			"jid":  asgbw.jid,
 		}).Error("failed to create scale out policy")
 		return err
@@ -104,7 +118,7 @@ func (asgbw *autoscalingGroupBuilderWorker) Build() error {
 	if err != nil {
 		log.WithFields(logrus.Fields{
 			"err":  err,
-			"name": asg.AutoScalingGroupName,
+			"name": asg.Name,
 			"jid":  asgbw.jid,
 		}).Error("failed to create scale in policy")
 		return err
@@ -116,7 +130,7 @@ func (asgbw *autoscalingGroupBuilderWorker) Build() error {
 	if err != nil {
 		log.WithFields(logrus.Fields{
 			"err":  err,
-			"name": asg.AutoScalingGroupName,
+			"name": asg.Name,
 			"jid":  asgbw.jid,
 		}).Error("failed to create scale out metric alarm")
 		return err
@@ -126,7 +140,7 @@ func (asgbw *autoscalingGroupBuilderWorker) Build() error {
 	if err != nil {
 		log.WithFields(logrus.Fields{
 			"err":  err,
-			"name": asg.AutoScalingGroupName,
+			"name": asg.Name,
 			"jid":  asgbw.jid,
 		}).Error("failed to create scale in metric alarm")
 		return err
@@ -136,7 +150,7 @@ func (asgbw *autoscalingGroupBuilderWorker) Build() error {
 	if err != nil {
 		log.WithFields(logrus.Fields{
 			"err":  err,
-			"name": asg.AutoScalingGroupName,
+			"name": asg.Name,
 			"jid":  asgbw.jid,
 		}).Error("failed to create launching lifecycle hook")
 		return err
@@ -146,7 +160,7 @@ func (asgbw *autoscalingGroupBuilderWorker) Build() error {
 	if err != nil {
 		log.WithFields(logrus.Fields{
 			"err":  err,
-			"name": asg.AutoScalingGroupName,
+			"name": asg.Name,
 			"jid":  asgbw.jid,
 		}).Error("failed to create terminating lifecycle hook")
 		return err
@@ -156,7 +170,7 @@ func (asgbw *autoscalingGroupBuilderWorker) Build() error {
 	return nil
 }
 
-func (asgbw *autoscalingGroupBuilderWorker) createAutoscalingGroup() (*autoscaling.CreateAutoScalingGroupParams, error) {
+func (asgbw *autoscalingGroupBuilderWorker) createAutoscalingGroup() (*cloud.AutoscalingGroupOptions, error) {
 	b := asgbw.b
 
 	nameTmpl, err := template.New(fmt.Sprintf("name-template-%s", asgbw.jid)).Parse(b.NameTemplate)
@@ -172,32 +186,40 @@ func (asgbw *autoscalingGroupBuilderWorker) createAutoscalingGroup() (*autoscali
 
 	asgbw.name = nameBuf.String()
 
-	tags := []autoscaling.Tag{
-		autoscaling.Tag{
-			Key: "role", Value: b.Role, PropagateAtLaunch: true,
-		},
-		autoscaling.Tag{
-			Key: "queue", Value: b.Queue, PropagateAtLaunch: true,
-		},
-		autoscaling.Tag{
-			Key: "site", Value: b.Site, PropagateAtLaunch: true,
-		},
-		autoscaling.Tag{
-			Key: "env", Value: b.Env, PropagateAtLaunch: true,
-		},
-		autoscaling.Tag{
-			Key: "Name", Value: asgbw.name, PropagateAtLaunch: true,
-		},
+	tags := map[string]string{}
+	for key, value := range b.Tags {
+		tags[key] = value
+	}
+
+	tags["role"] = b.Role
+	tags["queue"] = b.Queue
+	tags["site"] = b.Site
+	tags["env"] = b.Env
+	tags["Name"] = asgbw.name
+	tags["build_id"] = b.ID
+
+	if b.Team != "" {
+		tags["build_team"] = b.Team
 	}
 
-	asg := &autoscaling.CreateAutoScalingGroupParams{
-		AutoScalingGroupName: asgbw.name,
-		InstanceId:           b.InstanceID,
-		MinSize:              b.MinSize,
-		MaxSize:              b.MaxSize,
-		DesiredCapacity:      b.DesiredCapacity,
-		DefaultCooldown:      b.DefaultCooldown,
-		Tags:                 tags,
+	asg := &cloud.AutoscalingGroupOptions{
+		Name:            asgbw.name,
+		InstanceID:      b.InstanceID,
+		MinSize:         b.MinSize,
+		MaxSize:         b.MaxSize,
+		DesiredCapacity: b.DesiredCapacity,
+		DefaultCooldown: b.DefaultCooldown,
+		Tags:            tags,
+	}
+
+	if b.UsesMixedInstances() {
+		asg.MixedInstances = &cloud.MixedInstancesOptions{
+			InstanceTypes:          b.InstanceTypes,
+			OnDemandBaseCapacity:   b.OnDemandBaseCapacity,
+			SpotPercentage:         b.SpotPercentage,
+			SpotMaxPrice:           b.SpotMaxPrice,
+			SpotAllocationStrategy: b.SpotAllocationStrategy,
+		}
 	}
 
 	log.WithFields(logrus.Fields{
@@ -205,8 +227,48 @@ func (asgbw *autoscalingGroupBuilderWorker) createAutoscalingGroup() (*autoscali
 		"asg": fmt.Sprintf("%#v", asg),
 	}).Debug("creating autoscaling group")
 
-	_, err = asgbw.as.CreateAutoScalingGroup(asg)
-	return asg, err
+	return asg, asgbw.c.CreateAutoscalingGroup(asg)
+}
+
+// shareInitScript lets the instances the group launches fetch the init
+// script of the instance the group was made from, as their user data
+// is copied from it
+func (asgbw *autoscalingGroupBuilderWorker) shareInitScript() error {
+	instanceBuildID := ""
+
+	rec, err := db.FetchInstanceLaunchRecord(asgbw.rc, asgbw.b.InstanceID)
+	if err != nil {
+		return err
+	}
+
+	if rec != nil {
+		instanceBuildID = rec.InstanceBuildID
+	} else {
+		instances, err := db.FetchInstances(asgbw.rc, map[string]string{"instance_id": asgbw.b.InstanceID})
+		if err != nil {
+			return err
+		}
+
+		if len(instances) > 0 {
+			instanceBuildID = instances[0].BuildID
+		}
+	}
+
+	if instanceBuildID == "" {
+		log.WithFields(logrus.Fields{
+			"jid":         asgbw.jid,
+			"instance_id": asgbw.b.InstanceID,
+		}).Warn("no init script known for autoscaling group instance")
+		return nil
+	}
+
+	log.WithFields(logrus.Fields{
+		"jid":               asgbw.jid,
+		"name":              asgbw.name,
+		"instance_build_id": instanceBuildID,
+	}).Debug("sharing init script with autoscaling group")
+
+	return db.StoreInitScriptAutoscalingGroup(asgbw.rc, instanceBuildID, asgbw.name, asgbw.b.ID, asgbw.cfg.InitScriptSharedExpiry)
 }
 
 func (asgbw *autoscalingGroupBuilderWorker) createScaleOutPolicy() (string, error) {
@@ -215,20 +277,12 @@ func (asgbw *autoscalingGroupBuilderWorker) createScaleOutPolicy() (string, erro
 		"name": asgbw.name,
 	}).Debug("creating scale out policy")
 
-	sop := &autoscaling.PutScalingPolicyParams{
-		PolicyName:           fmt.Sprintf("%s-sop", asgbw.name),
-		AutoScalingGroupName: asgbw.name,
-		AdjustmentType:       "ChangeInCapacity",
+	return asgbw.c.PutScalingPolicy(&cloud.ScalingPolicyOptions{
+		Name:                 fmt.Sprintf("%s-sop", asgbw.name),
+		AutoscalingGroupName: asgbw.name,
 		Cooldown:             asgbw.b.ScaleOutCooldown,
-		ScalingAdjustment:    asgbw.b.ScaleOutAdjustment,
-	}
-
-	resp, err := asgbw.as.PutScalingPolicy(sop)
-	if err != nil {
-		return "", err
-	}
-
-	return resp.PolicyARN, nil
+		Adjustment:           asgbw.b.ScaleOutAdjustment,
+	})
 }
 
 func (asgbw *autoscalingGroupBuilderWorker) createScaleInPolicy() (string, error) {
@@ -237,20 +291,12 @@ func (asgbw *autoscalingGroupBuilderWorker) createScaleInPolicy() (string, error
 		"name": asgbw.name,
 	}).Debug("creating scale in policy")
 
-	sip := &autoscaling.PutScalingPolicyParams{
-		PolicyName:           fmt.Sprintf("%s-sip", asgbw.name),
-		AutoScalingGroupName: asgbw.name,
-		AdjustmentType:       "ChangeInCapacity",
+	return asgbw.c.PutScalingPolicy(&cloud.ScalingPolicyOptions{
+		Name:                 fmt.Sprintf("%s-sip", asgbw.name),
+		AutoscalingGroupName: asgbw.name,
 		Cooldown:             asgbw.b.ScaleInCooldown,
-		ScalingAdjustment:    asgbw.b.ScaleInAdjustment,
-	}
-
-	resp, err := asgbw.as.PutScalingPolicy(sip)
-	if err != nil {
-		return "", err
-	}
-
-	return resp.PolicyARN, nil
+		Adjustment:           asgbw.b.ScaleInAdjustment,
+	})
 }
 
 func (asgbw *autoscalingGroupBuilderWorker) createScaleOutMetricAlarm() error {
@@ -259,8 +305,8 @@ func (asgbw *autoscalingGroupBuilderWorker) createScaleOutMetricAlarm() error {
 		"name": asgbw.name,
 	}).Debug("creating scale out metric alarm")
 
-	ma := &cloudwatch.MetricAlarm{
-		AlarmName:          fmt.Sprintf("%s-add-capacity", asgbw.name),
+	return asgbw.c.PutMetricAlarm(&cloud.MetricAlarmOptions{
+		Name:               fmt.Sprintf("%s-add-capacity", asgbw.name),
 		MetricName:         asgbw.b.ScaleOutMetricName,
 		Namespace:          asgbw.b.ScaleOutMetricNamespace,
 		Statistic:          asgbw.b.ScaleOutMetricStatistic,
@@ -268,21 +314,8 @@ func (asgbw *autoscalingGroupBuilderWorker) createScaleOutMetricAlarm() error {
 		Threshold:          asgbw.b.ScaleOutMetricThreshold,
 		ComparisonOperator: asgbw.b.ScaleOutMetricComparisonOperator,
 		EvaluationPeriods:  asgbw.b.ScaleOutMetricEvaluationPeriods,
-		AlarmActions: []cloudwatch.AlarmAction{
-			cloudwatch.AlarmAction{
-				ARN: asgbw.sopARN,
-			},
-		},
-		//		Dimensions: []cloudwatch.Dimension{
-		//			cloudwatch.Dimension{
-		//				Name:  "AutoScalingGroupName",
-		//				Value: asgbw.name,
-		//			},
-		//		},
-	}
-
-	_, err := asgbw.cw.PutMetricAlarm(ma)
-	return err
+		ActionARNs:         []string{asgbw.sopARN},
+	})
 }
 
 func (asgbw *autoscalingGroupBuilderWorker) createScaleInMetricAlarm() error {
@@ -291,8 +324,8 @@ func (asgbw *autoscalingGroupBuilderWorker) createScaleInMetricAlarm() error {
 		"name": asgbw.name,
 	}).Debug("creating scale in metric alarm")
 
-	ma := &cloudwatch.MetricAlarm{
-		AlarmName:          fmt.Sprintf("%s-remove-capacity", asgbw.name),
+	return asgbw.c.PutMetricAlarm(&cloud.MetricAlarmOptions{
+		Name:               fmt.Sprintf("%s-remove-capacity", asgbw.name),
 		MetricName:         asgbw.b.ScaleInMetricName,
 		Namespace:          asgbw.b.ScaleInMetricNamespace,
 		Statistic:          asgbw.b.ScaleInMetricStatistic,
@@ -300,21 +333,8 @@ func (asgbw *autoscalingGroupBuilderWorker) createScaleInMetricAlarm() error {
 		Threshold:          asgbw.b.ScaleInMetricThreshold,
 		ComparisonOperator: asgbw.b.ScaleInMetricComparisonOperator,
 		EvaluationPeriods:  asgbw.b.ScaleInMetricEvaluationPeriods,
-		AlarmActions: []cloudwatch.AlarmAction{
-			cloudwatch.AlarmAction{
-				ARN: asgbw.sipARN,
-			},
-		},
-		//		Dimensions: []cloudwatch.Dimension{
-		//			cloudwatch.Dimension{
-		//				Name:  "AutoScalingGroupName",
-		//				Value: asgbw.name,
-		//			},
-		//		},
-	}
-
-	_, err := asgbw.cw.PutMetricAlarm(ma)
-	return err
+		ActionARNs:         []string{asgbw.sipARN},
+	})
 }
 
 func (asgbw *autoscalingGroupBuilderWorker) createLaunchingLifecycleHook() error {
@@ -323,18 +343,15 @@ func (asgbw *autoscalingGroupBuilderWorker) createLaunchingLifecycleHook() error
 		"name": asgbw.name,
 	}).Debug("creating launching lifecycle hook")
 
-	llch := &autoscaling.PutLifecycleHookParams{
-		AutoScalingGroupName:  asgbw.name,
+	return asgbw.c.PutLifecycleHook(&cloud.LifecycleHookOptions{
+		Name:                  fmt.Sprintf("%s-lch-launching", asgbw.name),
+		AutoscalingGroupName:  asgbw.name,
+		Transition:            "autoscaling:EC2_INSTANCE_LAUNCHING",
 		DefaultResult:         asgbw.b.LifecycleDefaultResult,
 		HeartbeatTimeout:      asgbw.b.LifecycleHeartbeatTimeout,
-		LifecycleHookName:     fmt.Sprintf("%s-lch-launching", asgbw.name),
-		LifecycleTransition:   "autoscaling:EC2_INSTANCE_LAUNCHING",
 		NotificationTargetARN: asgbw.b.TopicARN,
 		RoleARN:               asgbw.b.RoleARN,
-	}
-
-	_, err := asgbw.as.PutLifecycleHook(llch)
-	return err
+	})
 }
 
 func (asgbw *autoscalingGroupBuilderWorker) createTerminatingLifecycleHook() error {
@@ -343,16 +360,13 @@ func (asgbw *autoscalingGroupBuilderWorker) createTerminatingLifecycleHook() err
 		"name": asgbw.name,
 	}).Debug("creating terminating lifecycle hook")
 
-	tlch := &autoscaling.PutLifecycleHookParams{
-		AutoScalingGroupName:  asgbw.name,
+	return asgbw.c.PutLifecycleHook(&cloud.LifecycleHookOptions{
+		Name:                  fmt.Sprintf("%s-lch-terminating", asgbw.name),
+		AutoscalingGroupName:  asgbw.name,
+		Transition:            "autoscaling:EC2_INSTANCE_TERMINATING",
 		DefaultResult:         asgbw.b.LifecycleDefaultResult,
 		HeartbeatTimeout:      asgbw.b.LifecycleHeartbeatTimeout,
-		LifecycleHookName:     fmt.Sprintf("%s-lch-terminating", asgbw.name),
-		LifecycleTransition:   "autoscaling:EC2_INSTANCE_TERMINATING",
 		NotificationTargetARN: asgbw.b.TopicARN,
 		RoleARN:               asgbw.b.RoleARN,
-	}
-
-	_, err := asgbw.as.PutLifecycleHook(tlch)
-	return err
+	})
 }
@@ -0,0 +1,48 @@
+package workers
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/travis-ci/pudding/cloud"
+)
+
+// newAWSCloudFunc returns the func used to get a cloud.Cloud for a
+// role and region.  The base credentials are the given key and secret
+// when present, and otherwise come from the standard credential chain.
+// Credentials for assumed roles are shared across regions and
+// refreshed by the sdk shortly before they expire.
+func newAWSCloudFunc(key, secret, processID string) func(string, string) cloud.Cloud {
+	var (
+		roleCreds      = map[string]*credentials.Credentials{}
+		roleCredsMutex sync.Mutex
+	)
+
+	return func(roleARN, region string) cloud.Cloud {
+		sess := cloud.NewAWSSession(key, secret, region)
+		if roleARN == "" {
+			return cloud.NewAWS(sess, region)
+		}
+
+		roleCredsMutex.Lock()
+		creds, ok := roleCreds[roleARN]
+		if !ok {
+			log.WithField("role_arn", roleARN).Debug("assuming role")
+
+			creds = stscreds.NewCredentials(sess, roleARN, func(p *stscreds.AssumeRoleProvider) {
+				p.RoleSessionName = fmt.Sprintf("pudding-workers-%s", processID)
+			})
+			roleCreds[roleARN] = creds
+		}
+		roleCredsMutex.Unlock()
+
+		return cloud.NewAWS(session.New(&aws.Config{
+			Region:      aws.String(region),
+			Credentials: creds,
+		}), region)
+	}
+}
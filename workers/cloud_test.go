@@ -0,0 +1,1062 @@
+package workers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/travis-ci/pudding"
+	"github.com/travis-ci/pudding/cloud"
+	"github.com/travis-ci/pudding/db"
+)
+
+func init() {
+	pudding.RedisNamespace = "pudding-workers-test"
+}
+
+func testRedisURL() string {
+	v := os.Getenv("REDIS_URL")
+	if v == "" {
+		v = "redis://localhost:6379/0"
+	}
+	return v
+}
+
+func buildTestInternalConfig(fake *cloud.Fake) *internalConfig {
+	return &internalConfig{
+		AWSRegion:  fake.Region(),
+		AWSRegions: map[string]bool{fake.Region(): true},
+		NewCloud: func(roleARN, region string) cloud.Cloud {
+			return fake
+		},
+		SecurityGroupGCGracePeriod: 3600,
+	}
+}
+
+func TestHandleInstanceLifecycleTransitionCompletesAction(t *testing.T) {
+	fake := cloud.NewFake("us-east-1")
+	cfg := buildTestInternalConfig(fake)
+
+	r, err := db.BuildRedisPool(testRedisURL())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn := r.Get()
+	defer conn.Close()
+
+	err = db.StoreInstanceLifecycleAction(conn, &pudding.AutoscalingLifecycleAction{
+		AutoScalingGroupName: "worky-com-prod-fancy",
+		LifecycleHookName:    "worky-com-prod-fancy-lch-launching",
+		LifecycleActionToken: "abcd-token",
+		LifecycleTransition:  "autoscaling:EC2_INSTANCE_LAUNCHING",
+		EC2InstanceID:        "i-abcd123",
+		Region:               "us-east-1",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = handleInstanceLifecycleTransition(cfg, conn, "jid-abcd", &pudding.InstanceLifecycleTransition{
+		InstanceID: "i-abcd123",
+		Transition: "launching",
+		Result:     "CONTINUE",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(fake.CompletedLifecycleActions) != 1 {
+		t.Fatalf("expected 1 completed lifecycle action, got %v", len(fake.CompletedLifecycleActions))
+	}
+
+	action := fake.CompletedLifecycleActions[0]
+	if action.Token != "abcd-token" || action.AutoscalingGroupName != "worky-com-prod-fancy" {
+		t.Fatalf("unexpected lifecycle action %#v", action)
+	}
+
+	ala, err := db.FetchInstanceLifecycleAction(conn, "launching", "i-abcd123")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ala != nil {
+		t.Fatalf("expected lifecycle action to be wiped, got %#v", ala)
+	}
+}
+
+func TestLifecycleActionResolverResolve(t *testing.T) {
+	fake := cloud.NewFake("us-east-1")
+	cfg := buildTestInternalConfig(fake)
+	n := &recordingNotifier{}
+	cfg.Notifier = n
+	cfg.DefaultSlackChannel = "#pudding-test"
+	cfg.LifecycleHeartbeatInterval = 60
+	cfg.LifecycleActionTimeout = 3600
+	cfg.LifecycleTimeoutResults = map[string]string{"launching": "ABANDON"}
+
+	r, err := db.BuildRedisPool(testRedisURL())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn := r.Get()
+	defer conn.Close()
+
+	now := time.Now().UTC().Unix()
+	suffix := fmt.Sprintf("%d", time.Now().UnixNano())
+	expiredID := "i-lcexpired" + suffix
+	beatingID := "i-lcbeating" + suffix
+	freshID := "i-lcfresh" + suffix
+
+	for instanceID, storedAt := range map[string]int64{
+		expiredID: now - 7200,
+		beatingID: now - 120,
+		freshID:   now - 10,
+	} {
+		err = db.StoreInstanceLifecycleAction(conn, &pudding.AutoscalingLifecycleAction{
+			AutoScalingGroupName: "worky-com-prod-fancy",
+			LifecycleHookName:    "worky-com-prod-fancy-lch-launching",
+			LifecycleActionToken: "token-" + instanceID,
+			LifecycleTransition:  "autoscaling:EC2_INSTANCE_LAUNCHING",
+			EC2InstanceID:        instanceID,
+			Region:               "us-east-1",
+			StoredAt:             storedAt,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	resolver, err := newLifecycleActionResolver(cfg, r, log)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = resolver.Resolve()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	actionsFor := func(actions []*cloud.LifecycleAction, instanceID string) int {
+		count := 0
+		for _, action := range actions {
+			if action.InstanceID == instanceID {
+				count++
+			}
+		}
+		return count
+	}
+
+	// the expired action is completed with the result configured for
+	// its transition and wiped
+	if actionsFor(fake.CompletedLifecycleActions, expiredID) != 1 {
+		t.Fatalf("expected expired lifecycle action to be completed")
+	}
+
+	if msg := n.find(expiredID); !strings.Contains(msg, "with *ABANDON*") {
+		t.Fatalf("expected expired lifecycle action to be resolved with ABANDON, got %q", msg)
+	}
+
+	ala, err := db.FetchInstanceLifecycleAction(conn, "launching", expiredID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ala != nil {
+		t.Fatalf("expected expired lifecycle action to be wiped, got %#v", ala)
+	}
+
+	// the unexpired action past the heartbeat interval gets a heartbeat
+	if actionsFor(fake.LifecycleHeartbeats, beatingID) != 1 || actionsFor(fake.CompletedLifecycleActions, beatingID) != 0 {
+		t.Fatalf("expected a heartbeat for the unexpired lifecycle action and nothing more")
+	}
+
+	ala, err = db.FetchInstanceLifecycleAction(conn, "launching", beatingID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ala == nil || ala.HeartbeatAt < now {
+		t.Fatalf("expected heartbeat to be recorded, got %#v", ala)
+	}
+
+	// the fresh action is left alone
+	if actionsFor(fake.LifecycleHeartbeats, freshID) != 0 || actionsFor(fake.CompletedLifecycleActions, freshID) != 0 {
+		t.Fatalf("expected the fresh lifecycle action to be left alone")
+	}
+
+	// a heartbeat is not recorded again within the interval
+	err = resolver.Resolve()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if actionsFor(fake.LifecycleHeartbeats, beatingID) != 1 {
+		t.Fatalf("expected no further heartbeat within the interval")
+	}
+
+	for _, instanceID := range []string{beatingID, freshID} {
+		err = db.WipeInstanceLifecycleAction(conn, "launching", instanceID)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestHandleAutoscalingEventLaunchAndTerminate(t *testing.T) {
+	fake := cloud.NewFake("us-east-1")
+	cfg := buildTestInternalConfig(fake)
+	cfg.InstanceStoreExpiry = 300
+
+	r, err := db.BuildRedisPool(testRedisURL())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn := r.Get()
+	defer conn.Close()
+
+	instanceID := fmt.Sprintf("i-asgevent%d", time.Now().UnixNano())
+	instanceAttrsKey := fmt.Sprintf("%s:instance:%s", pudding.RedisNamespace, instanceID)
+
+	err = handleAutoscalingEvent(cfg, conn, &pudding.AutoscalingEvent{
+		Event:                pudding.AutoscalingEventLaunch,
+		AutoScalingGroupName: "worky-com-prod-fancy",
+		EC2InstanceID:        instanceID,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ttl, err := redis.Int(conn.Do("TTL", instanceAttrsKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ttl <= 0 || ttl > cfg.InstanceStoreExpiry {
+		t.Fatalf("expected launched instance to expire within %v, got ttl %v", cfg.InstanceStoreExpiry, ttl)
+	}
+
+	err = handleAutoscalingEvent(cfg, conn, &pudding.AutoscalingEvent{
+		Event:                pudding.AutoscalingEventTerminate,
+		AutoScalingGroupName: "worky-com-prod-fancy",
+		EC2InstanceID:        instanceID,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exists, err := redis.Bool(conn.Do("EXISTS", instanceAttrsKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if exists {
+		t.Fatalf("expected terminated instance hash to be removed")
+	}
+}
+
+func TestHandleEC2EventNotifiesBuildChannel(t *testing.T) {
+	fake := cloud.NewFake("us-east-1")
+	cfg := buildTestInternalConfig(fake)
+	n := &recordingNotifier{}
+	cfg.Notifier = n
+	cfg.DefaultSlackChannel = "#pudding-default"
+
+	r, err := db.BuildRedisPool(testRedisURL())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn := r.Get()
+	defer conn.Close()
+
+	suffix := fmt.Sprintf("%d", time.Now().UnixNano())
+	teamInstanceID := "i-ec2team" + suffix
+	otherInstanceID := "i-ec2other" + suffix
+
+	err = db.SetInstanceAttributes(conn, teamInstanceID, map[string]string{
+		"instance_id":   teamInstanceID,
+		"slack_channel": "#team-spot",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, instanceID := range []string{teamInstanceID, otherInstanceID} {
+		err = handleEC2Event(cfg, conn, &pudding.EC2Event{
+			Source:     "aws.ec2",
+			DetailType: pudding.EC2EventSpotInterruption,
+			Detail:     pudding.EC2EventDetail{InstanceID: instanceID, InstanceAction: "terminate"},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if msg := n.find(teamInstanceID); !strings.HasPrefix(msg, "#team-spot: ") {
+		t.Fatalf("expected the build's channel to be notified, got %q", msg)
+	}
+
+	if msg := n.find(otherInstanceID); !strings.HasPrefix(msg, "#pudding-default: ") {
+		t.Fatalf("expected the default channel to be notified, got %q", msg)
+	}
+
+	conn.Do("DEL",
+		fmt.Sprintf("%s:instance:%s", pudding.RedisNamespace, teamInstanceID),
+		fmt.Sprintf("%s:instance:%s", pudding.RedisNamespace, otherInstanceID))
+}
+
+func TestSecurityGroupCollectorCollect(t *testing.T) {
+	fake := cloud.NewFake("us-east-1")
+	cfg := buildTestInternalConfig(fake)
+
+	old := time.Now().UTC().Add(-2 * time.Hour).Unix()
+	recent := time.Now().UTC().Unix()
+
+	unused, _ := fake.CreateSecurityGroup(fmt.Sprintf("pudding-%d-0xc820000001", old), "")
+	inUse, _ := fake.CreateSecurityGroup(fmt.Sprintf("pudding-%d-0xc820000002", old), "")
+	young, _ := fake.CreateSecurityGroup(fmt.Sprintf("pudding-%d-0xc820000003", recent), "")
+	managed, _ := fake.CreateSecurityGroup(pudding.ManagedSecurityGroupName("org", "prod"), "")
+	asgOnly, _ := fake.CreateSecurityGroup(fmt.Sprintf("pudding-%d-0xc820000004", old), "")
+	templateOnly, _ := fake.CreateSecurityGroup(fmt.Sprintf("pudding-%d-0xc820000005", old), "")
+
+	_, err := fake.RunInstance(&cloud.LaunchOptions{SecurityGroupIDs: []string{inUse.ID}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// an autoscaling group scaled in to nothing, made from an instance
+	// since terminated, still launches with the instance's group
+	source, err := fake.RunInstance(&cloud.LaunchOptions{SecurityGroupIDs: []string{asgOnly.ID}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = fake.CreateAutoscalingGroup(&cloud.AutoscalingGroupOptions{Name: "pudding-asg-gc", InstanceID: source.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = fake.TerminateInstances([]string{source.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fake.LaunchTemplates["lt-gc"] = &cloud.LaunchTemplate{
+		ID:               "lt-gc",
+		Name:             "pudding-lt-gc",
+		SecurityGroupIDs: []string{templateOnly.ID},
+	}
+
+	// the launch templates of mixed-instances groups go with the group,
+	// taking the security group they launch with along
+	orphanedTemplateOnly, _ := fake.CreateSecurityGroup(fmt.Sprintf("pudding-%d-0xc820000006", old), "")
+	fake.LaunchTemplates["lt-orphaned"] = &cloud.LaunchTemplate{
+		ID:               "lt-orphaned",
+		Name:             "pudding-asg-gone-lt",
+		CreatedAt:        old,
+		SecurityGroupIDs: []string{orphanedTemplateOnly.ID},
+		Tags:             map[string]string{cloud.LaunchTemplateAutoscalingGroupTag: "pudding-asg-gone"},
+	}
+	fake.LaunchTemplates["lt-asg"] = &cloud.LaunchTemplate{
+		ID:        "lt-asg",
+		Name:      "pudding-asg-gc-lt",
+		CreatedAt: old,
+		Tags:      map[string]string{cloud.LaunchTemplateAutoscalingGroupTag: "pudding-asg-gc"},
+	}
+	fake.LaunchTemplates["lt-young"] = &cloud.LaunchTemplate{
+		ID:        "lt-young",
+		Name:      "pudding-asg-coming-lt",
+		CreatedAt: recent,
+		Tags:      map[string]string{cloud.LaunchTemplateAutoscalingGroupTag: "pudding-asg-coming"},
+	}
+
+	r, err := db.BuildRedisPool(testRedisURL())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sgc, err := newSecurityGroupCollector(cfg, r, log)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = sgc.Collect()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, sg := range []*cloud.SecurityGroup{unused, orphanedTemplateOnly} {
+		if _, ok := fake.SecurityGroups[sg.ID]; ok {
+			t.Fatalf("expected unused security group %q to be deleted", sg.Name)
+		}
+	}
+
+	if _, ok := fake.LaunchTemplates["lt-orphaned"]; ok {
+		t.Fatalf("expected launch template of missing autoscaling group to be deleted")
+	}
+
+	for _, ID := range []string{"lt-gc", "lt-asg", "lt-young"} {
+		if _, ok := fake.LaunchTemplates[ID]; !ok {
+			t.Fatalf("expected launch template %q to be kept", ID)
+		}
+	}
+
+	report, err := sgc.rep.Fetch()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(report.LaunchTemplates) != 1 || report.LaunchTemplates[0].Action != "deleted" ||
+		report.LaunchTemplates[0].AutoscalingGroupName != "pudding-asg-gone" {
+		t.Fatalf("unexpected launch template gc report %#v", report.LaunchTemplates)
+	}
+
+	for _, sg := range []*cloud.SecurityGroup{inUse, young, managed, asgOnly, templateOnly} {
+		if _, ok := fake.SecurityGroups[sg.ID]; !ok {
+			t.Fatalf("expected security group %q to be kept", sg.Name)
+		}
+	}
+}
+
+func TestInstanceBuilderSecurityGroupIngress(t *testing.T) {
+	fake := cloud.NewFake("us-east-1")
+	cfg := buildTestInternalConfig(fake)
+
+	defaults, err := pudding.ParseIngressRules(pudding.DefaultIngressRulesJSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.DefaultIngressRules = defaults
+
+	for _, rule := range defaults {
+		if rule.IsWorldOpenSSH() {
+			t.Fatalf("expected default ingress rules not to open ssh to the world, got %v", rule)
+		}
+	}
+
+	r, err := db.BuildRedisPool(testRedisURL())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn := r.Get()
+	defer conn.Close()
+
+	newBuild := func() *pudding.InstanceBuild {
+		b := pudding.NewInstanceBuild()
+		b.ID = "abcd1234-abcd-abcd-abcd-abcdingress00"
+		b.Site, b.Env, b.Role, b.Queue = "org", "ingress", "worker", "docker"
+		b.Hydrate()
+		return b
+	}
+
+	newWorker := func(b *pudding.InstanceBuild) *instanceBuilderWorker {
+		ibw, err := newInstanceBuilderWorker(b, cfg, "jid-ingress", conn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ibw
+	}
+
+	// site and env rules opening ssh to the world are refused before
+	// any security group is made
+	os.Setenv("PUDDING_INGRESS_RULES_ORG_INGRESS", `[{"protocol":"tcp","from_port":0,"to_port":65535,"cidrs":["0.0.0.0/0"]}]`)
+	err = newWorker(newBuild()).createSecurityGroup()
+	os.Unsetenv("PUDDING_INGRESS_RULES_ORG_INGRESS")
+
+	if err == nil || len(fake.SecurityGroups) != 0 {
+		t.Fatalf("expected world open ssh to be refused, got %v and %#v", err, fake.SecurityGroups)
+	}
+
+	// a security group whose rules can't be authorized isn't left behind
+	fake.Errors["AuthorizeSecurityGroupIngress"] = &cloud.Error{Code: "InvalidPermission.Malformed"}
+	err = newWorker(newBuild()).createSecurityGroup()
+	delete(fake.Errors, "AuthorizeSecurityGroupIngress")
+
+	if err == nil || len(fake.SecurityGroups) != 0 {
+		t.Fatalf("expected security group to be deleted, got %v and %#v", err, fake.SecurityGroups)
+	}
+
+	// the managed security group gets the site and env rules rather
+	// than those of whichever build happens to create it
+	b := newBuild()
+	b.ManagedSecurityGroup = true
+	b.IngressRules = []*pudding.IngressRule{
+		{Protocol: "tcp", FromPort: 8080, ToPort: 8080, CIDRs: []string{"10.1.0.0/16"}},
+	}
+
+	ibw := newWorker(b)
+	err = ibw.resolveManagedSecurityGroup()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rules := fake.Ingress[ibw.sg.ID]
+	if len(rules) != len(defaults) || rules[0].String() != defaults[0].String() {
+		t.Fatalf("expected managed security group to get the default rules, got %v", rules)
+	}
+}
+
+func TestInstanceBuilderResolveAMI(t *testing.T) {
+	fake := cloud.NewFake("us-east-1")
+	cfg := buildTestInternalConfig(fake)
+
+	r, err := db.BuildRedisPool(testRedisURL())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn := r.Get()
+	defer conn.Close()
+
+	suffix := fmt.Sprintf("%d", time.Now().UnixNano())
+	role := "resolve" + suffix
+	pinnedAMI, siteAMI, canaryAMI := "ami-pinned"+suffix, "ami-site"+suffix, "ami-canary"+suffix
+	for _, ID := range []string{pinnedAMI, siteAMI, canaryAMI} {
+		fake.Images[ID] = &cloud.Image{ID: ID, Tags: map[string]string{"role": role}}
+	}
+
+	resolve := func(site, ami string) (*pudding.InstanceBuild, error) {
+		b := pudding.NewInstanceBuild()
+		b.ID = "abcd1234-abcd-abcd-abcd-abcdresolve0"
+		b.Site, b.Env, b.Role, b.Queue, b.AMI = site, "test", role, "docker", ami
+		b.Hydrate()
+
+		ibw, err := newInstanceBuilderWorker(b, cfg, "jid-resolve", conn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b, ibw.resolveAMI()
+	}
+
+	for _, p := range []*pudding.ImagePromotion{
+		{ImageID: pinnedAMI, Role: role, Region: fake.Region(), Pin: true},
+		{ImageID: siteAMI, Role: role, Site: "org", Region: fake.Region()},
+	} {
+		err = db.PromoteImage(conn, p, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// pins only hold back promotions in their own scope, so the more
+	// specific scope wins
+	for site, expected := range map[string]string{"org": siteAMI, "com": pinnedAMI} {
+		b, err := resolve(site, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if b.AMI != expected || b.Canary {
+			t.Fatalf("expected %s to resolve to %s, got %s", site, expected, b.AMI)
+		}
+	}
+
+	err = db.SetImageCanary(conn, &pudding.ImageCanary{ImageID: canaryAMI, Role: role, Site: "org", Region: fake.Region(), Weight: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := resolve("org", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if b.AMI != canaryAMI || !b.Canary {
+		t.Fatalf("expected canary ami, got %s", b.AMI)
+	}
+
+	// a deprecated canary falls back to the image catalog, while a
+	// deprecated ami given explicitly is refused
+	err = db.DeprecateImage(conn, canaryAMI, "busted")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err = resolve("org", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if b.AMI != siteAMI || b.Canary {
+		t.Fatalf("expected deprecated canary to fall back to %s, got %s", siteAMI, b.AMI)
+	}
+
+	_, err = resolve("org", canaryAMI)
+	if _, ok := err.(*db.ImageDeprecatedError); !ok {
+		t.Fatalf("expected deprecated ami to be refused, got %v", err)
+	}
+}
+
+func TestInstanceReconcilerReconcile(t *testing.T) {
+	fake := cloud.NewFake("us-east-1")
+	n := &recordingNotifier{}
+
+	cfg := buildTestInternalConfig(fake)
+	cfg.Notifier = n
+	cfg.DefaultSlackChannel = "#pudding-test"
+	cfg.OrphanGracePeriod = 900
+	cfg.OrphanAction = pudding.OrphanActionAdopt
+
+	r, err := db.BuildRedisPool(testRedisURL())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn := r.Get()
+	defer conn.Close()
+
+	old := time.Now().UTC().Add(-2 * time.Hour)
+	suffix := fmt.Sprintf("%d", time.Now().UnixNano())
+	buildTags := func(buildID string) map[string]string {
+		return map[string]string{"role": "worker", "site": "org", "env": "test", "queue": "docker", "build_id": buildID}
+	}
+
+	run := func(tags map[string]string) *cloud.Instance {
+		inst, err := fake.RunInstance(&cloud.LaunchOptions{Tags: tags})
+		if err != nil {
+			t.Fatal(err)
+		}
+		inst.LaunchTime = old.Format(time.RFC3339)
+		return inst
+	}
+
+	tagged := run(buildTags("build-tagged-" + suffix))
+	untagged := run(map[string]string{})
+	unknown := run(buildTags("build-unknown-" + suffix))
+	unrelated := run(map[string]string{"Name": "not-pudding"})
+
+	asgName := "pudding-asg-" + suffix
+	err = fake.CreateAutoscalingGroup(&cloud.AutoscalingGroupOptions{
+		Name:       asgName,
+		InstanceID: tagged.ID,
+		Tags:       buildTags("build-asg-" + suffix),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	asg, err := fake.LaunchAutoscalingGroupInstance(asgName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	asg.LaunchTime = old.Format(time.RFC3339)
+
+	// the fake reuses instance ids, which earlier runs have recorded
+	for _, key := range []string{"instance_launches", "orphan_instance_report", "queue:instance-terminations"} {
+		_, err = conn.Do("DEL", fmt.Sprintf("%s:%s", pudding.RedisNamespace, key))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	enabledAt := old.Add(-time.Hour).Unix()
+	_, err = conn.Do("SET", fmt.Sprintf("%s:instance_reconciler_enabled_at", pudding.RedisNamespace), enabledAt)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, rec := range []*pudding.InstanceLaunchRecord{
+		{InstanceID: tagged.ID, InstanceBuildID: "build-tagged-" + suffix, LaunchedAt: old.Unix()},
+		{InstanceID: untagged.ID, InstanceBuildID: "build-untagged-" + suffix, LaunchedAt: old.Unix()},
+		{InstanceID: "i-missing", InstanceBuildID: "build-missing-" + suffix, LaunchedAt: old.Unix()},
+		{InstanceID: "i-gone", InstanceBuildID: "build-gone-" + suffix, LaunchedAt: old.Unix(), SeenAt: old.Unix()},
+	} {
+		rec.Role, rec.Site, rec.Env, rec.Queue = "worker", "org", "test", "docker"
+		err = db.StoreInstanceLaunchRecord(conn, rec, db.InstanceLaunchRecordExpiry)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ir, err := newInstanceReconciler(cfg, r, log)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ir.Reconcile()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := db.FetchOrphanInstanceReport(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	orphans := map[string]*pudding.OrphanInstance{}
+	for _, orphan := range report.Orphans {
+		orphans[orphan.InstanceID] = orphan
+	}
+
+	for ID, expected := range map[string]string{
+		untagged.ID: pudding.OrphanKindUntagged + " adopted",
+		unknown.ID:  pudding.OrphanKindUnknownBuild + " adopted",
+		"i-missing": pudding.OrphanKindMissing + " reported",
+	} {
+		orphan, ok := orphans[ID]
+		if !ok {
+			t.Fatalf("expected %s to be an orphan, got %#v", ID, report.Orphans)
+		}
+
+		if actual := orphan.Kind + " " + orphan.Action; actual != expected {
+			t.Fatalf("expected %s to be %q, got %q", ID, expected, actual)
+		}
+
+		if n.find(fmt.Sprintf("orphan instance `%s`", ID)) == "" {
+			t.Fatalf("expected notification for %s, got %v", ID, n.messages)
+		}
+	}
+
+	for _, inst := range []*cloud.Instance{tagged, asg, unrelated} {
+		if _, ok := orphans[inst.ID]; ok {
+			t.Fatalf("expected %s not to be an orphan, got %#v", inst.ID, orphans[inst.ID])
+		}
+	}
+
+	if fake.Instances[untagged.ID].Tags["build_id"] != "build-untagged-"+suffix {
+		t.Fatalf("expected untagged instance to be tagged, got %v", fake.Instances[untagged.ID].Tags)
+	}
+
+	records, err := db.FetchInstanceLaunchRecords(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	recorded := map[string]*pudding.InstanceLaunchRecord{}
+	for _, rec := range records {
+		recorded[rec.InstanceID] = rec
+	}
+
+	if _, ok := recorded["i-gone"]; ok {
+		t.Fatalf("expected launch record of gone instance to be removed")
+	}
+
+	for _, inst := range []*cloud.Instance{tagged, untagged, unknown} {
+		if rec, ok := recorded[inst.ID]; !ok || rec.SeenAt == 0 {
+			t.Fatalf("expected %s to be recorded as seen, got %#v", inst.ID, rec)
+		}
+	}
+
+	// adopted orphans are known from then on, while those that are
+	// still orphans are only notified of once
+	n.messages = []string{}
+	err = ir.Reconcile()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	report, err = db.FetchOrphanInstanceReport(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(report.Orphans) != 1 || report.Orphans[0].InstanceID != "i-missing" {
+		t.Fatalf("expected only the missing instance to remain an orphan, got %#v", report.Orphans)
+	}
+
+	if len(n.messages) != 0 {
+		t.Fatalf("expected no further notifications, got %v", n.messages)
+	}
+
+	// terminations are left to the instance-terminations worker, no
+	// more than the limit per run, and never of instances launched
+	// before reconciliation was enabled
+	cfg.OrphanAction = pudding.OrphanActionTerminate
+	cfg.OrphanMaxTerminations = 1
+	strays := []*cloud.Instance{
+		run(buildTags("build-stray-a-" + suffix)),
+		run(buildTags("build-stray-b-" + suffix)),
+	}
+	preexisting := run(buildTags("build-preexisting-" + suffix))
+	preexisting.LaunchTime = time.Unix(enabledAt-60, 0).UTC().Format(time.RFC3339)
+
+	err = ir.Reconcile()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	report, err = db.FetchOrphanInstanceReport(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	actions := map[string]string{}
+	for _, orphan := range report.Orphans {
+		actions[orphan.InstanceID] = orphan.Action
+	}
+
+	if actions[strays[0].ID]+" "+actions[strays[1].ID] != "terminating reported" &&
+		actions[strays[0].ID]+" "+actions[strays[1].ID] != "reported terminating" {
+		t.Fatalf("expected one stray instance to be terminating, got %v", actions)
+	}
+
+	if actions[preexisting.ID] != "reported" {
+		t.Fatalf("expected preexisting instance to be reported, got %v", actions)
+	}
+
+	jobs, err := redis.Strings(conn.Do("LRANGE", fmt.Sprintf("%s:queue:instance-terminations", pudding.RedisNamespace), 0, -1))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(jobs) != 1 {
+		t.Fatalf("expected one termination to be enqueued, got %v", jobs)
+	}
+
+	payload := &pudding.InstanceTerminationPayload{}
+	err = json.Unmarshal([]byte(jobs[0]), payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if actions[payload.InstanceID] != "terminating" || payload.Region != fake.Region() {
+		t.Fatalf("expected termination of the terminating instance, got %#v", payload)
+	}
+
+	for _, inst := range append(strays, preexisting) {
+		if fake.Instances[inst.ID].State == "terminated" {
+			t.Fatalf("expected %s not to be terminated by the reconciler itself", inst.ID)
+		}
+	}
+}
+
+func TestInstanceReconcilerPreexistingFleet(t *testing.T) {
+	fake := cloud.NewFake("us-east-1")
+
+	cfg := buildTestInternalConfig(fake)
+	cfg.Notifier = &recordingNotifier{}
+	cfg.OrphanGracePeriod = 900
+	cfg.OrphanAction = pudding.OrphanActionTerminate
+	cfg.OrphanMaxTerminations = 100
+
+	r, err := db.BuildRedisPool(testRedisURL())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn := r.Get()
+	defer conn.Close()
+
+	// a fleet launched before reconciliation was enabled, or whose
+	// records were lost, without any launch records or known builds
+	for _, key := range []string{"instance_launches", "orphan_instance_report", "instance_reconciler_enabled_at", "queue:instance-terminations"} {
+		_, err = conn.Do("DEL", fmt.Sprintf("%s:%s", pudding.RedisNamespace, key))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	old := time.Now().UTC().Add(-2 * time.Hour)
+	suffix := fmt.Sprintf("%d", time.Now().UnixNano())
+
+	fleet := map[string]*cloud.Instance{}
+	for _, buildID := range []string{"build-fleet-a-" + suffix, "build-fleet-b-" + suffix, "build-fleet-c-" + suffix} {
+		inst, err := fake.RunInstance(&cloud.LaunchOptions{
+			Tags: map[string]string{"role": "worker", "site": "org", "env": "test", "queue": "docker", "build_id": buildID},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		inst.LaunchTime = old.Format(time.RFC3339)
+		fleet[inst.ID] = inst
+	}
+
+	// only some of the fleet has been synced so far
+	synced := map[string]*cloud.Instance{}
+	for ID, inst := range fleet {
+		if inst.Tags["build_id"] != "build-fleet-c-"+suffix {
+			synced[ID] = inst
+		}
+	}
+
+	err = db.StoreInstances(conn, synced, 300)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ir, err := newInstanceReconciler(cfg, r, log)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ir.Reconcile()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := db.FetchOrphanInstanceReport(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	unsynced := 0
+	for _, orphan := range report.Orphans {
+		if _, ok := fleet[orphan.InstanceID]; !ok {
+			continue
+		}
+
+		if _, ok := synced[orphan.InstanceID]; ok {
+			t.Fatalf("expected synced instance %s not to be an orphan, got %#v", orphan.InstanceID, orphan)
+		}
+
+		if orphan.Action != "reported" || orphan.Error == "" {
+			t.Fatalf("expected unsynced instance %s to only be reported, got %#v", orphan.InstanceID, orphan)
+		}
+		unsynced++
+	}
+
+	if unsynced != 1 {
+		t.Fatalf("expected the unsynced instance to be reported, got %#v", report.Orphans)
+	}
+
+	jobs, err := redis.Strings(conn.Do("LRANGE", fmt.Sprintf("%s:queue:instance-terminations", pudding.RedisNamespace), 0, -1))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(jobs) != 0 {
+		t.Fatalf("expected no terminations of the preexisting fleet, got %v", jobs)
+	}
+}
+
+func TestEC2SyncerSyncsRegionsIndependently(t *testing.T) {
+	east := cloud.NewFake("us-east-1")
+	west := cloud.NewFake("eu-west-1")
+
+	cfg := buildTestInternalConfig(east)
+	cfg.AWSRegions[west.Region()] = true
+	cfg.NewCloud = func(roleARN, region string) cloud.Cloud {
+		if region == west.Region() {
+			return west
+		}
+		return east
+	}
+	cfg.InstanceStoreExpiry = 300
+	cfg.ImageStoreExpiry = 300
+
+	r, err := db.BuildRedisPool(testRedisURL())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn := r.Get()
+	defer conn.Close()
+
+	// the fakes number their instances alike, so the instances are
+	// seeded with ids unique across regions and test runs
+	suffix := fmt.Sprintf("%d", time.Now().UnixNano())
+	launched := 0
+	launch := func(c *cloud.Fake) *cloud.Instance {
+		launched++
+		inst := &cloud.Instance{
+			ID:     fmt.Sprintf("i-sync%d-%s", launched, suffix),
+			Region: c.Region(),
+			State:  "running",
+			Tags:   map[string]string{"role": "worker", "site": "org", "env": "test", "queue": "docker"},
+		}
+		c.Instances[inst.ID] = inst
+		return inst
+	}
+
+	synced := func(inst *cloud.Instance) bool {
+		instances, err := db.FetchInstances(conn, map[string]string{"region": inst.Region})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, fetched := range instances {
+			if fetched.InstanceID == inst.ID {
+				return true
+			}
+		}
+		return false
+	}
+
+	west.Images["ami-west"+suffix] = &cloud.Image{ID: "ami-west" + suffix, Tags: map[string]string{"role": "worker"}}
+
+	eastInst := launch(east)
+	westInst := launch(west)
+
+	syncer, err := newEC2Syncer(cfg, r, log)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = syncer.Sync()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !synced(eastInst) || !synced(westInst) {
+		t.Fatalf("expected instances of both regions to be synced")
+	}
+
+	images, err := db.FetchImages(conn, map[string]string{"image_id": "ami-west" + suffix})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(images) != 1 || images[0].Region != west.Region() {
+		t.Fatalf("expected image synced with its region, got %#v", images)
+	}
+
+	// an unreachable region keeps what was stored for it, while the
+	// others are synced as usual
+	west.Errors["DescribeInstances"] = &net.OpError{Op: "dial", Err: errors.New("connection refused")}
+	err = east.TerminateInstances([]string{eastInst.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	eastInst2 := launch(east)
+
+	err = syncer.Sync()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if synced(eastInst) || !synced(eastInst2) || !synced(westInst) {
+		t.Fatalf("expected the reachable region to be synced and the unreachable one kept")
+	}
+
+	// as does a region that fails otherwise, which is reported
+	west.Errors["DescribeInstances"] = errors.New("kaboom")
+	eastInst3 := launch(east)
+
+	err = syncer.Sync()
+	if err == nil {
+		t.Fatal("expected the failing region to be reported")
+	}
+
+	if !synced(eastInst3) || !synced(westInst) {
+		t.Fatalf("expected the other region to be synced regardless")
+	}
+}
+
+func TestIsInsufficientCapacityError(t *testing.T) {
+	for code, expected := range map[string]bool{
+		"InsufficientInstanceCapacity": true,
+		"InsufficientCapacity":         true,
+		"SpotMaxPriceTooLow":           false,
+		"MaxSpotInstanceCountExceeded": false,
+		"Unsupported":                  false,
+		"InvalidParameterValue":        false,
+	} {
+		if isInsufficientCapacityError(&cloud.Error{Code: code}) != expected {
+			t.Fatalf("expected %q to be an insufficient capacity error: %v", code, expected)
+		}
+	}
+
+	if isInsufficientCapacityError(fmt.Errorf("boom")) {
+		t.Fatalf("expected errors without a code not to be insufficient capacity errors")
+	}
+}
@@ -14,18 +14,72 @@ type Config struct {
 	AWSSecret string
 	AWSRegion string
 
+	// AWSRegions are the comma-delimited regions besides AWSRegion that
+	// builds may target and that are synced
+	AWSRegions string
+
+	// AccountRoles are the comma-delimited "{site}[:{env}]={role_arn}"
+	// pairs of roles to assume for sites in other AWS accounts
+	AccountRoles string
+
+	// FakeCloudURL points the workers at a pudding-fake-cloud endpoint
+	// rather than AWS, for running offline
+	FakeCloudURL string
+
 	InstanceRSA        string
 	InstanceYML        string
 	InstanceTagRetries int
 
-	InitScriptTemplate string
-	MiniWorkerInterval int
-	InstanceExpiry     int
-	ImageExpiry        int
+	InitScriptTemplate     string
+	InitScriptExpiry       int
+	InitScriptMaxUses      int
+	InitScriptSharedExpiry int
+	MiniWorkerInterval     int
+	InstanceExpiry         int
+	ImageExpiry            int
+
+	// InstanceTTLWarning is how many seconds before their expiry to
+	// warn about instances launched with a ttl
+	InstanceTTLWarning int
+
+	LifecycleHeartbeatInterval        int
+	LifecycleActionTimeout            int
+	LifecycleLaunchingTimeoutResult   string
+	LifecycleTerminatingTimeoutResult string
 
-	SlackHookPath string
-	SlackUsername string
-	SlackIcon     string
+	SecurityGroupGCGracePeriod int
+	SecurityGroupGCDryRun      bool
+	DefaultIngressRules        string
+
+	// OrphanGracePeriod is how many seconds after launch instances are
+	// reconciled, with 0 disabling reconciliation, OrphanAction is what
+	// is done with orphans, being "report", "adopt", or "terminate", and
+	// OrphanMaxTerminations is the most orphans terminated per run
+	OrphanGracePeriod     int
+	OrphanAction          string
+	OrphanMaxTerminations int
+
+	SlackHookPath       string
+	SlackUsername       string
+	SlackIcon           string
+	DefaultSlackChannel string
 
 	SentryDSN string
+
+	// SecretsProvider is where init script templates look up secrets,
+	// being "env", "file", or "vault", and SecretsAllowlist is the
+	// comma-delimited keys and "PREFIX_*" patterns they may look up
+	SecretsProvider   string
+	SecretsAllowlist  string
+	SecretsFile       string
+	SecretsVaultAddr  string
+	SecretsVaultToken string
+	SecretsVaultPath  string
+
+	// EncryptionKeys are the keys with which init scripts and auths are
+	// encrypted at rest, as parsed by pudding.ParseKeyring
+	EncryptionKeys string
+	// EncryptionMigration allows reading values stored as plaintext
+	// despite EncryptionKeys
+	EncryptionMigration bool
 }
@@ -1,19 +1,16 @@
 package workers
 
 import (
-	"net"
-	"net/url"
-
 	"github.com/Sirupsen/logrus"
 	"github.com/garyburd/redigo/redis"
-	"github.com/goamz/goamz/ec2"
 	"github.com/travis-ci/pudding"
+	"github.com/travis-ci/pudding/cloud"
 	"github.com/travis-ci/pudding/db"
 )
 
 type ec2Syncer struct {
 	cfg *internalConfig
-	ec2 *ec2.EC2
+	tgt []*awsTarget
 	log *logrus.Logger
 	i   db.InstanceFetcherStorer
 	img db.ImageFetcherStorer
@@ -30,101 +27,141 @@ func newEC2Syncer(cfg *internalConfig, r *redis.Pool, log *logrus.Logger) (*ec2S
 		return nil, err
 	}
 
+	tgt, err := awsTargets(cfg)
+	if err != nil {
+		return nil, err
+	}
+
 	return &ec2Syncer{
 		cfg: cfg,
 		log: log,
 		i:   i,
 		img: img,
-		ec2: ec2.New(cfg.AWSAuth, cfg.AWSRegion),
+		tgt: tgt,
 	}, nil
 }
 
+// Sync stores the running instances and role-tagged images of every
+// configured region, each synced independently so that a region that
+// cannot be fetched keeps what was last stored for it until it expires
 func (es *ec2Syncer) Sync() error {
+	errs := []error{}
+
+	for _, region := range awsRegionNames(es.cfg) {
+		err := es.syncRegion(region)
+		if err != nil {
+			es.log.WithFields(logrus.Fields{
+				"err":    err,
+				"region": region,
+			}).Error("ec2 syncer failed to sync region")
+			errs = append(errs, err)
+		}
+	}
+
+	if len(errs) > 0 {
+		return &pudding.MultiError{Errors: errs}
+	}
+
+	return nil
+}
+
+func (es *ec2Syncer) syncRegion(region string) error {
 	var (
-		instances map[string]ec2.Instance
-		images    map[string]ec2.Image
+		instances map[string]*cloud.Instance
+		images    map[string]*cloud.Image
 		err       error
 	)
 
-	es.log.Debug("ec2 syncer fetching instances")
+	es.log.WithField("region", region).Debug("ec2 syncer fetching instances")
 	for i := 3; i > 0; i-- {
-		instances, err = es.fetchInstances()
+		instances, err = es.fetchInstances(region)
 		if err == nil {
 			break
 		}
 	}
 
 	if err != nil {
-		panic(err)
-	}
-
-	if instances == nil {
-		es.log.Debug("ec2 syncer failed to get any instances; assuming temporary network error")
-		return nil
+		if cloud.IsNetworkError(err) {
+			es.log.WithField("region", region).Debug("ec2 syncer failed to get any instances; assuming temporary network error")
+			return nil
+		}
+		return err
 	}
 
-	es.log.Debug("ec2 syncer storing instances")
-	err = es.i.Store(instances)
+	es.log.WithField("region", region).Debug("ec2 syncer storing instances")
+	err = es.i.Store(region, instances)
 	if err != nil {
-		panic(err)
+		return err
 	}
 
-	es.log.Debug("ec2 syncer fetching images")
+	es.log.WithField("region", region).Debug("ec2 syncer fetching images")
 	for i := 3; i > 0; i-- {
-		images, err = es.fetchImages()
+		images, err = es.fetchImages(region)
 		if err == nil {
 			break
 		}
 	}
 
 	if err != nil {
-		panic(err)
+		if cloud.IsNetworkError(err) {
+			es.log.WithField("region", region).Debug("ec2 syncer failed to get any images; assuming temporary network error")
+			return nil
+		}
+		return err
 	}
 
-	if images == nil {
-		es.log.Debug("ec2 syncer failed to get any images; assuming temporary network error")
-		return nil
-	}
+	es.log.WithField("region", region).Debug("ec2 syncer storing images")
+	return es.img.Store(region, images)
+}
 
-	es.log.Debug("ec2 syncer storing images")
-	err = es.img.Store(images)
-	if err != nil {
-		panic(err)
-	}
+// fetchInstances gathers the running instances of the region from
+// every account, as storing them replaces those of the whole region
+func (es *ec2Syncer) fetchInstances(region string) (map[string]*cloud.Instance, error) {
+	instances := map[string]*cloud.Instance{}
 
-	return nil
-}
+	for _, t := range es.tgt {
+		if t.Cloud.Region() != region {
+			continue
+		}
 
-func (es *ec2Syncer) fetchInstances() (map[string]ec2.Instance, error) {
-	f := ec2.NewFilter()
-	f.Add("instance-state-name", "running")
-	instances, err := pudding.GetInstancesWithFilter(es.ec2, f)
-	if err == nil {
-		return instances, nil
-	}
+		f := cloud.Filter{"instance-state-name": []string{"running"}}
+		accountInstances, err := cloud.GetInstancesWithFilter(t.Cloud, f)
+		if err != nil {
+			if cloud.IsNetworkError(err) {
+				log.WithFields(logrus.Fields{"err": err, "account_id": t.AccountID, "region": region}).Warn("network error while fetching ec2 instances")
+			}
+			return nil, err
+		}
 
-	switch err.(type) {
-	case *url.Error, *net.OpError:
-		log.WithFields(logrus.Fields{"err": err}).Warn("network error while fetching ec2 instances")
-		return nil, nil
-	default:
-		return nil, err
+		for ID, inst := range accountInstances {
+			instances[ID] = inst
+		}
 	}
+
+	return instances, nil
 }
 
-func (es *ec2Syncer) fetchImages() (map[string]ec2.Image, error) {
-	f := ec2.NewFilter()
-	f.Add("tag-key", "role")
-	images, err := pudding.GetImagesWithFilter(es.ec2, f)
-	if err == nil {
-		return images, nil
-	}
+func (es *ec2Syncer) fetchImages(region string) (map[string]*cloud.Image, error) {
+	images := map[string]*cloud.Image{}
 
-	switch err.(type) {
-	case *url.Error, *net.OpError:
-		log.WithFields(logrus.Fields{"err": err}).Warn("network error while fetching ec2 images")
-		return nil, nil
-	default:
-		return nil, err
+	for _, t := range es.tgt {
+		if t.Cloud.Region() != region {
+			continue
+		}
+
+		f := cloud.Filter{"tag-key": []string{"role"}}
+		accountImages, err := cloud.GetImagesWithFilter(t.Cloud, f)
+		if err != nil {
+			if cloud.IsNetworkError(err) {
+				log.WithFields(logrus.Fields{"err": err, "account_id": t.AccountID, "region": region}).Warn("network error while fetching ec2 images")
+			}
+			return nil, err
+		}
+
+		for ID, img := range accountImages {
+			images[ID] = img
+		}
 	}
+
+	return images, nil
 }
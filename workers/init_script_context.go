@@ -17,4 +17,5 @@ type initScriptContext struct {
 	InstanceLaunchURL    string
 	InstanceTerminateURL string
 	InstanceHeartbeatURL string
+	InstanceIdentityURL  string
 }
@@ -0,0 +1,49 @@
+package workers
+
+import (
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/garyburd/redigo/redis"
+	"github.com/travis-ci/pudding/db"
+)
+
+type initScriptPurger struct {
+	log *logrus.Logger
+	r   *redis.Pool
+}
+
+func newInitScriptPurger(r *redis.Pool, log *logrus.Logger) (*initScriptPurger, error) {
+	return &initScriptPurger{
+		log: log,
+		r:   r,
+	}, nil
+}
+
+// Purge removes the init scripts and temporary auths that may no
+// longer be used to fetch them, and then the instance auths of those
+// whose instances are gone
+func (isp *initScriptPurger) Purge() error {
+	conn := isp.r.Get()
+	defer func() { _ = conn.Close() }()
+
+	IDs, err := db.PurgeInitScripts(conn, time.Now().UTC().Unix())
+	if err != nil {
+		return err
+	}
+
+	if len(IDs) > 0 {
+		isp.log.WithField("instance_build_ids", IDs).Info("purged stale init scripts")
+	}
+
+	IDs, err = db.PurgeInstanceAuths(conn)
+	if err != nil {
+		return err
+	}
+
+	if len(IDs) > 0 {
+		isp.log.WithField("instance_build_ids", IDs).Info("purged stale instance auths")
+	}
+
+	return nil
+}
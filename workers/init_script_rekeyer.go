@@ -0,0 +1,53 @@
+package workers
+
+import (
+	"github.com/Sirupsen/logrus"
+	"github.com/garyburd/redigo/redis"
+	"github.com/travis-ci/pudding"
+	"github.com/travis-ci/pudding/db"
+)
+
+type initScriptRekeyer struct {
+	log *logrus.Logger
+	r   *redis.Pool
+	kr  *pudding.Keyring
+}
+
+func newInitScriptRekeyer(cfg *internalConfig, r *redis.Pool, log *logrus.Logger) (*initScriptRekeyer, error) {
+	return &initScriptRekeyer{
+		log: log,
+		r:   r,
+		kr:  cfg.Keyring,
+	}, nil
+}
+
+// Rekey re-encrypts the init scripts and auths still stored as
+// plaintext or with a key other than the primary one, so that old
+// keys may be dropped once rotated out.  Entries that can't be
+// decrypted, e.g. for a key no longer configured, are logged and left
+// for the others to be re-encrypted regardless.
+func (isr *initScriptRekeyer) Rekey() error {
+	conn := isr.r.Get()
+	defer func() { _ = conn.Close() }()
+
+	n, failed, err := db.RekeyInitScripts(conn, isr.kr)
+	if err != nil {
+		return err
+	}
+
+	if len(failed) > 0 {
+		isr.log.WithFields(logrus.Fields{
+			"count":   len(failed),
+			"entries": failed,
+		}).Error("skipped init scripts and auths that could not be decrypted")
+	}
+
+	if n > 0 {
+		isr.log.WithFields(logrus.Fields{
+			"count":  n,
+			"key_id": isr.kr.PrimaryKeyID(),
+		}).Info("re-encrypted init scripts and auths")
+	}
+
+	return nil
+}
@@ -7,23 +7,47 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"math/rand"
 	"net/url"
 	"os"
+	"strings"
+	"sync"
 	"text/template"
 	"time"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/garyburd/redigo/redis"
-	"github.com/goamz/goamz/ec2"
 	"github.com/gorilla/feeds"
 	"github.com/jrallison/go-workers"
 	"github.com/travis-ci/pudding"
+	"github.com/travis-ci/pudding/cloud"
+	"github.com/travis-ci/pudding/db"
+)
+
+var (
+	// canaryRand picks the instance builds that use a canary image
+	canaryRand = &lockedRand{r: rand.New(rand.NewSource(time.Now().UTC().UnixNano()))}
 )
 
 func init() {
 	defaultQueueFuncs["instance-builds"] = instanceBuildsMain
 }
 
+// lockedRand is a *rand.Rand that is safe for concurrent use, as
+// builds are worked concurrently
+type lockedRand struct {
+	mutex sync.Mutex
+	r     *rand.Rand
+}
+
+// Intn returns a number in [0,n)
+func (lr *lockedRand) Intn(n int) int {
+	lr.mutex.Lock()
+	defer lr.mutex.Unlock()
+
+	return lr.r.Intn(n)
+}
+
 func instanceBuildsMain(cfg *internalConfig, msg *workers.Msg) {
 	buildPayloadJSON := []byte(msg.OriginalJson())
 	buildPayload := &pudding.InstanceBuildPayload{
@@ -46,9 +70,9 @@ func instanceBuildsMain(cfg *internalConfig, msg *workers.Msg) {
 	}
 
 	if b.BootInstance {
-		ibw.Build()
+		err = ibw.Build()
 	} else {
-		ibw.CreateUserData()
+		_, err = ibw.CreateUserData()
 	}
 
 	if err != nil {
@@ -61,20 +85,19 @@ type instanceBuilderWorker struct {
 	n      []pudding.Notifier
 	jid    string
 	cfg    *internalConfig
-	ec2    *ec2.EC2
-	sg     *ec2.SecurityGroup
+	c      cloud.Cloud
+	sg     *cloud.SecurityGroup
 	sgName string
-	ami    *ec2.Image
+	ami    *cloud.Image
 	b      *pudding.InstanceBuild
-	i      *ec2.Instance
+	i      *cloud.Instance
 	t      *template.Template
 }
 
 func newInstanceBuilderWorker(b *pudding.InstanceBuild, cfg *internalConfig, jid string, redisConn redis.Conn) (*instanceBuilderWorker, error) {
 	var err error
-	notifier := pudding.NewSlackNotifier(cfg.SlackHookPath, cfg.SlackUsername, cfg.SlackIcon)
-
 	t := template.New("init-script")
+	t.Funcs(newTemplateSecrets(cfg, b, jid).Funcs())
 	t.Funcs(template.FuncMap{
 		"env_for":    pudding.MakeInstanceBuildEnvForFunc(b),
 		"env":        os.Getenv,
@@ -86,13 +109,20 @@ func newInstanceBuilderWorker(b *pudding.InstanceBuild, cfg *internalConfig, jid
 		return nil, err
 	}
 
+	c, err := cloudForSite(cfg, b.Site, b.Env, b.Region)
+	if err != nil {
+		return nil, err
+	}
+	c = withJobID(c, jid)
+	b.Region = c.Region()
+
 	ibw := &instanceBuilderWorker{
 		rc:  redisConn,
 		jid: jid,
 		cfg: cfg,
-		n:   []pudding.Notifier{notifier},
+		n:   []pudding.Notifier{cfg.Notifier},
 		b:   b,
-		ec2: ec2.New(cfg.AWSAuth, cfg.AWSRegion),
+		c:   c,
 		t:   t,
 	}
 
@@ -101,30 +131,23 @@ func newInstanceBuilderWorker(b *pudding.InstanceBuild, cfg *internalConfig, jid
 }
 
 func (ibw *instanceBuilderWorker) Build() error {
-	var err error
-
-	f := ec2.NewFilter()
-	if ibw.b.Role != "" {
-		f.Add("tag:role", ibw.b.Role)
-	}
-
-	log.WithFields(logrus.Fields{
-		"jid":    ibw.jid,
-		"filter": f,
-	}).Debug("resolving ami")
-
-	ibw.ami, err = pudding.ResolveAMI(ibw.ec2, ibw.b.AMI, f)
+	err := ibw.resolveAMI()
 	if err != nil {
-		log.WithFields(logrus.Fields{
-			"jid":    ibw.jid,
-			"ami_id": ibw.b.AMI,
-			"err":    err,
-		}).Error("failed to resolve ami")
 		return err
 	}
 
 	if ibw.b.SecurityGroupID != "" {
-		ibw.sg = &ec2.SecurityGroup{Id: ibw.b.SecurityGroupID}
+		ibw.sg = &cloud.SecurityGroup{ID: ibw.b.SecurityGroupID}
+	} else if ibw.b.ManagedSecurityGroup {
+		log.WithField("jid", ibw.jid).Debug("resolving managed security group")
+		err = ibw.resolveManagedSecurityGroup()
+		if err != nil {
+			log.WithFields(logrus.Fields{
+				"jid": ibw.jid,
+				"err": err,
+			}).Error("failed to resolve managed security group")
+			return err
+		}
 	} else {
 		log.WithField("jid", ibw.jid).Debug("creating security group")
 		err = ibw.createSecurityGroup()
@@ -149,23 +172,69 @@ func (ibw *instanceBuilderWorker) Build() error {
 		return err
 	}
 
-	ibw.b.InstanceID = ibw.i.InstanceId
+	ibw.b.InstanceID = ibw.i.ID
 
-	for i := ibw.cfg.InstanceTagRetries; i > 0; i-- {
-		log.WithField("jid", ibw.jid).Debug("tagging instance")
-		err = ibw.tagInstance()
-		if err == nil {
-			break
+	err = db.StoreInitScriptInstanceID(ibw.rc, ibw.b.ID, ibw.i.ID)
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			"err": err,
+			"jid": ibw.jid,
+		}).Warn("failed to store init script instance id")
+	}
+
+	err = db.StoreInstanceLaunchRecord(ibw.rc, &pudding.InstanceLaunchRecord{
+		InstanceID:      ibw.i.ID,
+		InstanceBuildID: ibw.b.ID,
+		AccountID:       pudding.AccountIDFromARN(ibw.cfg.AccountRoles.RoleARNFor(ibw.b.Site, ibw.b.Env)),
+		Region:          ibw.c.Region(),
+		Role:            ibw.b.Role,
+		Site:            ibw.b.Site,
+		Env:             ibw.b.Env,
+		Queue:           ibw.b.Queue,
+		LaunchedAt:      time.Now().UTC().Unix(),
+	}, db.InstanceLaunchRecordExpiry)
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			"err": err,
+			"jid": ibw.jid,
+		}).Warn("failed to store instance launch record")
+	}
+
+	if nameNeedsInstanceID(ibw.b) {
+		for i := ibw.cfg.InstanceTagRetries; i > 0; i-- {
+			log.WithField("jid", ibw.jid).Debug("tagging instance with name")
+			err = ibw.tagInstanceName()
+			if err == nil {
+				break
+			}
+			time.Sleep(3 * time.Second)
+		}
+
+		if err != nil {
+			log.WithFields(logrus.Fields{
+				"err": err,
+				"jid": ibw.jid,
+			}).Error("failed to tag instance(s)")
+			ibw.terminateUntaggedInstance(err)
+			return err
 		}
-		time.Sleep(3 * time.Second)
 	}
 
+	err = db.StoreInstanceImageRecord(ibw.rc, &pudding.InstanceImageRecord{
+		InstanceID: ibw.b.InstanceID,
+		ImageID:    ibw.b.AMI,
+		Role:       ibw.b.Role,
+		Site:       ibw.b.Site,
+		Env:        ibw.b.Env,
+		Region:     ibw.b.Region,
+		Canary:     ibw.b.Canary,
+		LaunchedAt: time.Now().UTC().Unix(),
+	}, db.InstanceImageRecordExpiry)
 	if err != nil {
 		log.WithFields(logrus.Fields{
 			"err": err,
 			"jid": ibw.jid,
-		}).Error("failed to tag instance(s)")
-		return err
+		}).Warn("failed to store instance image record")
 	}
 
 	ibw.notifyInstanceLaunched()
@@ -174,6 +243,99 @@ func (ibw *instanceBuilderWorker) Build() error {
 	return nil
 }
 
+// resolveAMI resolves the ami of the build, which without an explicit
+// ami comes from the image canary or catalog, and refuses deprecated
+// ones
+func (ibw *instanceBuilderWorker) resolveAMI() error {
+	var err error
+
+	if ibw.b.AMI == "" {
+		canary, err := db.ResolveImageCanary(ibw.rc, ibw.b.Role, ibw.b.Site, ibw.b.Env, ibw.b.Region)
+		if err != nil {
+			log.WithFields(logrus.Fields{
+				"jid": ibw.jid,
+				"err": err,
+			}).Error("failed to resolve image canary")
+			return err
+		}
+
+		if canary != nil && canaryRand.Intn(100) < canary.Weight {
+			reason, deprecated, err := db.FetchImageDeprecation(ibw.rc, canary.ImageID)
+			if err != nil {
+				return err
+			}
+
+			// a canary deprecated since it was set falls back to the
+			// image catalog rather than failing the build
+			if deprecated {
+				log.WithFields(logrus.Fields{
+					"jid":    ibw.jid,
+					"ami_id": canary.ImageID,
+					"reason": reason,
+				}).Warn("skipping deprecated canary ami")
+			} else {
+				log.WithFields(logrus.Fields{
+					"jid":    ibw.jid,
+					"ami_id": canary.ImageID,
+					"weight": canary.Weight,
+				}).Info("using canary ami")
+
+				ibw.b.AMI = canary.ImageID
+				ibw.b.Canary = true
+			}
+		}
+	}
+
+	if ibw.b.AMI == "" {
+		ibw.b.AMI, err = db.ResolveCatalogImage(ibw.rc, ibw.b.Role, ibw.b.Site, ibw.b.Env, ibw.b.Region)
+		if err != nil {
+			log.WithFields(logrus.Fields{
+				"jid": ibw.jid,
+				"err": err,
+			}).Error("failed to resolve ami from image catalog")
+			return err
+		}
+	}
+
+	f := cloud.Filter{}
+	if ibw.b.Role != "" {
+		f["tag:role"] = []string{ibw.b.Role}
+	}
+
+	log.WithFields(logrus.Fields{
+		"jid":    ibw.jid,
+		"filter": f,
+	}).Debug("resolving ami")
+
+	ibw.ami, err = cloud.ResolveAMI(ibw.c, ibw.b.AMI, f)
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			"jid":    ibw.jid,
+			"ami_id": ibw.b.AMI,
+			"err":    err,
+		}).Error("failed to resolve ami")
+		return err
+	}
+
+	reason, deprecated, err := db.FetchImageDeprecation(ibw.rc, ibw.ami.ID)
+	if err != nil {
+		return err
+	}
+
+	if deprecated {
+		err = &db.ImageDeprecatedError{ImageID: ibw.ami.ID, Reason: reason}
+		log.WithFields(logrus.Fields{
+			"jid":    ibw.jid,
+			"ami_id": ibw.ami.ID,
+			"err":    err,
+		}).Error("refusing to build with deprecated ami")
+		return err
+	}
+
+	ibw.b.AMI = ibw.ami.ID
+	return nil
+}
+
 func (ibw *instanceBuilderWorker) CreateUserData() ([]byte, error) {
 	log.WithFields(logrus.Fields{
 		"jid":           ibw.jid,
@@ -184,17 +346,21 @@ func (ibw *instanceBuilderWorker) CreateUserData() ([]byte, error) {
 }
 
 func (ibw *instanceBuilderWorker) createSecurityGroup() error {
-	newSg := ec2.SecurityGroup{
-		Name:        ibw.sgName,
-		Description: "custom security group",
-	}
-
 	log.WithFields(logrus.Fields{
 		"jid": ibw.jid,
 		"security_group_name": ibw.sgName,
 	}).Debug("creating security group")
 
-	resp, err := ibw.ec2.CreateSecurityGroup(newSg)
+	rules, err := pudding.IngressRulesFor(ibw.b, ibw.cfg.DefaultIngressRules)
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			"err": err,
+			"jid": ibw.jid,
+		}).Error("failed to resolve ingress rules")
+		return err
+	}
+
+	sg, err := ibw.c.CreateSecurityGroup(ibw.sgName, "custom security group")
 	if err != nil {
 		log.WithFields(logrus.Fields{
 			"err": err,
@@ -203,40 +369,93 @@ func (ibw *instanceBuilderWorker) createSecurityGroup() error {
 		return err
 	}
 
-	ibw.sg = &resp.SecurityGroup
+	ibw.sg = sg
+
+	if len(rules) == 0 {
+		return nil
+	}
 
 	log.WithFields(logrus.Fields{
-		"jid": ibw.jid,
+		"jid":                 ibw.jid,
 		"security_group_name": ibw.sgName,
-	}).Debug("authorizing port 22 on security group")
-
-	_, err = ibw.ec2.AuthorizeSecurityGroup(*ibw.sg, []ec2.IPPerm{
-		ec2.IPPerm{
-			Protocol:  "tcp",
-			FromPort:  22,
-			ToPort:    22,
-			SourceIPs: []string{"0.0.0.0/0"},
-		},
-	})
+		"rules":               rules,
+	}).Debug("authorizing ingress rules on security group")
+
+	err = ibw.c.AuthorizeSecurityGroupIngress(ibw.sg.ID, rules)
 	if err != nil {
 		log.WithFields(logrus.Fields{
 			"err": err,
 			"jid": ibw.jid,
 			"security_group_name": ibw.sgName,
-		}).Error("failed to authorize port 22")
+		}).Error("failed to authorize ingress rules")
+
+		delErr := ibw.c.DeleteSecurityGroup(sg.ID)
+		if delErr != nil {
+			log.WithFields(logrus.Fields{
+				"err":                 delErr,
+				"jid":                 ibw.jid,
+				"security_group_name": ibw.sgName,
+			}).Error("failed to delete security group without ingress rules")
+		}
+
+		ibw.sg = nil
 		return err
 	}
 
 	return nil
 }
 
+// resolveManagedSecurityGroup looks up the security group shared by
+// all builds for the site and env, creating it if absent
+func (ibw *instanceBuilderWorker) resolveManagedSecurityGroup() error {
+	ibw.sgName = pudding.ManagedSecurityGroupName(ibw.b.Site, ibw.b.Env)
+
+	sg, err := ibw.fetchSecurityGroupByName(ibw.sgName)
+	if err != nil {
+		return err
+	}
+
+	if sg != nil {
+		ibw.sg = sg
+		return nil
+	}
+
+	err = ibw.createSecurityGroup()
+	if cloud.ErrorCode(err) == "InvalidGroup.Duplicate" {
+		// another build got there first
+		createErr := err
+		sg, err = ibw.fetchSecurityGroupByName(ibw.sgName)
+		if err == nil && sg == nil {
+			err = createErr
+		}
+		ibw.sg = sg
+	}
+
+	return err
+}
+
+func (ibw *instanceBuilderWorker) fetchSecurityGroupByName(name string) (*cloud.SecurityGroup, error) {
+	groups, err := ibw.c.DescribeSecurityGroups(cloud.Filter{"group-name": []string{name}})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(groups) == 0 {
+		return nil, nil
+	}
+
+	return groups[0], nil
+}
+
 func (ibw *instanceBuilderWorker) createInstance() error {
 	log.WithFields(logrus.Fields{
-		"jid":           ibw.jid,
-		"instance_type": ibw.b.InstanceType,
-		"ami.id":        ibw.ami.Id,
-		"ami.name":      ibw.ami.Name,
-		"count":         ibw.b.Count,
+		"jid":            ibw.jid,
+		"instance_type":  ibw.b.InstanceType,
+		"instance_types": ibw.b.InstanceTypes,
+		"market":         ibw.b.Market,
+		"ami.id":         ibw.ami.ID,
+		"ami.name":       ibw.ami.Name,
+		"count":          ibw.b.Count,
 	}).Info("booting instance")
 
 	userData, err := ibw.buildUserData()
@@ -244,49 +463,230 @@ func (ibw *instanceBuilderWorker) createInstance() error {
 		return err
 	}
 
-	resp, err := ibw.ec2.RunInstances(&ec2.RunInstancesOptions{
-		ImageId:        ibw.ami.Id,
-		UserData:       userData,
-		InstanceType:   ibw.b.InstanceType,
-		SecurityGroups: []ec2.SecurityGroup{*ibw.sg},
-		SubnetId:       ibw.b.SubnetID,
-	})
+	instanceTypes := ibw.b.CandidateInstanceTypes()
+
+	if ibw.b.Market == pudding.MarketSpot {
+		for _, instanceType := range instanceTypes {
+			err = ibw.runSpotInstance(instanceType, userData)
+			if err == nil {
+				return nil
+			}
+
+			if !isInsufficientCapacityError(err) {
+				return err
+			}
+
+			log.WithFields(logrus.Fields{
+				"jid":           ibw.jid,
+				"instance_type": instanceType,
+				"err":           err,
+			}).Warn("no spot capacity for instance type")
+		}
+
+		if !ibw.b.OnDemandFallback {
+			return err
+		}
+
+		log.WithField("jid", ibw.jid).Warn("falling back to on-demand")
+	}
+
+	for _, instanceType := range instanceTypes {
+		err = ibw.runOnDemandInstance(instanceType, userData)
+		if err == nil {
+			return nil
+		}
+
+		if !isInsufficientCapacityError(err) {
+			return err
+		}
+
+		log.WithFields(logrus.Fields{
+			"jid":           ibw.jid,
+			"instance_type": instanceType,
+			"err":           err,
+		}).Warn("no on-demand capacity for instance type")
+	}
+
+	return err
+}
+
+func (ibw *instanceBuilderWorker) runOnDemandInstance(instanceType string, userData []byte) error {
+	return ibw.runInstance(instanceType, pudding.MarketOnDemand, userData)
+}
+
+func (ibw *instanceBuilderWorker) runSpotInstance(instanceType string, userData []byte) error {
+	return ibw.runInstance(instanceType, pudding.MarketSpot, userData)
+}
+
+func (ibw *instanceBuilderWorker) runInstance(instanceType, market string, userData []byte) error {
+	tags, err := ibw.launchTags(market)
+	if err != nil {
+		return err
+	}
+
+	opts := &cloud.LaunchOptions{
+		ImageID:          ibw.ami.ID,
+		InstanceType:     instanceType,
+		UserData:         userData,
+		SecurityGroupIDs: []string{ibw.sg.ID},
+		SubnetID:         ibw.b.SubnetID,
+		Market:           market,
+		Tags:             tags,
+	}
+	if market == pudding.MarketSpot {
+		opts.SpotMaxPrice = ibw.b.SpotMaxPrice
+	}
+
+	ibw.i, err = ibw.c.RunInstance(opts)
 	if err != nil {
 		return err
 	}
 
-	ibw.i = &resp.Instances[0]
+	ibw.b.InstanceType = instanceType
+	ibw.b.Market = market
+	if market != pudding.MarketSpot {
+		ibw.b.SpotMaxPrice = ""
+	}
 	return nil
 }
 
-func (ibw *instanceBuilderWorker) tagInstance() error {
+// isInsufficientCapacityError returns whether the error means that
+// there is no capacity for the requested instance type right now, and
+// that another instance type or market may be worth a try.  Errors such
+// as a spot max price below the going price or an unsupported instance
+// type are the build's own doing, and aren't retried.
+func isInsufficientCapacityError(err error) bool {
+	switch cloud.ErrorCode(err) {
+	case "InsufficientInstanceCapacity", "InsufficientCapacity":
+		return true
+	}
+	return false
+}
+
+// nameNeedsInstanceID returns whether the build's name template refers
+// to the instance id, in which case the Name tag can only be applied
+// once the instance exists
+func nameNeedsInstanceID(b *pudding.InstanceBuild) bool {
+	return strings.Contains(b.NameTemplate, "InstanceID")
+}
+
+func (ibw *instanceBuilderWorker) instanceName() (string, error) {
 	nameTmpl, err := template.New(fmt.Sprintf("name-template-%s", ibw.jid)).Parse(ibw.b.NameTemplate)
 	if err != nil {
-		return err
+		return "", err
 	}
 
 	var nameBuf bytes.Buffer
 	err = nameTmpl.Execute(&nameBuf, ibw.b)
 	if err != nil {
-		return err
+		return "", err
 	}
 
-	tags := []ec2.Tag{
-		ec2.Tag{Key: "Name", Value: nameBuf.String()},
-		ec2.Tag{Key: "role", Value: ibw.b.Role},
-		ec2.Tag{Key: "site", Value: ibw.b.Site},
-		ec2.Tag{Key: "env", Value: ibw.b.Env},
-		ec2.Tag{Key: "queue", Value: ibw.b.Queue},
+	return nameBuf.String(), nil
+}
+
+// launchTags returns the tags applied as part of the launch request,
+// which is all of them unless the Name tag needs the instance id
+func (ibw *instanceBuilderWorker) launchTags(market string) (map[string]string, error) {
+	tags := map[string]string{}
+	for key, value := range ibw.b.Tags {
+		tags[key] = value
+	}
+
+	tags["role"] = ibw.b.Role
+	tags["site"] = ibw.b.Site
+	tags["env"] = ibw.b.Env
+	tags["queue"] = ibw.b.Queue
+	tags["market"] = market
+	tags["build_id"] = ibw.b.ID
+
+	if ibw.b.Canary {
+		tags["canary"] = "true"
+	}
+
+	if market == pudding.MarketSpot && ibw.b.SpotMaxPrice != "" {
+		tags["requested_spot_max_price"] = ibw.b.SpotMaxPrice
+	}
+
+	if ibw.b.Team != "" {
+		tags["build_team"] = ibw.b.Team
+	}
+
+	if ibw.b.SlackChannel != "" {
+		tags["slack_channel"] = ibw.b.SlackChannel
+	}
+
+	if expiresAt := ibw.b.ExpiresAt; expiresAt > 0 || ibw.b.TTL > 0 {
+		if expiresAt == 0 {
+			expiresAt = time.Now().UTC().Unix() + int64(ibw.b.TTL)
+		}
+		tags["expires_at"] = fmt.Sprintf("%d", expiresAt)
+	}
+
+	if !nameNeedsInstanceID(ibw.b) {
+		name, err := ibw.instanceName()
+		if err != nil {
+			return nil, err
+		}
+		tags["Name"] = name
 	}
 
 	log.WithFields(logrus.Fields{
 		"jid":  ibw.jid,
 		"tags": tags,
-	}).Debug("tagging instance")
+	}).Debug("tagging instance at launch")
 
-	_, err = ibw.ec2.CreateTags([]string{ibw.i.InstanceId}, tags)
+	return tags, nil
+}
 
-	return err
+func (ibw *instanceBuilderWorker) tagInstanceName() error {
+	name, err := ibw.instanceName()
+	if err != nil {
+		return err
+	}
+
+	return ibw.c.CreateTags([]string{ibw.i.ID}, map[string]string{"Name": name})
+}
+
+// terminateUntaggedInstance gets rid of an instance that could not be
+// fully tagged rather than leaving it running where nothing will find
+// it, and reports the would-be leak
+func (ibw *instanceBuilderWorker) terminateUntaggedInstance(tagErr error) {
+	err := ibw.c.TerminateInstances([]string{ibw.i.ID})
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			"err":         err,
+			"jid":         ibw.jid,
+			"instance_id": ibw.i.ID,
+		}).Error("failed to terminate untagged instance")
+
+		for _, notifier := range ibw.n {
+			notifier.Notify(ibw.b.SlackChannel,
+				fmt.Sprintf(":rotating_light: Leaked untagged instance `%s` for instance build *%s* after failing to tag it (%v) and then to terminate it (%v)",
+					ibw.i.ID, ibw.b.ID, tagErr, err))
+		}
+		return
+	}
+
+	log.WithFields(logrus.Fields{
+		"jid":         ibw.jid,
+		"instance_id": ibw.i.ID,
+	}).Warn("terminated untagged instance")
+
+	err = db.RemoveInstanceLaunchRecord(ibw.rc, ibw.i.ID)
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			"err":         err,
+			"jid":         ibw.jid,
+			"instance_id": ibw.i.ID,
+		}).Warn("failed to remove instance launch record")
+	}
+
+	for _, notifier := range ibw.n {
+		notifier.Notify(ibw.b.SlackChannel,
+			fmt.Sprintf("Terminated instance `%s` for instance build *%s* as it could not be tagged (%v)",
+				ibw.i.ID, ibw.b.ID, tagErr))
+	}
 }
 
 func (ibw *instanceBuilderWorker) buildUserData() ([]byte, error) {
@@ -296,6 +696,7 @@ func (ibw *instanceBuilderWorker) buildUserData() ([]byte, error) {
 	}
 
 	instAuth := feeds.NewUUID().String()
+	initAuth := feeds.NewUUID().String()
 	webURL.User = url.UserPassword("x", instAuth)
 
 	webURL.Path = fmt.Sprintf("/instance-launches/%s", ibw.b.ID)
@@ -307,12 +708,19 @@ func (ibw *instanceBuilderWorker) buildUserData() ([]byte, error) {
 	webURL.Path = fmt.Sprintf("/instance-builds/%s", ibw.b.ID)
 	instanceBuildURL := webURL.String()
 
-	webURL.Path = fmt.Sprintf("/init-scripts/%s", ibw.b.ID)
-	initScriptURL := webURL.String()
-
 	webURL.Path = fmt.Sprintf("/instance-heartbeats/%s", ibw.b.ID)
 	instanceHeartbeatURL := webURL.String()
 
+	webURL.Path = fmt.Sprintf("/instance-identities/%s", ibw.b.ID)
+	instanceIdentityURL := webURL.String()
+
+	// the init script is fetched with its own auth, which is limited
+	// in use and time, while the instance auth it contains is used for
+	// lifecycle transitions and heartbeats
+	webURL.User = url.UserPassword("x", initAuth)
+	webURL.Path = fmt.Sprintf("/init-scripts/%s", ibw.b.ID)
+	initScriptURL := webURL.String()
+
 	buf := &bytes.Buffer{}
 	gzw, err := gzip.NewWriterLevel(buf, gzip.BestCompression)
 	if err != nil {
@@ -346,6 +754,7 @@ func (ibw *instanceBuilderWorker) buildUserData() ([]byte, error) {
 		InstanceLaunchURL:    instanceLaunchURL,
 		InstanceTerminateURL: instanceTerminateURL,
 		InstanceHeartbeatURL: instanceHeartbeatURL,
+		InstanceIdentityURL:  instanceIdentityURL,
 
 		// TODO: extract InstanceRSA key via `env` func
 		InstanceRSA: ibw.cfg.InstanceRSA,
@@ -358,9 +767,11 @@ func (ibw *instanceBuilderWorker) buildUserData() ([]byte, error) {
 		return nil, err
 	}
 
+	// only the length is logged, as the script holds the instance rsa
+	// key, template secrets, and auths
 	log.WithFields(logrus.Fields{
-		"jid":    ibw.jid,
-		"script": tw.String(),
+		"jid":          ibw.jid,
+		"script_bytes": tw.Len(),
 	}).Debug("rendered init script")
 
 	err = gzw.Close()
@@ -370,24 +781,14 @@ func (ibw *instanceBuilderWorker) buildUserData() ([]byte, error) {
 
 	initScriptB64 := base64.StdEncoding.EncodeToString(buf.Bytes())
 
-	err = ibw.rc.Send("MULTI")
-	if err != nil {
-		return nil, err
-	}
-
-	err = ibw.rc.Send("HSET", fmt.Sprintf("%s:init-scripts", pudding.RedisNamespace), ibw.b.ID, initScriptB64)
-	if err != nil {
-		ibw.rc.Send("DISCARD")
-		return nil, err
-	}
-
-	err = ibw.rc.Send("HSET", fmt.Sprintf("%s:auths", pudding.RedisNamespace), ibw.b.ID, instAuth)
-	if err != nil {
-		ibw.rc.Send("DISCARD")
-		return nil, err
-	}
-
-	_, err = ibw.rc.Do("EXEC")
+	err = db.StoreInitScript(ibw.rc, &db.InitScriptRecord{
+		InstanceBuildID: ibw.b.ID,
+		Script:          initScriptB64,
+		InstanceAuth:    instAuth,
+		InitScriptAuth:  initAuth,
+		MaxUses:         ibw.cfg.InitScriptMaxUses,
+		ExpiresAt:       time.Now().UTC().Unix() + int64(ibw.cfg.InitScriptExpiry),
+	}, ibw.cfg.Keyring)
 	if err != nil {
 		return nil, err
 	}
@@ -396,9 +797,14 @@ func (ibw *instanceBuilderWorker) buildUserData() ([]byte, error) {
 }
 
 func (ibw *instanceBuilderWorker) notifyInstanceLaunched() {
+	ami := fmt.Sprintf("`%s`", ibw.b.AMI)
+	if ibw.b.Canary {
+		ami = fmt.Sprintf("canary `%s` :hatching_chick:", ibw.b.AMI)
+	}
+
 	for _, notifier := range ibw.n {
 		notifier.Notify(ibw.b.SlackChannel,
-			fmt.Sprintf("Started instance `%s` for instance build *%s* %s",
-				ibw.i.InstanceId, ibw.b.ID, pudding.NotificationInstanceBuildSummary(ibw.b)))
+			fmt.Sprintf("Started %s %s instance `%s` with ami %s for instance build *%s* %s",
+				ibw.b.Market, ibw.b.InstanceType, ibw.i.ID, ami, ibw.b.ID, pudding.NotificationInstanceBuildSummary(ibw.b)))
 	}
 }
@@ -6,9 +6,9 @@ import (
 
 	"github.com/Sirupsen/logrus"
 	"github.com/garyburd/redigo/redis"
-	"github.com/goamz/goamz/autoscaling"
 	"github.com/jrallison/go-workers"
 	"github.com/travis-ci/pudding"
+	"github.com/travis-ci/pudding/cloud"
 	"github.com/travis-ci/pudding/db"
 )
 
@@ -37,12 +37,13 @@ func instanceLifecycleTransitionsMain(cfg *internalConfig, msg *workers.Msg) {
 		return
 	}
 
+	ilt.Hydrate()
+
 	err = handleInstanceLifecycleTransition(cfg, workers.Config.Pool.Get(), msg.Jid(), ilt)
 	if err != nil {
-		switch err.(type) {
-		case *autoscaling.Error:
+		if cloud.IsAPIError(err) {
 			log.WithField("err", err).Error("discarding autoscaling error")
-		default:
+		} else {
 			log.WithField("err", err).Panic("instance lifecycle transition handler returned an error")
 		}
 	}
@@ -69,30 +70,34 @@ func handleInstanceLifecycleTransition(cfg *internalConfig, rc redis.Conn, jid s
 		return nil
 	}
 
-	as := autoscaling.New(cfg.AWSAuth, cfg.AWSRegion)
-
-	cla := &autoscaling.CompleteLifecycleActionParams{
-		AutoScalingGroupName:  ala.AutoScalingGroupName,
-		LifecycleActionResult: "CONTINUE",
-		LifecycleActionToken:  ala.LifecycleActionToken,
-		LifecycleHookName:     ala.LifecycleHookName,
-	}
-
 	log.WithFields(logrus.Fields{
 		"jid":        jid,
 		"transition": ilt.Transition,
 		"instance":   ilt.InstanceID,
-		"params":     fmt.Sprintf("%#v", cla),
+		"result":     ilt.Result,
 	}).Info("completing lifecycle action")
 
-	_, err = as.CompleteLifecycleAction(cla)
+	c, err := cloudForAccount(cfg, ala.AccountID, ala.Region)
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			"err":        err,
+			"jid":        jid,
+			"transition": ilt.Transition,
+			"instance":   ilt.InstanceID,
+			"region":     ala.Region,
+			"account_id": ala.AccountID,
+		}).Error("failed to find cloud for lifecycle action")
+		return err
+	}
+
+	err = completeLifecycleAction(withJobID(c, jid), ala, ilt.Result)
 	if err != nil {
 		log.WithFields(logrus.Fields{
 			"err":        err,
 			"jid":        jid,
 			"transition": ilt.Transition,
 			"instance":   ilt.InstanceID,
-			"params":     fmt.Sprintf("%#v", cla),
+			"result":     ilt.Result,
 		}).Error("failed to complete lifecycle action")
 		return err
 	}
@@ -104,3 +109,14 @@ func handleInstanceLifecycleTransition(cfg *internalConfig, rc redis.Conn, jid s
 
 	return nil
 }
+
+func completeLifecycleAction(c cloud.Cloud, ala *pudding.AutoscalingLifecycleAction, result string) error {
+	action := cloud.NewLifecycleAction(ala)
+
+	log.WithFields(logrus.Fields{
+		"action": fmt.Sprintf("%#v", action),
+		"result": result,
+	}).Debug("completing lifecycle action")
+
+	return c.CompleteLifecycleAction(action, result)
+}
@@ -0,0 +1,233 @@
+package workers
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/garyburd/redigo/redis"
+	"github.com/gorilla/feeds"
+	"github.com/travis-ci/pudding"
+	"github.com/travis-ci/pudding/db"
+)
+
+var (
+	// instanceReaperClaimExpiry is how long a warning or termination
+	// for a given expiry is claimed past the expiry, beyond which it
+	// may happen again should the instance still be around
+	instanceReaperClaimExpiry = 3600
+)
+
+type instanceReaper struct {
+	cfg *internalConfig
+	log *logrus.Logger
+	r   *redis.Pool
+	n   []pudding.Notifier
+}
+
+func newInstanceReaper(cfg *internalConfig, r *redis.Pool, log *logrus.Logger) (*instanceReaper, error) {
+	return &instanceReaper{
+		cfg: cfg,
+		log: log,
+		r:   r,
+		n:   []pudding.Notifier{cfg.Notifier},
+	}, nil
+}
+
+// Reap updates the expiry tags of instances whose ttl was extended,
+// warns about instances nearing their expiry, and enqueues the
+// termination of those past it which have been warned
+func (ir *instanceReaper) Reap() error {
+	conn := ir.r.Get()
+	defer func() { _ = conn.Close() }()
+
+	instances, err := db.FetchInstances(conn, map[string]string{})
+	if err != nil {
+		return err
+	}
+
+	err = ir.syncExpiryTags(conn, instances)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UTC().Unix()
+
+	for _, inst := range instances {
+		if inst.ExpiresAt == 0 {
+			continue
+		}
+
+		if now >= inst.ExpiresAt {
+			ir.reapOne(conn, inst, now)
+			continue
+		}
+
+		if ir.cfg.InstanceTTLWarning > 0 && inst.ExpiresAt-now <= int64(ir.cfg.InstanceTTLWarning) {
+			ir.warnOne(conn, inst, inst.ExpiresAt-now)
+		}
+	}
+
+	return nil
+}
+
+// syncExpiryTags updates the expires_at tag of the instances whose ttl
+// was extended, as the server has no cloud of its own with which to
+// do so
+func (ir *instanceReaper) syncExpiryTags(conn redis.Conn, instances []*pudding.Instance) error {
+	syncs, err := db.FetchInstanceExpiryTagSyncs(conn)
+	if err != nil {
+		return err
+	}
+
+	if len(syncs) == 0 {
+		return nil
+	}
+
+	for _, inst := range instances {
+		expiresAt, ok := syncs[inst.InstanceID]
+		if !ok {
+			continue
+		}
+
+		fields := logrus.Fields{
+			"instance":   inst.InstanceID,
+			"expires_at": expiresAt,
+		}
+
+		c, err := cloudForSite(ir.cfg, inst.Site, inst.Env, inst.Region)
+		if err != nil {
+			ir.log.WithFields(fields).WithField("err", err).Error("failed to get cloud for instance expiry tag")
+			continue
+		}
+
+		err = c.CreateTags([]string{inst.InstanceID}, map[string]string{
+			"expires_at": fmt.Sprintf("%d", expiresAt),
+		})
+		if err != nil {
+			ir.log.WithFields(fields).WithField("err", err).Error("failed to update instance expiry tag")
+			continue
+		}
+
+		err = db.ForgetInstanceExpiryTagSync(conn, inst.InstanceID, expiresAt)
+		if err != nil {
+			return err
+		}
+
+		ir.log.WithFields(fields).Info("updated instance expiry tag")
+	}
+
+	return nil
+}
+
+func (ir *instanceReaper) reapOne(conn redis.Conn, inst *pudding.Instance, now int64) {
+	fields := logrus.Fields{
+		"instance":   inst.InstanceID,
+		"expires_at": inst.ExpiresAt,
+	}
+
+	// instances are only ever terminated after a warning, which for
+	// those that expired unwarned, e.g. with warnings disabled or the
+	// workers down, comes now with the termination at the next run
+	warned, err := db.InstanceExpiryActionClaimed(conn, "warning", inst.InstanceID, inst.ExpiresAt)
+	if err != nil {
+		ir.log.WithFields(fields).WithField("err", err).Error("failed to check instance expiry warning")
+		return
+	}
+
+	if !warned {
+		ir.warnOne(conn, inst, inst.ExpiresAt-now)
+		return
+	}
+
+	claimed, err := db.ClaimInstanceExpiryAction(conn, "termination", inst.InstanceID, inst.ExpiresAt, instanceReaperClaimExpiry)
+	if err != nil {
+		ir.log.WithFields(fields).WithField("err", err).Error("failed to claim instance termination")
+		return
+	}
+
+	if !claimed {
+		return
+	}
+
+	payload := &pudding.InstanceTerminationPayload{
+		JID:          feeds.NewUUID().String(),
+		Retry:        true,
+		InstanceID:   inst.InstanceID,
+		SlackChannel: ir.slackChannel(inst),
+	}
+
+	payloadJSON, err := json.Marshal(payload)
+	if err != nil {
+		ir.log.WithFields(fields).WithField("err", err).Error("failed to marshal instance termination payload")
+		return
+	}
+
+	ir.log.WithFields(fields).WithField("jid", payload.JID).Info("enqueueing termination of expired instance")
+
+	err = db.EnqueueJob(conn, "instance-terminations", string(payloadJSON))
+	if err != nil {
+		ir.log.WithFields(fields).WithField("err", err).Error("failed to enqueue instance termination")
+		return
+	}
+
+	ir.notify(inst, fmt.Sprintf("Terminating expired instance `%s` (%s) :skull:",
+		inst.InstanceID, inst.Name))
+}
+
+func (ir *instanceReaper) warnOne(conn redis.Conn, inst *pudding.Instance, remaining int64) {
+	fields := logrus.Fields{
+		"instance":   inst.InstanceID,
+		"expires_at": inst.ExpiresAt,
+	}
+
+	// the warning is claimed until well past the expiry, so that the
+	// termination can tell it was given
+	expiry := instanceReaperClaimExpiry
+	if remaining > 0 {
+		expiry += int(remaining)
+	}
+
+	claimed, err := db.ClaimInstanceExpiryAction(conn, "warning", inst.InstanceID, inst.ExpiresAt, expiry)
+	if err != nil {
+		ir.log.WithFields(fields).WithField("err", err).Error("failed to claim instance expiry warning")
+		return
+	}
+
+	if !claimed {
+		return
+	}
+
+	ir.log.WithFields(fields).WithField("remaining", remaining).Info("warning of instance expiry")
+
+	if remaining <= 0 {
+		ir.notify(inst, fmt.Sprintf("Instance `%s` (%s) has expired and is about to be terminated, extend it via `POST /instances/%s/ttl-extensions` :alarm_clock:",
+			inst.InstanceID, inst.Name, inst.InstanceID))
+		return
+	}
+
+	ir.notify(inst, fmt.Sprintf("Instance `%s` (%s) expires in %ds, extend it via `POST /instances/%s/ttl-extensions` :alarm_clock:",
+		inst.InstanceID, inst.Name, remaining, inst.InstanceID))
+}
+
+// slackChannel returns the channel of the build that launched the
+// instance, falling back to the default
+func (ir *instanceReaper) slackChannel(inst *pudding.Instance) string {
+	if inst.SlackChannel != "" {
+		return inst.SlackChannel
+	}
+
+	return ir.cfg.DefaultSlackChannel
+}
+
+func (ir *instanceReaper) notify(inst *pudding.Instance, msg string) {
+	channel := ir.slackChannel(inst)
+	if channel == "" {
+		return
+	}
+
+	for _, notifier := range ir.n {
+		notifier.Notify(channel, msg)
+	}
+}
@@ -0,0 +1,433 @@
+package workers
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/garyburd/redigo/redis"
+	"github.com/gorilla/feeds"
+	"github.com/travis-ci/pudding"
+	"github.com/travis-ci/pudding/cloud"
+	"github.com/travis-ci/pudding/db"
+)
+
+type instanceReconciler struct {
+	cfg *internalConfig
+	log *logrus.Logger
+	r   *redis.Pool
+	tgt []*awsTarget
+	rep db.OrphanInstanceReportFetcherStorer
+	n   []pudding.Notifier
+
+	enabledAt    int64
+	terminations int
+}
+
+func newInstanceReconciler(cfg *internalConfig, r *redis.Pool, log *logrus.Logger) (*instanceReconciler, error) {
+	rep, err := db.NewOrphanInstanceReports(r, log)
+	if err != nil {
+		return nil, err
+	}
+
+	tgt, err := awsTargets(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	return &instanceReconciler{
+		cfg: cfg,
+		log: log,
+		r:   r,
+		tgt: tgt,
+		rep: rep,
+		n:   []pudding.Notifier{cfg.Notifier},
+	}, nil
+}
+
+// Reconcile compares the instances in every configured region and
+// account against the instances pudding launched, reporting those that
+// have lost their tags, those tagged with a build pudding doesn't know,
+// and those that never appeared, once older than the grace period
+func (ir *instanceReconciler) Reconcile() error {
+	if ir.cfg.OrphanGracePeriod <= 0 {
+		return nil
+	}
+
+	conn := ir.r.Get()
+	defer func() { _ = conn.Close() }()
+
+	now := time.Now().UTC().Unix()
+	ir.terminations = 0
+
+	enabledAt, first, err := db.ClaimInstanceReconcilerEnabledAt(conn, now)
+	if err != nil {
+		return err
+	}
+	ir.enabledAt = enabledAt
+
+	if first {
+		err = ir.seedKnownBuilds(conn, now)
+		if err != nil {
+			return err
+		}
+	}
+
+	previous, err := ir.rep.Fetch()
+	if err != nil {
+		return err
+	}
+
+	records, err := db.FetchInstanceLaunchRecords(conn)
+	if err != nil {
+		return err
+	}
+
+	recordsByID := map[string]*pudding.InstanceLaunchRecord{}
+	for _, rec := range records {
+		recordsByID[rec.InstanceID] = rec
+	}
+
+	report := &pudding.OrphanInstanceReport{
+		RunAt:       now,
+		Action:      ir.cfg.OrphanAction,
+		GracePeriod: ir.cfg.OrphanGracePeriod,
+		Orphans:     []*pudding.OrphanInstance{},
+	}
+
+	seen := map[string]bool{}
+
+	for _, t := range ir.tgt {
+		instances, err := cloud.GetInstancesWithFilter(t.Cloud, cloud.Filter{
+			"instance-state-name": []string{"pending", "running", "stopping", "stopped"},
+		})
+		if err != nil {
+			return err
+		}
+
+		asgMembers, err := ir.recordAutoscalingGroups(conn, t, now)
+		if err != nil {
+			return err
+		}
+
+		err = ir.reconcileTarget(conn, t, instances, asgMembers, recordsByID, report, now)
+		if err != nil {
+			return err
+		}
+
+		for ID := range instances {
+			seen[ID] = true
+		}
+	}
+
+	for _, rec := range records {
+		if seen[rec.InstanceID] {
+			continue
+		}
+
+		if rec.SeenAt > 0 {
+			ir.log.WithField("instance_id", rec.InstanceID).Debug("forgetting launch of instance that is gone")
+			err = db.RemoveInstanceLaunchRecord(conn, rec.InstanceID)
+			if err != nil {
+				ir.log.WithFields(logrus.Fields{
+					"err":         err,
+					"instance_id": rec.InstanceID,
+				}).Warn("failed to remove instance launch record")
+			}
+			continue
+		}
+
+		if now-rec.LaunchedAt < int64(ir.cfg.OrphanGracePeriod) {
+			continue
+		}
+
+		report.Orphans = append(report.Orphans, &pudding.OrphanInstance{
+			Kind:            pudding.OrphanKindMissing,
+			InstanceID:      rec.InstanceID,
+			InstanceBuildID: rec.InstanceBuildID,
+			AccountID:       rec.AccountID,
+			Region:          rec.Region,
+			LaunchedAt:      rec.LaunchedAt,
+			Action:          "reported",
+		})
+	}
+
+	ir.notifyNew(previous, report)
+
+	return ir.rep.Store(report)
+}
+
+// seedKnownBuilds marks the builds of the instances already synced as
+// known, so that the fleet running when reconciliation is first enabled
+// (or after its records are lost) isn't taken for orphans
+func (ir *instanceReconciler) seedKnownBuilds(conn redis.Conn, now int64) error {
+	instances, err := db.FetchInstances(conn, map[string]string{})
+	if err != nil {
+		return err
+	}
+
+	seeded := map[string]bool{}
+	for _, inst := range instances {
+		if inst.BuildID == "" || seeded[inst.BuildID] {
+			continue
+		}
+
+		err = db.RecordKnownInstanceBuild(conn, inst.BuildID, now, db.InstanceLaunchRecordExpiry)
+		if err != nil {
+			return err
+		}
+		seeded[inst.BuildID] = true
+	}
+
+	ir.log.WithField("builds", len(seeded)).Info("seeded known instance builds")
+	return nil
+}
+
+// recordAutoscalingGroups marks the builds of the target's autoscaling
+// groups as known, and keeps sharing the init scripts they launch
+// instances with, for as long as the groups exist, however long they
+// sit without instances, and returns the groups' instances
+func (ir *instanceReconciler) recordAutoscalingGroups(conn redis.Conn, t *awsTarget, now int64) (map[string]bool, error) {
+	groups, err := t.Cloud.DescribeAutoscalingGroups()
+	if err != nil {
+		return nil, err
+	}
+
+	members := map[string]bool{}
+	for _, asg := range groups {
+		for _, ID := range asg.InstanceIDs {
+			members[ID] = true
+		}
+
+		err = db.RefreshInitScriptAutoscalingGroup(conn, asg.Name, ir.cfg.InitScriptSharedExpiry)
+		if err != nil {
+			return nil, err
+		}
+
+		if asg.Tags["build_id"] == "" {
+			continue
+		}
+
+		err = db.RecordKnownInstanceBuild(conn, asg.Tags["build_id"], now, db.InstanceLaunchRecordExpiry)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return members, nil
+}
+
+func (ir *instanceReconciler) reconcileTarget(conn redis.Conn, t *awsTarget, instances map[string]*cloud.Instance,
+	asgMembers map[string]bool, recordsByID map[string]*pudding.InstanceLaunchRecord,
+	report *pudding.OrphanInstanceReport, now int64) error {
+
+	unrecorded := []*cloud.Instance{}
+	buildIDs := []string{}
+
+	for _, inst := range instances {
+		rec, ok := recordsByID[inst.ID]
+		if !ok {
+			if inst.Tags["build_id"] != "" && !asgMembers[inst.ID] {
+				unrecorded = append(unrecorded, inst)
+				buildIDs = append(buildIDs, inst.Tags["build_id"])
+			}
+			continue
+		}
+
+		rec.SeenAt = now
+		err := db.StoreInstanceLaunchRecord(conn, rec, db.InstanceLaunchRecordExpiry)
+		if err != nil {
+			return err
+		}
+
+		if hasTags(inst, rec.Tags()) || now-rec.LaunchedAt < int64(ir.cfg.OrphanGracePeriod) {
+			continue
+		}
+
+		orphan := &pudding.OrphanInstance{
+			Kind:            pudding.OrphanKindUntagged,
+			InstanceID:      inst.ID,
+			InstanceBuildID: rec.InstanceBuildID,
+			AccountID:       t.AccountID,
+			Region:          t.Cloud.Region(),
+			LaunchedAt:      rec.LaunchedAt,
+		}
+		report.Orphans = append(report.Orphans, orphan)
+
+		ir.act(orphan, func() error {
+			return t.Cloud.CreateTags([]string{inst.ID}, rec.Tags())
+		})
+	}
+
+	known, err := db.FetchKnownInstanceBuilds(conn, buildIDs)
+	if err != nil {
+		return err
+	}
+
+	for _, inst := range unrecorded {
+		buildID := inst.Tags["build_id"]
+
+		if known[buildID] {
+			err = db.RecordKnownInstanceBuild(conn, buildID, now, db.InstanceLaunchRecordExpiry)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		launchedAt := now
+		if launchTime, err := time.Parse(time.RFC3339, inst.LaunchTime); err == nil {
+			launchedAt = launchTime.Unix()
+		}
+
+		if now-launchedAt < int64(ir.cfg.OrphanGracePeriod) {
+			continue
+		}
+
+		orphan := &pudding.OrphanInstance{
+			Kind:            pudding.OrphanKindUnknownBuild,
+			InstanceID:      inst.ID,
+			InstanceBuildID: buildID,
+			AccountID:       t.AccountID,
+			Region:          t.Cloud.Region(),
+			LaunchedAt:      launchedAt,
+		}
+		report.Orphans = append(report.Orphans, orphan)
+
+		rec := &pudding.InstanceLaunchRecord{
+			InstanceID:      inst.ID,
+			InstanceBuildID: buildID,
+			AccountID:       t.AccountID,
+			Region:          t.Cloud.Region(),
+			Role:            inst.Tags["role"],
+			Site:            inst.Tags["site"],
+			Env:             inst.Tags["env"],
+			Queue:           inst.Tags["queue"],
+			LaunchedAt:      launchedAt,
+			SeenAt:          now,
+		}
+
+		ir.act(orphan, func() error {
+			return db.StoreInstanceLaunchRecord(conn, rec, db.InstanceLaunchRecordExpiry)
+		})
+	}
+
+	return nil
+}
+
+// act adopts or terminates the orphan as configured, recording what
+// happened on it
+func (ir *instanceReconciler) act(orphan *pudding.OrphanInstance, adopt func() error) {
+	fields := logrus.Fields{
+		"kind":              orphan.Kind,
+		"instance_id":       orphan.InstanceID,
+		"instance_build_id": orphan.InstanceBuildID,
+		"region":            orphan.Region,
+		"account_id":        orphan.AccountID,
+	}
+
+	var err error
+
+	switch ir.cfg.OrphanAction {
+	case pudding.OrphanActionAdopt:
+		ir.log.WithFields(fields).Info("adopting orphan instance")
+		err = adopt()
+		orphan.Action = "adopted"
+	case pudding.OrphanActionTerminate:
+		if reason := ir.refuseTermination(orphan); reason != "" {
+			ir.log.WithFields(fields).WithField("reason", reason).Warn("not terminating orphan instance")
+			orphan.Action = "reported"
+			orphan.Error = reason
+			return
+		}
+
+		ir.log.WithFields(fields).Info("terminating orphan instance")
+		err = ir.enqueueTermination(orphan)
+		orphan.Action = "terminating"
+		ir.terminations++
+	default:
+		ir.log.WithFields(fields).Info("found orphan instance")
+		orphan.Action = "reported"
+	}
+
+	if err != nil {
+		ir.log.WithFields(fields).WithField("err", err).Error("failed to act on orphan instance")
+		orphan.Action = "failed"
+		orphan.Error = err.Error()
+	}
+}
+
+// refuseTermination returns why the orphan mustn't be terminated, if
+// it mustn't: instances of unknown builds launched before reconciliation
+// was enabled may well be pudding's own, and no run terminates more
+// than the configured number of orphans
+func (ir *instanceReconciler) refuseTermination(orphan *pudding.OrphanInstance) string {
+	if orphan.Kind == pudding.OrphanKindUnknownBuild && orphan.LaunchedAt <= ir.enabledAt {
+		return "launched before reconciliation was enabled"
+	}
+
+	if ir.terminations >= ir.cfg.OrphanMaxTerminations {
+		return fmt.Sprintf("over the limit of %d terminations per run", ir.cfg.OrphanMaxTerminations)
+	}
+
+	return ""
+}
+
+func (ir *instanceReconciler) enqueueTermination(orphan *pudding.OrphanInstance) error {
+	payload := &pudding.InstanceTerminationPayload{
+		JID:          feeds.NewUUID().String(),
+		Retry:        true,
+		InstanceID:   orphan.InstanceID,
+		SlackChannel: ir.cfg.DefaultSlackChannel,
+		AccountID:    orphan.AccountID,
+		Region:       orphan.Region,
+	}
+
+	payloadJSON, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	conn := ir.r.Get()
+	defer func() { _ = conn.Close() }()
+
+	return db.EnqueueJob(conn, "instance-terminations", string(payloadJSON))
+}
+
+// notifyNew notifies of the orphans which weren't in the previous
+// report, so that each is only brought up once
+func (ir *instanceReconciler) notifyNew(previous, report *pudding.OrphanInstanceReport) {
+	if ir.cfg.DefaultSlackChannel == "" {
+		return
+	}
+
+	known := map[string]bool{}
+	if previous != nil {
+		for _, orphan := range previous.Orphans {
+			known[orphan.Kind+":"+orphan.InstanceID] = true
+		}
+	}
+
+	for _, orphan := range report.Orphans {
+		if known[orphan.Kind+":"+orphan.InstanceID] {
+			continue
+		}
+
+		for _, notifier := range ir.n {
+			notifier.Notify(ir.cfg.DefaultSlackChannel,
+				fmt.Sprintf("Found *%s* orphan instance `%s` from instance build *%s* in %s, which was *%s* :mag:",
+					orphan.Kind, orphan.InstanceID, orphan.InstanceBuildID, orphan.Region, orphan.Action))
+		}
+	}
+}
+
+func hasTags(inst *cloud.Instance, tags map[string]string) bool {
+	for key, value := range tags {
+		if inst.Tags[key] != value {
+			return false
+		}
+	}
+
+	return true
+}
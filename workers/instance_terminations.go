@@ -6,9 +6,9 @@ import (
 
 	"github.com/Sirupsen/logrus"
 	"github.com/garyburd/redigo/redis"
-	"github.com/goamz/goamz/ec2"
 	"github.com/jrallison/go-workers"
 	"github.com/travis-ci/pudding"
+	"github.com/travis-ci/pudding/cloud"
 	"github.com/travis-ci/pudding/db"
 )
 
@@ -29,8 +29,11 @@ func instanceTerminationsMain(cfg *internalConfig, msg *workers.Msg) {
 		log.WithField("err", err).Panic("failed to deserialize message")
 	}
 
-	err = newInstanceTerminatorWorker(buildPayload.InstanceID, buildPayload.SlackChannel,
-		cfg, msg.Jid(), workers.Config.Pool.Get()).Terminate()
+	itw := newInstanceTerminatorWorker(buildPayload.InstanceID, buildPayload.SlackChannel,
+		cfg, msg.Jid(), workers.Config.Pool.Get())
+	itw.acct, itw.region = buildPayload.AccountID, buildPayload.Region
+
+	err = itw.Terminate()
 	if err != nil {
 		log.WithField("err", err).Panic("instance termination failed")
 	}
@@ -43,30 +46,49 @@ type instanceTerminatorWorker struct {
 	n   []pudding.Notifier
 	iid string
 	cfg *internalConfig
-	ec2 *ec2.EC2
+
+	acct   string
+	region string
 }
 
 func newInstanceTerminatorWorker(instanceID, slackChannel string, cfg *internalConfig, jid string, redisConn redis.Conn) *instanceTerminatorWorker {
-	notifier := pudding.NewSlackNotifier(cfg.SlackHookPath, cfg.SlackUsername, cfg.SlackIcon)
-
 	return &instanceTerminatorWorker{
 		rc:  redisConn,
 		jid: jid,
 		cfg: cfg,
 		nc:  slackChannel,
-		n:   []pudding.Notifier{notifier},
+		n:   []pudding.Notifier{cfg.Notifier},
 		iid: instanceID,
-		ec2: ec2.New(cfg.AWSAuth, cfg.AWSRegion),
 	}
 }
 
 func (itw *instanceTerminatorWorker) Terminate() error {
-	_, err := itw.ec2.TerminateInstances([]string{itw.iid})
+	instances, _ := db.FetchInstances(itw.rc, map[string]string{"instance_id": itw.iid})
+
+	regionName, site, env := "", "", ""
+	if instances != nil && len(instances) > 0 {
+		regionName, site, env = instances[0].Region, instances[0].Site, instances[0].Env
+	}
+
+	var (
+		c   cloud.Cloud
+		err error
+	)
+
+	if regionName == "" && itw.region != "" {
+		c, err = cloudForAccount(itw.cfg, itw.acct, itw.region)
+	} else {
+		c, err = cloudForSite(itw.cfg, site, env, regionName)
+	}
 	if err != nil {
 		return err
 	}
+	c = withJobID(c, itw.jid)
 
-	instances, _ := db.FetchInstances(itw.rc, map[string]string{"instance_id": itw.iid})
+	err = c.TerminateInstances([]string{itw.iid})
+	if err != nil {
+		return err
+	}
 
 	err = db.RemoveInstances(itw.rc, []string{itw.iid})
 	if err != nil && instances != nil && len(instances) > 0 {
@@ -4,20 +4,34 @@ import (
 	"net/url"
 	"text/template"
 
-	"github.com/goamz/goamz/aws"
 	"github.com/jrallison/go-workers"
+	"github.com/travis-ci/pudding"
+	"github.com/travis-ci/pudding/cloud"
+	"github.com/travis-ci/pudding/db"
+	"github.com/travis-ci/pudding/secrets"
 )
 
 type internalConfig struct {
-	AWSAuth   aws.Auth
-	AWSRegion aws.Region
+	AWSRegion string
+
+	// AWSRegions contains every configured region, including AWSRegion
+	AWSRegions map[string]bool
+
+	// NewCloud returns the cloud for a region, using the base
+	// credentials when the role ARN is empty
+	NewCloud func(string, string) cloud.Cloud
+
+	Notifier pudding.Notifier
+
+	AccountRoles pudding.AccountRoles
 
 	RedisURL      *url.URL
 	RedisPoolSize string
 
-	SlackHookPath string
-	SlackUsername string
-	SlackIcon     string
+	SlackHookPath       string
+	SlackUsername       string
+	SlackIcon           string
+	DefaultSlackChannel string
 
 	SentryDSN string
 
@@ -36,6 +50,41 @@ type internalConfig struct {
 	InstanceStoreExpiry int
 	ImageStoreExpiry    int
 
+	// InstanceTTLWarning is how many seconds before their expiry to
+	// warn about instances launched with a ttl
+	InstanceTTLWarning int
+
+	LifecycleHeartbeatInterval int
+	LifecycleActionTimeout     int
+	LifecycleTimeoutResults    map[string]string
+
+	SecurityGroupGCGracePeriod int
+	SecurityGroupGCDryRun      bool
+	DefaultIngressRules        []*pudding.IngressRule
+
+	OrphanGracePeriod     int
+	OrphanAction          string
+	OrphanMaxTerminations int
+
 	InitScriptTemplate       *template.Template
 	InitScriptTemplateString string
+
+	// InitScriptExpiry and InitScriptMaxUses limit how long and how
+	// often an init script may be fetched with its temporary auth
+	InitScriptExpiry  int
+	InitScriptMaxUses int
+	// InitScriptSharedExpiry is how long an init script shared with an
+	// autoscaling group may be fetched after the group was last seen
+	InitScriptSharedExpiry int
+
+	// Keyring encrypts init scripts and auths at rest, or is nil when
+	// storing them as plaintext
+	Keyring *pudding.Keyring
+
+	Secrets          secrets.Provider
+	SecretsAllowlist secrets.Allowlist
+
+	// AuditLog records the actions taken through the cloud, which go
+	// unrecorded when nil
+	AuditLog db.AuditRecorder
 }
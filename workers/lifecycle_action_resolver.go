@@ -0,0 +1,137 @@
+package workers
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/garyburd/redigo/redis"
+	"github.com/travis-ci/pudding"
+	"github.com/travis-ci/pudding/cloud"
+	"github.com/travis-ci/pudding/db"
+)
+
+type lifecycleActionResolver struct {
+	cfg *internalConfig
+	log *logrus.Logger
+	r   *redis.Pool
+	n   []pudding.Notifier
+}
+
+func newLifecycleActionResolver(cfg *internalConfig, r *redis.Pool, log *logrus.Logger) (*lifecycleActionResolver, error) {
+	return &lifecycleActionResolver{
+		cfg: cfg,
+		log: log,
+		r:   r,
+		n:   []pudding.Notifier{cfg.Notifier},
+	}, nil
+}
+
+// Resolve sends heartbeats for pending lifecycle actions that are
+// still within the configured timeout, and completes those that have
+// gone stale with the result configured for their transition
+func (lar *lifecycleActionResolver) Resolve() error {
+	conn := lar.r.Get()
+	defer func() { _ = conn.Close() }()
+
+	now := time.Now().UTC().Unix()
+
+	for transition, result := range lar.cfg.LifecycleTimeoutResults {
+		actions, err := db.FetchInstanceLifecycleActions(conn, transition)
+		if err != nil {
+			return err
+		}
+
+		for _, ala := range actions {
+			lar.resolveOne(conn, transition, result, ala, now)
+		}
+	}
+
+	return nil
+}
+
+func (lar *lifecycleActionResolver) resolveOne(conn redis.Conn, transition, result string, ala *pudding.AutoscalingLifecycleAction, now int64) {
+	fields := logrus.Fields{
+		"transition": transition,
+		"instance":   ala.EC2InstanceID,
+		"asg":        ala.AutoScalingGroupName,
+	}
+
+	if ala.StoredAt == 0 {
+		lar.log.WithFields(fields).Debug("starting the clock on untimed lifecycle action")
+		err := db.SetInstanceLifecycleActionAttributes(conn, transition, ala.EC2InstanceID,
+			map[string]string{"stored_at": fmt.Sprintf("%d", now)})
+		if err != nil {
+			lar.log.WithFields(fields).WithField("err", err).Error("failed to set lifecycle action stored_at")
+		}
+		return
+	}
+
+	age := now - ala.StoredAt
+
+	c, err := cloudForAccount(lar.cfg, ala.AccountID, ala.Region)
+	if err != nil {
+		lar.log.WithFields(fields).WithField("err", err).Error("failed to find cloud for lifecycle action")
+		return
+	}
+
+	if lar.cfg.LifecycleActionTimeout > 0 && age >= int64(lar.cfg.LifecycleActionTimeout) {
+		lar.log.WithFields(fields).WithFields(logrus.Fields{
+			"age":    age,
+			"result": result,
+		}).Info("resolving timed out lifecycle action")
+
+		err := completeLifecycleAction(c, ala, result)
+		if err != nil {
+			if !cloud.IsAPIError(err) {
+				lar.log.WithFields(fields).WithField("err", err).Error("failed to complete timed out lifecycle action")
+				return
+			}
+
+			lar.log.WithFields(fields).WithField("err", err).Warn("discarding lifecycle action rejected by autoscaling")
+		}
+
+		err = db.WipeInstanceLifecycleAction(conn, transition, ala.EC2InstanceID)
+		if err != nil {
+			lar.log.WithFields(fields).WithField("err", err).Warn("failed to clean up lifecycle action bits")
+		}
+
+		lar.notifyResolved(transition, result, ala, age)
+		return
+	}
+
+	lastBeat := ala.HeartbeatAt
+	if lastBeat == 0 {
+		lastBeat = ala.StoredAt
+	}
+
+	if lar.cfg.LifecycleHeartbeatInterval <= 0 || now-lastBeat < int64(lar.cfg.LifecycleHeartbeatInterval) {
+		return
+	}
+
+	lar.log.WithFields(fields).WithField("age", age).Debug("recording lifecycle action heartbeat")
+
+	err = c.RecordLifecycleActionHeartbeat(cloud.NewLifecycleAction(ala))
+	if err != nil {
+		lar.log.WithFields(fields).WithField("err", err).Error("failed to record lifecycle action heartbeat")
+		return
+	}
+
+	err = db.SetInstanceLifecycleActionAttributes(conn, transition, ala.EC2InstanceID,
+		map[string]string{"heartbeat_at": fmt.Sprintf("%d", now)})
+	if err != nil {
+		lar.log.WithFields(fields).WithField("err", err).Error("failed to set lifecycle action heartbeat_at")
+	}
+}
+
+func (lar *lifecycleActionResolver) notifyResolved(transition, result string, ala *pudding.AutoscalingLifecycleAction, age int64) {
+	if lar.cfg.DefaultSlackChannel == "" {
+		return
+	}
+
+	for _, notifier := range lar.n {
+		notifier.Notify(lar.cfg.DefaultSlackChannel,
+			fmt.Sprintf("Completed stale *%s* lifecycle action for `%s` in *%s* with *%s* after %ds :hourglass:",
+				transition, ala.EC2InstanceID, ala.AutoScalingGroupName, result, age))
+	}
+}
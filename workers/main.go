@@ -5,10 +5,11 @@ import (
 	"os"
 	"strconv"
 	"strings"
-	"time"
 
 	"github.com/Sirupsen/logrus"
-	"github.com/goamz/goamz/aws"
+	"github.com/travis-ci/pudding"
+	"github.com/travis-ci/pudding/cloud"
+	"github.com/travis-ci/pudding/secrets"
 )
 
 // Main is the whole shebang
@@ -20,9 +21,12 @@ func Main(cfg *Config) {
 	ic := &internalConfig{
 		RedisPoolSize: cfg.RedisPoolSize,
 
-		SlackHookPath: cfg.SlackHookPath,
-		SlackUsername: cfg.SlackUsername,
-		SlackIcon:     cfg.SlackIcon,
+		SlackHookPath:       cfg.SlackHookPath,
+		SlackUsername:       cfg.SlackUsername,
+		SlackIcon:           cfg.SlackIcon,
+		DefaultSlackChannel: cfg.DefaultSlackChannel,
+
+		Notifier: pudding.NewSlackNotifier(cfg.SlackHookPath, cfg.SlackUsername, cfg.SlackIcon),
 
 		SentryDSN: cfg.SentryDSN,
 
@@ -40,23 +44,111 @@ func Main(cfg *Config) {
 		MiniWorkerInterval:  cfg.MiniWorkerInterval,
 		InstanceStoreExpiry: cfg.InstanceExpiry,
 		ImageStoreExpiry:    cfg.ImageExpiry,
+		InstanceTTLWarning:  cfg.InstanceTTLWarning,
+
+		LifecycleHeartbeatInterval: cfg.LifecycleHeartbeatInterval,
+		LifecycleActionTimeout:     cfg.LifecycleActionTimeout,
+		LifecycleTimeoutResults: map[string]string{
+			"launching":   strings.ToUpper(cfg.LifecycleLaunchingTimeoutResult),
+			"terminating": strings.ToUpper(cfg.LifecycleTerminatingTimeoutResult),
+		},
+
+		SecurityGroupGCGracePeriod: cfg.SecurityGroupGCGracePeriod,
+		SecurityGroupGCDryRun:      cfg.SecurityGroupGCDryRun,
+
+		OrphanGracePeriod:     cfg.OrphanGracePeriod,
+		OrphanAction:          cfg.OrphanAction,
+		OrphanMaxTerminations: cfg.OrphanMaxTerminations,
 
 		InitScriptTemplateString: cfg.InitScriptTemplate,
+		InitScriptExpiry:         cfg.InitScriptExpiry,
+		InitScriptMaxUses:        cfg.InitScriptMaxUses,
+		InitScriptSharedExpiry:   cfg.InitScriptSharedExpiry,
 	}
 
-	auth, err := aws.GetAuth(cfg.AWSKey, cfg.AWSSecret, "", time.Now().UTC().Add(8766*time.Hour))
+	regions, err := pudding.ParseRegions(cfg.AWSRegion, cfg.AWSRegions)
 	if err != nil {
-		log.WithField("err", err).Fatal("failed to load aws auth")
+		log.WithField("err", err).Fatal("failed to parse regions")
+		os.Exit(1)
+	}
+	ic.AWSRegion = cfg.AWSRegion
+	ic.AWSRegions = regions
+	ic.NewCloud = newAWSCloudFunc(cfg.AWSKey, cfg.AWSSecret, cfg.ProcessID)
+	if cfg.FakeCloudURL != "" {
+		log.WithField("url", cfg.FakeCloudURL).Warn("using fake cloud")
+		ic.NewCloud = func(roleARN, region string) cloud.Cloud {
+			return cloud.NewRemote(cfg.FakeCloudURL, region)
+		}
+	}
+
+	for transition, result := range ic.LifecycleTimeoutResults {
+		if !pudding.IsValidLifecycleActionResult(result) {
+			log.WithFields(logrus.Fields{
+				"transition": transition,
+				"result":     result,
+			}).Fatal("invalid lifecycle timeout result")
+			os.Exit(1)
+		}
+	}
+
+	if ic.OrphanAction == "" {
+		ic.OrphanAction = pudding.OrphanActionReport
+	}
+
+	if !pudding.IsValidOrphanAction(ic.OrphanAction) {
+		log.WithField("action", ic.OrphanAction).Fatal("invalid orphan action")
 		os.Exit(1)
 	}
 
-	region, ok := aws.Regions[cfg.AWSRegion]
-	if !ok {
-		log.WithField("region", cfg.AWSRegion).Fatal("invalid region")
+	ic.AccountRoles, err = pudding.ParseAccountRoles(cfg.AccountRoles)
+	if err != nil {
+		log.WithField("err", err).Fatal("invalid account roles")
 		os.Exit(1)
 	}
-	ic.AWSAuth = auth
-	ic.AWSRegion = region
+
+	if cfg.DefaultIngressRules == "" {
+		cfg.DefaultIngressRules = pudding.DefaultIngressRulesJSON
+	}
+
+	ic.DefaultIngressRules, err = pudding.ParseIngressRules(cfg.DefaultIngressRules)
+	if err != nil {
+		log.WithField("err", err).Fatal("invalid default ingress rules")
+		os.Exit(1)
+	}
+
+	if ic.InitScriptExpiry <= 0 || ic.InitScriptMaxUses <= 0 || ic.InitScriptSharedExpiry <= 0 {
+		log.WithFields(logrus.Fields{
+			"expiry":        ic.InitScriptExpiry,
+			"max_uses":      ic.InitScriptMaxUses,
+			"shared_expiry": ic.InitScriptSharedExpiry,
+		}).Fatal("init script expiry, max uses, and shared expiry must be positive")
+		os.Exit(1)
+	}
+
+	ic.Keyring, err = pudding.ParseKeyring(cfg.EncryptionKeys)
+	if err != nil {
+		log.WithField("err", err).Fatal("invalid encryption keys")
+		os.Exit(1)
+	}
+
+	if ic.Keyring == nil {
+		log.Warn("no encryption keys configured, storing init scripts and auths as plaintext")
+	} else if cfg.EncryptionMigration {
+		log.Warn("reading init scripts and auths stored as plaintext until they are encrypted")
+		ic.Keyring.AllowPlaintext()
+	}
+
+	ic.Secrets, err = newSecretsProvider(cfg, ic.Keyring)
+	if err != nil {
+		log.WithField("err", err).Fatal("invalid secrets provider")
+		os.Exit(1)
+	}
+
+	ic.SecretsAllowlist = secrets.ParseAllowlist(cfg.SecretsAllowlist)
+	log.WithFields(logrus.Fields{
+		"provider":  ic.Secrets.Name(),
+		"allowlist": ic.SecretsAllowlist,
+	}).Info("looking up init script secrets")
 
 	if ic.InstanceRSA == "" {
 		log.Fatal("missing instance rsa key")
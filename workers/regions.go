@@ -0,0 +1,32 @@
+package workers
+
+import (
+	"fmt"
+	"sort"
+)
+
+// awsRegion returns the name of the configured region, or the default
+// region when the name is empty
+func awsRegion(cfg *internalConfig, name string) (string, error) {
+	if name == "" {
+		return cfg.AWSRegion, nil
+	}
+
+	if !cfg.AWSRegions[name] {
+		return "", fmt.Errorf("region %q is not configured", name)
+	}
+
+	return name, nil
+}
+
+// awsRegionNames returns the names of all configured regions in a
+// stable order
+func awsRegionNames(cfg *internalConfig) []string {
+	names := []string{}
+	for name := range cfg.AWSRegions {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,247 @@
+package workers
+
+import (
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/garyburd/redigo/redis"
+	"github.com/travis-ci/pudding"
+	"github.com/travis-ci/pudding/cloud"
+	"github.com/travis-ci/pudding/db"
+)
+
+type securityGroupCollector struct {
+	cfg *internalConfig
+	log *logrus.Logger
+	tgt []*awsTarget
+	rep db.SecurityGroupGCReportFetcherStorer
+}
+
+func newSecurityGroupCollector(cfg *internalConfig, r *redis.Pool, log *logrus.Logger) (*securityGroupCollector, error) {
+	rep, err := db.NewSecurityGroupGCReports(r, log)
+	if err != nil {
+		return nil, err
+	}
+
+	tgt, err := awsTargets(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	return &securityGroupCollector{
+		cfg: cfg,
+		log: log,
+		tgt: tgt,
+		rep: rep,
+	}, nil
+}
+
+// Collect deletes the launch templates made for autoscaling groups
+// that are gone, and then the per-build security groups in every
+// configured region and account that are older than the grace period
+// and neither attached to any instance nor launched with by any
+// autoscaling group or launch template, or only reports them when in
+// dry-run mode
+func (sgc *securityGroupCollector) Collect() error {
+	if sgc.cfg.SecurityGroupGCGracePeriod <= 0 {
+		return nil
+	}
+
+	now := time.Now().UTC()
+	report := &pudding.SecurityGroupGCReport{
+		RunAt:       now.Unix(),
+		DryRun:      sgc.cfg.SecurityGroupGCDryRun,
+		GracePeriod: sgc.cfg.SecurityGroupGCGracePeriod,
+		Groups:      []*pudding.SecurityGroupGCEntry{},
+
+		LaunchTemplates: []*pudding.LaunchTemplateGCEntry{},
+	}
+
+	for _, t := range sgc.tgt {
+		err := sgc.collectTarget(t, report, now)
+		if err != nil {
+			return err
+		}
+	}
+
+	return sgc.rep.Store(report)
+}
+
+func (sgc *securityGroupCollector) collectTarget(t *awsTarget, report *pudding.SecurityGroupGCReport, now time.Time) error {
+	err := sgc.collectLaunchTemplates(t, report, now)
+	if err != nil {
+		return err
+	}
+
+	groups, err := t.Cloud.DescribeSecurityGroups(cloud.Filter{
+		"group-name": []string{pudding.SecurityGroupNamePrefix + "*"},
+	})
+	if err != nil {
+		return err
+	}
+
+	inUse, err := sgc.fetchInUseGroupIDs(t.Cloud)
+	if err != nil {
+		return err
+	}
+
+	for _, sg := range groups {
+		createdAt, ok := pudding.SecurityGroupCreatedAt(sg.Name)
+		if !ok {
+			continue
+		}
+
+		entry := &pudding.SecurityGroupGCEntry{
+			ID:        sg.ID,
+			Name:      sg.Name,
+			Region:    t.Cloud.Region(),
+			AccountID: t.AccountID,
+			CreatedAt: createdAt,
+			InUse:     inUse[sg.ID],
+			Action:    "kept",
+		}
+		report.Groups = append(report.Groups, entry)
+
+		if entry.InUse || now.Unix()-createdAt < int64(sgc.cfg.SecurityGroupGCGracePeriod) {
+			continue
+		}
+
+		fields := logrus.Fields{
+			"security_group_id":   sg.ID,
+			"security_group_name": sg.Name,
+			"region":              t.Cloud.Region(),
+			"account_id":          t.AccountID,
+		}
+
+		if sgc.cfg.SecurityGroupGCDryRun {
+			sgc.log.WithFields(fields).Info("would delete unused security group")
+			entry.Action = "would-delete"
+			continue
+		}
+
+		sgc.log.WithFields(fields).Info("deleting unused security group")
+
+		err = t.Cloud.DeleteSecurityGroup(sg.ID)
+		if err != nil {
+			sgc.log.WithFields(fields).WithField("err", err).Error("failed to delete security group")
+			entry.Action = "failed"
+			entry.Error = err.Error()
+			continue
+		}
+
+		entry.Action = "deleted"
+	}
+
+	return nil
+}
+
+// collectLaunchTemplates deletes the launch templates made for
+// mixed-instances autoscaling groups once the group is gone, leaving
+// those younger than the grace period as their group may still be
+// being created
+func (sgc *securityGroupCollector) collectLaunchTemplates(t *awsTarget, report *pudding.SecurityGroupGCReport, now time.Time) error {
+	templates, err := t.Cloud.DescribeLaunchTemplates()
+	if err != nil {
+		return err
+	}
+
+	groups, err := t.Cloud.DescribeAutoscalingGroups()
+	if err != nil {
+		return err
+	}
+
+	asgNames := map[string]bool{}
+	for _, asg := range groups {
+		asgNames[asg.Name] = true
+	}
+
+	for _, lt := range templates {
+		asgName := lt.Tags[cloud.LaunchTemplateAutoscalingGroupTag]
+		if asgName == "" || asgNames[asgName] || now.Unix()-lt.CreatedAt < int64(sgc.cfg.SecurityGroupGCGracePeriod) {
+			continue
+		}
+
+		entry := &pudding.LaunchTemplateGCEntry{
+			ID:                   lt.ID,
+			Name:                 lt.Name,
+			AutoscalingGroupName: asgName,
+			Region:               t.Cloud.Region(),
+			AccountID:            t.AccountID,
+			CreatedAt:            lt.CreatedAt,
+		}
+		report.LaunchTemplates = append(report.LaunchTemplates, entry)
+
+		fields := logrus.Fields{
+			"launch_template_id":      lt.ID,
+			"launch_template_name":    lt.Name,
+			"auto_scaling_group_name": asgName,
+			"region":                  t.Cloud.Region(),
+			"account_id":              t.AccountID,
+		}
+
+		if sgc.cfg.SecurityGroupGCDryRun {
+			sgc.log.WithFields(fields).Info("would delete launch template of missing autoscaling group")
+			entry.Action = "would-delete"
+			continue
+		}
+
+		sgc.log.WithFields(fields).Info("deleting launch template of missing autoscaling group")
+
+		err = t.Cloud.DeleteLaunchTemplate(lt.ID)
+		if err != nil {
+			sgc.log.WithFields(fields).WithField("err", err).Error("failed to delete launch template")
+			entry.Action = "failed"
+			entry.Error = err.Error()
+			continue
+		}
+
+		entry.Action = "deleted"
+	}
+
+	return nil
+}
+
+func (sgc *securityGroupCollector) fetchInUseGroupIDs(c cloud.Cloud) (map[string]bool, error) {
+	f := cloud.Filter{
+		"instance-state-name": []string{"pending", "running", "shutting-down", "stopping", "stopped"},
+	}
+
+	instances, err := cloud.GetInstancesWithFilter(c, f)
+	if err != nil {
+		return nil, err
+	}
+
+	inUse := map[string]bool{}
+	for _, inst := range instances {
+		for _, sgID := range inst.SecurityGroupIDs {
+			inUse[sgID] = true
+		}
+	}
+
+	// autoscaling groups may be without instances for a while, and
+	// still launch with the security groups of their launch
+	// configuration or template
+	groups, err := c.DescribeAutoscalingGroups()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, asg := range groups {
+		for _, sgID := range asg.SecurityGroupIDs {
+			inUse[sgID] = true
+		}
+	}
+
+	templates, err := c.DescribeLaunchTemplates()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, lt := range templates {
+		for _, sgID := range lt.SecurityGroupIDs {
+			inUse[sgID] = true
+		}
+	}
+
+	return inUse, nil
+}
@@ -6,9 +6,7 @@ import (
 	"os"
 	"strconv"
 
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/sns"
+	"github.com/Sirupsen/logrus"
 	"github.com/garyburd/redigo/redis"
 	"github.com/jrallison/go-workers"
 	"github.com/travis-ci/pudding"
@@ -17,7 +15,7 @@ import (
 
 var (
 	errMissingSNSMessage = fmt.Errorf("missing sns message")
-	snsMessageHandlers   = map[string]func(redis.Conn, *pudding.SNSMessage) error{
+	snsMessageHandlers   = map[string]func(*internalConfig, redis.Conn, *pudding.SNSMessage) error{
 		"SubscriptionConfirmation": handleSNSConfirmation,
 		"Notification":             handleSNSNotification,
 	}
@@ -50,29 +48,29 @@ func snsMessagesMain(cfg *internalConfig, msg *workers.Msg) {
 		return
 	}
 
-	err = handlerFunc(workers.Config.Pool.Get(), snsMsg)
+	err = handlerFunc(cfg, workers.Config.Pool.Get(), snsMsg)
 	if err != nil {
 		log.WithField("err", err).Panic("sns handler returned an error")
 	}
 }
 
 // http://docs.aws.amazon.com/sns/latest/dg/SendMessageToHttp.html
-func handleSNSConfirmation(rc redis.Conn, msg *pudding.SNSMessage) error {
+func handleSNSConfirmation(cfg *internalConfig, rc redis.Conn, msg *pudding.SNSMessage) error {
 	if v, _ := strconv.ParseBool(os.Getenv("SNS_CONFIRMATION")); v {
 		log.WithField("msg", msg).Info("handling subscription confirmation")
 
-		svc := sns.New(session.New(), &aws.Config{Region: aws.String(os.Getenv("SNS_REGION"))})
-
-		params := &sns.ConfirmSubscriptionInput{
-			Token:    aws.String(msg.Token),
-			TopicArn: aws.String(msg.TopicARN),
+		region := os.Getenv("SNS_REGION")
+		if region == "" {
+			region = pudding.RegionFromARN(msg.TopicARN)
 		}
-		resp, err := svc.ConfirmSubscription(params)
+
+		c := withJobID(newAuditedCloud(cfg, cfg.NewCloud("", region)), msg.MessageID)
+		err := c.ConfirmSubscription(msg.TopicARN, msg.Token)
 		if err != nil {
 			return err
 		}
 
-		log.WithField("subscription", resp.String()).Info("confirmed subscription")
+		log.WithField("topic_arn", msg.TopicARN).Info("confirmed subscription")
 
 		return nil
 	}
@@ -82,20 +80,35 @@ func handleSNSConfirmation(rc redis.Conn, msg *pudding.SNSMessage) error {
 	return nil
 }
 
-func handleSNSNotification(rc redis.Conn, msg *pudding.SNSMessage) error {
+func handleSNSNotification(cfg *internalConfig, rc redis.Conn, msg *pudding.SNSMessage) error {
 	log.WithField("msg", msg).Debug("received an SNS notification")
 
+	ec2Event, err := msg.EC2Event()
+	if err == nil && ec2Event.IsEC2Event() {
+		return handleEC2Event(cfg, rc, ec2Event)
+	}
+
 	a, err := msg.AutoscalingLifecycleAction()
 	if err != nil {
 		log.WithField("err", err).Warn("unable to handle notification")
 		return nil
 	}
 
-	if a.Event == "autoscaling:TEST_NOTIFICATION" {
+	if a.Event == pudding.AutoscalingEventTestNotification {
 		log.WithField("event", a.Event).Info("ignoring")
 		return nil
 	}
 
+	if pudding.IsAutoscalingEvent(a.Event) {
+		e, err := msg.AutoscalingEvent()
+		if err != nil {
+			log.WithField("err", err).Warn("unable to handle autoscaling event")
+			return nil
+		}
+
+		return handleAutoscalingEvent(cfg, rc, e)
+	}
+
 	switch a.LifecycleTransition {
 	case "autoscaling:EC2_INSTANCE_LAUNCHING":
 		log.WithField("action", a).Debug("storing instance launching lifecycle action")
@@ -114,3 +127,116 @@ func handleSNSNotification(rc redis.Conn, msg *pudding.SNSMessage) error {
 
 	return nil
 }
+
+func handleAutoscalingEvent(cfg *internalConfig, rc redis.Conn, e *pudding.AutoscalingEvent) error {
+	log.WithField("event", e).Debug("storing autoscaling event")
+	err := db.StoreAutoscalingEvent(rc, e, db.AutoscalingEventHistoryLength)
+	if err != nil {
+		return err
+	}
+
+	switch e.Event {
+	case pudding.AutoscalingEventLaunch:
+		log.WithField("event", e).Debug("setting expected_state to up")
+		err = db.SetExpiringInstanceAttributes(rc, e.EC2InstanceID, map[string]string{
+			"instance_id":    e.EC2InstanceID,
+			"expected_state": "up",
+		}, cfg.InstanceStoreExpiry)
+		if err != nil {
+			return err
+		}
+
+		err = db.RefreshInitScriptAutoscalingGroup(rc, e.AutoScalingGroupName, cfg.InitScriptSharedExpiry)
+	case pudding.AutoscalingEventTerminate:
+		log.WithField("event", e).Debug("removing terminated instance")
+		err = db.RemoveInstances(rc, []string{e.EC2InstanceID})
+	}
+
+	if err != nil {
+		return err
+	}
+
+	notifyAutoscalingEvent(cfg, e)
+	return nil
+}
+
+func notifyAutoscalingEvent(cfg *internalConfig, e *pudding.AutoscalingEvent) {
+	if cfg.DefaultSlackChannel == "" {
+		return
+	}
+
+	instanceID := e.EC2InstanceID
+	if instanceID == "" {
+		instanceID = "(no instance)"
+	}
+
+	if e.IsError() {
+		cfg.Notifier.Notify(cfg.DefaultSlackChannel,
+			fmt.Sprintf("Autoscaling *%s* for `%s` in *%s*: %s :warning:",
+				e.EventName(), instanceID, e.AutoScalingGroupName, e.StatusMessage))
+		return
+	}
+
+	cfg.Notifier.Notify(cfg.DefaultSlackChannel,
+		fmt.Sprintf("Autoscaling *%s* for `%s` in *%s*: %s",
+			e.EventName(), instanceID, e.AutoScalingGroupName, e.Description))
+}
+
+func handleEC2Event(cfg *internalConfig, rc redis.Conn, e *pudding.EC2Event) error {
+	instanceID := e.InstanceID()
+	if instanceID == "" {
+		log.WithField("event", e).Warn("unable to handle EC2 event without instance id")
+		return nil
+	}
+
+	if e.DetailType == pudding.EC2EventSpotInterruption || e.IsStopping() {
+		log.WithField("event", e).Debug("setting expected_state to down")
+		err := db.SetInstanceAttributes(rc, instanceID, map[string]string{"expected_state": "down"})
+		if err != nil {
+			return err
+		}
+	}
+
+	log.WithField("event", e).Debug("storing EC2 event")
+	err := db.StoreInstanceEvent(rc, e, db.InstanceEventHistoryLength)
+	if err != nil {
+		return err
+	}
+
+	switch e.DetailType {
+	case pudding.EC2EventSpotInterruption:
+		notifyEC2Event(cfg, rc, instanceID, fmt.Sprintf("Spot interruption warning for `%s`, will *%s* :rotating_light:",
+			instanceID, e.Detail.InstanceAction))
+	case pudding.EC2EventRebalanceRecommendation:
+		notifyEC2Event(cfg, rc, instanceID, fmt.Sprintf("Rebalance recommendation for `%s` :warning:", instanceID))
+	case pudding.EC2EventStateChange:
+	default:
+		log.WithField("event", e).Warn("recorded EC2 event of unknown detail type")
+	}
+
+	return nil
+}
+
+// notifyEC2Event notifies the channel of the build that launched the
+// instance, falling back to the default
+func notifyEC2Event(cfg *internalConfig, rc redis.Conn, instanceID, text string) {
+	channel := cfg.DefaultSlackChannel
+
+	instances, err := db.FetchInstances(rc, map[string]string{"instance_id": instanceID})
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			"err":         err,
+			"instance_id": instanceID,
+		}).Warn("failed to fetch instance for slack channel")
+	}
+
+	if len(instances) > 0 && instances[0].SlackChannel != "" {
+		channel = instances[0].SlackChannel
+	}
+
+	if channel == "" {
+		return
+	}
+
+	cfg.Notifier.Notify(channel, text)
+}
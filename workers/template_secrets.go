@@ -0,0 +1,135 @@
+package workers
+
+import (
+	"fmt"
+	"text/template"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/travis-ci/pudding"
+	"github.com/travis-ci/pudding/db"
+	"github.com/travis-ci/pudding/secrets"
+)
+
+var (
+	errMissingVaultConfig = fmt.Errorf("the vault secrets provider needs an address, a token, and a path")
+)
+
+// newSecretsProvider builds the secrets provider named in the config,
+// being "env" (the default), "file", or "vault"
+func newSecretsProvider(cfg *Config, kr *pudding.Keyring) (secrets.Provider, error) {
+	switch cfg.SecretsProvider {
+	case "", "env":
+		return secrets.NewEnv(), nil
+	case "file":
+		return secrets.NewFile(cfg.SecretsFile, kr)
+	case "vault":
+		if cfg.SecretsVaultAddr == "" || cfg.SecretsVaultToken == "" || cfg.SecretsVaultPath == "" {
+			return nil, errMissingVaultConfig
+		}
+		return secrets.NewVault(cfg.SecretsVaultAddr, cfg.SecretsVaultToken, cfg.SecretsVaultPath), nil
+	default:
+		return nil, fmt.Errorf("unknown secrets provider %q", cfg.SecretsProvider)
+	}
+}
+
+// templateSecrets looks up secrets on behalf of the init script
+// template of an instance build, refusing keys not in the allowlist
+// and logging every lookup without the value, to the audit log too
+// if there is one
+type templateSecrets struct {
+	p     secrets.Provider
+	al    secrets.Allowlist
+	audit db.AuditRecorder
+	actor string
+	b     *pudding.InstanceBuild
+	jid   string
+}
+
+func newTemplateSecrets(cfg *internalConfig, b *pudding.InstanceBuild, jid string) *templateSecrets {
+	p := cfg.Secrets
+	if p == nil {
+		p = secrets.NewEnv()
+	}
+
+	return &templateSecrets{
+		p:     p,
+		al:    cfg.SecretsAllowlist,
+		audit: cfg.AuditLog,
+		actor: fmt.Sprintf("workers:%s", cfg.ProcessID),
+		b:     b,
+		jid:   jid,
+	}
+}
+
+// Funcs provides `secret`, which fails rendering when the secret is
+// missing, e.g.:
+// {{ secret `RSA_KEY` `site` `env` }} => the `RSA_KEY_ORG_PROD` secret
+func (ts *templateSecrets) Funcs() template.FuncMap {
+	return template.FuncMap{
+		"secret": func(key string, filters ...string) (string, error) {
+			return ts.lookup(ts.b.KeyFor(key, filters...))
+		},
+	}
+}
+
+func (ts *templateSecrets) lookup(key string) (string, error) {
+	fields := logrus.Fields{
+		"jid":               ts.jid,
+		"instance_build_id": ts.b.ID,
+		"site":              ts.b.Site,
+		"env":               ts.b.Env,
+		"role":              ts.b.Role,
+		"key":               key,
+		"provider":          ts.p.Name(),
+	}
+
+	if !ts.al.Allows(key) {
+		log.WithFields(fields).WithField("allowed", false).Warn("refused secret lookup")
+		ts.record(key, pudding.AuditOutcomeDenied, "not in the allowlist")
+		return "", fmt.Errorf("secret %q is not in the allowlist", key)
+	}
+
+	v, err := ts.p.Get(key)
+	fields["allowed"] = true
+	fields["found"] = err == nil
+
+	if err != nil {
+		log.WithFields(fields).WithField("err", err).Error("failed secret lookup")
+		ts.record(key, pudding.AuditOutcomeError, err.Error())
+		return "", fmt.Errorf("failed to look up secret %q: %v", key, err)
+	}
+
+	log.WithFields(fields).Info("secret lookup")
+	ts.record(key, pudding.AuditOutcomeOK, "")
+	return v, nil
+}
+
+// record appends the lookup of the given key to the audit log, never
+// with the value
+func (ts *templateSecrets) record(key, outcome, errMsg string) {
+	if ts.audit == nil {
+		return
+	}
+
+	e := &pudding.AuditEntry{
+		Time:    time.Now().UTC().Unix(),
+		Source:  "workers",
+		Actor:   ts.actor,
+		Action:  "SecretLookup",
+		Target:  key,
+		Summary: fmt.Sprintf("provider=%s instance_build_id=%s", ts.p.Name(), ts.b.ID),
+		JobID:   ts.jid,
+		Outcome: outcome,
+		Error:   errMsg,
+	}
+
+	err := ts.audit.Record(e)
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			"err": err,
+			"key": key,
+			"jid": ts.jid,
+		}).Error("failed to record secret lookup audit entry")
+	}
+}
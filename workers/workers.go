@@ -7,6 +7,7 @@ import (
 	"github.com/Sirupsen/logrus"
 	"github.com/garyburd/redigo/redis"
 	"github.com/jrallison/go-workers"
+	"github.com/travis-ci/pudding/db"
 )
 
 var (
@@ -30,6 +31,14 @@ func runWorkers(cfg *internalConfig, log *logrus.Logger) error {
 
 	workers.Middleware.Prepend(rm)
 
+	al, err := db.NewAuditLog(workers.Config.Pool, log)
+	if err != nil {
+		log.WithField("err", err).Error("failed to build audit log")
+		return err
+	}
+
+	cfg.AuditLog = al
+
 	for _, queue := range cfg.Queues {
 		registered, ok := cfg.QueueFuncs[queue]
 		if !ok {
@@ -61,6 +70,66 @@ func setupMiniWorkers(cfg *internalConfig, r *redis.Pool, log *logrus.Logger, rm
 		return syncer.Sync()
 	})
 
+	mw.Register("lifecycle-actions", func() error {
+		resolver, err := newLifecycleActionResolver(cfg, r, log)
+		if err != nil {
+			log.WithField("err", err).Error("failed to build lifecycle action resolver")
+			return err
+		}
+
+		return resolver.Resolve()
+	})
+
+	mw.Register("security-group-gc", func() error {
+		collector, err := newSecurityGroupCollector(cfg, r, log)
+		if err != nil {
+			log.WithField("err", err).Error("failed to build security group collector")
+			return err
+		}
+
+		return collector.Collect()
+	})
+
+	mw.Register("instance-reconciler", func() error {
+		reconciler, err := newInstanceReconciler(cfg, r, log)
+		if err != nil {
+			log.WithField("err", err).Error("failed to build instance reconciler")
+			return err
+		}
+
+		return reconciler.Reconcile()
+	})
+
+	mw.Register("instance-reaper", func() error {
+		reaper, err := newInstanceReaper(cfg, r, log)
+		if err != nil {
+			log.WithField("err", err).Error("failed to build instance reaper")
+			return err
+		}
+
+		return reaper.Reap()
+	})
+
+	mw.Register("init-script-purge", func() error {
+		purger, err := newInitScriptPurger(r, log)
+		if err != nil {
+			log.WithField("err", err).Error("failed to build init script purger")
+			return err
+		}
+
+		return purger.Purge()
+	})
+
+	mw.Register("init-script-rekey", func() error {
+		rekeyer, err := newInitScriptRekeyer(cfg, r, log)
+		if err != nil {
+			log.WithField("err", err).Error("failed to build init script rekeyer")
+			return err
+		}
+
+		return rekeyer.Rekey()
+	})
+
 	mw.Register("keepalive", func() error {
 		_, err := http.Get(cfg.WebHost)
 		if err != nil {
@@ -1,9 +1,1162 @@
 package workers
 
-import "testing"
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"text/template"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/jrallison/go-workers"
+	"github.com/travis-ci/pudding"
+	"github.com/travis-ci/pudding/cloud"
+	"github.com/travis-ci/pudding/db"
+	"github.com/travis-ci/pudding/secrets"
+	"github.com/travis-ci/pudding/server"
+)
+
+const (
+	defaultTestAuthToken = "swordfish"
+	defaultTestTopicARN  = "arn:aws:sns:us-east-1:1234567899:pudding-test-foo"
+	defaultTestRoleARN   = "arn:aws:iam::1234567899:role/pudding-test-foo"
+
+	defaultTestEncryptionKeys = "e2e:cHVkZGluZy1lMmUtdGVzdC1lbmNyeXB0aW9uLWtleSE="
+
+	testInitScriptTemplate = `#!/bin/bash
+# {{ .Role }} {{ .Site }} {{ .Env }} {{ .Queue }}
+curl -s -X POST -d '{"instance_id":"'$INSTANCE_ID'"}' '{{ .InstanceLaunchURL }}'
+`
+)
+
+var (
+	testQueueNames = []string{
+		"instance-builds",
+		"instance-terminations",
+		"autoscaling-group-builds",
+		"sns-messages",
+		"instance-lifecycle-transitions",
+	}
+
+	configureWorkersOnce sync.Once
+)
 
 func TestNothing(t *testing.T) {
 	if 1 != 1 {
 		t.Fail()
 	}
 }
+
+type recordingNotifier struct {
+	sync.Mutex
+	messages []string
+}
+
+func (rn *recordingNotifier) Notify(channel, msg string) error {
+	rn.Lock()
+	defer rn.Unlock()
+
+	rn.messages = append(rn.messages, fmt.Sprintf("%s: %s", channel, msg))
+	return nil
+}
+
+func (rn *recordingNotifier) find(substr string) string {
+	rn.Lock()
+	defer rn.Unlock()
+
+	for _, msg := range rn.messages {
+		if strings.Contains(msg, substr) {
+			return msg
+		}
+	}
+
+	return ""
+}
+
+// e2eHarness wires the real server and the worker queue funcs to a
+// fake cloud served over HTTP, with jobs run one at a time by the test
+type e2eHarness struct {
+	t    *testing.T
+	h    *cloud.FakeHandler
+	fake *cloud.Fake
+	api  *httptest.Server
+	fcs  *httptest.Server
+	cfg  *internalConfig
+	n    *recordingNotifier
+}
+
+func newE2EHarness(t *testing.T) *e2eHarness {
+	redisURL, err := url.Parse(testRedisURL())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	configureWorkersOnce.Do(func() {
+		workers.Configure(map[string]string{
+			"server":    redisURL.Host,
+			"database":  strings.TrimLeft(redisURL.Path, "/"),
+			"pool":      "5",
+			"process":   "test",
+			"namespace": pudding.RedisNamespace,
+		})
+	})
+
+	queueNames := map[string]string{}
+	for _, name := range testQueueNames {
+		queueNames[name] = name
+	}
+
+	handler, err := server.NewHandler(&server.Config{
+		AuthToken:      defaultTestAuthToken,
+		AWSRegion:      "us-east-1",
+		RedisURL:       redisURL.String(),
+		QueueNames:     queueNames,
+		EncryptionKeys: defaultTestEncryptionKeys,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	kr, err := pudding.ParseKeyring(defaultTestEncryptionKeys)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	yml, err := ioutil.ReadFile("../examples/simple/meta.yml")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e := &e2eHarness{
+		t:   t,
+		h:   cloud.NewFakeHandler(),
+		api: httptest.NewServer(handler),
+		n:   &recordingNotifier{},
+	}
+
+	e.fcs = httptest.NewServer(e.h)
+	e.fake = e.h.Fake("us-east-1")
+
+	rules, err := pudding.ParseIngressRules(pudding.DefaultIngressRulesJSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	al, err := db.NewAuditLog(workers.Config.Pool, log)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e.cfg = &internalConfig{
+		AWSRegion:  "us-east-1",
+		AWSRegions: map[string]bool{"us-east-1": true},
+		NewCloud: func(roleARN, region string) cloud.Cloud {
+			return cloud.NewRemote(e.fcs.URL, region)
+		},
+
+		Notifier:            e.n,
+		DefaultSlackChannel: "#pudding-test",
+
+		RedisURL: redisURL,
+
+		WebHost:            e.api.URL,
+		InstanceRSA:        "fake",
+		InstanceYML:        string(yml),
+		InstanceTagRetries: 1,
+
+		QueueFuncs: defaultQueueFuncs,
+
+		InstanceStoreExpiry: 90,
+		ImageStoreExpiry:    90,
+
+		SecurityGroupGCGracePeriod: 3600,
+		DefaultIngressRules:        rules,
+
+		InitScriptTemplateString: testInitScriptTemplate,
+		InitScriptExpiry:         60,
+		InitScriptMaxUses:        1,
+		InitScriptSharedExpiry:   300,
+
+		Keyring:  kr,
+		AuditLog: al,
+	}
+
+	for _, name := range testQueueNames {
+		e.do("DEL", fmt.Sprintf("%s:queue:%s", pudding.RedisNamespace, name))
+	}
+
+	return e
+}
+
+func (e *e2eHarness) Close() {
+	e.api.Close()
+	e.fcs.Close()
+}
+
+func (e *e2eHarness) do(cmd string, args ...interface{}) interface{} {
+	conn := workers.Config.Pool.Get()
+	defer conn.Close()
+
+	reply, err := conn.Do(cmd, args...)
+	if err != nil {
+		e.t.Fatal(err)
+	}
+
+	return reply
+}
+
+// request makes a request to the server, using token auth unless the
+// url carries its own credentials, and decodes any JSON response
+func (e *e2eHarness) request(method, path string, body interface{}, out interface{}) {
+	u := path
+	if !strings.HasPrefix(u, "http") {
+		u = e.api.URL + path
+	}
+
+	var bodyString string
+	switch b := body.(type) {
+	case nil:
+	case string:
+		bodyString = b
+	default:
+		j, err := json.Marshal(b)
+		if err != nil {
+			e.t.Fatal(err)
+		}
+		bodyString = string(j)
+	}
+
+	req, err := http.NewRequest(method, u, strings.NewReader(bodyString))
+	if err != nil {
+		e.t.Fatal(err)
+	}
+
+	if req.URL.User == nil {
+		req.Header.Set("Authorization", fmt.Sprintf("token %s", defaultTestAuthToken))
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		e.t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	resBody, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		e.t.Fatal(err)
+	}
+
+	if res.StatusCode >= 300 {
+		e.t.Fatalf("%s %s returned %v: %s", method, path, res.StatusCode, resBody)
+	}
+
+	if out == nil {
+		return
+	}
+
+	if s, ok := out.(*string); ok {
+		*s = string(resBody)
+		return
+	}
+
+	err = json.Unmarshal(resBody, out)
+	if err != nil {
+		e.t.Fatal(err)
+	}
+}
+
+// work runs the next job on the named queue the way go-workers would
+func (e *e2eHarness) work(queue string) {
+	reply := e.do("RPOP", fmt.Sprintf("%s:queue:%s", pudding.RedisNamespace, queue))
+	if reply == nil {
+		e.t.Fatalf("no job on queue %q", queue)
+	}
+
+	payload, err := redis.String(reply, nil)
+	if err != nil {
+		e.t.Fatal(err)
+	}
+
+	msg, err := workers.NewMsg(payload)
+	if err != nil {
+		e.t.Fatal(err)
+	}
+
+	e.cfg.QueueFuncs[queue](e.cfg, msg)
+}
+
+func (e *e2eHarness) postSNSMessage(msgType string, message interface{}) {
+	j, err := json.Marshal(message)
+	if err != nil {
+		e.t.Fatal(err)
+	}
+
+	e.request("POST", "/sns-messages", &pudding.SNSMessage{
+		Type:      msgType,
+		MessageID: fmt.Sprintf("msg-%s", msgType),
+		Token:     "sns-token",
+		TopicARN:  defaultTestTopicARN,
+		Message:   string(j),
+	}, nil)
+	e.work("sns-messages")
+}
+
+func TestInstanceBuildLifecycleEndToEnd(t *testing.T) {
+	os.Setenv("SNS_CONFIRMATION", "true")
+	defer os.Unsetenv("SNS_CONFIRMATION")
+
+	e := newE2EHarness(t)
+	defer e.Close()
+
+	e.fake.Images["ami-e2e0001"] = &cloud.Image{
+		ID:    "ami-e2e0001",
+		Name:  "travis-ci-worker-e2e",
+		State: "available",
+		Tags:  map[string]string{"role": "worker", "active": "true"},
+	}
+
+	// subscription confirmation goes all the way to the fake SNS
+	e.postSNSMessage("SubscriptionConfirmation", map[string]string{})
+	if e.fake.ConfirmedSubscriptions[defaultTestTopicARN] != "sns-token" {
+		t.Fatalf("expected subscription to be confirmed, got %#v", e.fake.ConfirmedSubscriptions)
+	}
+
+	builds := &pudding.InstanceBuildsCollection{}
+	e.request("POST", "/instance-builds", `{
+  "instance_builds": {
+    "count": 1,
+    "site": "org",
+    "env": "prod",
+    "queue": "docker",
+    "role": "worker",
+    "instance_type": "c3.4xlarge",
+    "slack_channel": "#builds",
+    "boot_instance": true,
+    "tags": {"cost-center": "e2e"}
+  }
+}`, builds)
+
+	if len(builds.InstanceBuilds) != 1 {
+		t.Fatalf("expected 1 instance build, got %v", len(builds.InstanceBuilds))
+	}
+	build := builds.InstanceBuilds[0]
+
+	e.work("instance-builds")
+
+	if len(e.fake.Instances) != 1 {
+		t.Fatalf("expected 1 instance, got %v", len(e.fake.Instances))
+	}
+
+	var inst *cloud.Instance
+	for _, i := range e.fake.Instances {
+		inst = i
+	}
+
+	expectedTags := map[string]string{
+		"role":        "worker",
+		"site":        "org",
+		"env":         "prod",
+		"queue":       "docker",
+		"build_id":    build.ID,
+		"cost-center": "e2e",
+		"Name":        fmt.Sprintf("worker-org-prod-docker-%s", strings.TrimPrefix(inst.ID, "i-")),
+	}
+	for key, value := range expectedTags {
+		if inst.Tags[key] != value {
+			t.Fatalf("expected tag %q to be %q, got %q", key, value, inst.Tags[key])
+		}
+	}
+
+	if inst.ImageID != "ami-e2e0001" {
+		t.Fatalf("expected ami-e2e0001, got %q", inst.ImageID)
+	}
+
+	if e.n.find(fmt.Sprintf("#builds: Started on-demand c3.4xlarge instance `%s`", inst.ID)) == "" {
+		t.Fatalf("expected a launch notification, got %#v", e.n.messages)
+	}
+
+	// the instance fetches its init script via the user data
+	userData := string(e.fake.UserData[inst.ID])
+	if !strings.HasPrefix(userData, "#include ") {
+		t.Fatalf("unexpected user data %q", userData)
+	}
+
+	initScriptURL := strings.TrimSpace(strings.TrimPrefix(userData, "#include "))
+
+	// the init script and its auths are only stored encrypted
+	for _, hash := range []string{"init-scripts", "auths", "init_script_auths"} {
+		v, err := redis.String(e.do("HGET", fmt.Sprintf("%s:%s", pudding.RedisNamespace, hash), build.ID), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !strings.HasPrefix(v, pudding.EncryptedValuePrefix+"e2e:") {
+			t.Fatalf("expected %s to be encrypted, got %q", hash, v)
+		}
+	}
+
+	var script string
+	e.request("GET", initScriptURL, nil, &script)
+	if !strings.Contains(script, "# worker org prod docker") {
+		t.Fatalf("unexpected init script %q", script)
+	}
+
+	// the init script auth is single-use, and its fetches are audited
+	res, err := http.Get(initScriptURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected init script auth to be used up, got %v", res.StatusCode)
+	}
+
+	fetches := &pudding.InitScriptFetchesCollection{}
+	e.request("GET", fmt.Sprintf("/init-scripts/%s/fetches", build.ID), nil, fetches)
+	if len(fetches.InitScriptFetches) != 2 {
+		t.Fatalf("expected 2 init script fetches, got %#v", fetches.InitScriptFetches)
+	}
+
+	for i, allowed := range []bool{false, true} {
+		f := fetches.InitScriptFetches[i]
+		if f.Allowed != allowed || f.InstanceID != inst.ID || f.IP != "127.0.0.1" || f.Auth != "init-script" {
+			t.Fatalf("unexpected init script fetch %#v", f)
+		}
+	}
+
+	launchURL := ""
+	for _, line := range strings.Split(script, "\n") {
+		if strings.HasPrefix(line, "curl") {
+			parts := strings.Split(line, "'")
+			launchURL = parts[len(parts)-2]
+		}
+	}
+
+	if !strings.Contains(launchURL, fmt.Sprintf("/instance-launches/%s", build.ID)) {
+		t.Fatalf("unexpected launch url %q", launchURL)
+	}
+
+	// the instance becomes the template for an autoscaling group
+	e.request("POST", "/autoscaling-group-builds", map[string]interface{}{
+		"autoscaling_group_builds": map[string]interface{}{
+			"site":             "org",
+			"env":              "prod",
+			"queue":            "docker",
+			"role":             "worker",
+			"instance_id":      inst.ID,
+			"role_arn":         defaultTestRoleARN,
+			"topic_arn":        defaultTestTopicARN,
+			"min_size":         1,
+			"max_size":         10,
+			"desired_capacity": 1,
+		},
+	}, nil)
+	e.work("autoscaling-group-builds")
+
+	if len(e.fake.AutoscalingGroups) != 1 {
+		t.Fatalf("expected 1 autoscaling group, got %v", len(e.fake.AutoscalingGroups))
+	}
+
+	var asg *cloud.AutoscalingGroupOptions
+	for _, a := range e.fake.AutoscalingGroups {
+		asg = a
+	}
+
+	if asg.InstanceID != inst.ID {
+		t.Fatalf("expected autoscaling group from %q, got %q", inst.ID, asg.InstanceID)
+	}
+
+	if len(e.fake.ScalingPolicies) != 2 || len(e.fake.MetricAlarms) != 2 || len(e.fake.LifecycleHooks) != 2 {
+		t.Fatalf("expected 2 policies, alarms and hooks, got %v, %v and %v",
+			len(e.fake.ScalingPolicies), len(e.fake.MetricAlarms), len(e.fake.LifecycleHooks))
+	}
+
+	hookName := fmt.Sprintf("%s-lch-launching", asg.Name)
+	if _, ok := e.fake.LifecycleHooks[hookName]; !ok {
+		t.Fatalf("expected lifecycle hook %q", hookName)
+	}
+
+	// autoscaling announces the launch, then the instance reports in
+	e.postSNSMessage("Notification", &pudding.AutoscalingLifecycleAction{
+		AutoScalingGroupName: asg.Name,
+		LifecycleTransition:  "autoscaling:EC2_INSTANCE_LAUNCHING",
+		LifecycleActionToken: "launching-token",
+		LifecycleHookName:    hookName,
+		EC2InstanceID:        inst.ID,
+	})
+
+	e.request("POST", launchURL, map[string]string{"instance_id": inst.ID}, nil)
+	e.work("instance-lifecycle-transitions")
+
+	if len(e.fake.CompletedLifecycleActions) != 1 {
+		t.Fatalf("expected 1 completed lifecycle action, got %v", len(e.fake.CompletedLifecycleActions))
+	}
+
+	action := e.fake.CompletedLifecycleActions[0]
+	if action.Token != "launching-token" || action.InstanceID != inst.ID || action.HookName != hookName {
+		t.Fatalf("unexpected lifecycle action %#v", action)
+	}
+
+	// the syncer picks the instance up, after which it can be terminated
+	syncer, err := newEC2Syncer(e.cfg, workers.Config.Pool, log)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = syncer.Sync()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var fetched map[string][]*pudding.Instance
+	e.request("GET", fmt.Sprintf("/instances/%s", inst.ID), nil, &fetched)
+	if len(fetched["instances"]) != 1 || fetched["instances"][0].Tags["cost-center"] != "e2e" {
+		t.Fatalf("expected synced instance, got %#v", fetched)
+	}
+
+	e.request("DELETE", fmt.Sprintf("/instances/%s?slack-channel=%%23builds", inst.ID), nil, nil)
+	e.work("instance-terminations")
+
+	if e.fake.Instances[inst.ID].State != "terminated" {
+		t.Fatalf("expected instance to be terminated, got %q", e.fake.Instances[inst.ID].State)
+	}
+
+	if e.n.find(fmt.Sprintf("#builds: Terminating *%s*", inst.ID)) == "" {
+		t.Fatalf("expected a termination notification, got %#v", e.n.messages)
+	}
+
+	// the launch and termination are both audited, with the termination
+	// tied to the api call that asked for it by its job id
+	entries, err := e.cfg.AuditLog.(db.AuditRecorderFetcher).Fetch(map[string]string{"target": inst.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// entries are newest first, and the fake reuses instance ids
+	byAction := map[string]*pudding.AuditEntry{}
+	for _, entry := range entries {
+		if _, ok := byAction[entry.Action]; !ok {
+			byAction[entry.Action] = entry
+		}
+	}
+
+	launched := byAction["RunInstances"]
+	if launched == nil || launched.JobID == "" || launched.JobID == build.ID || launched.Source != "workers" ||
+		!strings.Contains(launched.Summary, "image_id=ami-e2e0001") {
+		t.Fatalf("unexpected launch audit entry %#v", launched)
+	}
+
+	built, err := e.cfg.AuditLog.(db.AuditRecorderFetcher).Fetch(map[string]string{
+		"route":  "instance-builds-create",
+		"job_id": launched.JobID,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(built) != 1 {
+		t.Fatalf("expected launch job id %q to match the api call, got %#v", launched.JobID, built)
+	}
+
+	tagged := byAction["CreateTags"]
+	if tagged == nil || tagged.JobID != launched.JobID || !strings.Contains(tagged.Summary, "tag:Name=") {
+		t.Fatalf("unexpected tagging audit entry %#v", tagged)
+	}
+
+	terminated := byAction["TerminateInstances"]
+	if terminated == nil || terminated.Outcome != pudding.AuditOutcomeOK {
+		t.Fatalf("unexpected termination audit entry %#v", terminated)
+	}
+
+	requested, err := e.cfg.AuditLog.(db.AuditRecorderFetcher).Fetch(map[string]string{
+		"route":  "delete-instances-by-id",
+		"target": inst.ID,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(requested) == 0 || requested[0].JobID != terminated.JobID {
+		t.Fatalf("expected termination job id %q to match the api call, got %#v", terminated.JobID, requested)
+	}
+}
+
+func TestAutoscalingGroupScaleOutEndToEnd(t *testing.T) {
+	e := newE2EHarness(t)
+	defer e.Close()
+
+	e.fake.Images["ami-e2e0002"] = &cloud.Image{
+		ID:    "ami-e2e0002",
+		Name:  "travis-ci-worker-e2e-asg",
+		State: "available",
+		Tags:  map[string]string{"role": "worker", "active": "true"},
+	}
+
+	builds := &pudding.InstanceBuildsCollection{}
+	e.request("POST", "/instance-builds", map[string]interface{}{
+		"instance_builds": map[string]interface{}{
+			"count":         1,
+			"site":          "org",
+			"env":           "prod",
+			"queue":         "docker",
+			"role":          "worker",
+			"instance_type": "c3.4xlarge",
+			"boot_instance": true,
+		},
+	}, builds)
+	build := builds.InstanceBuilds[0]
+
+	e.work("instance-builds")
+
+	var inst *cloud.Instance
+	for _, i := range e.fake.Instances {
+		inst = i
+	}
+
+	initScriptURL := strings.TrimSpace(strings.TrimPrefix(string(e.fake.UserData[inst.ID]), "#include "))
+
+	// the instance uses up its init script auth while booting
+	e.request("GET", initScriptURL, nil, nil)
+
+	e.request("POST", "/autoscaling-group-builds", map[string]interface{}{
+		"autoscaling_group_builds": map[string]interface{}{
+			"site":             "org",
+			"env":              "prod",
+			"queue":            "docker",
+			"role":             "worker",
+			"instance_id":      inst.ID,
+			"role_arn":         defaultTestRoleARN,
+			"topic_arn":        defaultTestTopicARN,
+			"min_size":         1,
+			"max_size":         10,
+			"desired_capacity": 1,
+		},
+	}, nil)
+	e.work("autoscaling-group-builds")
+
+	var asg *cloud.AutoscalingGroupOptions
+	for _, a := range e.fake.AutoscalingGroups {
+		asg = a
+	}
+
+	// long after the init script would have expired and been purged,
+	// every instance the group launches still boots with it
+	e.do("ZADD", fmt.Sprintf("%s:init_script_expiries", pudding.RedisNamespace), 1, build.ID)
+
+	purger, err := newInitScriptPurger(workers.Config.Pool, log)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		err = purger.Purge()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		scaled, err := e.fake.LaunchAutoscalingGroupInstance(asg.Name)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		userData := string(e.fake.UserData[scaled.ID])
+		if userData != string(e.fake.UserData[inst.ID]) {
+			t.Fatalf("expected scaled out instance to have the same user data, got %q", userData)
+		}
+
+		var script string
+		e.request("GET", initScriptURL, nil, &script)
+		if !strings.Contains(script, "# worker org prod docker") {
+			t.Fatalf("unexpected init script %q", script)
+		}
+	}
+}
+
+func TestInitScriptRekey(t *testing.T) {
+	e := newE2EHarness(t)
+	defer e.Close()
+
+	ID := "abcd1234-abcd-abcd-abcd-abcdrekey000"
+
+	// entries left over from earlier runs may be encrypted with keys
+	// not configured here
+	for _, hash := range []string{"init-scripts", "auths", "init_script_auths"} {
+		e.do("DEL", fmt.Sprintf("%s:%s", pudding.RedisNamespace, hash))
+	}
+
+	conn := workers.Config.Pool.Get()
+	defer conn.Close()
+
+	err := db.StoreInitScript(conn, &db.InitScriptRecord{
+		InstanceBuildID: ID,
+		Script:          "c2NyaXB0",
+		InstanceAuth:    "swordfish-rekey",
+		InitScriptAuth:  "swordfish-rekey-init",
+		MaxUses:         1,
+		ExpiresAt:       time.Now().UTC().Unix() + 60,
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	kr, err := pudding.ParseKeyring(defaultTestEncryptionKeys)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = db.UseInitScriptAuth(conn, ID, "swordfish-rekey-init", time.Now().UTC().Unix(), kr)
+	if err == nil {
+		t.Fatalf("expected plaintext init script auth to be refused outside of migration")
+	}
+
+	// an entry encrypted with a key since dropped from the keyring is
+	// skipped without holding up the others
+	goneKr, err := pudding.ParseKeyring("gone:" + base64.StdEncoding.EncodeToString([]byte("pudding-dropped-encryption-key!!")))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	goneID := ID + "-gone"
+	goneValue, err := goneKr.Encrypt("c2NyaXB0", "init-scripts:"+goneID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.do("HSET", fmt.Sprintf("%s:init-scripts", pudding.RedisNamespace), goneID, goneValue)
+
+	newKeys := "rotated:" + base64.StdEncoding.EncodeToString([]byte("pudding-rotated-encryption-key!!")) + "," + defaultTestEncryptionKeys
+	for _, keys := range []string{defaultTestEncryptionKeys, newKeys} {
+		e.cfg.Keyring, err = pudding.ParseKeyring(keys)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if keys == defaultTestEncryptionKeys {
+			e.cfg.Keyring.AllowPlaintext()
+		}
+
+		rekeyer, err := newInitScriptRekeyer(e.cfg, workers.Config.Pool, log)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = rekeyer.Rekey()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for hash, expected := range map[string]string{
+			"init-scripts":      "c2NyaXB0",
+			"auths":             "swordfish-rekey",
+			"init_script_auths": "swordfish-rekey-init",
+		} {
+			v, err := redis.String(e.do("HGET", fmt.Sprintf("%s:%s", pudding.RedisNamespace, hash), ID), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if e.cfg.Keyring.NeedsRekey(v) {
+				t.Fatalf("expected %s to be encrypted with %q, got %q", hash, e.cfg.Keyring.PrimaryKeyID(), v)
+			}
+
+			plaintext, err := e.cfg.Keyring.Decrypt(v, hash+":"+ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if plaintext != expected {
+				t.Fatalf("expected %s to decrypt to %q, got %q", hash, expected, plaintext)
+			}
+
+			_, err = e.cfg.Keyring.Decrypt(v, hash+":"+ID+"-other")
+			if err == nil {
+				t.Fatalf("expected %s to only decrypt for its own field", hash)
+			}
+		}
+	}
+
+	ok, err := db.UseInitScriptAuth(conn, ID, "swordfish-rekey-init", time.Now().UTC().Unix(), e.cfg.Keyring)
+	if err != nil || !ok {
+		t.Fatalf("expected rekeyed init script auth to be usable, got %v %v", ok, err)
+	}
+
+	_, failed, err := db.RekeyInitScripts(conn, e.cfg.Keyring)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(failed) != 1 || failed[0] != "init-scripts:"+goneID {
+		t.Fatalf("expected only the entry with the dropped key to be skipped, got %v", failed)
+	}
+
+	v, err := redis.String(e.do("HGET", fmt.Sprintf("%s:init-scripts", pudding.RedisNamespace), goneID), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if v != goneValue {
+		t.Fatalf("expected the skipped entry to be left alone, got %q", v)
+	}
+}
+
+func TestInitScriptPurger(t *testing.T) {
+	e := newE2EHarness(t)
+	defer e.Close()
+
+	conn := workers.Config.Pool.Get()
+	defer conn.Close()
+
+	suffix := fmt.Sprintf("%d", time.Now().UnixNano())
+	goneID := "purge-gone-" + suffix
+	upID := "purge-up-" + suffix
+	sharedID := "purge-shared-" + suffix
+	asgName := "pudding-purge-asg-" + suffix
+
+	for _, ID := range []string{goneID, upID, sharedID} {
+		err := db.StoreInitScript(conn, &db.InitScriptRecord{
+			InstanceBuildID: ID,
+			Script:          "c2NyaXB0",
+			InstanceAuth:    "swordfish-purge",
+			InitScriptAuth:  "swordfish-purge-init",
+			MaxUses:         1,
+			ExpiresAt:       time.Now().UTC().Unix() - 1,
+		}, e.cfg.Keyring)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = db.StoreInitScriptInstanceID(conn, ID, "i-"+ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	e.do("SADD", fmt.Sprintf("%s:instances", pudding.RedisNamespace), "i-"+upID)
+
+	err := db.StoreInitScriptAutoscalingGroup(conn, sharedID, asgName, "asg-build-"+suffix, e.cfg.InitScriptSharedExpiry)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sharedKey := fmt.Sprintf("%s:init_script_autoscaling_groups:%s", pudding.RedisNamespace, sharedID)
+	ttl, err := redis.Int(e.do("TTL", sharedKey), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ttl <= 0 || ttl > e.cfg.InitScriptSharedExpiry {
+		t.Fatalf("expected shared init script to expire within %v, got ttl %v", e.cfg.InitScriptSharedExpiry, ttl)
+	}
+
+	ok, err := db.UseInitScriptAuth(conn, sharedID, "swordfish-purge-init", time.Now().UTC().Unix(), e.cfg.Keyring)
+	if err != nil || !ok {
+		t.Fatalf("expected shared init script auth to be usable, got %v %v", ok, err)
+	}
+
+	purger, err := newInitScriptPurger(workers.Config.Pool, log)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hasField := func(hash, ID string) bool {
+		exists, err := redis.Bool(e.do("HEXISTS", fmt.Sprintf("%s:%s", pudding.RedisNamespace, hash), ID), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return exists
+	}
+
+	err = purger.Purge()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for ID, expected := range map[string]bool{goneID: false, upID: true, sharedID: true} {
+		if hasField("auths", ID) != expected {
+			t.Fatalf("expected instance auth of %q to be kept %v", ID, expected)
+		}
+	}
+
+	if hasField("init_script_auths", goneID) || hasField("init_script_auths", upID) || !hasField("init_script_auths", sharedID) {
+		t.Fatalf("expected only the shared init script auth to be kept")
+	}
+
+	// once the autoscaling group has gone unseen for long enough
+	e.do("DEL", sharedKey)
+
+	ok, err = db.UseInitScriptAuth(conn, sharedID, "swordfish-purge-init", time.Now().UTC().Unix(), e.cfg.Keyring)
+	if err != nil || ok {
+		t.Fatalf("expected expired shared init script auth to be refused, got %v %v", ok, err)
+	}
+
+	e.do("SREM", fmt.Sprintf("%s:instances", pudding.RedisNamespace), "i-"+upID)
+
+	err = purger.Purge()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, ID := range []string{upID, sharedID} {
+		if hasField("auths", ID) || hasField("init_script_auths", ID) || hasField("init-scripts", ID) {
+			t.Fatalf("expected init script and auths of %q to be purged", ID)
+		}
+	}
+}
+
+type recordingAuditLog struct {
+	entries []*pudding.AuditEntry
+}
+
+func (ral *recordingAuditLog) Record(e *pudding.AuditEntry) error {
+	ral.entries = append(ral.entries, e)
+	return nil
+}
+
+func TestTemplateSecrets(t *testing.T) {
+	vault := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(`{"data":{"data":{"RSA_KEY_ORG_PROD":"sekrit","AWS_SECRET_ACCESS_KEY":"nope"}}}`))
+	}))
+	defer vault.Close()
+
+	_, err := newSecretsProvider(&Config{
+		SecretsProvider:  "vault",
+		SecretsVaultAddr: vault.URL,
+		SecretsVaultPath: "secret/data/pudding",
+	}, nil)
+	if err != errMissingVaultConfig {
+		t.Fatalf("expected vault secrets provider without a token to be refused, got %v", err)
+	}
+
+	os.Setenv("API_HOSTNAME_ORG_PROD", "api.example.org")
+	defer os.Unsetenv("API_HOSTNAME_ORG_PROD")
+
+	al := &recordingAuditLog{}
+	cfg := &internalConfig{
+		ProcessID:        "test",
+		Secrets:          secrets.NewVault(vault.URL, "swordfish", "secret/data/pudding"),
+		SecretsAllowlist: secrets.ParseAllowlist("RSA_KEY_*,API_HOSTNAME_*"),
+		AuditLog:         al,
+	}
+	b := &pudding.InstanceBuild{ID: "abcd1234", Site: "org", Env: "prod"}
+
+	for tmpl, expected := range map[string]string{
+		"{{ secret `RSA_KEY` `site` `env` }}":          "sekrit",
+		"{{ secret `RSA_KEY` `site` `env` `queue` }}":  "sekrit",
+		"{{ secret `API_HOSTNAME` `site` `env` }}":     "!",
+		"{{ secret `AWS_SECRET_ACCESS_KEY` }}":         "!",
+		"{{ env_for `API_HOSTNAME` `site` `env` }}":    "api.example.org",
+		"{{ env `API_HOSTNAME_ORG_PROD` }}":            "api.example.org",
+		"{{ env_for `RSA_KEY` `site` `env` `queue` }}": "",
+	} {
+		tp := template.New("test").Funcs(newTemplateSecrets(cfg, b, "jid").Funcs())
+		tp.Funcs(template.FuncMap{
+			"env_for": pudding.MakeInstanceBuildEnvForFunc(b),
+			"env":     os.Getenv,
+		})
+
+		tp, err := tp.Parse(tmpl)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		buf := &bytes.Buffer{}
+		err = tp.Execute(buf, nil)
+		if expected == "!" {
+			if err == nil {
+				t.Errorf("expected %s to fail, got %q", tmpl, buf.String())
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("expected %s to render, got %v", tmpl, err)
+			continue
+		}
+
+		if buf.String() != expected {
+			t.Errorf("expected %s to render %q, got %q", tmpl, expected, buf.String())
+		}
+	}
+
+	if len(al.entries) != 4 {
+		t.Fatalf("expected 4 secret lookups in the audit log, got %d", len(al.entries))
+	}
+
+	outcomes := map[string]string{}
+	for _, e := range al.entries {
+		if e.Action != "SecretLookup" || e.JobID != "jid" {
+			t.Errorf("unexpected audit entry %#v", e)
+		}
+
+		if strings.Contains(e.Summary, "sekrit") || strings.Contains(e.Error, "sekrit") {
+			t.Errorf("expected no secret values in the audit log, got %#v", e)
+		}
+
+		outcomes[e.Target] = e.Outcome
+	}
+
+	for key, outcome := range map[string]string{
+		"RSA_KEY_ORG_PROD":      pudding.AuditOutcomeOK,
+		"API_HOSTNAME_ORG_PROD": pudding.AuditOutcomeError,
+		"AWS_SECRET_ACCESS_KEY": pudding.AuditOutcomeDenied,
+	} {
+		if outcomes[key] != outcome {
+			t.Errorf("expected lookup of %s to be %q, got %q", key, outcome, outcomes[key])
+		}
+	}
+}
+
+func TestInstanceReaper(t *testing.T) {
+	e := newE2EHarness(t)
+	defer e.Close()
+
+	e.cfg.InstanceTTLWarning = 600
+
+	// expiries extended by earlier runs would outlive the tagged ones
+	e.do("DEL", fmt.Sprintf("%s:instance_expiries", pudding.RedisNamespace))
+	e.do("DEL", fmt.Sprintf("%s:instance_expiry_tag_syncs", pudding.RedisNamespace))
+
+	conn := workers.Config.Pool.Get()
+	defer conn.Close()
+
+	now := time.Now().UTC().Unix()
+	err := db.StoreInstances(conn, map[string]*cloud.Instance{
+		"i-reap0001": {ID: "i-reap0001", Tags: map[string]string{"Name": "reap-expired", "expires_at": fmt.Sprintf("%d", now-10), "slack_channel": "#reapers"}},
+		"i-reap0002": {ID: "i-reap0002", Tags: map[string]string{"Name": "reap-expiring", "expires_at": fmt.Sprintf("%d", now+300)}},
+		"i-reap0003": {ID: "i-reap0003", Tags: map[string]string{"Name": "reap-later", "expires_at": fmt.Sprintf("%d", now+3600)}},
+		"i-reap0004": {ID: "i-reap0004", Tags: map[string]string{"Name": "reap-never"}},
+	}, 90)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reaper, err := newInstanceReaper(e.cfg, workers.Config.Pool, log)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	terminations := func() map[string]int {
+		jobs, err := redis.Strings(e.do("LRANGE", fmt.Sprintf("%s:queue:instance-terminations", pudding.RedisNamespace), 0, -1), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		terminated := map[string]int{}
+		for _, job := range jobs {
+			payload := &pudding.InstanceTerminationPayload{}
+			err = json.Unmarshal([]byte(job), payload)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if payload.InstanceID == "i-reap0001" && payload.SlackChannel != "#reapers" {
+				t.Fatalf("expected termination in the build's channel, got %#v", payload)
+			}
+			terminated[payload.InstanceID]++
+		}
+		return terminated
+	}
+
+	// the expired instance was never warned, so is only warned at first
+	err = reaper.Reap()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if terminated := terminations(); terminated["i-reap0001"] != 0 {
+		t.Fatalf("expected the unwarned instance not to be terminated, got %v", terminated)
+	}
+
+	if e.n.find("#reapers: Instance `i-reap0001` (reap-expired) has expired") == "" {
+		t.Fatalf("expected expiry warning in the build's channel, got %v", e.n.messages)
+	}
+
+	// reaping again must not repeat warnings or terminations
+	for i := 0; i < 2; i++ {
+		err = reaper.Reap()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	terminated := terminations()
+	if terminated["i-reap0001"] != 1 {
+		t.Fatalf("expected one termination of the expired instance, got %v", terminated)
+	}
+
+	for _, ID := range []string{"i-reap0002", "i-reap0003", "i-reap0004"} {
+		if terminated[ID] != 0 {
+			t.Fatalf("expected %s not to be terminated, got %v", ID, terminated)
+		}
+	}
+
+	if e.n.find("#reapers: Terminating expired instance `i-reap0001`") == "" {
+		t.Fatalf("expected termination notification, got %v", e.n.messages)
+	}
+
+	warnings := 0
+	for _, msg := range e.n.messages {
+		if strings.Contains(msg, "`i-reap0002`") && strings.Contains(msg, "/instances/i-reap0002/ttl-extensions") {
+			warnings++
+		}
+		if strings.Contains(msg, "i-reap0003") || strings.Contains(msg, "i-reap0004") {
+			t.Fatalf("expected no notification for unexpiring instances, got %q", msg)
+		}
+	}
+
+	if warnings != 1 {
+		t.Fatalf("expected one expiry warning, got %v", e.n.messages)
+	}
+
+	// extending the ttl pushes the expiry out of the warning window
+	res := &struct {
+		Instances []*pudding.Instance `json:"instances"`
+	}{}
+	e.request("POST", "/instances/i-reap0002/ttl-extensions?ttl=3600", nil, res)
+
+	if len(res.Instances) != 1 || res.Instances[0].ExpiresAt != now+300+3600 {
+		t.Fatalf("expected extended expiry of %d, got %#v", now+300+3600, res.Instances)
+	}
+
+	instances, err := db.FetchInstances(conn, map[string]string{"instance_id": "i-reap0002"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(instances) != 1 || instances[0].ExpiresAt != now+300+3600 {
+		t.Fatalf("expected stored expiry of %d, got %#v", now+300+3600, instances)
+	}
+
+	// the reaper carries the extension over to the instance's tags
+	e.fake.Instances["i-reap0002"] = &cloud.Instance{
+		ID:    "i-reap0002",
+		State: "running",
+		Tags:  map[string]string{"expires_at": fmt.Sprintf("%d", now+300)},
+	}
+
+	err = reaper.Reap()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if v := e.fake.Instances["i-reap0002"].Tags["expires_at"]; v != fmt.Sprintf("%d", now+300+3600) {
+		t.Fatalf("expected expiry tag of %d, got %q", now+300+3600, v)
+	}
+
+	syncs, err := db.FetchInstanceExpiryTagSyncs(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := syncs["i-reap0002"]; ok {
+		t.Fatalf("expected expiry tag sync to be done, got %v", syncs)
+	}
+}